@@ -1,16 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"net/mail"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/habibiefaried/email-server/internal/dnsutil"
+	"github.com/habibiefaried/email-server/internal/forward"
 	"github.com/habibiefaried/email-server/internal/server"
 	"github.com/habibiefaried/email-server/internal/storage"
 )
@@ -29,9 +37,93 @@ func extractDomain(address string) (string, error) {
 	return parts[1], nil
 }
 
+// envInt reads a non-negative integer from the environment, returning def
+// when the variable is unset or invalid
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	parsed, err := strconv.Atoi(v)
+	if err != nil || parsed < 0 {
+		log.Printf("Warning: Invalid %s value %q, using default %d", name, v, def)
+		return def
+	}
+	return parsed
+}
+
+// envDuration reads a non-negative Go duration from the environment,
+// returning def when the variable is unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil || parsed < 0 {
+		log.Printf("Warning: Invalid %s value %q, using default %s", name, v, def)
+		return def
+	}
+	return parsed
+}
+
+// parseSearchDate parses a since or until parameter of /search, either
+// RFC 3339 or a YYYY-MM-DD date (UTC). A date until covers that whole day.
+func parseSearchDate(v string, until bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q (want YYYY-MM-DD or RFC 3339)", v)
+	}
+	if until {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// blobStoreFromEnv returns the blob store selected by BLOB_STORE, or nil
+// to keep content in the database
+func blobStoreFromEnv() (storage.BlobStore, error) {
+	switch kind := os.Getenv("BLOB_STORE"); kind {
+	case "":
+		return nil, nil
+	case "fs":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "blobs"
+		}
+		log.Printf("Storing raw messages and attachments in %s", dir)
+		return storage.NewFSBlobStore(dir)
+	case "s3":
+		cfg := storage.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		}
+		log.Printf("Storing raw messages and attachments in bucket %s at %s", cfg.Bucket, cfg.Endpoint)
+		return storage.NewS3BlobStore(cfg)
+	default:
+		return nil, fmt.Errorf("invalid BLOB_STORE %q (want fs or s3)", kind)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "retention" {
+		runRetention(os.Args[2:])
+		return
+	}
+
 	mailServers := os.Getenv("MAIL_SERVERS")
 	var fqdn string
+	var recipientDomains []string
 
 	if mailServers != "" {
 		pairs := strings.Split(mailServers, ":")
@@ -52,6 +144,7 @@ func main() {
 			if err := dnsutil.PrintDNSRecords(fqdnVal, ip); err != nil {
 				log.Fatalf("Configuration error for %s,%s: %v", fqdnVal, ip, err)
 			}
+			recipientDomains = append(recipientDomains, fqdnVal)
 		}
 
 		// Use the first FQDN for the SMTP server
@@ -61,34 +154,281 @@ func main() {
 		log.Printf("MAIL_SERVERS not set — Email server is running without FQDN")
 	}
 
-	// Initialize storage backend
+	// Initialize storage backend. With a database, saves fail over to file
+	// storage while it is unreachable (including at startup) and are
+	// replayed into it once it recovers.
 	var store storage.Storage
 	var pgStore *storage.PostgresStorage
+	var failover *storage.FailoverStorage
 	dbURL := os.Getenv("DB_URL")
 	if dbURL != "" {
-		var err error
-		pgStore, err = storage.NewPostgresStorage(dbURL)
+		blobs, err := blobStoreFromEnv()
+		if err != nil {
+			log.Fatalf("Failed to set up blob storage: %v", err)
+		}
+		connect := func() (*storage.PostgresStorage, error) {
+			ps, err := storage.NewPostgresStorage(dbURL)
+			if err != nil {
+				return nil, err
+			}
+			if blobs != nil {
+				ps.SetBlobStore(blobs)
+			}
+			// Index emails stored before search existed, a batch at a time
+			go func() {
+				n, err := ps.BackfillSearch(context.Background(), storage.DefaultBackfillBatch)
+				if n > 0 {
+					log.Printf("Indexed %d email(s) for search", n)
+				}
+				if err != nil {
+					log.Printf("Warning: failed to index emails for search: %v", err)
+				}
+			}()
+			return ps, nil
+		}
+		cfg := storage.FailoverConfig{
+			Connect: func() (storage.HealthCheckedStorage, error) {
+				return connect()
+			},
+			Fallback:      storage.NewFileStorage("emails"),
+			BacklogDir:    filepath.Join("emails", ".backlog"),
+			CheckInterval: envDuration("DB_HEALTH_INTERVAL", 10*time.Second),
+		}
+		pgStore, err = connect()
 		if err != nil {
 			log.Printf("Warning: Failed to connect to postgres: %v", err)
-			log.Printf("Falling back to file-only storage")
-			store = storage.NewFileStorage("emails")
+			log.Printf("Saving to file storage until the database is reachable")
 		} else {
-			log.Printf("PostgreSQL storage initialized (database-only mode)")
-			store = pgStore
+			log.Printf("PostgreSQL storage initialized (file storage while it is unreachable)")
+			cfg.Primary = pgStore
+		}
+		failover, err = storage.NewFailoverStorage(cfg)
+		if err != nil {
+			log.Fatalf("Failed to create failover backlog: %v", err)
 		}
+		go failover.Run(context.Background())
+		store = failover
 	} else {
 		log.Printf("DB_URL not set, using file-only storage")
+		if os.Getenv("BLOB_STORE") != "" {
+			log.Printf("Warning: BLOB_STORE is ignored without DB_URL")
+		}
 		store = storage.NewFileStorage("emails")
 	}
 
+	// Durable spool in front of the storage backend: messages are on disk
+	// before the 250 reply and drained into the backend with retries
+	if spoolDir := os.Getenv("SPOOL_DIR"); spoolDir != "" {
+		spool, err := storage.NewSpoolStorage(spoolDir, store)
+		if err != nil {
+			log.Fatalf("Failed to create spool directory: %v", err)
+		}
+		spool.MaxAttempts = envInt("SPOOL_MAX_ATTEMPTS", storage.DefaultSpoolMaxAttempts)
+		log.Printf("Spooling accepted messages in %s", spoolDir)
+		go spool.Run(context.Background())
+		store = spool
+	}
+
+	// Retention janitor: deletes emails older than their mailbox's TTL
+	retention, err := retentionPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid retention policy: %v", err)
+	}
+	if expirer, ok := store.(storage.Expirer); ok && retention.Enabled() {
+		interval := envDuration("RETENTION_INTERVAL", time.Hour)
+		log.Printf("Expiring emails after %s (overrides: %d), checking every %s", retention.TTL, len(retention.Overrides), interval)
+		janitor := storage.NewJanitor(expirer, retention, interval, envInt("RETENTION_BATCH", storage.DefaultExpireBatch))
+		go janitor.Run(context.Background())
+	}
+
 	// Get SMTP port from environment variable, default to 2525
 	smtpPort := os.Getenv("SMTP_PORT")
 	if smtpPort == "" {
 		smtpPort = "2525"
 	}
 
+	// Read email size limit from environment (default 512KB = 524288 bytes)
+	maxEmailSize := int64(524288)
+	if envSize := os.Getenv("EMAIL_SIZE_LIMIT"); envSize != "" {
+		if parsed, err := strconv.ParseInt(envSize, 10, 64); err == nil && parsed >= 0 {
+			maxEmailSize = parsed
+		} else {
+			log.Printf("Warning: Invalid EMAIL_SIZE_LIMIT value %q, using default 512KB", envSize)
+		}
+	}
+	// Without a blob store postgres holds each raw message in memory
+	if dbURL != "" && os.Getenv("BLOB_STORE") == "" && (maxEmailSize == 0 || maxEmailSize > storage.MaxInlineRawSize) {
+		log.Fatalf("EMAIL_SIZE_LIMIT above %d bytes (or 0) requires BLOB_STORE with DB_URL", storage.MaxInlineRawSize)
+	}
+	sizePolicy, err := server.ParseOversizePolicy(os.Getenv("EMAIL_SIZE_POLICY"))
+	if err != nil {
+		log.Fatalf("Invalid EMAIL_SIZE_POLICY: %v", err)
+	}
+	spfPolicy, err := server.ParseSPFPolicy(os.Getenv("SPF_MODE"))
+	if err != nil {
+		log.Fatalf("Invalid SPF_MODE: %v", err)
+	}
+
+	mode, err := server.ParseServerMode(os.Getenv("SMTP_MODE"))
+	if err != nil {
+		log.Fatalf("Invalid SMTP_MODE: %v", err)
+	}
+
+	dnsblZones, err := server.ParseDNSBLZones(os.Getenv("DNSBL_ZONES"))
+	if err != nil {
+		log.Fatalf("Invalid DNSBL_ZONES: %v", err)
+	}
+
+	maxRecipients := envInt("SMTP_MAX_RECIPIENTS", 100)
+	timeout := envDuration("SMTP_TIMEOUT", 5*time.Minute)
+
+	// Inbound rate limits; all off by default, and 0 disables a limit
+	limits := server.LimitConfig{
+		MaxSessions:               envInt("SMTP_MAX_SESSIONS", 0),
+		MaxSessionsPerIP:          envInt("SMTP_MAX_SESSIONS_PER_IP", 0),
+		SessionsPerMinute:         float64(envInt("SMTP_SESSION_RATE", 0)),
+		RecipientsPerMinute:       float64(envInt("SMTP_RECIPIENT_RATE", 0)),
+		ClientRecipientsPerMinute: float64(envInt("SMTP_CLIENT_RECIPIENT_RATE", 0)),
+	}
+	var limiter *server.Limiter
+	if limits.Enabled() {
+		limiter = server.NewLimiter(limits)
+	}
+
+	var greylister *server.Greylister
+	if os.Getenv("GREYLIST") == "true" {
+		cfg := server.GreylistConfig{
+			Delay:   envDuration("GREYLIST_DELAY", 0),
+			PassTTL: envDuration("GREYLIST_TTL", 0),
+		}
+		if pgStore != nil {
+			greylister = server.NewGreylister(pgStore.Greylist(), cfg)
+			log.Printf("Greylisting enabled (state in postgres)")
+		} else if dbURL != "" {
+			greylister = server.NewGreylister(storage.NewMemoryGreylist(), cfg)
+			log.Printf("Greylisting enabled (state in memory until restart: postgres was unreachable at startup)")
+		} else {
+			greylister = server.NewGreylister(storage.NewMemoryGreylist(), cfg)
+			log.Printf("Greylisting enabled (state in memory)")
+		}
+	}
+
+	// PROXY protocol from a load balancer in front of the SMTP ports
+	var proxyTrusted []*net.IPNet
+	if os.Getenv("PROXY_PROTOCOL") == "true" {
+		proxyTrusted, err = server.ParseCIDRs(os.Getenv("PROXY_PROTOCOL_TRUSTED"))
+		if err != nil {
+			log.Fatalf("Invalid PROXY_PROTOCOL_TRUSTED: %v", err)
+		}
+		if len(proxyTrusted) == 0 {
+			log.Fatalf("PROXY_PROTOCOL=true requires PROXY_PROTOCOL_TRUSTED")
+		}
+	}
+
+	// Forwarding rules relayed through a smarthost, with SRS-rewritten senders
+	var forwarder *forward.Forwarder
+	if rulesPath := os.Getenv("FORWARD_RULES"); rulesPath != "" {
+		rules, err := forward.LoadRules(rulesPath)
+		if err != nil {
+			log.Fatalf("Failed to load FORWARD_RULES: %v", err)
+		}
+		smarthost := os.Getenv("SMARTHOST")
+		if smarthost == "" {
+			log.Fatalf("FORWARD_RULES requires SMARTHOST")
+		}
+		tlsMode, err := forward.ParseTLSMode(os.Getenv("SMARTHOST_TLS"))
+		if err != nil {
+			log.Fatalf("Invalid SMARTHOST_TLS: %v", err)
+		}
+		srsSecret := os.Getenv("SRS_SECRET")
+		if srsSecret == "" {
+			log.Fatalf("FORWARD_RULES requires SRS_SECRET")
+		}
+		srsDomain := os.Getenv("SRS_DOMAIN")
+		if srsDomain == "" {
+			srsDomain = fqdn
+		}
+		if srsDomain == "" {
+			log.Fatalf("FORWARD_RULES requires SRS_DOMAIN or MAIL_SERVERS")
+		}
+		// Bounces to rewritten senders come back to the SRS domain
+		recipientDomains = append(recipientDomains, srsDomain)
+
+		var queue storage.OutboundQueue
+		if pgStore != nil {
+			queue = pgStore.Outbound()
+			log.Printf("Forwarding %d rules through %s (queue in postgres)", len(rules), smarthost)
+		} else if dbURL != "" {
+			queue = storage.NewMemoryOutbound()
+			log.Printf("Forwarding %d rules through %s (queue in memory until restart: postgres was unreachable at startup)", len(rules), smarthost)
+		} else {
+			queue = storage.NewMemoryOutbound()
+			log.Printf("Forwarding %d rules through %s (queue in memory)", len(rules), smarthost)
+		}
+		forwarder = forward.New(queue, forward.Config{
+			Rules:     rules,
+			SRS:       forward.NewSRS(srsSecret, srsDomain),
+			Smarthost: smarthost,
+			Username:  os.Getenv("SMARTHOST_USERNAME"),
+			Password:  os.Getenv("SMARTHOST_PASSWORD"),
+			TLS:       tlsMode,
+			HeloName:  fqdn,
+		})
+		go forwarder.Run(context.Background())
+	}
+
+	// Extra recipient domains on top of the MAIL_SERVERS FQDNs
+	if acceptDomains := os.Getenv("ACCEPT_DOMAINS"); acceptDomains != "" {
+		for _, d := range strings.Split(acceptDomains, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				recipientDomains = append(recipientDomains, d)
+			}
+		}
+	}
+	catchAll := os.Getenv("SMTP_CATCH_ALL") == "true"
+	if len(recipientDomains) == 0 && !catchAll {
+		log.Fatalf("No recipient domains configured: set MAIL_SERVERS or ACCEPT_DOMAINS, or SMTP_CATCH_ALL=true to accept mail for every domain")
+	}
+
+	smtpConfig := server.Config{
+		FQDN:             fqdn,
+		Port:             smtpPort,
+		Mode:             mode,
+		LMTPSocket:       os.Getenv("LMTP_SOCKET"),
+		RecipientDomains: recipientDomains,
+		CatchAll:         catchAll,
+		MaxMessageBytes:  maxEmailSize,
+		OversizePolicy:   sizePolicy,
+		TLSCertFile:      os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:       os.Getenv("TLS_KEY_FILE"),
+		TLSSelfSigned:    os.Getenv("TLS_SELF_SIGNED") == "true",
+		ImplicitTLSPort:  os.Getenv("SMTPS_PORT"),
+		ProxyTrusted:     proxyTrusted,
+		SPFPolicy:        spfPolicy,
+		DNSBLZones:       dnsblZones,
+		MaxRecipients:    maxRecipients,
+		Timeout:          timeout,
+	}
+	if limiter != nil {
+		smtpConfig.Limiter = limiter
+	}
+	smtpConfig.Greylist = greylister
+	if forwarder != nil {
+		smtpConfig.Forwarder = forwarder
+	}
+
+	// Authenticated submission (accounts managed with cmd/smtp-user)
+	if submissionPort := os.Getenv("SUBMISSION_PORT"); submissionPort != "" {
+		if pgStore == nil {
+			// Accounts are looked up through the startup connection only
+			log.Fatalf("SUBMISSION_PORT requires DB_URL to be reachable at startup for the smtp_user table")
+		}
+		smtpConfig.SubmissionPort = submissionPort
+		smtpConfig.Users = pgStore.Users()
+	}
+
 	// Always run the email server
-	go server.RunSMTPServer(fqdn, smtpPort, store)
+	go server.RunSMTPServer(smtpConfig, store)
 
 	// HTTP API setup
 	port := os.Getenv("HTTP_PORT")
@@ -122,12 +462,6 @@ func main() {
 
 		w.Header().Set("Content-Type", "application/json")
 
-		// Check if postgres is available
-		if pgStore == nil {
-			http.Error(w, "Postgres storage not configured", http.StatusServiceUnavailable)
-			return
-		}
-
 		// Get email address from query parameter
 		address := r.URL.Query().Get("email")
 		if address == "" {
@@ -144,12 +478,19 @@ func main() {
 		}
 
 		// Fetch email summaries (5 per page, no body/attachments)
-		emails, err := pgStore.GetInbox(address, page)
+		emails, err := store.List(r.Context(), address, page)
 		if err != nil {
 			log.Printf("Error fetching inbox for %s: %v", address, err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		total, err := store.Count(r.Context(), address)
+		if err != nil {
+			log.Printf("Error counting inbox for %s: %v", address, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
 
 		if err := json.NewEncoder(w).Encode(emails); err != nil {
 			log.Printf("Error encoding JSON: %v", err)
@@ -158,9 +499,10 @@ func main() {
 		}
 	})
 
-	// Email detail endpoint (full content by UUIDv7)
-	http.HandleFunc("/email", func(w http.ResponseWriter, r *http.Request) {
-		// Set CORS headers
+	// Search endpoint: full-text search within one mailbox, optionally in
+	// a date range. The mailbox is required, as for /inbox, so the API
+	// never returns every mailbox's mail at once.
+	http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
@@ -175,10 +517,64 @@ func main() {
 			return
 		}
 
+		params := r.URL.Query()
+		query := storage.SearchQuery{Text: strings.TrimSpace(params.Get("q")), Mailbox: params.Get("email"), Page: 1}
+		if query.Text == "" {
+			http.Error(w, "Missing 'q' query parameter", http.StatusBadRequest)
+			return
+		}
+		if query.Mailbox == "" {
+			http.Error(w, "Missing 'email' query parameter", http.StatusBadRequest)
+			return
+		}
+		if pageStr := params.Get("page"); pageStr != "" {
+			if parsedPage, err := strconv.Atoi(pageStr); err == nil && parsedPage >= 1 {
+				query.Page = parsedPage
+			}
+		}
+		var err error
+		if v := params.Get("since"); v != "" {
+			if query.Since, err = parseSearchDate(v, false); err != nil {
+				http.Error(w, "Invalid 'since': "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := params.Get("until"); v != "" {
+			if query.Until, err = parseSearchDate(v, true); err != nil {
+				http.Error(w, "Invalid 'until': "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		emails, err := store.Search(r.Context(), query)
+		if err != nil {
+			log.Printf("Error searching for %q: %v", query.Text, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(emails); err != nil {
+			log.Printf("Error encoding JSON: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	})
 
-		if pgStore == nil {
-			http.Error(w, "Postgres storage not configured", http.StatusServiceUnavailable)
+	// Email detail endpoint (full content by ID)
+	http.HandleFunc("/email", func(w http.ResponseWriter, r *http.Request) {
+		// Set CORS headers
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
@@ -188,19 +584,113 @@ func main() {
 			return
 		}
 
-		email, err := pgStore.GetEmailByID(id)
+		w.Header().Set("Content-Type", "application/json")
+
+		email, err := store.Get(r.Context(), id)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "Email not found", http.StatusNotFound)
+			return
+		}
 		if err != nil {
 			log.Printf("Error fetching email %s: %v", id, err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
-		if email == nil {
-			http.Error(w, "Email not found", http.StatusNotFound)
+		if err := json.NewEncoder(w).Encode(email); err != nil {
+			log.Printf("Error encoding JSON: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+	})
 
-		if err := json.NewEncoder(w).Encode(email); err != nil {
+	// Raw message download, /email/{id}/raw, and attachment download,
+	// /email/{id}/attachments/{n}. File storage IDs contain slashes, so the
+	// ID is everything before the suffix.
+	http.HandleFunc("GET /email/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		path := r.PathValue("path")
+		if id, ok := strings.CutSuffix(path, "/raw"); ok {
+			content, err := store.OpenRaw(r.Context(), id)
+			if errors.Is(err, storage.ErrNotFound) {
+				http.Error(w, "Email not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("Error opening raw email %s: %v", id, err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			defer content.Close()
+
+			filename := strings.TrimSuffix(id[strings.LastIndex(id, "/")+1:], ".txt") + ".eml"
+			w.Header().Set("Content-Type", "message/rfc822")
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("Content-Security-Policy", "sandbox")
+			if _, err := io.Copy(w, content); err != nil {
+				log.Printf("Error sending raw email %s: %v", id, err)
+			}
+			return
+		}
+		i := strings.LastIndex(path, "/attachments/")
+		if i < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		id := path[:i]
+		n, err := strconv.Atoi(path[i+len("/attachments/"):])
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid attachment number", http.StatusBadRequest)
+			return
+		}
+
+		attachment, content, err := store.OpenAttachment(r.Context(), id, n)
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "Attachment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error opening attachment %d of email %s: %v", n, id, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer content.Close()
+
+		disposition := "attachment"
+		if attachment.Disposition == "inline" {
+			disposition = "inline"
+		}
+		if attachment.Filename != "" {
+			if v := mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}); v != "" {
+				disposition = v
+			}
+		}
+		w.Header().Set("Content-Type", attachment.ContentType)
+		w.Header().Set("Content-Disposition", disposition)
+		w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+		// Attachments come from strangers: never sniff or run them
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		if _, err := io.Copy(w, content); err != nil {
+			log.Printf("Error sending attachment %d of email %s: %v", n, id, err)
+		}
+	})
+
+	// Rate limiter counters
+	http.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if limiter == nil {
+			http.Error(w, "Rate limiting disabled", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(limiter.Stats()); err != nil {
 			log.Printf("Error encoding JSON: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
@@ -267,7 +757,7 @@ func main() {
 	})
 
 	log.Printf("Starting HTTP API on %s", addr)
-	log.Printf("Endpoints: / (health), /inbox?email=<address> (list), /email?id=<uuid> (detail), /domain/validate?email=<address>")
+	log.Printf("Endpoints: / (health), /inbox?email=<address> (list), /email?id=<uuid> (detail), /search?q=<text>&email=<address> (search), /domain/validate?email=<address>")
 	if err := http.ListenAndServe(addr, nil); err != nil {
 		log.Fatalf("Failed to start HTTP server: %v", err)
 	}
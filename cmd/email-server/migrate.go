@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+const migrateUsage = `Usage:
+  email-server migrate up                apply every pending migration
+  email-server migrate down [-steps n]   revert the latest n migrations (default 1)
+  email-server migrate status            list migrations and when they were applied
+  email-server migrate drop-legacy-attachments -confirm
+                                         drop attachment_legacy, the attachment rows of
+                                         old releases (destructive)
+
+DB_URL selects the database. The server applies pending migrations itself
+when it connects.`
+
+// runMigrate implements the migrate subcommand
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+	dbURL := os.Getenv("DB_URL")
+	if dbURL == "" {
+		log.Fatal("DB_URL environment variable is required")
+	}
+	// Not NewPostgresStorage, which would migrate up on connect
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+	migrator, err := storage.NewMigrator(db)
+	if err != nil {
+		log.Fatalf("Invalid migrations: %v", err)
+	}
+	ctx := context.Background()
+
+	switch cmd := args[0]; {
+	case cmd == "up" && len(args) == 1:
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			log.Printf("Applied %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		if len(applied) == 0 {
+			log.Printf("Schema is up to date")
+		}
+	case cmd == "down":
+		flags := flag.NewFlagSet("down", flag.ExitOnError)
+		steps := flags.Int("steps", 1, "number of migrations to revert")
+		flags.Parse(args[1:])
+		if *steps < 1 || flags.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, migrateUsage)
+			os.Exit(2)
+		}
+		reverted, err := migrator.Down(ctx, *steps)
+		for _, m := range reverted {
+			log.Printf("Reverted %04d_%s", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalf("Revert failed: %v", err)
+		}
+		if len(reverted) == 0 {
+			log.Printf("No migrations applied")
+		}
+	case cmd == "status" && len(args) == 1:
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			log.Fatalf("Failed to read schema status: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, s := range status {
+			name, applied := s.Name, "pending"
+			if name == "" {
+				name = "(unknown to this release)"
+			}
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Local().Format(time.DateTime)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, name, applied)
+		}
+		w.Flush()
+	case cmd == "drop-legacy-attachments":
+		flags := flag.NewFlagSet("drop-legacy-attachments", flag.ExitOnError)
+		confirm := flags.Bool("confirm", false, "confirm destructive migration")
+		flags.Parse(args[1:])
+		if flags.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, migrateUsage)
+			os.Exit(2)
+		}
+		if !*confirm {
+			fmt.Println("This is destructive and will DROP attachment_legacy, the attachment rows of old releases.")
+			fmt.Println("Re-run with -confirm to proceed.")
+			return
+		}
+		if _, err := db.ExecContext(ctx, `DROP TABLE IF EXISTS attachment_legacy`); err != nil {
+			log.Fatalf("Failed to drop attachment_legacy: %v", err)
+		}
+		log.Printf("Dropped attachment_legacy")
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+}
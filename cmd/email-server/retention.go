@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+const retentionUsage = `Usage:
+  email-server retention [-dry-run] [-batch n]
+
+Deletes the emails older than RETENTION_TTL, or than the TTL of their
+mailbox or domain in RETENTION_OVERRIDES, from the database in DB_URL and
+from file storage. -dry-run only counts them. The server does the same
+every RETENTION_INTERVAL while RETENTION_TTL or an override is set.`
+
+// retentionPolicyFromEnv returns the policy of RETENTION_TTL and
+// RETENTION_OVERRIDES. Neither set keeps emails forever.
+func retentionPolicyFromEnv() (storage.RetentionPolicy, error) {
+	var policy storage.RetentionPolicy
+	if v := os.Getenv("RETENTION_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl < 0 {
+			return policy, fmt.Errorf("invalid RETENTION_TTL %q (want a duration such as 720h, or 0 to keep forever)", v)
+		}
+		policy.TTL = ttl
+	}
+	overrides, err := storage.ParseRetentionOverrides(os.Getenv("RETENTION_OVERRIDES"))
+	if err != nil {
+		return policy, err
+	}
+	policy.Overrides = overrides
+	return policy, nil
+}
+
+// runRetention implements the retention subcommand
+func runRetention(args []string) {
+	flags := flag.NewFlagSet("retention", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, retentionUsage) }
+	dryRun := flags.Bool("dry-run", false, "count the expired emails without deleting them")
+	batch := flags.Int("batch", envInt("RETENTION_BATCH", storage.DefaultExpireBatch), "emails deleted per transaction")
+	flags.Parse(args)
+	if *batch < 1 || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, retentionUsage)
+		os.Exit(2)
+	}
+	policy, err := retentionPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid retention policy: %v", err)
+	}
+	if !policy.Enabled() {
+		log.Printf("Neither RETENTION_TTL nor RETENTION_OVERRIDES expires any email")
+		return
+	}
+
+	// File storage holds the emails saved while the database was down
+	backends := []storage.Storage{storage.NewFileStorage("emails")}
+	if dbURL := os.Getenv("DB_URL"); dbURL != "" {
+		ps, err := storage.NewPostgresStorage(dbURL)
+		if err != nil {
+			log.Fatalf("Failed to connect to database: %v", err)
+		}
+		blobs, err := blobStoreFromEnv()
+		if err != nil {
+			log.Fatalf("Failed to set up blob storage: %v", err)
+		}
+		if blobs != nil {
+			ps.SetBlobStore(blobs)
+		}
+		backends = append([]storage.Storage{ps}, backends...)
+	}
+	store := storage.NewCompositeStorage(backends...)
+	defer store.Close()
+
+	result, err := store.Expire(context.Background(), policy, storage.ExpireOptions{Batch: *batch, DryRun: *dryRun})
+	rules := make([]string, 0, len(result.ByRule))
+	for rule := range result.ByRule {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RULE\tTTL\tEMAILS")
+	for _, rule := range rules {
+		ttl, ok := policy.Overrides[rule]
+		if !ok {
+			ttl = policy.TTL
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\n", rule, ttl, result.ByRule[rule])
+	}
+	w.Flush()
+	if err != nil {
+		log.Fatalf("Expiry failed after %d email(s): %v", result.Purged, err)
+	}
+	if *dryRun {
+		log.Printf("Would purge %d expired email(s)", result.Purged)
+	} else {
+		log.Printf("Purged %d expired email(s)", result.Purged)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+const usage = `Usage:
+  smtp-user add <username>      create a user or reset its password
+  smtp-user delete <username>   remove a user
+  smtp-user list                list users
+
+The password is read from SMTP_USER_PASSWORD, or from the first line of
+standard input when it is not set. DB_URL selects the database.`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	dbURL := os.Getenv("DB_URL")
+	if dbURL == "" {
+		log.Fatal("DB_URL environment variable is required")
+	}
+	pgStore, err := storage.NewPostgresStorage(dbURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer pgStore.Close()
+	users := pgStore.Users()
+	ctx := context.Background()
+
+	switch cmd := os.Args[1]; {
+	case cmd == "add" && len(os.Args) == 3:
+		password, err := readPassword()
+		if err != nil {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+		hash, err := storage.HashPassword(password)
+		if err != nil {
+			log.Fatalf("Failed to hash password: %v", err)
+		}
+		if err := users.SetPasswordHash(ctx, os.Args[2], hash); err != nil {
+			log.Fatalf("Failed to save user: %v", err)
+		}
+		log.Printf("User %s saved", storage.NormalizeUsername(os.Args[2]))
+	case cmd == "delete" && len(os.Args) == 3:
+		found, err := users.Delete(ctx, os.Args[2])
+		if err != nil {
+			log.Fatalf("Failed to delete user: %v", err)
+		}
+		if !found {
+			log.Fatalf("User %s not found", os.Args[2])
+		}
+		log.Printf("User %s deleted", storage.NormalizeUsername(os.Args[2]))
+	case cmd == "list" && len(os.Args) == 2:
+		names, err := users.List(ctx)
+		if err != nil {
+			log.Fatalf("Failed to list users: %v", err)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// readPassword returns SMTP_USER_PASSWORD or the first line of stdin
+func readPassword() (string, error) {
+	if password := os.Getenv("SMTP_USER_PASSWORD"); password != "" {
+		return password, nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		if err == nil {
+			err = fmt.Errorf("empty password")
+		}
+		return "", err
+	}
+	return password, nil
+}
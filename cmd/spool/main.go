@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+const usage = `Usage:
+  spool list [-json]   show the messages waiting in the spool, and those
+                       that failed too often and were moved to failed/
+  spool flush          save every waiting message now
+
+SPOOL_DIR selects the spool directory. flush saves to the database given
+by DB_URL, or to file storage in ./emails when it is not set, like the
+server does, and moves messages to failed/ after SPOOL_MAX_ATTEMPTS tries.
+Move a message from failed/ back into SPOOL_DIR to retry it.`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	spoolDir := os.Getenv("SPOOL_DIR")
+	if spoolDir == "" {
+		log.Fatal("SPOOL_DIR environment variable is required")
+	}
+
+	switch cmd := os.Args[1]; {
+	case cmd == "list" && len(os.Args) == 2:
+		list(openSpool(spoolDir, nil), false)
+	case cmd == "list" && len(os.Args) == 3 && os.Args[2] == "-json":
+		list(openSpool(spoolDir, nil), true)
+	case cmd == "flush" && len(os.Args) == 2:
+		flush(spoolDir)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func openSpool(dir string, next storage.Storage) *storage.SpoolStorage {
+	spool, err := storage.NewSpoolStorage(dir, next)
+	if err != nil {
+		log.Fatalf("Failed to open spool: %v", err)
+	}
+	if v := os.Getenv("SPOOL_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid SPOOL_MAX_ATTEMPTS %q (want a number of attempts, or 0 for the default)", v)
+		}
+		spool.MaxAttempts = n
+	}
+	return spool
+}
+
+func list(spool *storage.SpoolStorage, asJSON bool) {
+	entries, err := spool.Entries()
+	if err != nil {
+		log.Fatalf("Failed to list spool: %v", err)
+	}
+	failed, err := spool.Failed()
+	if err != nil {
+		log.Fatalf("Failed to list failed spool entries: %v", err)
+	}
+	waiting := len(entries)
+	entries = append(entries, failed...)
+	if asJSON {
+		if entries == nil {
+			entries = []storage.SpoolEntry{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(entries)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tATTEMPTS\tQUEUED\tSIZE\tFROM\tTO")
+	for _, e := range entries {
+		status := "waiting"
+		if e.Failed {
+			status = "failed"
+		}
+		size := fmt.Sprint(e.Size)
+		if e.Truncated {
+			size += " (truncated)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", e.ID, status, e.Attempts, e.QueuedAt.Local().Format(time.DateTime), size, e.From, strings.Join(e.To, ", "))
+	}
+	w.Flush()
+	for _, e := range entries {
+		if e.LastError != "" {
+			log.Printf("%s: %s", e.ID, e.LastError)
+		}
+	}
+	log.Printf("%d messages in %s, %d failed", waiting, os.Getenv("SPOOL_DIR"), len(failed))
+}
+
+func flush(spoolDir string) {
+	var store storage.Storage
+	if dbURL := os.Getenv("DB_URL"); dbURL != "" {
+		pgStore, err := storage.NewPostgresStorage(dbURL)
+		if err != nil {
+			log.Fatalf("Failed to connect to database: %v", err)
+		}
+		defer pgStore.Close()
+		store = pgStore
+	} else {
+		store = storage.NewFileStorage("emails")
+	}
+
+	n, err := openSpool(spoolDir, store).Flush(context.Background())
+	log.Printf("Saved %d spooled messages", n)
+	if err != nil {
+		log.Fatalf("Some messages could not be saved: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package dnsutil
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// DKIMResult is the result of verifying one DKIM signature, using the
+// result names of RFC 8601 section 2.7.1
+type DKIMResult string
+
+const (
+	DKIMPass      DKIMResult = "pass"
+	DKIMFail      DKIMResult = "fail"
+	DKIMTempError DKIMResult = "temperror"
+	DKIMPermError DKIMResult = "permerror"
+)
+
+const (
+	dkimMaxSignatures = 5         // Signatures verified per message
+	dkimHeaderPeek    = 256 << 10 // Header bytes scanned for signature tags
+)
+
+// DKIMCheck is the outcome of verifying one DKIM-Signature header
+type DKIMCheck struct {
+	Result     DKIMResult
+	Domain     string // Signing domain (d=)
+	Selector   string // Key selector (s=)
+	Algorithm  string // Signing algorithm (a=), e.g. rsa-sha256 or ed25519-sha256
+	Identifier string // Agent or user identifier (i=)
+	Reason     string // Failure description, empty on pass
+}
+
+// VerifyDKIM verifies the DKIM signatures of a message, looking up public
+// keys through r. It returns one check per signature, in header order, and
+// no checks when the message is unsigned. The error is only set when the
+// message itself cannot be read.
+func VerifyDKIM(ctx context.Context, r Resolver, msg io.Reader) ([]DKIMCheck, error) {
+	br := bufio.NewReaderSize(msg, dkimHeaderPeek)
+	tags, err := dkimSignatureTags(br)
+	if err != nil {
+		return nil, err
+	}
+	verifications, err := dkim.VerifyWithOptions(br, &dkim.VerifyOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			return r.LookupTXT(ctx, name)
+		},
+		MaxVerifications: dkimMaxSignatures,
+	})
+	if err != nil && err != dkim.ErrTooManySignatures {
+		return nil, err
+	}
+
+	var checks []DKIMCheck
+	for i, v := range verifications {
+		var sig map[string]string
+		if i < len(tags) {
+			sig = tags[i]
+		}
+		check := DKIMCheck{
+			Result:     DKIMPass,
+			Domain:     v.Domain,
+			Selector:   sig["s"],
+			Algorithm:  sig["a"],
+			Identifier: v.Identifier,
+		}
+		if check.Domain == "" {
+			check.Domain = sig["d"]
+		}
+		if v.Err != nil {
+			check.Reason = strings.TrimPrefix(v.Err.Error(), "dkim: ")
+			switch {
+			case dkim.IsTempFail(v.Err):
+				check.Result = DKIMTempError
+			case dkim.IsPermFail(v.Err):
+				check.Result = DKIMPermError
+			default:
+				check.Result = DKIMFail
+			}
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// dkimSignatureTags peeks at the header section of br and returns the tags
+// of each DKIM-Signature field in order, without consuming the message. The
+// verifier does not expose the selector and algorithm it used.
+func dkimSignatureTags(br *bufio.Reader) ([]map[string]string, error) {
+	buf, err := br.Peek(dkimHeaderPeek)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	header := buf
+	if end := headerEnd(buf); end >= 0 {
+		header = buf[:end]
+	}
+
+	mh, err := textproto.NewReader(bufio.NewReader(strings.NewReader(string(header) + "\r\n\r\n"))).ReadMIMEHeader()
+	if err != nil && len(mh) == 0 {
+		// Malformed header: let the verifier report it
+		return nil, nil
+	}
+
+	var tags []map[string]string
+	for _, value := range mh.Values("Dkim-Signature") {
+		tags = append(tags, parseDKIMTags(value))
+	}
+	return tags, nil
+}
+
+// headerEnd returns the offset of the blank line ending the header section
+func headerEnd(buf []byte) int {
+	s := string(buf)
+	if strings.HasPrefix(s, "\r\n") || strings.HasPrefix(s, "\n") {
+		return 0
+	}
+	if i := strings.Index(s, "\r\n\r\n"); i >= 0 {
+		return i
+	}
+	if i := strings.Index(s, "\n\n"); i >= 0 {
+		return i
+	}
+	return -1
+}
+
+// parseDKIMTags parses a DKIM tag=value list (RFC 6376 section 3.2)
+func parseDKIMTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(value, ";") {
+		name, val, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(val), "")
+	}
+	return tags
+}
@@ -0,0 +1,147 @@
+package dnsutil
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+const dkimTestMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@test.com\r\n" +
+	"Subject: DKIM test\r\n" +
+	"\r\n" +
+	"Hello Bob,\r\n" +
+	"this message is signed.\r\n"
+
+func signMessage(t *testing.T, msg string, opts *dkim.SignOptions) string {
+	t.Helper()
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, strings.NewReader(msg), opts); err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	return signed.String()
+}
+
+func dkimKeys(t *testing.T) (*StaticResolver, crypto.Signer, crypto.Signer) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &StaticResolver{
+		TXT: map[string][]string{
+			"rsa._domainkey.example.com": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+			"ed._domainkey.example.com":  {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+		},
+		Fail: map[string]bool{"down._domainkey.example.com": true},
+	}
+	return r, rsaKey, edKey
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	r, rsaKey, edKey := dkimKeys(t)
+
+	cases := []struct {
+		name     string
+		selector string
+		key      crypto.Signer
+		header   dkim.Canonicalization
+		body     dkim.Canonicalization
+		tamper   bool
+		want     DKIMResult
+		algo     string
+	}{
+		{"rsa relaxed", "rsa", rsaKey, dkim.CanonicalizationRelaxed, dkim.CanonicalizationRelaxed, false, DKIMPass, "rsa-sha256"},
+		{"rsa simple", "rsa", rsaKey, dkim.CanonicalizationSimple, dkim.CanonicalizationSimple, false, DKIMPass, "rsa-sha256"},
+		{"ed25519 relaxed", "ed", edKey, dkim.CanonicalizationRelaxed, dkim.CanonicalizationSimple, false, DKIMPass, "ed25519-sha256"},
+		{"body modified", "rsa", rsaKey, dkim.CanonicalizationRelaxed, dkim.CanonicalizationRelaxed, true, DKIMFail, "rsa-sha256"},
+		{"unknown selector", "missing", rsaKey, dkim.CanonicalizationRelaxed, dkim.CanonicalizationRelaxed, false, DKIMPermError, "rsa-sha256"},
+		{"key lookup failure", "down", rsaKey, dkim.CanonicalizationRelaxed, dkim.CanonicalizationRelaxed, false, DKIMTempError, "rsa-sha256"},
+	}
+
+	for _, c := range cases {
+		signed := signMessage(t, dkimTestMessage, &dkim.SignOptions{
+			Domain:                 "example.com",
+			Selector:               c.selector,
+			Signer:                 c.key,
+			HeaderCanonicalization: c.header,
+			BodyCanonicalization:   c.body,
+		})
+		if c.tamper {
+			signed = strings.Replace(signed, "Hello Bob", "Hello Eve", 1)
+		}
+
+		checks, err := VerifyDKIM(context.Background(), r, strings.NewReader(signed))
+		if err != nil {
+			t.Fatalf("%s: VerifyDKIM failed: %v", c.name, err)
+		}
+		if len(checks) != 1 {
+			t.Fatalf("%s: expected 1 check, got %d", c.name, len(checks))
+		}
+		got := checks[0]
+		if got.Result != c.want {
+			t.Errorf("%s: result = %s (%s), want %s", c.name, got.Result, got.Reason, c.want)
+		}
+		if got.Domain != "example.com" || got.Selector != c.selector || got.Algorithm != c.algo {
+			t.Errorf("%s: unexpected signature details: %+v", c.name, got)
+		}
+		if (got.Result == DKIMPass) != (got.Reason == "") {
+			t.Errorf("%s: reason %q does not match result %s", c.name, got.Reason, got.Result)
+		}
+	}
+}
+
+func TestVerifyDKIM_MultipleSignatures(t *testing.T) {
+	r, rsaKey, edKey := dkimKeys(t)
+	signed := signMessage(t, dkimTestMessage, &dkim.SignOptions{Domain: "example.com", Selector: "rsa", Signer: rsaKey})
+	signed = signMessage(t, signed, &dkim.SignOptions{Domain: "example.com", Selector: "ed", Signer: edKey})
+
+	checks, err := VerifyDKIM(context.Background(), r, strings.NewReader(signed))
+	if err != nil {
+		t.Fatalf("VerifyDKIM failed: %v", err)
+	}
+	if len(checks) != 2 {
+		t.Fatalf("Expected 2 checks, got %d", len(checks))
+	}
+	// The newest signature is prepended, so it comes first
+	if checks[0].Selector != "ed" || checks[1].Selector != "rsa" {
+		t.Errorf("Unexpected order: %+v", checks)
+	}
+	for _, c := range checks {
+		if c.Result != DKIMPass {
+			t.Errorf("Expected pass, got %+v", c)
+		}
+	}
+}
+
+func TestVerifyDKIM_Unsigned(t *testing.T) {
+	checks, err := VerifyDKIM(context.Background(), &StaticResolver{}, strings.NewReader(dkimTestMessage))
+	if err != nil || len(checks) != 0 {
+		t.Errorf("Expected no checks for unsigned message, got %+v, %v", checks, err)
+	}
+}
+
+func TestParseDKIMTags(t *testing.T) {
+	tags := parseDKIMTags("v=1; a=rsa-sha256; d=example.com;\r\n s=sel;\r\n\tb=abc\r\n def=")
+	if tags["a"] != "rsa-sha256" || tags["d"] != "example.com" || tags["s"] != "sel" || tags["b"] != "abcdef=" {
+		t.Errorf("Unexpected tags: %v", tags)
+	}
+}
@@ -0,0 +1,116 @@
+package dnsutil
+
+import (
+	"context"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARCResult is the result of a DMARC evaluation, using the result names
+// of RFC 8601 section 2.7.1
+type DMARCResult string
+
+const (
+	DMARCNone      DMARCResult = "none"
+	DMARCPass      DMARCResult = "pass"
+	DMARCFail      DMARCResult = "fail"
+	DMARCTempError DMARCResult = "temperror"
+	DMARCPermError DMARCResult = "permerror"
+)
+
+// DMARCCheck is the outcome of a DMARC evaluation
+type DMARCCheck struct {
+	Result      DMARCResult
+	Domain      string // RFC5322.From domain
+	Policy      string // Policy the domain owner requests (p= or sp=), empty without a record
+	SPFAligned  bool   // SPF passed for a domain aligned with Domain
+	DKIMAligned bool   // A DKIM signature of an aligned domain passed
+	Reason      string
+}
+
+// CheckDMARC evaluates the DMARC policy of fromDomain (RFC 7489) against
+// the SPF and DKIM results of the message. spf may be nil when SPF was not
+// checked. The policy is discovered at the From domain, then at its
+// organizational domain.
+func CheckDMARC(ctx context.Context, r Resolver, fromDomain string, spf *SPFCheck, dkims []DKIMCheck) DMARCCheck {
+	fromDomain = strings.TrimSuffix(strings.ToLower(fromDomain), ".")
+	check := DMARCCheck{Result: DMARCNone, Domain: fromDomain}
+
+	options := &dmarc.LookupOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			return r.LookupTXT(ctx, name)
+		},
+	}
+	record, err := dmarc.LookupWithOptions(fromDomain, options)
+	orgDomain := OrganizationalDomain(fromDomain)
+	subdomain := false
+	if err == dmarc.ErrNoPolicy && orgDomain != fromDomain {
+		record, err = dmarc.LookupWithOptions(orgDomain, options)
+		subdomain = true
+	}
+	switch {
+	case err == dmarc.ErrNoPolicy:
+		check.Reason = "no DMARC record"
+		return check
+	case dmarc.IsTempFail(err):
+		check.Result = DMARCTempError
+		check.Reason = strings.TrimPrefix(err.Error(), "dmarc: ")
+		return check
+	case err != nil:
+		check.Result = DMARCPermError
+		check.Reason = strings.TrimPrefix(err.Error(), "dmarc: ")
+		return check
+	}
+
+	check.Policy = string(record.Policy)
+	if subdomain && record.SubdomainPolicy != "" {
+		check.Policy = string(record.SubdomainPolicy)
+	}
+
+	if spf != nil && spf.Result == SPFPass {
+		check.SPFAligned = aligned(spf.Domain, fromDomain, record.SPFAlignment)
+	}
+	for _, d := range dkims {
+		if d.Result == DKIMPass && aligned(d.Domain, fromDomain, record.DKIMAlignment) {
+			check.DKIMAligned = true
+			break
+		}
+	}
+
+	if check.SPFAligned || check.DKIMAligned {
+		check.Result = DMARCPass
+	} else {
+		check.Result = DMARCFail
+		check.Reason = "no aligned SPF or DKIM pass"
+	}
+	return check
+}
+
+// aligned reports whether an authenticated domain is aligned with the From
+// domain: identical in strict mode, same organizational domain in relaxed mode
+func aligned(domain, fromDomain string, mode dmarc.AlignmentMode) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" {
+		return false
+	}
+	if domain == fromDomain {
+		return true
+	}
+	if mode == dmarc.AlignmentStrict {
+		return false
+	}
+	return OrganizationalDomain(domain) == OrganizationalDomain(fromDomain)
+}
+
+// OrganizationalDomain returns the registrable domain of domain (one label
+// below its public suffix), or domain itself if it has none
+func OrganizationalDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
@@ -0,0 +1,71 @@
+package dnsutil
+
+import (
+	"context"
+	"testing"
+)
+
+func dmarcResolver() *StaticResolver {
+	return &StaticResolver{
+		TXT: map[string][]string{
+			"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine"},
+			"_dmarc.strict.com":  {"v=DMARC1; p=quarantine; adkim=s; aspf=s"},
+			"_dmarc.bad.com":     {"v=DMARC1; p=bogus"},
+		},
+		Fail: map[string]bool{"_dmarc.down.com": true},
+	}
+}
+
+func TestCheckDMARC(t *testing.T) {
+	spfPass := func(domain string) *SPFCheck { return &SPFCheck{Result: SPFPass, Domain: domain} }
+	dkimPass := func(domain string) []DKIMCheck { return []DKIMCheck{{Result: DKIMPass, Domain: domain}} }
+
+	cases := []struct {
+		name       string
+		from       string
+		spf        *SPFCheck
+		dkim       []DKIMCheck
+		want       DMARCResult
+		policy     string
+		spfAligned bool
+		dkimAlign  bool
+	}{
+		{"spf aligned", "example.com", spfPass("example.com"), nil, DMARCPass, "reject", true, false},
+		{"dkim aligned", "example.com", nil, dkimPass("example.com"), DMARCPass, "reject", false, true},
+		{"relaxed subdomain", "example.com", spfPass("bounce.example.com"), dkimPass("mail.example.com"), DMARCPass, "reject", true, true},
+		{"unaligned", "example.com", spfPass("other.net"), dkimPass("other.net"), DMARCFail, "reject", false, false},
+		{"dkim failed", "example.com", nil, []DKIMCheck{{Result: DKIMFail, Domain: "example.com"}}, DMARCFail, "reject", false, false},
+		{"spf softfail", "example.com", &SPFCheck{Result: SPFSoftFail, Domain: "example.com"}, nil, DMARCFail, "reject", false, false},
+		{"subdomain policy", "news.example.com", nil, dkimPass("example.com"), DMARCPass, "quarantine", false, true},
+		{"strict rejects subdomain", "strict.com", spfPass("mail.strict.com"), dkimPass("mail.strict.com"), DMARCFail, "quarantine", false, false},
+		{"strict exact match", "strict.com", nil, dkimPass("strict.com"), DMARCPass, "quarantine", false, true},
+		{"no record", "norecord.com", spfPass("norecord.com"), nil, DMARCNone, "", false, false},
+		{"temperror", "down.com", nil, nil, DMARCTempError, "", false, false},
+		{"invalid record", "bad.com", nil, nil, DMARCPermError, "", false, false},
+		{"case insensitive", "Example.COM", nil, dkimPass("EXAMPLE.com"), DMARCPass, "reject", false, true},
+	}
+
+	r := dmarcResolver()
+	for _, c := range cases {
+		got := CheckDMARC(context.Background(), r, c.from, c.spf, c.dkim)
+		if got.Result != c.want || got.Policy != c.policy || got.SPFAligned != c.spfAligned || got.DKIMAligned != c.dkimAlign {
+			t.Errorf("%s: CheckDMARC = %+v, want %s policy=%q spf=%v dkim=%v", c.name, got, c.want, c.policy, c.spfAligned, c.dkimAlign)
+		}
+	}
+}
+
+func TestOrganizationalDomain(t *testing.T) {
+	cases := map[string]string{
+		"example.com":          "example.com",
+		"mail.example.com":     "example.com",
+		"a.b.example.co.uk":    "example.co.uk",
+		"Mail.Example.COM.":    "example.com",
+		"com":                  "com",
+		"test.milahabibie.com": "milahabibie.com",
+	}
+	for domain, want := range cases {
+		if got := OrganizationalDomain(domain); got != want {
+			t.Errorf("OrganizationalDomain(%q) = %q, want %q", domain, got, want)
+		}
+	}
+}
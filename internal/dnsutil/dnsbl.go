@@ -0,0 +1,57 @@
+package dnsutil
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// DNSBLHit is a listing of a client address in a DNS blocklist
+type DNSBLHit struct {
+	Zone   string
+	Codes  []string // Listing codes (A records in 127.0.0.0/8)
+	Reason string   // TXT record of the listing, if any
+}
+
+// LookupDNSBL queries zone for ip as described in RFC 5782: the address is
+// reversed (nibbles for IPv6) and prefixed to the zone. It returns nil when
+// the address is not listed. Answers outside 127.0.0.0/8 and the
+// 127.255.255.0/24 codes some lists use to refuse a query are not listings.
+func LookupDNSBL(ctx context.Context, r Resolver, ip net.IP, zone string) (*DNSBLHit, error) {
+	zone = strings.TrimSuffix(zone, ".")
+	name := dnsblQueryName(ip, zone)
+
+	ips, err := r.LookupIP(ctx, "ip4", name)
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hit := &DNSBLHit{Zone: zone}
+	for _, answer := range ips {
+		v4 := answer.To4()
+		if v4 == nil || v4[0] != 127 || (v4[1] == 255 && v4[2] == 255) {
+			continue
+		}
+		hit.Codes = append(hit.Codes, v4.String())
+	}
+	if len(hit.Codes) == 0 {
+		return nil, nil
+	}
+
+	if txts, err := r.LookupTXT(ctx, name); err == nil {
+		hit.Reason = strings.Join(txts, " ")
+	}
+	return hit, nil
+}
+
+// dnsblQueryName builds the name queried for ip in zone
+func dnsblQueryName(ip net.IP, zone string) string {
+	labels := strings.Split(dottedIP(ip), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".") + "." + zone
+}
@@ -0,0 +1,49 @@
+package dnsutil
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestLookupDNSBL(t *testing.T) {
+	r := &StaticResolver{
+		IP: map[string][]net.IP{
+			"2.0.0.127.bl.test":  {net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.4")},
+			"10.2.0.192.bl.test": {net.ParseIP("127.0.0.3")},
+			"11.2.0.192.bl.test": {net.ParseIP("127.255.255.254")},
+			"12.2.0.192.bl.test": {net.ParseIP("198.51.100.1")},
+			"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.bl.test": {net.ParseIP("127.0.0.2")},
+		},
+		TXT: map[string][]string{
+			"10.2.0.192.bl.test": {"Listed for spam, see https://bl.test/192.0.2.10"},
+		},
+		Fail: map[string]bool{"13.2.0.192.bl.test": true},
+	}
+	ctx := context.Background()
+
+	hit, err := LookupDNSBL(ctx, r, net.ParseIP("127.0.0.2"), "bl.test.")
+	if err != nil || hit == nil || hit.Zone != "bl.test" || len(hit.Codes) != 2 || hit.Codes[1] != "127.0.0.4" {
+		t.Errorf("Test address: got %+v, %v", hit, err)
+	}
+
+	hit, err = LookupDNSBL(ctx, r, net.ParseIP("192.0.2.10"), "bl.test")
+	if err != nil || hit == nil || hit.Reason != "Listed for spam, see https://bl.test/192.0.2.10" {
+		t.Errorf("Listing with reason: got %+v, %v", hit, err)
+	}
+
+	hit, err = LookupDNSBL(ctx, r, net.ParseIP("2001:db8::1"), "bl.test")
+	if err != nil || hit == nil {
+		t.Errorf("IPv6 listing: got %+v, %v", hit, err)
+	}
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.11", "192.0.2.12"} {
+		if hit, err := LookupDNSBL(ctx, r, net.ParseIP(ip), "bl.test"); hit != nil || err != nil {
+			t.Errorf("%s should not be listed, got %+v, %v", ip, hit, err)
+		}
+	}
+
+	if _, err := LookupDNSBL(ctx, r, net.ParseIP("192.0.2.13"), "bl.test"); err == nil {
+		t.Error("Expected an error for a failing lookup")
+	}
+}
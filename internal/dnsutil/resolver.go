@@ -0,0 +1,105 @@
+package dnsutil
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Resolver is the subset of *net.Resolver used by the mail authentication
+// checks. Use net.DefaultResolver in production and a StaticResolver to run
+// checks against canned answers without network access.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+var _ Resolver = net.DefaultResolver
+
+// StaticResolver answers lookups from in-memory records. Names are matched
+// case-insensitively and without a trailing dot. Unknown names fail with a
+// not-found *net.DNSError, names listed in Fail with a temporary one.
+type StaticResolver struct {
+	TXT  map[string][]string
+	IP   map[string][]net.IP // A and AAAA records
+	MX   map[string][]*net.MX
+	PTR  map[string][]string // keyed by IP address string
+	Fail map[string]bool
+}
+
+func staticKey(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+func (r *StaticResolver) check(name string) error {
+	if r.Fail[staticKey(name)] {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return nil
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *StaticResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if err := r.check(name); err != nil {
+		return nil, err
+	}
+	if txt, ok := r.TXT[staticKey(name)]; ok {
+		return txt, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *StaticResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if err := r.check(host); err != nil {
+		return nil, err
+	}
+	all, ok := r.IP[staticKey(host)]
+	if !ok {
+		return nil, notFound(host)
+	}
+	var ips []net.IP
+	for _, ip := range all {
+		is4 := ip.To4() != nil
+		if network == "ip" || (network == "ip4" && is4) || (network == "ip6" && !is4) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, notFound(host)
+	}
+	return ips, nil
+}
+
+func (r *StaticResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if err := r.check(name); err != nil {
+		return nil, err
+	}
+	if mx, ok := r.MX[staticKey(name)]; ok {
+		return mx, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *StaticResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if err := r.check(addr); err != nil {
+		return nil, err
+	}
+	if names, ok := r.PTR[addr]; ok {
+		return names, nil
+	}
+	return nil, notFound(addr)
+}
+
+// IsNotFound reports whether err means the name does not exist (NXDOMAIN or
+// no records), as opposed to a temporary resolver failure.
+func IsNotFound(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return dnsErr.IsNotFound
+	}
+	return false
+}
@@ -0,0 +1,746 @@
+package dnsutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SPFResult is the result of an SPF check, as defined in RFC 7208 section 2.6
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+// SPFCheck is the outcome of an SPF evaluation
+type SPFCheck struct {
+	Result SPFResult
+	Domain string // Domain whose policy was evaluated
+	Reason string // Matched mechanism or error description
+}
+
+const (
+	spfMaxLookups     = 10 // DNS-querying terms per check (RFC 7208 section 4.6.4)
+	spfMaxVoidLookups = 2  // Lookups returning no answer
+	spfMaxNames       = 10 // MX or PTR names considered per mechanism
+)
+
+// spfError aborts an evaluation with a temperror or permerror result
+type spfError struct {
+	result SPFResult
+	msg    string
+}
+
+func (e *spfError) Error() string { return e.msg }
+
+func permErrorf(format string, args ...interface{}) error {
+	return &spfError{SPFPermError, fmt.Sprintf(format, args...)}
+}
+
+func tempErrorf(format string, args ...interface{}) error {
+	return &spfError{SPFTempError, fmt.Sprintf(format, args...)}
+}
+
+// CheckSPF evaluates the SPF policy of the envelope sender for a message
+// from ip (RFC 7208 check_host()). An empty sender, as used by bounces, is
+// checked as postmaster@helo.
+func CheckSPF(ctx context.Context, r Resolver, ip net.IP, helo, sender string) SPFCheck {
+	local, domain := splitSender(sender, helo)
+	e := &spfEvaluator{
+		ctx:    ctx,
+		r:      r,
+		ip:     ip,
+		helo:   helo,
+		local:  local,
+		domain: domain,
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		e.ip = ip4
+	}
+	result, reason := e.checkHost(domain)
+	return SPFCheck{Result: result, Domain: domain, Reason: reason}
+}
+
+func splitSender(sender, helo string) (string, string) {
+	if sender == "" {
+		return "postmaster", helo
+	}
+	at := strings.LastIndex(sender, "@")
+	if at == -1 {
+		return "postmaster", sender
+	}
+	local := sender[:at]
+	if local == "" {
+		local = "postmaster"
+	}
+	return local, sender[at+1:]
+}
+
+type spfEvaluator struct {
+	ctx    context.Context
+	r      Resolver
+	ip     net.IP
+	helo   string
+	local  string // Sender local-part
+	domain string // Sender domain
+
+	lookups int
+	voids   int
+}
+
+type spfMechanism struct {
+	raw        string
+	qualifier  SPFResult
+	name       string
+	domainSpec string
+	ipNet      *net.IPNet
+	cidr4      int
+	cidr6      int
+}
+
+type spfRecord struct {
+	mechanisms []spfMechanism
+	redirect   string
+}
+
+func (e *spfEvaluator) checkHost(domain string) (SPFResult, string) {
+	if !validSPFDomain(domain) {
+		return SPFNone, fmt.Sprintf("%q is not a valid domain", domain)
+	}
+	record, err := e.fetchRecord(domain)
+	if err != nil {
+		return resultOf(err)
+	}
+	parsed, err := parseSPF(record)
+	if err != nil {
+		return resultOf(err)
+	}
+
+	for _, m := range parsed.mechanisms {
+		match, err := e.evalMechanism(m, domain)
+		if err != nil {
+			return resultOf(err)
+		}
+		if match {
+			return m.qualifier, fmt.Sprintf("%s matched %q", domain, m.raw)
+		}
+	}
+
+	if parsed.redirect != "" {
+		if err := e.countLookup(); err != nil {
+			return resultOf(err)
+		}
+		target, err := e.expand(parsed.redirect, domain)
+		if err != nil {
+			return resultOf(err)
+		}
+		result, reason := e.checkHost(target)
+		if result == SPFNone {
+			return SPFPermError, fmt.Sprintf("redirect target %s has no SPF record", target)
+		}
+		return result, reason
+	}
+
+	return SPFNeutral, fmt.Sprintf("no mechanism matched in %s", domain)
+}
+
+func resultOf(err error) (SPFResult, string) {
+	if se, ok := err.(*spfError); ok {
+		return se.result, se.msg
+	}
+	return SPFTempError, err.Error()
+}
+
+func (e *spfEvaluator) fetchRecord(domain string) (string, error) {
+	txts, err := e.r.LookupTXT(e.ctx, domain)
+	if err != nil {
+		if IsNotFound(err) {
+			return "", &spfError{SPFNone, "no SPF record for " + domain}
+		}
+		return "", tempErrorf("TXT lookup for %s failed: %v", domain, err)
+	}
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || (len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ")) {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", &spfError{SPFNone, "no SPF record for " + domain}
+	case 1:
+		return records[0], nil
+	}
+	return "", permErrorf("%s publishes %d SPF records", domain, len(records))
+}
+
+func isModifierName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		alpha := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if i == 0 && !alpha {
+			return false
+		}
+		if !alpha && !(c >= '0' && c <= '9') && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSPF parses a whole record up front, so a syntax error anywhere is a
+// permerror even if an earlier mechanism would have matched.
+func parseSPF(record string) (*spfRecord, error) {
+	parsed := &spfRecord{}
+	seenExp := false
+	for _, term := range strings.Fields(record)[1:] {
+		if eq := strings.IndexByte(term, '='); eq != -1 && isModifierName(term[:eq]) {
+			name, value := strings.ToLower(term[:eq]), term[eq+1:]
+			switch name {
+			case "redirect":
+				if parsed.redirect != "" {
+					return nil, permErrorf("duplicate redirect modifier")
+				}
+				if value == "" {
+					return nil, permErrorf("empty redirect modifier")
+				}
+				parsed.redirect = value
+			case "exp":
+				if seenExp {
+					return nil, permErrorf("duplicate exp modifier")
+				}
+				seenExp = true
+			}
+			// Unknown modifiers are ignored (RFC 7208 section 6)
+			continue
+		}
+
+		m, err := parseMechanism(term)
+		if err != nil {
+			return nil, err
+		}
+		parsed.mechanisms = append(parsed.mechanisms, m)
+	}
+	return parsed, nil
+}
+
+func parseMechanism(term string) (spfMechanism, error) {
+	m := spfMechanism{raw: term, qualifier: SPFPass, cidr4: 32, cidr6: 128}
+	rest := term
+	switch rest[0] {
+	case '+':
+		rest = rest[1:]
+	case '-':
+		m.qualifier, rest = SPFFail, rest[1:]
+	case '~':
+		m.qualifier, rest = SPFSoftFail, rest[1:]
+	case '?':
+		m.qualifier, rest = SPFNeutral, rest[1:]
+	}
+
+	end := strings.IndexAny(rest, ":/")
+	if end == -1 {
+		end = len(rest)
+	}
+	m.name, rest = strings.ToLower(rest[:end]), rest[end:]
+
+	var arg string
+	if strings.HasPrefix(rest, ":") {
+		arg = rest[1:]
+		rest = ""
+		if m.name == "a" || m.name == "mx" {
+			// The domain-spec may be followed by a dual CIDR length
+			if slash := strings.IndexByte(arg, '/'); slash != -1 {
+				arg, rest = arg[:slash], arg[slash:]
+			}
+		}
+		if arg == "" {
+			return m, permErrorf("empty argument in %q", term)
+		}
+	}
+
+	switch m.name {
+	case "all":
+		if arg != "" || rest != "" {
+			return m, permErrorf("unexpected argument in %q", term)
+		}
+	case "include", "exists":
+		if arg == "" || rest != "" {
+			return m, permErrorf("%s requires a domain in %q", m.name, term)
+		}
+		m.domainSpec = arg
+	case "ptr":
+		if rest != "" {
+			return m, permErrorf("unexpected CIDR in %q", term)
+		}
+		m.domainSpec = arg
+	case "a", "mx":
+		m.domainSpec = arg
+		if err := parseDualCIDR(rest, &m); err != nil {
+			return m, permErrorf("invalid CIDR in %q", term)
+		}
+	case "ip4", "ip6":
+		if arg == "" {
+			return m, permErrorf("%s requires an address in %q", m.name, term)
+		}
+		ipNet, err := parseIPNet(arg, m.name == "ip4")
+		if err != nil {
+			return m, permErrorf("invalid address in %q", term)
+		}
+		m.ipNet = ipNet
+	default:
+		return m, permErrorf("unknown mechanism %q", term)
+	}
+	return m, nil
+}
+
+// parseDualCIDR parses "/24", "//64" or "/24//64" after an a or mx mechanism
+func parseDualCIDR(s string, m *spfMechanism) error {
+	if s == "" {
+		return nil
+	}
+	v4, v6, dual := s, "", false
+	if i := strings.Index(s, "//"); i != -1 {
+		v4, v6, dual = s[:i], s[i+2:], true
+	}
+	if v4 != "" {
+		if !strings.HasPrefix(v4, "/") {
+			return fmt.Errorf("bad cidr")
+		}
+		n, err := strconv.Atoi(v4[1:])
+		if err != nil || n < 0 || n > 32 {
+			return fmt.Errorf("bad cidr")
+		}
+		m.cidr4 = n
+	}
+	if dual {
+		n, err := strconv.Atoi(v6)
+		if err != nil || n < 0 || n > 128 {
+			return fmt.Errorf("bad cidr")
+		}
+		m.cidr6 = n
+	}
+	return nil
+}
+
+func parseIPNet(arg string, v4 bool) (*net.IPNet, error) {
+	bits := 128
+	if v4 {
+		bits = 32
+	}
+	addr, length := arg, bits
+	if slash := strings.IndexByte(arg, '/'); slash != -1 {
+		n, err := strconv.Atoi(arg[slash+1:])
+		if err != nil || n < 0 || n > bits {
+			return nil, fmt.Errorf("bad prefix length")
+		}
+		addr, length = arg[:slash], n
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return nil, fmt.Errorf("bad address")
+	}
+	if v4 {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip.Mask(net.CIDRMask(length, bits)), Mask: net.CIDRMask(length, bits)}, nil
+}
+
+func (e *spfEvaluator) countLookup() error {
+	e.lookups++
+	if e.lookups > spfMaxLookups {
+		return permErrorf("more than %d DNS lookups", spfMaxLookups)
+	}
+	return nil
+}
+
+func (e *spfEvaluator) countVoid() error {
+	e.voids++
+	if e.voids > spfMaxVoidLookups {
+		return permErrorf("more than %d void DNS lookups", spfMaxVoidLookups)
+	}
+	return nil
+}
+
+func (e *spfEvaluator) isIPv4() bool {
+	return e.ip.To4() != nil
+}
+
+// matchIP reports whether candidate is within the mechanism's CIDR of the client IP
+func (e *spfEvaluator) matchIP(candidate net.IP, m spfMechanism) bool {
+	if e.isIPv4() {
+		c4 := candidate.To4()
+		if c4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(m.cidr4, 32)
+		return c4.Mask(mask).Equal(e.ip.Mask(mask))
+	}
+	if candidate.To4() != nil {
+		return false
+	}
+	mask := net.CIDRMask(m.cidr6, 128)
+	return candidate.Mask(mask).Equal(e.ip.Mask(mask))
+}
+
+// lookupIPs resolves the addresses of host in the client's address family.
+// Missing names count as void lookups rather than errors.
+func (e *spfEvaluator) lookupIPs(host string) ([]net.IP, error) {
+	network := "ip6"
+	if e.isIPv4() {
+		network = "ip4"
+	}
+	ips, err := e.r.LookupIP(e.ctx, network, host)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, e.countVoid()
+		}
+		return nil, tempErrorf("address lookup for %s failed: %v", host, err)
+	}
+	if len(ips) == 0 {
+		return nil, e.countVoid()
+	}
+	return ips, nil
+}
+
+func (e *spfEvaluator) target(m spfMechanism, domain string) (string, error) {
+	if m.domainSpec == "" {
+		return domain, nil
+	}
+	return e.expand(m.domainSpec, domain)
+}
+
+func (e *spfEvaluator) evalMechanism(m spfMechanism, domain string) (bool, error) {
+	switch m.name {
+	case "all":
+		return true, nil
+
+	case "ip4", "ip6":
+		if (m.name == "ip4") != e.isIPv4() {
+			return false, nil
+		}
+		return m.ipNet.Contains(e.ip), nil
+
+	case "include":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.target(m, domain)
+		if err != nil {
+			return false, err
+		}
+		result, reason := e.checkHost(target)
+		switch result {
+		case SPFPass:
+			return true, nil
+		case SPFFail, SPFSoftFail, SPFNeutral:
+			return false, nil
+		case SPFTempError:
+			return false, &spfError{SPFTempError, reason}
+		}
+		return false, permErrorf("include:%s: %s", target, reason)
+
+	case "a":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.target(m, domain)
+		if err != nil {
+			return false, err
+		}
+		ips, err := e.lookupIPs(target)
+		if err != nil {
+			return false, err
+		}
+		for _, ip := range ips {
+			if e.matchIP(ip, m) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "mx":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.target(m, domain)
+		if err != nil {
+			return false, err
+		}
+		mxs, err := e.r.LookupMX(e.ctx, target)
+		if err != nil {
+			if IsNotFound(err) {
+				return false, e.countVoid()
+			}
+			return false, tempErrorf("MX lookup for %s failed: %v", target, err)
+		}
+		if len(mxs) > spfMaxNames {
+			return false, permErrorf("%s has more than %d MX records", target, spfMaxNames)
+		}
+		for _, mx := range mxs {
+			ips, err := e.lookupIPs(strings.TrimSuffix(mx.Host, "."))
+			if err != nil {
+				return false, err
+			}
+			for _, ip := range ips {
+				if e.matchIP(ip, m) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.target(m, domain)
+		if err != nil {
+			return false, err
+		}
+		target = strings.ToLower(target)
+		for _, name := range e.validatedNames() {
+			if name == target || strings.HasSuffix(name, "."+target) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "exists":
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.target(m, domain)
+		if err != nil {
+			return false, err
+		}
+		ips, err := e.r.LookupIP(e.ctx, "ip4", target)
+		if err != nil {
+			if IsNotFound(err) {
+				return false, e.countVoid()
+			}
+			return false, tempErrorf("exists lookup for %s failed: %v", target, err)
+		}
+		return len(ips) > 0, nil
+	}
+	return false, permErrorf("unknown mechanism %q", m.raw)
+}
+
+// validatedNames returns the client's PTR names whose forward lookup points
+// back to the client IP. Lookup failures simply yield no names.
+func (e *spfEvaluator) validatedNames() []string {
+	names, err := e.r.LookupAddr(e.ctx, e.ip.String())
+	if err != nil {
+		return nil
+	}
+	if len(names) > spfMaxNames {
+		names = names[:spfMaxNames]
+	}
+	network := "ip6"
+	if e.isIPv4() {
+		network = "ip4"
+	}
+	var validated []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		ips, err := e.r.LookupIP(e.ctx, network, name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(e.ip) {
+				validated = append(validated, name)
+				break
+			}
+		}
+	}
+	return validated
+}
+
+// expand performs macro expansion of a domain-spec (RFC 7208 section 7)
+func (e *spfEvaluator) expand(spec, domain string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(spec); i++ {
+		c := spec[i]
+		if c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(spec) {
+			return "", permErrorf("trailing %% in %q", spec)
+		}
+		switch spec[i] {
+		case '%':
+			sb.WriteByte('%')
+		case '_':
+			sb.WriteByte(' ')
+		case '-':
+			sb.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end == -1 {
+				return "", permErrorf("unterminated macro in %q", spec)
+			}
+			value, err := e.expandMacro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(value)
+			i += end
+		default:
+			return "", permErrorf("invalid macro in %q", spec)
+		}
+	}
+
+	// Shorten over-long names by dropping labels from the left
+	result := sb.String()
+	for len(result) > 253 {
+		dot := strings.IndexByte(result, '.')
+		if dot == -1 {
+			break
+		}
+		result = result[dot+1:]
+	}
+	return result, nil
+}
+
+func (e *spfEvaluator) expandMacro(body, domain string) (string, error) {
+	if body == "" {
+		return "", permErrorf("empty macro")
+	}
+	letter := body[0]
+	rest := body[1:]
+
+	var value string
+	switch letter | 0x20 { // Lowercase
+	case 's':
+		value = e.local + "@" + e.domain
+	case 'l':
+		value = e.local
+	case 'o':
+		value = e.domain
+	case 'd':
+		value = domain
+	case 'i':
+		value = dottedIP(e.ip)
+	case 'p':
+		value = "unknown"
+		if names := e.validatedNames(); len(names) > 0 {
+			value = names[0]
+		}
+	case 'v':
+		value = "ip6"
+		if e.isIPv4() {
+			value = "in-addr"
+		}
+	case 'h':
+		value = e.helo
+	default:
+		// c, r and t are only allowed in exp, which is not evaluated
+		return "", permErrorf("invalid macro letter %q", letter)
+	}
+
+	digits := 0
+	for len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+		digits++
+		rest = rest[1:]
+	}
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(body[1 : 1+digits])
+		if err != nil || n == 0 {
+			return "", permErrorf("invalid macro transformer in %%{%s}", body)
+		}
+		keep = n
+	}
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse = true
+		rest = rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", permErrorf("invalid macro delimiter in %%{%s}", body)
+		}
+		delimiters = rest
+	}
+
+	if keep > 0 || reverse || delimiters != "." {
+		parts := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delimiters, r)
+		})
+		if reverse {
+			for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+				parts[i], parts[j] = parts[j], parts[i]
+			}
+		}
+		if keep > 0 && keep < len(parts) {
+			parts = parts[len(parts)-keep:]
+		}
+		value = strings.Join(parts, ".")
+	}
+
+	if letter >= 'A' && letter <= 'Z' {
+		value = urlEscape(value)
+	}
+	return value, nil
+}
+
+// dottedIP formats an IPv4 address as-is and an IPv6 address as dot-separated nibbles
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, string(hex[b>>4]), string(hex[b&0x0f]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// urlEscape escapes everything outside the RFC 3986 unreserved set
+func urlEscape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// validSPFDomain performs the syntax checks of RFC 7208 section 4.3: at
+// most 253 octets and at least two labels, none empty or longer than 63
+// octets. Unlike ValidateFQDN it does not restrict the characters of a
+// label, since SPF names such as _spf.example.com and macro-expanded local
+// parts need not be host names.
+func validSPFDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package dnsutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func spfResolver() *StaticResolver {
+	return &StaticResolver{
+		TXT: map[string][]string{
+			"example.com":        {"v=spf1 ip4:192.0.2.0/24 include:_spf.example.net -all"},
+			"_spf.example.net":   {"v=spf1 ip6:2001:db8::/32 a:relay.example.net ~all"},
+			"soft.test":          {"v=spf1 ~all"},
+			"neutral.test":       {"v=spf1 ?all"},
+			"empty.test":         {"v=spf1"},
+			"mx.test":            {"v=spf1 mx/24 -all"},
+			"redirect.test":      {"v=spf1 redirect=example.com"},
+			"redirect-none.test": {"v=spf1 redirect=nothing.test"},
+			"double.test":        {"v=spf1 -all", "v=spf1 +all"},
+			"notspf.test":        {"google-site-verification=abc"},
+			"syntax.test":        {"v=spf1 ip4:192.0.2.1 foo:bar -all"},
+			"exists.test":        {"v=spf1 exists:%{ir}.allow.exists.test -all"},
+			"include-none.test":  {"v=spf1 include:nothing.test -all"},
+			"include-temp.test":  {"v=spf1 include:broken.test -all"},
+			"ptr.test":           {"v=spf1 ptr -all"},
+			"void.test":          {"v=spf1 a:v1.test a:v2.test a:v3.test +all"},
+			"unknown-mod.test":   {"v=spf1 foo=bar +all"},
+			"dual.test":          {"v=spf1 a:host.dual.test/32//64 -all"},
+			"case.test":          {"V=SPF1 IP4:192.0.2.7 -ALL"},
+		},
+		IP: map[string][]net.IP{
+			"relay.example.net":           {net.ParseIP("198.51.100.7")},
+			"mail.mx.test":                {net.ParseIP("203.0.113.10")},
+			"3.2.0.192.allow.exists.test": {net.ParseIP("127.0.0.2")},
+			"client.ptr.test":             {net.ParseIP("192.0.2.55")},
+			"host.dual.test":              {net.ParseIP("192.0.2.80"), net.ParseIP("2001:db8:1::1")},
+		},
+		MX: map[string][]*net.MX{
+			"mx.test": {{Host: "mail.mx.test.", Pref: 10}},
+		},
+		PTR: map[string][]string{
+			"192.0.2.55": {"client.ptr.test."},
+		},
+		Fail: map[string]bool{
+			"broken.test": true,
+		},
+	}
+}
+
+func TestCheckSPF(t *testing.T) {
+	cases := []struct {
+		name   string
+		ip     string
+		sender string
+		want   SPFResult
+	}{
+		{"ip4 match", "192.0.2.10", "user@example.com", SPFPass},
+		{"include ip6 match", "2001:db8::25", "user@example.com", SPFPass},
+		{"include a match", "198.51.100.7", "user@example.com", SPFPass},
+		{"hard fail", "203.0.113.1", "user@example.com", SPFFail},
+		{"softfail", "203.0.113.1", "user@soft.test", SPFSoftFail},
+		{"neutral", "203.0.113.1", "user@neutral.test", SPFNeutral},
+		{"no mechanism", "203.0.113.1", "user@empty.test", SPFNeutral},
+		{"mx cidr match", "203.0.113.99", "user@mx.test", SPFPass},
+		{"mx no match", "203.0.114.1", "user@mx.test", SPFFail},
+		{"redirect", "192.0.2.10", "user@redirect.test", SPFPass},
+		{"redirect to nothing", "192.0.2.10", "user@redirect-none.test", SPFPermError},
+		{"no record", "192.0.2.10", "user@nothing.test", SPFNone},
+		{"no spf among txt", "192.0.2.10", "user@notspf.test", SPFNone},
+		{"two records", "192.0.2.10", "user@double.test", SPFPermError},
+		{"syntax error", "192.0.2.1", "user@syntax.test", SPFPermError},
+		{"exists macro", "192.0.2.3", "user@exists.test", SPFPass},
+		{"exists miss", "192.0.2.4", "user@exists.test", SPFFail},
+		{"include without record", "192.0.2.10", "user@include-none.test", SPFPermError},
+		{"include temperror", "192.0.2.10", "user@include-temp.test", SPFTempError},
+		{"temperror", "192.0.2.10", "user@broken.test", SPFTempError},
+		{"ptr validated", "192.0.2.55", "user@ptr.test", SPFPass},
+		{"ptr unknown", "192.0.2.56", "user@ptr.test", SPFFail},
+		{"void lookup limit", "192.0.2.1", "user@void.test", SPFPermError},
+		{"unknown modifier ignored", "192.0.2.1", "user@unknown-mod.test", SPFPass},
+		{"dual cidr v6", "2001:db8:1::ffff", "user@dual.test", SPFPass},
+		{"dual cidr v4 exact", "192.0.2.81", "user@dual.test", SPFFail},
+		{"case insensitive", "192.0.2.7", "user@case.test", SPFPass},
+		{"ipv4-mapped client", "::ffff:192.0.2.10", "user@example.com", SPFPass},
+		{"invalid domain", "192.0.2.10", "user@localhost", SPFNone},
+	}
+	r := spfResolver()
+	for _, c := range cases {
+		got := CheckSPF(context.Background(), r, net.ParseIP(c.ip), "helo.test", c.sender)
+		if got.Result != c.want {
+			t.Errorf("%s: CheckSPF(%s, %s) = %s (%s), want %s", c.name, c.ip, c.sender, got.Result, got.Reason, c.want)
+		}
+	}
+}
+
+func TestCheckSPF_NullSenderUsesHelo(t *testing.T) {
+	got := CheckSPF(context.Background(), spfResolver(), net.ParseIP("192.0.2.10"), "example.com", "")
+	if got.Result != SPFPass || got.Domain != "example.com" {
+		t.Errorf("Expected pass for HELO identity, got %+v", got)
+	}
+}
+
+func TestCheckSPF_LookupLimit(t *testing.T) {
+	r := &StaticResolver{TXT: map[string][]string{}}
+	// A chain of 11 includes exceeds the 10-lookup limit
+	for i := 0; i < 11; i++ {
+		r.TXT[fmt.Sprintf("l%d.test", i)] = []string{fmt.Sprintf("v=spf1 include:l%d.test -all", i+1)}
+	}
+	r.TXT["l11.test"] = []string{"v=spf1 +all"}
+
+	got := CheckSPF(context.Background(), r, net.ParseIP("192.0.2.1"), "helo.test", "user@l0.test")
+	if got.Result != SPFPermError {
+		t.Errorf("Expected permerror after 10 lookups, got %+v", got)
+	}
+
+	// Ten includes stay within the limit
+	got = CheckSPF(context.Background(), r, net.ParseIP("192.0.2.1"), "helo.test", "user@l1.test")
+	if got.Result != SPFPass {
+		t.Errorf("Expected pass within the limit, got %+v", got)
+	}
+}
+
+func TestCheckSPF_IncludeLoop(t *testing.T) {
+	r := &StaticResolver{TXT: map[string][]string{
+		"loop-a.test": {"v=spf1 include:loop-b.test -all"},
+		"loop-b.test": {"v=spf1 include:loop-a.test -all"},
+	}}
+	got := CheckSPF(context.Background(), r, net.ParseIP("192.0.2.1"), "helo.test", "user@loop-a.test")
+	if got.Result != SPFPermError {
+		t.Errorf("Expected permerror for include loop, got %+v", got)
+	}
+}
+
+// Examples from RFC 7208 section 7.4
+func TestSPFMacroExpansion(t *testing.T) {
+	e := &spfEvaluator{
+		ctx:    context.Background(),
+		r:      &StaticResolver{},
+		ip:     net.ParseIP("192.0.2.3").To4(),
+		helo:   "mx.example.org",
+		local:  "strong-bad",
+		domain: "email.example.com",
+	}
+	cases := map[string]string{
+		"%{s}":                  "strong-bad@email.example.com",
+		"%{o}":                  "email.example.com",
+		"%{d}":                  "email.example.com",
+		"%{d4}":                 "email.example.com",
+		"%{d3}":                 "email.example.com",
+		"%{d2}":                 "example.com",
+		"%{d1}":                 "com",
+		"%{dr}":                 "com.example.email",
+		"%{d2r}":                "example.email",
+		"%{l}":                  "strong-bad",
+		"%{l-}":                 "strong.bad",
+		"%{lr}":                 "strong-bad",
+		"%{lr-}":                "bad.strong",
+		"%{l1r-}":               "strong",
+		"%{ir}.%{v}._spf.%{d2}": "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":  "bad.strong.lp._spf.example.com",
+		"%{h}":                  "mx.example.org",
+		"%%%_%-":                "% %20",
+		"%{S}":                  "strong-bad%40email.example.com",
+	}
+	for spec, want := range cases {
+		got, err := e.expand(spec, "email.example.com")
+		if err != nil || got != want {
+			t.Errorf("expand(%q) = %q, %v; want %q", spec, got, err, want)
+		}
+	}
+
+	e.ip = net.ParseIP("2001:db8::cb01")
+	got, err := e.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	want := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if err != nil || got != want {
+		t.Errorf("IPv6 expand = %q, %v; want %q", got, err, want)
+	}
+
+	for _, bad := range []string{"%{x}", "%{d0}", "%", "%{d", "%a", "%{t}"} {
+		if _, err := e.expand(bad, "email.example.com"); err == nil {
+			t.Errorf("expand(%q) should fail", bad)
+		}
+	}
+}
+
+func TestValidSPFDomain(t *testing.T) {
+	cases := map[string]bool{
+		"example.com":                     true,
+		"example.com.":                    true,
+		"_spf.example.com":                true,
+		"first+last.lp._spf.example.com":  true,
+		"localhost":                       false,
+		"a..example.com":                  false,
+		strings.Repeat("a", 64) + ".com":  false,
+		strings.Repeat("a.", 127) + "com": false,
+	}
+	for domain, want := range cases {
+		if got := validSPFDomain(domain); got != want {
+			t.Errorf("validSPFDomain(%q) = %v, want %v", domain, got, want)
+		}
+	}
+}
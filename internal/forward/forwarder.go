@@ -0,0 +1,349 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+const (
+	// claimBatch is how many queued messages one poll relays
+	claimBatch = 20
+	// claimLease is how long a claimed message is hidden from other workers
+	claimLease = 10 * time.Minute
+	// dialTimeout bounds connecting to the smarthost
+	dialTimeout = 30 * time.Second
+	// minBackoff is the delay before the first retry; it doubles per attempt
+	minBackoff = time.Minute
+	// maxBackoff caps the delay between retries
+	maxBackoff = 6 * time.Hour
+)
+
+// TLSMode selects how the connection to the smarthost is secured
+type TLSMode string
+
+const (
+	// TLSStartTLS upgrades a plain connection with STARTTLS (port 587)
+	TLSStartTLS TLSMode = "starttls"
+	// TLSImplicit connects with TLS from the start (port 465)
+	TLSImplicit TLSMode = "tls"
+	// TLSNone relays in the clear, for smarthosts on a trusted network
+	TLSNone TLSMode = "none"
+)
+
+// ParseTLSMode parses the SMARTHOST_TLS setting. An empty value selects
+// TLSStartTLS.
+func ParseTLSMode(value string) (TLSMode, error) {
+	switch TLSMode(strings.ToLower(strings.TrimSpace(value))) {
+	case "", TLSStartTLS:
+		return TLSStartTLS, nil
+	case TLSImplicit:
+		return TLSImplicit, nil
+	case TLSNone:
+		return TLSNone, nil
+	}
+	return "", fmt.Errorf("invalid smarthost TLS mode %q (want %q, %q or %q)", value, TLSStartTLS, TLSImplicit, TLSNone)
+}
+
+// Config configures a Forwarder
+type Config struct {
+	Rules []Rule
+	// SRS rewrites envelope senders; nil relays them unchanged, which
+	// usually fails the recipient's SPF check
+	SRS *SRS
+
+	Smarthost string // host:port
+	Username  string // Authenticates with AUTH PLAIN when set
+	Password  string
+	TLS       TLSMode
+	TLSConfig *tls.Config // Optional, e.g. for a private CA
+	HeloName  string
+
+	PollInterval time.Duration // Default 5s
+	MaxAge       time.Duration // Give up on messages this old, default 5 days
+}
+
+// Forwarder queues copies of matching messages and relays them to the
+// smarthost. Temporary failures are retried with exponential backoff;
+// permanent (5xx) failures and messages older than MaxAge are marked
+// failed in the queue.
+type Forwarder struct {
+	queue storage.OutboundQueue
+	cfg   Config
+	now   func() time.Time
+}
+
+// New creates a Forwarder relaying the messages of queue
+func New(queue storage.OutboundQueue, cfg Config) *Forwarder {
+	if cfg.TLS == "" {
+		cfg.TLS = TLSStartTLS
+	}
+	if cfg.HeloName == "" {
+		cfg.HeloName = "localhost"
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 5 * time.Second
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = 5 * 24 * time.Hour
+	}
+	return &Forwarder{queue: queue, cfg: cfg, now: time.Now}
+}
+
+// Forward queues a copy of a received message for every external address
+// its matching rules name, and returns how many copies were queued. A
+// bounce sent to one of our SRS addresses is queued for the original
+// sender instead. The content is only read when a rule may match, and is
+// then spooled to a temporary file rather than held in memory.
+func (f *Forwarder) Forward(ctx context.Context, from string, to []string, content io.Reader) (int, error) {
+	var bounceTo []string
+	var candidates []*Rule
+	for _, rcpt := range to {
+		if f.cfg.SRS != nil {
+			if orig, err := f.cfg.SRS.Reverse(rcpt); err == nil {
+				bounceTo = append(bounceTo, orig)
+				continue
+			} else if errors.Is(err, ErrSRSInvalid) {
+				log.Printf("Dropping message to invalid SRS address %s", rcpt)
+				continue
+			}
+		}
+		for i := range f.cfg.Rules {
+			rule := &f.cfg.Rules[i]
+			if rule.matchesEnvelope(rcpt, from) {
+				candidates = append(candidates, rule)
+			}
+		}
+	}
+	if len(bounceTo) == 0 && len(candidates) == 0 {
+		return 0, nil
+	}
+
+	spool, err := os.CreateTemp("", "forward-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	if _, err := io.Copy(spool, content); err != nil {
+		return 0, err
+	}
+
+	queued := 0
+	for _, rcpt := range dedupe(bounceTo) {
+		// Bounces are relayed with the null sender so they cannot loop
+		if err := f.enqueue(ctx, "", rcpt, spool); err != nil {
+			return queued, err
+		}
+		queued++
+	}
+
+	subject, err := messageSubject(spool)
+	if err != nil {
+		return queued, err
+	}
+	var dests []string
+	for _, rule := range candidates {
+		if rule.subject == nil || rule.subject.MatchString(subject) {
+			dests = append(dests, rule.ForwardTo...)
+		}
+	}
+	mailFrom := from
+	if f.cfg.SRS != nil {
+		mailFrom = f.cfg.SRS.Forward(from)
+	}
+	for _, rcpt := range dedupe(dests) {
+		if err := f.enqueue(ctx, mailFrom, rcpt, spool); err != nil {
+			return queued, err
+		}
+		queued++
+	}
+	return queued, nil
+}
+
+func (f *Forwarder) enqueue(ctx context.Context, mailFrom, rcpt string, content io.ReadSeeker) error {
+	return f.queue.Enqueue(ctx, storage.OutboundMessage{
+		MailFrom:    mailFrom,
+		RcptTo:      rcpt,
+		NextAttempt: f.now(),
+	}, content)
+}
+
+// Run relays due messages every PollInterval until ctx is cancelled
+func (f *Forwarder) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		f.processDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// processDue relays the messages that are due, one batch at a time, until
+// none are left
+func (f *Forwarder) processDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		msgs, err := f.queue.Claim(ctx, f.now(), claimBatch, claimLease)
+		if err != nil {
+			log.Printf("Failed to claim outbound messages: %v", err)
+			return
+		}
+		for _, msg := range msgs {
+			f.relay(ctx, msg)
+		}
+		if len(msgs) < claimBatch {
+			return
+		}
+	}
+}
+
+// relay delivers one message and records the outcome in the queue
+func (f *Forwarder) relay(ctx context.Context, msg storage.OutboundMessage) {
+	err := f.deliver(ctx, msg)
+	if err == nil {
+		log.Printf("Forwarded message %s to %s", msg.ID, msg.RcptTo)
+		if err := f.queue.Delivered(ctx, msg.ID); err != nil {
+			log.Printf("Failed to remove forwarded message %s: %v", msg.ID, err)
+		}
+		return
+	}
+
+	var smtpErr *smtp.SMTPError
+	permanent := errors.As(err, &smtpErr) && smtpErr.Code >= 500
+	now := f.now()
+	if permanent || now.Sub(msg.CreatedAt) >= f.cfg.MaxAge {
+		log.Printf("Giving up forwarding message %s to %s: %v", msg.ID, msg.RcptTo, err)
+		err = f.queue.Fail(ctx, msg.ID, err.Error())
+	} else {
+		next := now.Add(backoff(msg.Attempts))
+		log.Printf("Forwarding message %s to %s failed, retrying at %s: %v", msg.ID, msg.RcptTo, next.Format(time.RFC3339), err)
+		err = f.queue.Retry(ctx, msg.ID, next, err.Error())
+	}
+	if err != nil {
+		log.Printf("Failed to update outbound message %s: %v", msg.ID, err)
+	}
+}
+
+// deliver relays msg through the smarthost, streaming its content from
+// the queue
+func (f *Forwarder) deliver(ctx context.Context, msg storage.OutboundMessage) error {
+	content, err := f.queue.Open(ctx, msg.ID)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	c, err := f.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if f.cfg.Username != "" {
+		if err := c.Auth(sasl.NewPlainClient("", f.cfg.Username, f.cfg.Password)); err != nil {
+			return err
+		}
+	}
+	if err := c.SendMail(msg.MailFrom, []string{msg.RcptTo}, content); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// dial connects to the smarthost and introduces us as HeloName. With
+// STARTTLS, only the EHLO before the upgrade says "localhost", as the
+// client library does not let us choose it; the EHLO sent over TLS says
+// HeloName.
+func (f *Forwarder) dial() (*smtp.Client, error) {
+	conn, err := net.DialTimeout("tcp", f.cfg.Smarthost, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var c *smtp.Client
+	switch f.cfg.TLS {
+	case TLSImplicit:
+		c = smtp.NewClient(tls.Client(conn, f.tlsConfig()))
+	case TLSStartTLS:
+		if c, err = smtp.NewClientStartTLS(conn, f.tlsConfig()); err != nil {
+			return nil, err
+		}
+	default:
+		c = smtp.NewClient(conn)
+	}
+	if err := c.Hello(f.cfg.HeloName); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// tlsConfig returns the TLS configuration verifying the smarthost name
+func (f *Forwarder) tlsConfig() *tls.Config {
+	cfg := &tls.Config{}
+	if f.cfg.TLSConfig != nil {
+		cfg = f.cfg.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(f.cfg.Smarthost)
+	}
+	return cfg
+}
+
+// backoff returns the delay before retrying a message that failed attempts
+// times before: one minute, doubling per attempt up to maxBackoff
+func backoff(attempts int) time.Duration {
+	if attempts >= 20 {
+		return maxBackoff
+	}
+	return min(minBackoff<<attempts, maxBackoff)
+}
+
+// messageSubject returns the decoded Subject of a raw message, reading
+// only its header section
+func messageSubject(r io.ReadSeeker) (string, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	msg, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return "", nil // No parsable header, so no subject to match
+	}
+	subject := msg.Header.Get("Subject")
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		return decoded, nil
+	}
+	return subject, nil
+}
+
+// dedupe removes repeated addresses, ignoring case
+func dedupe(addrs []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, addr := range addrs {
+		key := strings.ToLower(addr)
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, addr)
+		}
+	}
+	return unique
+}
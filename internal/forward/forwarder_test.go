@@ -0,0 +1,277 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+// relayed is a message received by the stand-in smarthost
+type relayed struct {
+	User string
+	From string
+	To   []string
+	Data string
+}
+
+// smarthost is a go-smtp server standing in for the upstream relay. It
+// requires AUTH when users is set and answers DATA with reply when set.
+type smarthost struct {
+	mu       sync.Mutex
+	users    map[string]string
+	reply    *smtp.SMTPError
+	messages []relayed
+}
+
+func (h *smarthost) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &smarthostSession{host: h}, nil
+}
+
+func (h *smarthost) setReply(reply *smtp.SMTPError) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reply = reply
+}
+
+func (h *smarthost) received() []relayed {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]relayed(nil), h.messages...)
+}
+
+type smarthostSession struct {
+	host *smarthost
+	msg  relayed
+}
+
+func (s *smarthostSession) AuthMechanisms() []string {
+	return []string{sasl.Plain}
+}
+
+func (s *smarthostSession) Auth(mech string) (sasl.Server, error) {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if s.host.users[username] == "" || s.host.users[username] != password {
+			return smtp.ErrAuthFailed
+		}
+		s.msg.User = username
+		return nil
+	}), nil
+}
+
+func (s *smarthostSession) Mail(from string, opts *smtp.MailOptions) error {
+	if s.host.users != nil && s.msg.User == "" {
+		return smtp.ErrAuthRequired
+	}
+	s.msg.From = from
+	return nil
+}
+
+func (s *smarthostSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.msg.To = append(s.msg.To, to)
+	return nil
+}
+
+func (s *smarthostSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.host.mu.Lock()
+	defer s.host.mu.Unlock()
+	if s.host.reply != nil {
+		return s.host.reply
+	}
+	s.msg.Data = string(data)
+	s.host.messages = append(s.host.messages, s.msg)
+	return nil
+}
+
+func (s *smarthostSession) Reset()        {}
+func (s *smarthostSession) Logout() error { return nil }
+
+// startSmarthost serves the stand-in smarthost on a loopback port
+func startSmarthost(t *testing.T, h *smarthost) string {
+	t.Helper()
+	s := smtp.NewServer(h)
+	s.Domain = "smarthost.test"
+	s.AllowInsecureAuth = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+// newTestForwarder forwards mail for ops@example.com through addr
+func newTestForwarder(t *testing.T, addr string, queue storage.OutboundQueue) *Forwarder {
+	t.Helper()
+	rules, err := ParseRules([]byte(`[{"recipient": "ops@example\\.com", "forward_to": ["oncall@external.net"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(queue, Config{
+		Rules:     rules,
+		SRS:       NewSRS("secret", "example.com"),
+		Smarthost: addr,
+		Username:  "relay",
+		Password:  "hunter2",
+		TLS:       TLSNone,
+		HeloName:  "mx.example.com",
+	})
+}
+
+const testMessage = "From: alice@origin.org\r\nSubject: disk full\r\n\r\nbody\r\n"
+
+func TestForwarder_RelaysWithSRS(t *testing.T) {
+	host := &smarthost{users: map[string]string{"relay": "hunter2"}}
+	queue := storage.NewMemoryOutbound()
+	f := newTestForwarder(t, startSmarthost(t, host), queue)
+	ctx := context.Background()
+
+	n, err := f.Forward(ctx, "alice@origin.org", []string{"ops@example.com", "bob@example.com"}, strings.NewReader(testMessage))
+	if err != nil || n != 1 {
+		t.Fatalf("Forward queued %d, %v; want 1", n, err)
+	}
+	f.processDue(ctx)
+
+	got := host.received()
+	if len(got) != 1 {
+		t.Fatalf("Smarthost received %d messages, want 1", len(got))
+	}
+	msg := got[0]
+	if msg.User != "relay" {
+		t.Errorf("Relayed as %q, want the configured user", msg.User)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "oncall@external.net" {
+		t.Errorf("Relayed to %v", msg.To)
+	}
+	if !strings.HasPrefix(msg.From, "SRS0=") || !strings.HasSuffix(msg.From, "=origin.org=alice@example.com") {
+		t.Errorf("Envelope sender %q is not SRS-rewritten", msg.From)
+	}
+	if msg.Data != testMessage {
+		t.Errorf("Content changed:\n%s", msg.Data)
+	}
+	if queue.Len() != 0 {
+		t.Errorf("Delivered message still queued")
+	}
+
+	// A bounce to the rewritten sender goes back to alice
+	n, err = f.Forward(ctx, "", []string{msg.From}, strings.NewReader("Subject: Undeliverable\r\n\r\n"))
+	if err != nil || n != 1 {
+		t.Fatalf("Bounce queued %d, %v; want 1", n, err)
+	}
+	f.processDue(ctx)
+	got = host.received()
+	if len(got) != 2 || got[1].From != "" || got[1].To[0] != "alice@origin.org" {
+		t.Errorf("Bounce relayed as %+v", got[len(got)-1])
+	}
+}
+
+func TestForwarder_RetriesTemporaryFailures(t *testing.T) {
+	host := &smarthost{users: map[string]string{"relay": "hunter2"}}
+	host.setReply(&smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Try later"})
+	queue := storage.NewMemoryOutbound()
+	f := newTestForwarder(t, startSmarthost(t, host), queue)
+	ctx := context.Background()
+
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { return now }
+	f.Forward(ctx, "alice@origin.org", []string{"ops@example.com"}, strings.NewReader(testMessage))
+
+	// Each failure doubles the delay before the next attempt
+	for attempt, delay := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		f.processDue(ctx)
+		msgs, _ := queue.Claim(ctx, now.Add(delay-time.Second), 10, 0)
+		if len(msgs) != 0 {
+			t.Fatalf("Attempt %d: message due before %s", attempt+1, delay)
+		}
+		now = now.Add(delay)
+	}
+	msgs, _ := queue.Claim(ctx, now, 10, 0)
+	if len(msgs) != 1 || msgs[0].Attempts != 3 || !strings.Contains(msgs[0].LastError, "Try later") {
+		t.Fatalf("Expected a message with 3 failed attempts, got %+v", msgs)
+	}
+
+	host.setReply(nil)
+	f.processDue(ctx)
+	if len(host.received()) != 1 || queue.Len() != 0 {
+		t.Errorf("Message not delivered once the smarthost recovered")
+	}
+}
+
+func TestForwarder_FailsPermanentErrors(t *testing.T) {
+	host := &smarthost{users: map[string]string{"relay": "hunter2"}}
+	host.setReply(&smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"})
+	queue := storage.NewMemoryOutbound()
+	f := newTestForwarder(t, startSmarthost(t, host), queue)
+	ctx := context.Background()
+
+	f.Forward(ctx, "alice@origin.org", []string{"ops@example.com"}, strings.NewReader(testMessage))
+	f.processDue(ctx)
+
+	failed := queue.Failed()
+	if queue.Len() != 0 || len(failed) != 1 || !strings.Contains(failed[0].LastError, "No such user") {
+		t.Errorf("Expected the message to fail permanently, queued %d, failed %+v", queue.Len(), failed)
+	}
+}
+
+func TestForwarder_GivesUpAfterMaxAge(t *testing.T) {
+	queue := storage.NewMemoryOutbound()
+	// Nothing listens on the smarthost address
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+	f := newTestForwarder(t, addr, queue)
+	ctx := context.Background()
+
+	queue.Enqueue(ctx, storage.OutboundMessage{RcptTo: "oncall@external.net", CreatedAt: time.Now().Add(-6 * 24 * time.Hour)}, strings.NewReader(testMessage))
+	f.processDue(ctx)
+	if queue.Len() != 0 || len(queue.Failed()) != 1 {
+		t.Errorf("Expected an expired message to fail, queued %d", queue.Len())
+	}
+}
+
+func TestForwarder_SubjectRuleReadsContentOnlyWhenNeeded(t *testing.T) {
+	rules, err := ParseRules([]byte(`[{"recipient": "me@example\\.com", "subject": "(?i)invoice", "forward_to": ["books@external.net"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := storage.NewMemoryOutbound()
+	f := New(queue, Config{Rules: rules})
+	ctx := context.Background()
+
+	// The rule cannot match, so the content is never read
+	if n, err := f.Forward(ctx, "a@b.com", []string{"you@example.com"}, failingReader{}); n != 0 || err != nil {
+		t.Errorf("Forward = %d, %v; want 0, nil", n, err)
+	}
+	// Encoded words are decoded before matching
+	msg := "Subject: =?UTF-8?Q?Your_INVOICE_=E2=82=AC?=\r\n\r\n"
+	if n, err := f.Forward(ctx, "a@b.com", []string{"me@example.com"}, strings.NewReader(msg)); n != 1 || err != nil {
+		t.Errorf("Forward = %d, %v; want 1, nil", n, err)
+	}
+	if n, _ := f.Forward(ctx, "a@b.com", []string{"me@example.com"}, strings.NewReader("Subject: hello\r\n\r\n")); n != 0 {
+		t.Errorf("Forwarded a message with a non-matching subject")
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{0: time.Minute, 1: 2 * time.Minute, 5: 32 * time.Minute, 9: maxBackoff, 64: maxBackoff} {
+		if got := backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package forward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"os"
+	"regexp"
+)
+
+// Rule forwards a copy of matching messages to external addresses. A
+// message matches when every pattern that is set matches: Recipient and
+// Sender must match the whole envelope address, case-insensitively, while
+// Subject may match anywhere in the decoded subject.
+type Rule struct {
+	Recipient string   `json:"recipient,omitempty"`
+	Sender    string   `json:"sender,omitempty"`
+	Subject   string   `json:"subject,omitempty"`
+	ForwardTo []string `json:"forward_to"`
+
+	recipient *regexp.Regexp
+	sender    *regexp.Regexp
+	subject   *regexp.Regexp
+}
+
+// ParseRules parses a JSON array of rules
+func ParseRules(data []byte) ([]Rule, error) {
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid forwarding rules: %w", err)
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("forwarding rule %d: %w", i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// LoadRules reads rules from a JSON file
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRules(data)
+}
+
+func (r *Rule) compile() error {
+	if r.Recipient == "" && r.Sender == "" && r.Subject == "" {
+		return fmt.Errorf("needs a recipient, sender or subject pattern")
+	}
+	if len(r.ForwardTo) == 0 {
+		return fmt.Errorf("forward_to is empty")
+	}
+	for _, addr := range r.ForwardTo {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return fmt.Errorf("invalid forward_to address %q", addr)
+		}
+	}
+
+	var err error
+	if r.recipient, err = compileAddressPattern(r.Recipient); err != nil {
+		return fmt.Errorf("invalid recipient pattern: %w", err)
+	}
+	if r.sender, err = compileAddressPattern(r.Sender); err != nil {
+		return fmt.Errorf("invalid sender pattern: %w", err)
+	}
+	if r.Subject != "" {
+		if r.subject, err = regexp.Compile(r.Subject); err != nil {
+			return fmt.Errorf("invalid subject pattern: %w", err)
+		}
+	}
+	return nil
+}
+
+// compileAddressPattern anchors an address pattern and ignores case
+func compileAddressPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("(?i)^(?:" + pattern + ")$")
+}
+
+// matchesEnvelope reports whether the recipient and sender patterns match
+func (r *Rule) matchesEnvelope(rcpt, sender string) bool {
+	if r.recipient != nil && !r.recipient.MatchString(rcpt) {
+		return false
+	}
+	if r.sender != nil && !r.sender.MatchString(sender) {
+		return false
+	}
+	return true
+}
+
+// Matches reports whether a message to rcpt matches the rule
+func (r *Rule) Matches(rcpt, sender, subject string) bool {
+	if !r.matchesEnvelope(rcpt, sender) {
+		return false
+	}
+	return r.subject == nil || r.subject.MatchString(subject)
+}
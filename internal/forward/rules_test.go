@@ -0,0 +1,47 @@
+package forward
+
+import "testing"
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules([]byte(`[
+		{"recipient": "ops@example\\.com", "forward_to": ["oncall@external.net"]},
+		{"sender": ".*@bank\\.com", "subject": "(?i)statement", "forward_to": ["me@external.net"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		rule                  int
+		rcpt, sender, subject string
+		want                  bool
+	}{
+		{0, "ops@example.com", "anyone@x.org", "", true},
+		{0, "OPS@Example.com", "anyone@x.org", "", true},
+		{0, "devops@example.com", "anyone@x.org", "", false}, // anchored
+		{0, "ops@example.com.evil", "anyone@x.org", "", false},
+		{1, "me@example.com", "alerts@bank.com", "Your Statement is ready", true},
+		{1, "me@example.com", "alerts@bank.com", "Hello", false},
+		{1, "me@example.com", "alerts@notbank.org", "Statement", false},
+	}
+	for _, tc := range cases {
+		if got := rules[tc.rule].Matches(tc.rcpt, tc.sender, tc.subject); got != tc.want {
+			t.Errorf("rule %d Matches(%q, %q, %q) = %v, want %v", tc.rule, tc.rcpt, tc.sender, tc.subject, got, tc.want)
+		}
+	}
+}
+
+func TestParseRules_Invalid(t *testing.T) {
+	for _, data := range []string{
+		`{}`,
+		`[{"forward_to": ["a@b.com"]}]`,
+		`[{"recipient": "a@b.com"}]`,
+		`[{"recipient": "a@b.com", "forward_to": ["not an address"]}]`,
+		`[{"recipient": "(", "forward_to": ["a@b.com"]}]`,
+		`[{"subject": "[", "forward_to": ["a@b.com"]}]`,
+	} {
+		if _, err := ParseRules([]byte(data)); err == nil {
+			t.Errorf("Expected an error for %s", data)
+		}
+	}
+}
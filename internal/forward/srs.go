@@ -0,0 +1,157 @@
+package forward
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// srsMaxAge is how long a rewritten address accepts bounces
+const srsMaxAge = 21 * 24 * time.Hour
+
+// srsAlphabet encodes the day timestamp of an SRS address
+const srsAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+var (
+	// ErrNotSRS is returned by Reverse for addresses that are not SRS
+	ErrNotSRS = errors.New("not an SRS address")
+	// ErrSRSInvalid is returned by Reverse for forged or expired addresses
+	ErrSRSInvalid = errors.New("invalid or expired SRS address")
+)
+
+// SRS rewrites envelope senders with the Sender Rewriting Scheme, so a
+// forwarded message passes the SPF check of the next hop and its bounces
+// come back to us. Addresses use the SRS0/SRS1 formats of libsrs2:
+//
+//	SRS0=HHHH=TT=example.com=alice@forwarder.example
+//
+// where HHHH authenticates the rest with an HMAC and TT is the day it was
+// issued.
+type SRS struct {
+	secret []byte
+	domain string
+	now    func() time.Time
+}
+
+// NewSRS creates an SRS rewriting senders into addresses at domain
+func NewSRS(secret, domain string) *SRS {
+	return &SRS{secret: []byte(secret), domain: strings.ToLower(domain), now: time.Now}
+}
+
+// Domain returns the domain of the rewritten addresses
+func (s *SRS) Domain() string {
+	return s.domain
+}
+
+// Forward rewrites sender. The null sender of bounces and senders already
+// in our domain are returned unchanged; SRS addresses of other forwarders
+// become SRS1 addresses.
+func (s *SRS) Forward(sender string) string {
+	local, domain, ok := splitAddress(sender)
+	if !ok || strings.EqualFold(domain, s.domain) {
+		return sender
+	}
+
+	if srs0, ok := cutPrefixFold(local, "SRS0="); ok {
+		// SRS1=HHHH=first-forwarder==<SRS0 hash, timestamp and address>
+		rest := "=" + srs0
+		return "SRS1=" + s.hash(domain, rest) + "=" + domain + "=" + rest + "@" + s.domain
+	}
+	if srs1, ok := cutPrefixFold(local, "SRS1="); ok {
+		// Keep pointing at the first forwarder
+		parts := strings.SplitN(srs1, "=", 3)
+		if len(parts) == 3 {
+			return "SRS1=" + s.hash(parts[1], parts[2]) + "=" + parts[1] + "=" + parts[2] + "@" + s.domain
+		}
+	}
+
+	ts := s.timestamp(s.now())
+	return "SRS0=" + s.hash(ts, domain, local) + "=" + ts + "=" + domain + "=" + local + "@" + s.domain
+}
+
+// Reverse recovers the address a bounce to an SRS address is meant for
+func (s *SRS) Reverse(address string) (string, error) {
+	local, domain, ok := splitAddress(address)
+	if !ok || !strings.EqualFold(domain, s.domain) {
+		return "", ErrNotSRS
+	}
+
+	if srs0, ok := cutPrefixFold(local, "SRS0="); ok {
+		parts := strings.SplitN(srs0, "=", 4)
+		if len(parts) != 4 {
+			return "", ErrSRSInvalid
+		}
+		hash, ts, origDomain, origLocal := parts[0], parts[1], parts[2], parts[3]
+		if !s.validHash(hash, ts, origDomain, origLocal) || !s.fresh(ts) {
+			return "", ErrSRSInvalid
+		}
+		return origLocal + "@" + origDomain, nil
+	}
+	if srs1, ok := cutPrefixFold(local, "SRS1="); ok {
+		parts := strings.SplitN(srs1, "=", 3)
+		if len(parts) != 3 || !strings.HasPrefix(parts[2], "=") {
+			return "", ErrSRSInvalid
+		}
+		hash, firstDomain, rest := parts[0], parts[1], parts[2]
+		if !s.validHash(hash, firstDomain, rest) {
+			return "", ErrSRSInvalid
+		}
+		return "SRS0" + rest + "@" + firstDomain, nil
+	}
+	return "", ErrNotSRS
+}
+
+// hash authenticates parts, case-insensitively since mail systems may
+// change the case of addresses
+func (s *SRS) hash(parts ...string) string {
+	mac := hmac.New(sha1.New, s.secret)
+	for _, part := range parts {
+		mac.Write([]byte(strings.ToLower(part)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:4]
+}
+
+func (s *SRS) validHash(hash string, parts ...string) bool {
+	return len(hash) == 4 && hmac.Equal([]byte(strings.ToLower(hash)), []byte(strings.ToLower(s.hash(parts...))))
+}
+
+// timestamp encodes the day of t in two base32 characters
+func (s *SRS) timestamp(t time.Time) string {
+	day := t.Unix() / 86400 % 1024
+	return string([]byte{srsAlphabet[day>>5], srsAlphabet[day&31]})
+}
+
+// fresh reports whether a timestamp is at most srsMaxAge old
+func (s *SRS) fresh(ts string) bool {
+	if len(ts) != 2 {
+		return false
+	}
+	hi := strings.IndexByte(srsAlphabet, strings.ToUpper(ts)[0])
+	lo := strings.IndexByte(srsAlphabet, strings.ToUpper(ts)[1])
+	if hi < 0 || lo < 0 {
+		return false
+	}
+	today := s.now().Unix() / 86400 % 1024
+	age := (today - int64(hi<<5|lo) + 1024) % 1024
+	return age <= int64(srsMaxAge/(24*time.Hour))
+}
+
+// splitAddress splits an address at its last @
+func splitAddress(address string) (local, domain string, ok bool) {
+	i := strings.LastIndexByte(address, '@')
+	if i <= 0 || i == len(address)-1 {
+		return "", "", false
+	}
+	return address[:i], address[i+1:], true
+}
+
+// cutPrefixFold is strings.CutPrefix ignoring case
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix) {
+		return s[len(prefix):], true
+	}
+	return s, false
+}
@@ -0,0 +1,77 @@
+package forward
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSRS(now time.Time) *SRS {
+	s := NewSRS("secret", "fwd.example")
+	s.now = func() time.Time { return now }
+	return s
+}
+
+func TestSRS_RoundTrip(t *testing.T) {
+	s := newTestSRS(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+
+	rewritten := s.Forward("alice@origin.org")
+	if !strings.HasPrefix(rewritten, "SRS0=") || !strings.HasSuffix(rewritten, "=origin.org=alice@fwd.example") {
+		t.Fatalf("Unexpected SRS0 address %q", rewritten)
+	}
+	orig, err := s.Reverse(rewritten)
+	if err != nil || orig != "alice@origin.org" {
+		t.Fatalf("Reverse(%q) = %q, %v", rewritten, orig, err)
+	}
+	// Mail systems may change the case of the address
+	if orig, err := s.Reverse(strings.ToUpper(rewritten)); err != nil || !strings.EqualFold(orig, "alice@origin.org") {
+		t.Errorf("Reverse of uppercased address = %q, %v", orig, err)
+	}
+}
+
+func TestSRS_Unchanged(t *testing.T) {
+	s := newTestSRS(time.Now())
+	for _, sender := range []string{"", "bob@fwd.example", "not-an-address"} {
+		if got := s.Forward(sender); got != sender {
+			t.Errorf("Forward(%q) = %q, want it unchanged", sender, got)
+		}
+	}
+}
+
+func TestSRS_RewritesOtherForwarders(t *testing.T) {
+	first := NewSRS("other-secret", "first.example")
+	srs0 := first.Forward("alice@origin.org")
+
+	s := newTestSRS(time.Now())
+	srs1 := s.Forward(srs0)
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.Contains(srs1, "=first.example==") {
+		t.Fatalf("Unexpected SRS1 address %q", srs1)
+	}
+	back, err := s.Reverse(srs1)
+	if err != nil || back != srs0 {
+		t.Fatalf("Reverse(%q) = %q, %v; want %q", srs1, back, err, srs0)
+	}
+	// A third forwarder keeps pointing at the first one
+	if again := s.Forward(srs1); !strings.Contains(again, "=first.example==") {
+		t.Errorf("Re-forwarded SRS1 address %q lost the first forwarder", again)
+	}
+}
+
+func TestSRS_RejectsForgedAndExpired(t *testing.T) {
+	issued := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	rewritten := newTestSRS(issued).Forward("alice@origin.org")
+
+	forged := strings.Replace(rewritten, "alice", "mallory", 1)
+	if _, err := newTestSRS(issued).Reverse(forged); err != ErrSRSInvalid {
+		t.Errorf("Forged address: got %v, want ErrSRSInvalid", err)
+	}
+	if _, err := newTestSRS(issued.Add(20 * 24 * time.Hour)).Reverse(rewritten); err != nil {
+		t.Errorf("20 day old address: %v", err)
+	}
+	if _, err := newTestSRS(issued.Add(30 * 24 * time.Hour)).Reverse(rewritten); err != ErrSRSInvalid {
+		t.Errorf("30 day old address: got %v, want ErrSRSInvalid", err)
+	}
+	if _, err := newTestSRS(issued).Reverse("alice@fwd.example"); err != ErrNotSRS {
+		t.Errorf("Plain address: got %v, want ErrNotSRS", err)
+	}
+}
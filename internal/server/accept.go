@@ -0,0 +1,165 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// refusalTimeout bounds the write of the reply refusing a connection
+const refusalTimeout = 5 * time.Second
+
+// admitListener admits the connections of a listener before they are
+// greeted, so a client is checked once per connection whatever it sends.
+// Each connection is admitted in its own goroutine, so a slow PROXY header
+// or DNSBL lookup does not hold up the others.
+type admitListener struct {
+	net.Listener
+	// admit returns the connection to serve, or nil once it has refused
+	// and closed it
+	admit func(net.Conn) net.Conn
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newAdmitListener(ln net.Listener, admit func(net.Conn) net.Conn) *admitListener {
+	al := &admitListener{
+		Listener: ln,
+		admit:    admit,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go al.serve()
+	return al
+}
+
+// serve accepts connections and passes the admitted ones to Accept. An
+// accept error is passed on too; a permanent one to every later Accept.
+func (al *admitListener) serve() {
+	for {
+		conn, err := al.Listener.Accept()
+		if err != nil {
+			var ne net.Error
+			temporary := errors.As(err, &ne) && ne.Temporary()
+			for {
+				select {
+				case al.errs <- err:
+				case <-al.done:
+					return
+				}
+				if temporary {
+					break
+				}
+			}
+			continue
+		}
+		go func() {
+			conn := al.admit(conn)
+			if conn == nil {
+				return
+			}
+			select {
+			case al.conns <- conn:
+			case <-al.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (al *admitListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-al.conns:
+		return conn, nil
+	case err := <-al.errs:
+		return nil, err
+	case <-al.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (al *admitListener) Close() error {
+	al.closeOnce.Do(func() { close(al.done) })
+	return al.Listener.Close()
+}
+
+// admittedConn is a connection admitted by Backend.admit. It holds the
+// limiter's session slot until it is closed, and the client's DNSBL
+// listings for every session on it, across STARTTLS.
+type admittedConn struct {
+	net.Conn
+	release   func() // Nil without a limiter
+	dnsbl     []dnsblHit
+	closeOnce sync.Once
+}
+
+func (c *admittedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if c.release != nil {
+			c.release()
+		}
+	})
+	return err
+}
+
+// admittedConnOf returns the admittedConn under conn, which STARTTLS or
+// implicit TLS may have wrapped, or nil when conn was not admitted
+func admittedConnOf(conn net.Conn) *admittedConn {
+	for {
+		switch c := conn.(type) {
+		case *admittedConn:
+			return c
+		case *tls.Conn:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// admit applies the limiter's session caps to a new connection and looks
+// the client up in the DNSBL zones, except on the submission listener. A
+// refused client is sent the reply, unless it expects implicit TLS, and
+// disconnected.
+func (bkd *Backend) admit(conn net.Conn, implicitTLS bool) net.Conn {
+	ip := remoteIP(conn.RemoteAddr())
+	admitted := &admittedConn{Conn: conn}
+	refuse := func(err error) net.Conn {
+		var smtpErr *smtp.SMTPError
+		if !implicitTLS && errors.As(err, &smtpErr) {
+			e := smtpErr.EnhancedCode
+			conn.SetWriteDeadline(time.Now().Add(refusalTimeout))
+			fmt.Fprintf(conn, "%d %d.%d.%d %s\r\n", smtpErr.Code, e[0], e[1], e[2], smtpErr.Message)
+		}
+		admitted.Close()
+		return nil
+	}
+
+	if bkd.Config.Limiter != nil {
+		release, err := bkd.Config.Limiter.AllowSession(ip)
+		if err != nil {
+			log.Printf("client %s: connection refused: %v", ip, err)
+			return refuse(err)
+		}
+		admitted.release = release
+	}
+	if !bkd.submission {
+		hits, err := bkd.checkDNSBL(ip)
+		if err != nil {
+			return refuse(err)
+		}
+		admitted.dnsbl = hits
+	}
+	return admitted
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/dnsutil"
+)
+
+// startLimitedServer serves SMTP on a loopback port with a limiter and a
+// self-signed certificate
+func startLimitedServer(t *testing.T, limits LimitConfig) (string, *Limiter, *memoryStore) {
+	t.Helper()
+	limiter := NewLimiter(limits)
+	cfg := Config{Limiter: limiter, CatchAll: true, TLSSelfSigned: true}
+	tlsConfig, err := buildTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memoryStore{}
+	be := NewBackend(cfg, store)
+	be.Resolver = &dnsutil.StaticResolver{}
+
+	s := newSMTPServer(be, "127.0.0.1:0", tlsConfig)
+	ln, err := listen(s, be, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String(), limiter, store
+}
+
+// greeting connects to addr and returns the first reply line
+func greeting(t *testing.T, addr string) (net.Conn, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Reading the greeting: %v", err)
+	}
+	return conn, line
+}
+
+func TestAdmitListener_RefusesAtConnect(t *testing.T) {
+	addr, limiter, _ := startLimitedServer(t, LimitConfig{MaxSessions: 1})
+
+	// The first client holds the only slot without ever sending EHLO
+	first, line := greeting(t, addr)
+	if !strings.HasPrefix(line, "220 ") {
+		t.Fatalf("First client got %q", line)
+	}
+	refused, line := greeting(t, addr)
+	if !strings.HasPrefix(line, "421 4.7.0 ") {
+		t.Fatalf("Second client got %q, want 421", line)
+	}
+	if _, err := refused.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Refused connection left open: %v", err)
+	}
+
+	first.Close()
+	for deadline := time.Now().Add(5 * time.Second); limiter.Stats().ActiveSessions != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("Closing the connection did not free its slot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, line := greeting(t, addr); !strings.HasPrefix(line, "220 ") {
+		t.Errorf("Client after release got %q", line)
+	}
+}
+
+func TestAdmitListener_STARTTLSKeepsSlot(t *testing.T) {
+	addr, limiter, store := startLimitedServer(t, LimitConfig{SessionsPerMinute: 1, SessionBurst: 1})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// EHLO, STARTTLS and EHLO again, which starts a second session
+	c, err := smtp.NewClientStartTLS(conn, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("STARTTLS failed: %v", err)
+	}
+	defer c.Close()
+	if err := c.SendMail("alice@example.com", []string{"bob@test.com"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatalf("Mail after STARTTLS was refused: %v", err)
+	}
+	c.Quit()
+
+	if len(store.saved) != 1 || store.saved[0].Connection.TLSVersion == "" {
+		t.Errorf("Expected one message over TLS, got %+v", store.saved)
+	}
+	if got := limiter.Stats().Decisions[DecisionSessionAllowed]; got != 1 {
+		t.Errorf("Connection charged %d sessions, want 1", got)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+// authTimeout bounds the user lookup of one AUTH attempt
+const authTimeout = 5 * time.Second
+
+// ErrTLSRequired is returned on the submission port before STARTTLS
+var ErrTLSRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Must issue a STARTTLS command first",
+}
+
+// ErrAuthRequired is returned on the submission port before AUTH
+var ErrAuthRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Authentication required",
+}
+
+// ErrAuthUnavailable is returned when the user store cannot be queried
+var ErrAuthUnavailable = &smtp.SMTPError{
+	Code:         454,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "Temporary authentication failure",
+}
+
+// dummyHash is compared against when a user does not exist, so unknown
+// and known usernames take as long to reject
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := storage.HashPassword("not a real password")
+	return hash
+})
+
+// AuthMechanisms lists the SASL mechanisms of submission sessions. SCRAM
+// is not offered: it needs salted SCRAM keys, which cannot be derived
+// from the bcrypt or argon2id hashes in the user table.
+func (s *Session) AuthMechanisms() []string {
+	if s.Users == nil {
+		return nil
+	}
+	return []string{sasl.Plain, sasl.Login}
+}
+
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if s.Users == nil {
+		return nil, smtp.ErrAuthUnsupported
+	}
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				return smtp.ErrAuthFailed
+			}
+			return s.checkCredentials(username, password)
+		}), nil
+	case sasl.Login:
+		return &loginServer{check: s.checkCredentials}, nil
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+// checkCredentials checks credentials against Users and records the user
+func (s *Session) checkCredentials(username, password string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+
+	hash, err := s.Users.PasswordHash(ctx, username)
+	if err != nil {
+		log.Printf("client %s: user lookup failed: %v", s.RemoteIP, err)
+		return ErrAuthUnavailable
+	}
+	known := hash != ""
+	if !known {
+		hash = dummyHash()
+	}
+	if !storage.CheckPassword(hash, password) || !known {
+		log.Printf("client %s: authentication failed for %q", s.RemoteIP, username)
+		return smtp.ErrAuthFailed
+	}
+
+	s.user = storage.NormalizeUsername(username)
+	log.Printf("client %s: authenticated as %s", s.RemoteIP, s.user)
+	return nil
+}
+
+// loginServer implements the LOGIN mechanism: the username and password
+// are requested one after the other. An initial response is the username.
+type loginServer struct {
+	check    func(username, password string) error
+	username string
+	step     int
+}
+
+func (a *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch a.step {
+	case 0:
+		if response == nil {
+			a.step = 1
+			return []byte("Username:"), false, nil
+		}
+		a.username, a.step = string(response), 2
+		return []byte("Password:"), false, nil
+	case 1:
+		a.username, a.step = string(response), 2
+		return []byte("Password:"), false, nil
+	case 2:
+		a.step = 3
+		return nil, true, a.check(a.username, string(response))
+	}
+	return nil, false, sasl.ErrUnexpectedClientResponse
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/dnsutil"
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+// startSubmissionServer serves the submission listener on a loopback port
+// with a self-signed certificate and one user, ci@test.com
+func startSubmissionServer(t *testing.T) (string, *memoryStore) {
+	t.Helper()
+	hash, err := storage.HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memoryStore{}
+	cfg := Config{
+		RecipientDomains: []string{"test.com"},
+		TLSSelfSigned:    true,
+		Users:            storage.MemoryUsers{"ci@test.com": hash},
+	}
+	tlsConfig, err := buildTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := NewBackend(cfg, store)
+	be.Resolver = &dnsutil.StaticResolver{}
+	be.submission = true
+
+	s := newSMTPServer(be, "127.0.0.1:0", tlsConfig)
+	ln, err := listen(s, be, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String(), store
+}
+
+func TestSubmission_RequiresTLSAndAuth(t *testing.T) {
+	addr, store := startSubmissionServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := smtp.NewClient(conn)
+	if err := c.Hello("ci.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Error("AUTH should not be offered before STARTTLS")
+	}
+	if err := c.Mail("ci@test.com", nil); smtpCode(err) != 530 {
+		t.Fatalf("MAIL before STARTTLS: expected 530, got %v", err)
+	}
+	c.Close()
+
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = smtp.NewClientStartTLS(conn, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.SupportsAuth(sasl.Plain) || !c.SupportsAuth(sasl.Login) {
+		t.Error("PLAIN and LOGIN should be offered after STARTTLS")
+	}
+	if err := c.Mail("ci@test.com", nil); smtpCode(err) != 530 {
+		t.Fatalf("MAIL before AUTH: expected 530, got %v", err)
+	}
+	if err := c.Auth(sasl.NewPlainClient("", "ci@test.com", "wrong")); smtpCode(err) != 535 {
+		t.Fatalf("Wrong password: expected 535, got %v", err)
+	}
+	if err := c.Auth(sasl.NewPlainClient("", "nobody@test.com", "s3cret")); smtpCode(err) != 535 {
+		t.Fatalf("Unknown user: expected 535, got %v", err)
+	}
+	if err := c.Auth(sasl.NewLoginClient("CI@test.com", "s3cret")); err != nil {
+		t.Fatalf("LOGIN failed: %v", err)
+	}
+
+	if err := c.SendMail("ci@test.com", []string{"bob@test.com"}, strings.NewReader("Subject: fixture\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	saved := store.saved[0]
+	if saved.Connection.AuthUser != "ci@test.com" {
+		t.Errorf("Auth user %q, want ci@test.com", saved.Connection.AuthUser)
+	}
+	if !strings.Contains(saved.Raw, "with ESMTPSA (TLS") {
+		t.Errorf("Received header should mark an authenticated TLS session:\n%s", saved.Raw)
+	}
+	if saved.SPF != nil {
+		t.Errorf("SPF should not be checked on submission, got %+v", saved.SPF)
+	}
+}
+
+func TestSession_NoAuthWithoutUsers(t *testing.T) {
+	s := &Session{}
+	if mechs := s.AuthMechanisms(); mechs != nil {
+		t.Errorf("Expected no mechanisms, got %v", mechs)
+	}
+	if _, err := s.Auth(sasl.Plain); err != smtp.ErrAuthUnsupported {
+		t.Errorf("Expected ErrAuthUnsupported, got %v", err)
+	}
+}
+
+func TestLoginServer(t *testing.T) {
+	var gotUser, gotPass string
+	check := func(username, password string) error {
+		gotUser, gotPass = username, password
+		return nil
+	}
+
+	// Without an initial response both prompts are sent
+	a := &loginServer{check: check}
+	if challenge, done, _ := a.Next(nil); done || string(challenge) != "Username:" {
+		t.Fatalf("Expected the username prompt, got %q", challenge)
+	}
+	if challenge, done, _ := a.Next([]byte("alice")); done || string(challenge) != "Password:" {
+		t.Fatalf("Expected the password prompt, got %q", challenge)
+	}
+	if _, done, err := a.Next([]byte("pw")); !done || err != nil || gotUser != "alice" || gotPass != "pw" {
+		t.Errorf("Got done=%v err=%v user=%q pass=%q", done, err, gotUser, gotPass)
+	}
+	if _, _, err := a.Next([]byte("extra")); err == nil {
+		t.Error("Expected an error for a response after completion")
+	}
+
+	// An initial response is the username
+	a = &loginServer{check: check}
+	if challenge, _, _ := a.Next([]byte("bob")); string(challenge) != "Password:" {
+		t.Fatalf("Expected the password prompt, got %q", challenge)
+	}
+	if a.Next([]byte("pw2")); gotUser != "bob" || gotPass != "pw2" {
+		t.Errorf("Got user=%q pass=%q", gotUser, gotPass)
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/habibiefaried/email-server/internal/dnsutil"
+)
+
+// errFromHeader is reported when DMARC has no single RFC5322.From domain
+var errFromHeader = errors.New("message must have exactly one From address")
+
+// headerFromDomain returns the domain of the RFC5322.From address of a
+// message, which is the identity DMARC aligns against
+func headerFromDomain(r io.Reader) (string, error) {
+	header, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return "", err
+	}
+	values := header.Values("From")
+	if len(values) != 1 {
+		return "", errFromHeader
+	}
+	addrs, err := mail.ParseAddressList(values[0])
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) != 1 {
+		return "", errFromHeader
+	}
+	at := strings.LastIndex(addrs[0].Address, "@")
+	if at < 0 || at == len(addrs[0].Address)-1 {
+		return "", errFromHeader
+	}
+	return strings.ToLower(addrs[0].Address[at+1:]), nil
+}
+
+// authenticationResults formats an Authentication-Results header (RFC 8601)
+// for the checks that ran on a message
+func authenticationResults(serverName, mailFrom, helo string, spf *dnsutil.SPFCheck, dkims []dnsutil.DKIMCheck, dmarc *dnsutil.DMARCCheck) string {
+	var results []authres.Result
+	if spf != nil {
+		result := &authres.SPFResult{Value: authres.ResultValue(spf.Result)}
+		if mailFrom != "" {
+			result.From = mailFrom
+		} else {
+			result.Helo = helo
+		}
+		results = append(results, result)
+	}
+	if len(dkims) == 0 && dmarc != nil {
+		results = append(results, &authres.DKIMResult{Value: authres.ResultNone})
+	}
+	for _, d := range dkims {
+		results = append(results, &authres.DKIMResult{
+			Value:      authres.ResultValue(d.Result),
+			Reason:     d.Reason,
+			Domain:     d.Domain,
+			Identifier: d.Identifier,
+		})
+	}
+	if dmarc != nil {
+		results = append(results, &authres.DMARCResult{
+			Value:  authres.ResultValue(dmarc.Result),
+			Reason: dmarc.Reason,
+			From:   dmarc.Domain,
+		})
+	}
+	return "Authentication-Results: " + headerSafe.Replace(authres.Format(serverName, results)) + "\r\n"
+}
+
+// stripAuthResults removes the Authentication-Results headers carrying
+// authservID from the header of a spooled message, so a sender cannot
+// forge results that look like ours (RFC 8601 section 5). The spool is
+// only copied when it has such a header; the file returned is rewound and
+// replaces spool, which is removed.
+func stripAuthResults(spool *os.File, authservID string) (*os.File, error) {
+	br := bufio.NewReader(spool)
+	var fields []string // Header fields with their folded lines, CRLFs kept
+	stripped := false
+	keep := func() {
+		if n := len(fields); n > 0 {
+			name, value, _ := strings.Cut(fields[n-1], ":")
+			if strings.EqualFold(strings.TrimSpace(name), "Authentication-Results") && strings.EqualFold(authResultsID(value), authservID) {
+				fields = fields[:n-1]
+				stripped = true
+			}
+		}
+	}
+	var end string // The empty line ending the header, if any
+	for {
+		line, err := br.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == "" && line != "" {
+			end = line
+			break
+		}
+		if line != "" {
+			if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+				fields[len(fields)-1] += line
+			} else {
+				keep()
+				fields = append(fields, line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return spool, err
+		}
+	}
+	keep()
+	if !stripped {
+		_, err := spool.Seek(0, io.SeekStart)
+		return spool, err
+	}
+
+	f, err := os.CreateTemp("", ".smtp-data-*")
+	if err != nil {
+		return spool, err
+	}
+	w := bufio.NewWriter(f)
+	for _, field := range fields {
+		w.WriteString(field)
+	}
+	w.WriteString(end)
+	_, err = io.Copy(w, br)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeSpool(f)
+		return spool, err
+	}
+	removeSpool(spool)
+	return f, nil
+}
+
+// authResultsID returns the authserv-id of an Authentication-Results
+// value, the first word before the ";" with comments removed
+func authResultsID(value string) string {
+	id, _, _ := strings.Cut(value, ";")
+	var b strings.Builder
+	depth := 0
+	for _, c := range id {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(c)
+		}
+	}
+	words := strings.Fields(b.String())
+	if len(words) == 0 {
+		return ""
+	}
+	return words[0]
+}
@@ -1,14 +1,90 @@
 package server
 
 import (
+	"crypto/tls"
+	"net"
+
 	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/dnsutil"
 	"github.com/habibiefaried/email-server/internal/storage"
 )
 
 type Backend struct {
-	Store storage.Storage
+	Store  storage.Storage
+	Config Config
+	// Resolver answers the DNS queries of SPF, DKIM, DMARC and DNSBL checks
+	Resolver dnsutil.Resolver
+
+	domains *DomainPolicy
+	// submission marks the backend of the submission listener
+	submission bool
+}
+
+func NewBackend(cfg Config, store storage.Storage) *Backend {
+	return &Backend{
+		Store:    store,
+		Config:   cfg,
+		Resolver: net.DefaultResolver,
+		domains:  NewDomainPolicy(cfg.RecipientDomains, cfg.CatchAll),
+	}
 }
 
 func (bkd *Backend) NewSession(conn *smtp.Conn) (smtp.Session, error) {
-	return &Session{Store: bkd.Store}, nil
+	ip := remoteIP(conn.Conn().RemoteAddr())
+
+	var tlsState *tls.ConnectionState
+	if state, ok := conn.TLSConnectionState(); ok {
+		tlsState = &state
+	}
+	session := &Session{
+		Store:          bkd.Store,
+		OversizePolicy: bkd.Config.OversizePolicy,
+		Domains:        bkd.domains,
+		SPFPolicy:      bkd.Config.SPFPolicy,
+		Resolver:       bkd.Resolver,
+		RemoteIP:       ip,
+		Helo:           conn.Hostname(),
+		ServerName:     bkd.Config.FQDN,
+		TLS:            tlsState,
+		Forwarder:      bkd.Config.Forwarder,
+	}
+
+	if bkd.Config.Mode == ModeLMTP {
+		// The upstream MTA already applied its policy to the real client
+		session.SPFPolicy = SPFOff
+		session.LMTP = true
+		return session, nil
+	}
+
+	// The session caps and DNSBL lookups ran when the connection was
+	// admitted, once for all its sessions
+
+	if bkd.submission {
+		// Clients are authenticated users, not MTAs relaying for a domain
+		session.SPFPolicy = SPFOff
+		session.Users = bkd.Config.Users
+		return session, nil
+	}
+
+	session.Limiter = bkd.Config.Limiter
+	session.Greylist = bkd.Config.Greylist
+	if admitted := admittedConnOf(conn.Conn()); admitted != nil {
+		session.dnsbl = admitted.dnsbl
+	}
+	return session, nil
+}
+
+// remoteIP extracts the client IP from a connection address
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
 }
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+// OversizePolicy decides what happens to a message that crosses the size
+// limit while its DATA is being received.
+type OversizePolicy string
+
+const (
+	// OversizeReject aborts DATA with a 552 reply
+	OversizeReject OversizePolicy = "reject"
+	// OversizeTruncate accepts the message but stores only a stub
+	// (headers plus a notice) in place of the full content
+	OversizeTruncate OversizePolicy = "truncate"
+)
+
+// ParseOversizePolicy parses an EMAIL_SIZE_POLICY value; empty means reject
+func ParseOversizePolicy(value string) (OversizePolicy, error) {
+	switch OversizePolicy(value) {
+	case "", OversizeReject:
+		return OversizeReject, nil
+	case OversizeTruncate:
+		return OversizeTruncate, nil
+	}
+	return "", fmt.Errorf("invalid size policy %q (want %q or %q)", value, OversizeReject, OversizeTruncate)
+}
+
+// SPFPolicy decides how the SPF result of the envelope sender is used.
+type SPFPolicy string
+
+const (
+	// SPFOff skips SPF checks entirely
+	SPFOff SPFPolicy = "off"
+	// SPFRecord checks SPF and stores the result with the message
+	SPFRecord SPFPolicy = "record"
+	// SPFReject also rejects MAIL FROM when the result is a hard fail
+	SPFReject SPFPolicy = "reject"
+)
+
+// ParseSPFPolicy parses an SPF_MODE value; empty means record
+func ParseSPFPolicy(value string) (SPFPolicy, error) {
+	switch SPFPolicy(value) {
+	case "", SPFRecord:
+		return SPFRecord, nil
+	case SPFOff:
+		return SPFOff, nil
+	case SPFReject:
+		return SPFReject, nil
+	}
+	return "", fmt.Errorf("invalid SPF mode %q (want %q, %q or %q)", value, SPFOff, SPFRecord, SPFReject)
+}
+
+// ServerMode selects the protocol spoken by the listener
+type ServerMode string
+
+const (
+	// ModeSMTP receives mail from the internet (default)
+	ModeSMTP ServerMode = "smtp"
+	// ModeLMTP receives mail handed over by an upstream MTA (RFC 2033)
+	ModeLMTP ServerMode = "lmtp"
+)
+
+// ParseServerMode parses an SMTP_MODE value; empty means smtp
+func ParseServerMode(value string) (ServerMode, error) {
+	switch ServerMode(value) {
+	case "", ModeSMTP:
+		return ModeSMTP, nil
+	case ModeLMTP:
+		return ModeLMTP, nil
+	}
+	return "", fmt.Errorf("invalid server mode %q (want %q or %q)", value, ModeSMTP, ModeLMTP)
+}
+
+// DNSBLAction decides what a listing in a DNS blocklist zone does
+type DNSBLAction string
+
+const (
+	// DNSBLRejectConnect refuses the session of a listed client
+	DNSBLRejectConnect DNSBLAction = "connect"
+	// DNSBLRejectRcpt refuses every recipient of a listed client
+	DNSBLRejectRcpt DNSBLAction = "rcpt"
+	// DNSBLTag accepts the message and records the listing with it
+	DNSBLTag DNSBLAction = "tag"
+)
+
+// DNSBLZone is a DNS blocklist queried for every client
+type DNSBLZone struct {
+	Zone   string
+	Action DNSBLAction
+}
+
+// ParseDNSBLZones parses a DNSBL_ZONES value: comma-separated zones, each
+// optionally followed by ":connect", ":rcpt" or ":tag" (the default)
+func ParseDNSBLZones(value string) ([]DNSBLZone, error) {
+	var zones []DNSBLZone
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		zone, action, _ := strings.Cut(entry, ":")
+		z := DNSBLZone{Zone: strings.ToLower(strings.TrimSpace(zone)), Action: DNSBLAction(strings.TrimSpace(action))}
+		switch z.Action {
+		case "":
+			z.Action = DNSBLTag
+		case DNSBLRejectConnect, DNSBLRejectRcpt, DNSBLTag:
+		default:
+			return nil, fmt.Errorf("invalid DNSBL action %q for %s (want %q, %q or %q)", z.Action, z.Zone, DNSBLRejectConnect, DNSBLRejectRcpt, DNSBLTag)
+		}
+		if z.Zone == "" {
+			return nil, fmt.Errorf("empty DNSBL zone in %q", entry)
+		}
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+// ParseCIDRs parses a comma-separated list of networks. A bare address is
+// taken as a single-host network.
+func ParseCIDRs(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Config holds the SMTP listener settings
+type Config struct {
+	FQDN string
+	Port string
+	// Mode selects SMTP or LMTP; empty means SMTP. In LMTP mode the client
+	// is a trusted MTA, so SPF, DNSBL, greylisting and rate limits are
+	// skipped, and the listener may be a unix socket.
+	Mode ServerMode
+	// LMTPSocket is the path of the unix socket listened on in LMTP mode
+	// instead of Port
+	LMTPSocket string
+
+	// RecipientDomains lists the domains RCPT TO may address: the
+	// MAIL_SERVERS FQDNs plus any extra domains. "*.example.com" matches
+	// subdomains. Other recipients get 550 5.1.1 unless CatchAll is set.
+	RecipientDomains []string
+	CatchAll         bool
+
+	// MaxMessageBytes is advertised through the SIZE extension, checked
+	// against MAIL FROM SIZE= and enforced while reading DATA. 0 disables it.
+	MaxMessageBytes int64
+	// OversizePolicy applies when DATA crosses MaxMessageBytes. A SIZE=
+	// declared above the limit is always rejected up front.
+	OversizePolicy OversizePolicy
+
+	// TLSCertFile and TLSKeyFile enable STARTTLS with a certificate that is
+	// reloaded from disk whenever the files change.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSSelfSigned enables STARTTLS with a generated self-signed
+	// certificate when no certificate files are given (development only).
+	TLSSelfSigned bool
+	// ImplicitTLSPort starts a second listener that speaks TLS from the
+	// first byte (SMTPS, usually 465). Requires a TLS certificate.
+	ImplicitTLSPort string
+	// SubmissionPort starts a submission listener (usually 587) where
+	// clients must STARTTLS and authenticate against Users before MAIL
+	// FROM. Requires a TLS certificate and Users.
+	SubmissionPort string
+	// Users holds the accounts of the submission listener
+	Users storage.UserStore
+	// ProxyTrusted enables the PROXY protocol (v1 and v2) on every listener
+	// for connections from these networks, so sessions see the client
+	// behind a load balancer. Headers from other peers are refused. Empty
+	// disables the PROXY protocol.
+	ProxyTrusted []*net.IPNet
+
+	// SPFPolicy controls SPF verification of the envelope sender
+	SPFPolicy SPFPolicy
+	// DNSBLZones are queried for the client address of every session
+	DNSBLZones []DNSBLZone
+
+	// MaxRecipients caps RCPT TO per message; 0 means unlimited
+	MaxRecipients int
+	// Timeout bounds each read and write on a connection; 0 means none
+	Timeout time.Duration
+	// Limiter throttles sessions and recipients per client; nil disables
+	// rate limiting. See NewLimiter for the default implementation.
+	Limiter RateLimiter
+	// Greylist defers first attempts from unknown senders; nil disables it
+	Greylist *Greylister
+	// Forwarder queues copies of stored messages for forwarding rules;
+	// nil disables forwarding
+	Forwarder Forwarder
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/dnsutil"
+)
+
+// dnsblTimeout bounds the lookups of all zones for one connection
+const dnsblTimeout = 5 * time.Second
+
+// ErrDNSBLListed is returned from RCPT TO when the client is listed in a
+// zone with the DNSBLRejectRcpt action
+var ErrDNSBLListed = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Client host is listed in a DNS blocklist",
+}
+
+// dnsblHit is a listing together with the action of its zone
+type dnsblHit struct {
+	dnsutil.DNSBLHit
+	Action DNSBLAction
+}
+
+// lookupDNSBLs queries every zone for ip concurrently and returns the hits
+// in zone order. Failed lookups are logged and treated as not listed.
+// Loopback and private clients are never looked up.
+func lookupDNSBLs(r dnsutil.Resolver, ip net.IP, zones []DNSBLZone) []dnsblHit {
+	if len(zones) == 0 || r == nil || ip == nil ||
+		ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsblTimeout)
+	defer cancel()
+
+	results := make([]*dnsutil.DNSBLHit, len(zones))
+	var wg sync.WaitGroup
+	for i, zone := range zones {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hit, err := dnsutil.LookupDNSBL(ctx, r, ip, zone.Zone)
+			if err != nil {
+				log.Printf("client %s: DNSBL lookup in %s failed: %v", ip, zone.Zone, err)
+				return
+			}
+			results[i] = hit
+		}()
+	}
+	wg.Wait()
+
+	var hits []dnsblHit
+	for i, hit := range results {
+		if hit != nil {
+			hits = append(hits, dnsblHit{DNSBLHit: *hit, Action: zones[i].Action})
+		}
+	}
+	return hits
+}
+
+// checkDNSBL looks up the client in the configured zones. A listing in a
+// DNSBLRejectConnect zone refuses the connection with a 554 reply.
+func (bkd *Backend) checkDNSBL(ip net.IP) ([]dnsblHit, error) {
+	hits := lookupDNSBLs(bkd.Resolver, ip, bkd.Config.DNSBLZones)
+	for _, hit := range hits {
+		log.Printf("client %s: listed in %s (%s), action %s", ip, hit.Zone, strings.Join(hit.Codes, ", "), hit.Action)
+		if hit.Action == DNSBLRejectConnect {
+			return nil, &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      fmt.Sprintf("Client host [%s] blocked using %s", ip, hit.Zone),
+			}
+		}
+	}
+	return hits, nil
+}
+
+// dnsblHeader formats the X-DNSBL header tagging a message with a listing
+func dnsblHeader(ip net.IP, hit dnsblHit) string {
+	header := fmt.Sprintf("X-DNSBL: %s listed in %s (%s)", ip, hit.Zone, strings.Join(hit.Codes, ", "))
+	if hit.Reason != "" {
+		header += " " + hit.Reason
+	}
+	return headerSafe.Replace(header) + "\r\n"
+}
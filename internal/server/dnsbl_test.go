@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/dnsutil"
+	"github.com/pires/go-proxyproto"
+)
+
+// dnsblResolver lists 192.0.2.10 in spam.test and policy.test and fails
+// every lookup in broken.test
+func dnsblResolver() *dnsutil.StaticResolver {
+	return &dnsutil.StaticResolver{
+		IP: map[string][]net.IP{
+			"10.2.0.192.spam.test":   {net.ParseIP("127.0.0.2")},
+			"10.2.0.192.policy.test": {net.ParseIP("127.0.0.10")},
+		},
+		TXT: map[string][]string{
+			"10.2.0.192.spam.test": {"Listed for spam"},
+		},
+		Fail: map[string]bool{"10.2.0.192.broken.test": true},
+	}
+}
+
+func TestParseDNSBLZones(t *testing.T) {
+	zones, err := ParseDNSBLZones(" Spam.Test:connect, policy.test:rcpt ,tagged.test,, other.test:tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DNSBLZone{
+		{"spam.test", DNSBLRejectConnect},
+		{"policy.test", DNSBLRejectRcpt},
+		{"tagged.test", DNSBLTag},
+		{"other.test", DNSBLTag},
+	}
+	if len(zones) != len(want) {
+		t.Fatalf("Got %v, want %v", zones, want)
+	}
+	for i := range want {
+		if zones[i] != want[i] {
+			t.Errorf("Zone %d: got %v, want %v", i, zones[i], want[i])
+		}
+	}
+
+	if zones, err := ParseDNSBLZones(""); err != nil || zones != nil {
+		t.Errorf("Empty value: got %v, %v", zones, err)
+	}
+	for _, value := range []string{"spam.test:drop", ":rcpt"} {
+		if _, err := ParseDNSBLZones(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestLookupDNSBLs(t *testing.T) {
+	zones := []DNSBLZone{
+		{"broken.test", DNSBLRejectConnect},
+		{"policy.test", DNSBLRejectRcpt},
+		{"clean.test", DNSBLRejectConnect},
+		{"spam.test", DNSBLTag},
+	}
+	hits := lookupDNSBLs(dnsblResolver(), net.ParseIP("192.0.2.10"), zones)
+	if len(hits) != 2 || hits[0].Zone != "policy.test" || hits[1].Zone != "spam.test" {
+		t.Fatalf("Expected hits in zone order, got %+v", hits)
+	}
+	if hits[0].Action != DNSBLRejectRcpt || hits[1].Reason != "Listed for spam" {
+		t.Errorf("Unexpected hits: %+v", hits)
+	}
+
+	for _, ip := range []string{"127.0.0.1", "10.0.0.5", "::1"} {
+		if hits := lookupDNSBLs(dnsblResolver(), net.ParseIP(ip), zones); hits != nil {
+			t.Errorf("%s should not be looked up, got %+v", ip, hits)
+		}
+	}
+}
+
+func TestBackend_DNSBLRejectsAtConnect(t *testing.T) {
+	bkd := NewBackend(Config{DNSBLZones: []DNSBLZone{{"spam.test", DNSBLRejectConnect}}}, &memoryStore{})
+	bkd.Resolver = dnsblResolver()
+
+	_, err := bkd.checkDNSBL(net.ParseIP("192.0.2.10"))
+	if smtpCode(err) != 554 || !strings.Contains(err.Error(), "spam.test") {
+		t.Errorf("Expected 554 naming the zone, got %v", err)
+	}
+	if hits, err := bkd.checkDNSBL(net.ParseIP("192.0.2.11")); hits != nil || err != nil {
+		t.Errorf("Unlisted client: got %+v, %v", hits, err)
+	}
+}
+
+func TestSession_DNSBLRejectsRecipients(t *testing.T) {
+	bkd := NewBackend(Config{DNSBLZones: []DNSBLZone{{"policy.test", DNSBLRejectRcpt}}}, &memoryStore{})
+	bkd.Resolver = dnsblResolver()
+	hits, err := bkd.checkDNSBL(net.ParseIP("192.0.2.10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Session{Store: &memoryStore{}, RemoteIP: net.ParseIP("192.0.2.10"), dnsbl: hits}
+	s.Mail("alice@example.com", nil)
+	if err := s.Rcpt("bob@test.com", nil); err != ErrDNSBLListed {
+		t.Errorf("Expected ErrDNSBLListed, got %v", err)
+	}
+	if len(s.To) != 0 {
+		t.Errorf("Listed client's recipient was accepted: %v", s.To)
+	}
+}
+
+func TestSession_DNSBLTagsMessage(t *testing.T) {
+	store := &memoryStore{}
+	bkd := NewBackend(Config{DNSBLZones: []DNSBLZone{{"spam.test", DNSBLTag}}}, store)
+	bkd.Resolver = dnsblResolver()
+	hits, err := bkd.checkDNSBL(net.ParseIP("192.0.2.10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Session{Store: store, RemoteIP: net.ParseIP("192.0.2.10"), dnsbl: hits}
+	s.Mail("alice@example.com", nil)
+	if err := s.Rcpt("bob@test.com", nil); err != nil {
+		t.Fatalf("Tagged client should be accepted: %v", err)
+	}
+	if err := s.Data(strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := store.saved[0]
+	if len(saved.DNSBL) != 1 {
+		t.Fatalf("Expected one DNSBL result, got %+v", saved.DNSBL)
+	}
+	got := saved.DNSBL[0]
+	if got.Zone != "spam.test" || got.Action != "tag" || len(got.Codes) != 1 || got.Codes[0] != "127.0.0.2" || got.Reason != "Listed for spam" {
+		t.Errorf("Unexpected DNSBL result: %+v", got)
+	}
+	if !strings.Contains(saved.Raw, "X-DNSBL: 192.0.2.10 listed in spam.test (127.0.0.2) Listed for spam\r\n") {
+		t.Errorf("Missing X-DNSBL header:\n%s", saved.Raw)
+	}
+}
+
+// countingResolver counts the DNSBL queries answered by dnsblResolver
+type countingResolver struct {
+	*dnsutil.StaticResolver
+	mu      sync.Mutex
+	queries int
+}
+
+func (r *countingResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	r.queries++
+	r.mu.Unlock()
+	return r.StaticResolver.LookupIP(ctx, network, host)
+}
+
+// startDNSBLServer serves SMTP on a loopback port trusting PROXY headers
+// from loopback, so tests can connect as a listed client
+func startDNSBLServer(t *testing.T, zones []DNSBLZone) (string, *countingResolver, *memoryStore) {
+	t.Helper()
+	loopback, _ := ParseCIDRs("127.0.0.0/8")
+	cfg := Config{CatchAll: true, ProxyTrusted: loopback, DNSBLZones: zones, TLSSelfSigned: true}
+	tlsConfig, err := buildTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memoryStore{}
+	resolver := &countingResolver{StaticResolver: dnsblResolver()}
+	be := NewBackend(cfg, store)
+	be.Resolver = resolver
+
+	s := newSMTPServer(be, "127.0.0.1:0", tlsConfig)
+	ln, err := listen(s, be, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String(), resolver, store
+}
+
+// dialAs connects to addr with a PROXY header claiming client as the source
+func dialAs(t *testing.T, addr, client string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	src := &net.TCPAddr{IP: net.ParseIP(client), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	if _, err := proxyproto.HeaderProxyFromAddrs(2, src, dst).WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestAdmitListener_DNSBLRejectsBeforeGreeting(t *testing.T) {
+	addr, _, _ := startDNSBLServer(t, []DNSBLZone{{"spam.test", DNSBLRejectConnect}})
+
+	conn := dialAs(t, addr, "192.0.2.10")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "554 5.7.1 ") || !strings.Contains(line, "spam.test") {
+		t.Fatalf("Listed client got %q, %v; want 554 naming the zone", line, err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("Refused connection left open: %v", err)
+	}
+
+	conn = dialAs(t, addr, "192.0.2.11")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); !strings.HasPrefix(line, "220 ") {
+		t.Errorf("Unlisted client got %q, %v", line, err)
+	}
+}
+
+func TestAdmitListener_DNSBLLookupOncePerConnection(t *testing.T) {
+	addr, resolver, store := startDNSBLServer(t, []DNSBLZone{{"spam.test", DNSBLTag}})
+
+	c, err := smtp.NewClientStartTLS(dialAs(t, addr, "192.0.2.10"), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("STARTTLS failed: %v", err)
+	}
+	defer c.Close()
+	if err := c.SendMail("alice@example.com", []string{"bob@test.com"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	if len(store.saved) != 1 || !strings.Contains(store.saved[0].Raw, "X-DNSBL: 192.0.2.10 listed in spam.test") {
+		t.Errorf("Session after STARTTLS lost the listing: %+v", store.saved)
+	}
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	if resolver.queries != 1 {
+		t.Errorf("DNSBL queried %d times, want once per connection", resolver.queries)
+	}
+}
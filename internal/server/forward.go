@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// forwardTimeout bounds queueing the forwarded copies of one message
+const forwardTimeout = 30 * time.Second
+
+// Forwarder queues copies of stored messages for external addresses.
+// forward.Forwarder is the default implementation.
+type Forwarder interface {
+	// Forward queues copies of a message and returns how many were queued
+	Forward(ctx context.Context, from string, to []string, content io.Reader) (int, error)
+}
+
+// forward hands the stored message to the Forwarder. The message is
+// already accepted, so failures are logged rather than returned.
+func (s *Session) forward(spool *os.File, headers string, to []string) {
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		log.Printf("from: %s, to: %s, forwarding failed: %v", s.From, strings.Join(to, ", "), err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+
+	n, err := s.Forwarder.Forward(ctx, s.From, to, io.MultiReader(strings.NewReader(headers), spool))
+	if err != nil {
+		log.Printf("from: %s, to: %s, forwarding failed: %v", s.From, strings.Join(to, ", "), err)
+		return
+	}
+	if n > 0 {
+		log.Printf("from: %s, to: %s, queued %d forwarded copies", s.From, strings.Join(to, ", "), n)
+	}
+}
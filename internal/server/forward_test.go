@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/habibiefaried/email-server/internal/forward"
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+func newForwardingSession(t *testing.T, queue storage.OutboundQueue) (*Session, *memoryStore) {
+	t.Helper()
+	rules, err := forward.ParseRules([]byte(`[{"recipient": "ops@test\\.com", "forward_to": ["oncall@external.net"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memoryStore{}
+	f := forward.New(queue, forward.Config{Rules: rules, SRS: forward.NewSRS("secret", "mx.test.com")})
+	return &Session{Store: store, ServerName: "mx.test.com", Forwarder: f}, store
+}
+
+func TestSession_QueuesForwardedCopy(t *testing.T) {
+	queue := storage.NewMemoryOutbound()
+	s, store := newForwardingSession(t, queue)
+	s.Mail("alice@example.com", nil)
+	s.Rcpt("ops@test.com", nil)
+	if err := s.Data(strings.NewReader("Subject: disk full\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, _ := queue.Claim(context.Background(), time.Now(), 10, time.Minute)
+	if len(store.saved) != 1 || len(msgs) != 1 {
+		t.Fatalf("Expected one stored and one queued copy, got %d and %d", len(store.saved), len(msgs))
+	}
+	msg := msgs[0]
+	if msg.RcptTo != "oncall@external.net" || !strings.HasSuffix(msg.MailFrom, "=example.com=alice@mx.test.com") {
+		t.Errorf("Queued %s -> %s", msg.MailFrom, msg.RcptTo)
+	}
+	// The forwarded copy carries the same trace headers as the stored one
+	r, err := queue.Open(context.Background(), msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if content, _ := io.ReadAll(r); string(content) != store.saved[0].Raw {
+		t.Errorf("Forwarded content differs from the stored message:\n%s", content)
+	}
+}
+
+func TestSession_DoesNotForwardTruncatedMessages(t *testing.T) {
+	queue := storage.NewMemoryOutbound()
+	s, store := newForwardingSession(t, queue)
+	s.OversizePolicy = OversizeTruncate
+	s.Mail("alice@example.com", nil)
+	s.Rcpt("ops@test.com", nil)
+	if err := s.Data(oversizeReader("Subject: big\r\n\r\nAAAA")); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.saved) != 1 || queue.Len() != 0 {
+		t.Errorf("Expected the truncated message stored but not queued, got %d and %d", len(store.saved), queue.Len())
+	}
+}
+
+// failingForwarder cannot queue anything
+type failingForwarder struct{}
+
+func (failingForwarder) Forward(context.Context, string, []string, io.Reader) (int, error) {
+	return 0, errors.New("queue unavailable")
+}
+
+func TestSession_ForwardFailureDoesNotRejectMessage(t *testing.T) {
+	store := &memoryStore{}
+	s := &Session{Store: store, Forwarder: failingForwarder{}}
+	s.Mail("alice@example.com", nil)
+	s.Rcpt("ops@test.com", nil)
+	if err := s.Data(strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		t.Errorf("Forwarding failure rejected the message: %v", err)
+	}
+	if len(store.saved) != 1 {
+		t.Errorf("Expected the message stored, got %d", len(store.saved))
+	}
+}
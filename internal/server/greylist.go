@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+// ErrGreylisted defers a delivery attempt from an unknown triplet
+var ErrGreylisted = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Greylisted, please try again later",
+}
+
+// GreylistConfig configures a Greylister. Zero durations use the defaults.
+type GreylistConfig struct {
+	// Delay is how long a new triplet is deferred (default 5 minutes)
+	Delay time.Duration
+	// RetryWindow is how long a deferred triplet waits for its retry
+	// before it must start over (default 24 hours)
+	RetryWindow time.Duration
+	// PassTTL is how long a triplet stays whitelisted after a successful
+	// retry, counted from its latest delivery (default 36 days)
+	PassTTL time.Duration
+}
+
+const (
+	defaultGreylistDelay       = 5 * time.Minute
+	defaultGreylistRetryWindow = 24 * time.Hour
+	defaultGreylistPassTTL     = 36 * 24 * time.Hour
+
+	greylistTimeout       = 5 * time.Second
+	greylistPruneInterval = time.Hour
+)
+
+// Greylister defers the first delivery attempt of every unknown (client
+// /24, MAIL FROM, RCPT TO) triplet. Legitimate MTAs retry and are accepted
+// once Delay has passed; most bulk senders never come back. A triplet is
+// only whitelisted by Pass, once a message for it has been stored.
+type Greylister struct {
+	store storage.GreylistStore
+	cfg   GreylistConfig
+	now   func() time.Time
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+// NewGreylister creates a Greylister keeping its state in store
+func NewGreylister(store storage.GreylistStore, cfg GreylistConfig) *Greylister {
+	if cfg.Delay <= 0 {
+		cfg.Delay = defaultGreylistDelay
+	}
+	if cfg.RetryWindow <= 0 {
+		cfg.RetryWindow = defaultGreylistRetryWindow
+	}
+	if cfg.PassTTL <= 0 {
+		cfg.PassTTL = defaultGreylistPassTTL
+	}
+	return &Greylister{store: store, cfg: cfg, now: time.Now}
+}
+
+// Check returns ErrGreylisted unless the triplet has waited long enough or
+// already passed. Accepting the recipient does not whitelist the triplet.
+// Store failures let the message through.
+func (g *Greylister) Check(ip net.IP, from, rcpt string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), greylistTimeout)
+	defer cancel()
+
+	now := g.now()
+	g.maybePrune(now)
+
+	key := greylistKey(ip, from, rcpt)
+	entry, err := g.store.Get(ctx, key)
+	if err != nil {
+		log.Printf("Greylist lookup failed, accepting: %v", err)
+		return nil
+	}
+
+	var next storage.GreylistEntry
+	var result error
+	switch {
+	case entry == nil,
+		!entry.Passed && now.Sub(entry.FirstSeen) > g.cfg.RetryWindow,
+		entry.Passed && now.Sub(entry.LastSeen) > g.cfg.PassTTL:
+		// New or expired triplet: start a new cycle
+		next = storage.GreylistEntry{FirstSeen: now, LastSeen: now}
+		result = ErrGreylisted
+	case !entry.Passed && now.Sub(entry.FirstSeen) < g.cfg.Delay:
+		// Retried too early
+		next = storage.GreylistEntry{FirstSeen: entry.FirstSeen, LastSeen: now}
+		result = ErrGreylisted
+	default:
+		return nil
+	}
+
+	if err := g.store.Put(ctx, key, next); err != nil {
+		log.Printf("Greylist update failed, accepting: %v", err)
+		return nil
+	}
+	return result
+}
+
+// Pass whitelists the triplet after a message for it was stored, or keeps
+// it whitelisted for another PassTTL. Store failures are only logged.
+func (g *Greylister) Pass(ip net.IP, from, rcpt string) {
+	ctx, cancel := context.WithTimeout(context.Background(), greylistTimeout)
+	defer cancel()
+
+	now := g.now()
+	key := greylistKey(ip, from, rcpt)
+	entry, err := g.store.Get(ctx, key)
+	if err != nil {
+		log.Printf("Greylist lookup failed, not whitelisting: %v", err)
+		return
+	}
+	next := storage.GreylistEntry{FirstSeen: now, LastSeen: now, Passed: true}
+	if entry != nil {
+		next.FirstSeen = entry.FirstSeen
+	}
+	if err := g.store.Put(ctx, key, next); err != nil {
+		log.Printf("Greylist update failed, not whitelisting: %v", err)
+	}
+}
+
+// maybePrune deletes stale entries at most once per greylistPruneInterval
+func (g *Greylister) maybePrune(now time.Time) {
+	g.mu.Lock()
+	if now.Sub(g.lastPrune) < greylistPruneInterval {
+		g.mu.Unlock()
+		return
+	}
+	g.lastPrune = now
+	g.mu.Unlock()
+
+	// Nothing older than both windows can still be useful
+	keep := g.cfg.PassTTL
+	if g.cfg.RetryWindow > keep {
+		keep = g.cfg.RetryWindow
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		n, err := g.store.Expire(ctx, now.Add(-keep))
+		if err != nil {
+			log.Printf("Greylist cleanup failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Greylist cleanup removed %d stale entries", n)
+		}
+	}()
+}
+
+// greylistKey identifies a triplet. IPv4 clients are grouped by /24 and
+// IPv6 clients by /64, since large senders retry from another address of
+// the same pool.
+func greylistKey(ip net.IP, from, rcpt string) string {
+	network := "unknown"
+	if v4 := ip.To4(); v4 != nil {
+		network = v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	} else if ip != nil {
+		network = ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return network + "|" + strings.ToLower(from) + "|" + strings.ToLower(rcpt)
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+func newTestGreylister(cfg GreylistConfig) (*Greylister, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	g := NewGreylister(storage.NewMemoryGreylist(), cfg)
+	g.now = clock.now
+	return g, clock
+}
+
+func TestGreylister_DefersThenAccepts(t *testing.T) {
+	g, clock := newTestGreylister(GreylistConfig{Delay: 5 * time.Minute})
+	ip := net.ParseIP("192.0.2.10")
+
+	if err := g.Check(ip, "alice@example.com", "bob@test.com"); err != ErrGreylisted {
+		t.Fatalf("First attempt should be greylisted, got %v", err)
+	}
+
+	clock.advance(time.Minute)
+	if err := g.Check(ip, "alice@example.com", "bob@test.com"); err != ErrGreylisted {
+		t.Fatalf("Early retry should be greylisted, got %v", err)
+	}
+
+	clock.advance(5 * time.Minute)
+	if err := g.Check(ip, "alice@example.com", "bob@test.com"); err != nil {
+		t.Fatalf("Retry after the delay should pass, got %v", err)
+	}
+	g.Pass(ip, "alice@example.com", "bob@test.com")
+
+	// Whitelisted: later messages are accepted without delay
+	clock.advance(48 * time.Hour)
+	if err := g.Check(ip, "alice@example.com", "bob@test.com"); err != nil {
+		t.Errorf("Passed triplet should stay whitelisted, got %v", err)
+	}
+}
+
+func TestGreylister_TripletParts(t *testing.T) {
+	g, clock := newTestGreylister(GreylistConfig{})
+	g.Check(net.ParseIP("192.0.2.10"), "alice@example.com", "bob@test.com")
+	clock.advance(10 * time.Minute)
+
+	// Another address of the same /24 retries the same message
+	if err := g.Check(net.ParseIP("192.0.2.99"), "Alice@Example.com", "BOB@test.com"); err != nil {
+		t.Errorf("Retry from the same /24 should pass, got %v", err)
+	}
+	if err := g.Check(net.ParseIP("192.0.3.10"), "alice@example.com", "bob@test.com"); err != ErrGreylisted {
+		t.Errorf("Another network is a new triplet, got %v", err)
+	}
+	if err := g.Check(net.ParseIP("192.0.2.10"), "alice@example.com", "carol@test.com"); err != ErrGreylisted {
+		t.Errorf("Another recipient is a new triplet, got %v", err)
+	}
+}
+
+func TestGreylister_Expiry(t *testing.T) {
+	g, clock := newTestGreylister(GreylistConfig{Delay: time.Minute, RetryWindow: time.Hour, PassTTL: 24 * time.Hour})
+	ip := net.ParseIP("192.0.2.10")
+
+	// A retry after the retry window starts over
+	g.Check(ip, "a@example.com", "b@test.com")
+	clock.advance(2 * time.Hour)
+	if err := g.Check(ip, "a@example.com", "b@test.com"); err != ErrGreylisted {
+		t.Fatalf("Stale triplet should be greylisted again, got %v", err)
+	}
+	clock.advance(2 * time.Minute)
+	if err := g.Check(ip, "a@example.com", "b@test.com"); err != nil {
+		t.Fatalf("Retry should pass, got %v", err)
+	}
+	g.Pass(ip, "a@example.com", "b@test.com")
+
+	// A whitelisted triplet unused for longer than PassTTL is forgotten
+	clock.advance(25 * time.Hour)
+	if err := g.Check(ip, "a@example.com", "b@test.com"); err != ErrGreylisted {
+		t.Errorf("Expired whitelist entry should be greylisted, got %v", err)
+	}
+}
+
+func TestGreylister_WhitelistsOnlyOnPass(t *testing.T) {
+	g, clock := newTestGreylister(GreylistConfig{Delay: time.Minute, RetryWindow: time.Hour})
+	ip := net.ParseIP("192.0.2.10")
+
+	// The retry is accepted at RCPT, but no message follows
+	g.Check(ip, "a@example.com", "b@test.com")
+	clock.advance(2 * time.Minute)
+	if err := g.Check(ip, "a@example.com", "b@test.com"); err != nil {
+		t.Fatalf("Retry should pass, got %v", err)
+	}
+	clock.advance(2 * time.Hour)
+	if err := g.Check(ip, "a@example.com", "b@test.com"); err != ErrGreylisted {
+		t.Errorf("Triplet whitelisted without a delivery, got %v", err)
+	}
+}
+
+type failingGreylist struct{ storage.GreylistStore }
+
+func (failingGreylist) Get(context.Context, string) (*storage.GreylistEntry, error) {
+	return nil, errors.New("database down")
+}
+
+func TestGreylister_FailsOpen(t *testing.T) {
+	g := NewGreylister(failingGreylist{storage.NewMemoryGreylist()}, GreylistConfig{})
+	if err := g.Check(net.ParseIP("192.0.2.10"), "a@example.com", "b@test.com"); err != nil {
+		t.Errorf("Store errors should not defer mail, got %v", err)
+	}
+}
+
+func TestGreylistKey(t *testing.T) {
+	cases := map[string]string{
+		"192.0.2.77":        "192.0.2.0/24|a@x.com|b@y.com",
+		"2001:db8:1:2::1":   "2001:db8:1:2::/64|a@x.com|b@y.com",
+		"::ffff:192.0.2.77": "192.0.2.0/24|a@x.com|b@y.com",
+	}
+	for ip, want := range cases {
+		if got := greylistKey(net.ParseIP(ip), "A@x.com", "b@Y.com"); got != want {
+			t.Errorf("greylistKey(%s) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestSession_Greylisting(t *testing.T) {
+	g, clock := newTestGreylister(GreylistConfig{})
+	s := &Session{Store: &memoryStore{}, Greylist: g, RemoteIP: net.ParseIP("192.0.2.10")}
+
+	s.Mail("alice@example.com", nil)
+	if err := s.Rcpt("bob@test.com", nil); smtpCode(err) != 451 {
+		t.Fatalf("Expected 451, got %v", err)
+	}
+	if len(s.To) != 0 {
+		t.Errorf("Greylisted recipient was accepted: %v", s.To)
+	}
+
+	clock.advance(10 * time.Minute)
+	if err := s.Rcpt("bob@test.com", nil); err != nil {
+		t.Errorf("Retry should be accepted: %v", err)
+	}
+	if err := s.Data(strings.NewReader("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("Data failed: %v", err)
+	}
+
+	// The delivery whitelisted the triplet, long after the retry window
+	clock.advance(48 * time.Hour)
+	s.Reset()
+	s.Mail("alice@example.com", nil)
+	if err := s.Rcpt("bob@test.com", nil); err != nil {
+		t.Errorf("Delivered triplet should be whitelisted: %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+package server
+
+import (
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// RateLimiter decides whether a client may open a session or send to a
+// recipient. Errors should be *smtp.SMTPError with a temporary (4xx) code.
+type RateLimiter interface {
+	// AllowSession is called when a client starts a session. On success
+	// the returned release func must be called when the session ends.
+	AllowSession(ip net.IP) (release func(), err error)
+	// AllowRecipient is called for each RCPT TO
+	AllowRecipient(ip net.IP, rcpt string) error
+}
+
+var (
+	// ErrTooManySessions is returned when a concurrency cap is reached
+	ErrTooManySessions = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many connections, try again later",
+	}
+	// ErrSessionRate is returned when a client opens sessions too quickly
+	ErrSessionRate = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Connection rate limit exceeded, try again later",
+	}
+	// ErrRecipientRate is returned when a mailbox receives mail too quickly
+	ErrRecipientRate = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Recipient rate limit exceeded, try again later",
+	}
+)
+
+// Limiter decisions, as counted in LimiterStats.Decisions
+const (
+	DecisionSessionAllowed      = "session_allowed"
+	DecisionSessionGlobalCap    = "session_rejected_global_cap"
+	DecisionSessionIPCap        = "session_rejected_ip_cap"
+	DecisionSessionIPRate       = "session_rejected_ip_rate"
+	DecisionRecipientAllowed    = "recipient_allowed"
+	DecisionRecipientRate       = "recipient_rejected_rate"
+	DecisionRecipientClientRate = "recipient_rejected_client_rate"
+)
+
+// LimitConfig configures the default Limiter. Zero values disable the
+// corresponding limit; a zero burst allows one minute's worth of tokens.
+type LimitConfig struct {
+	MaxSessions      int // Concurrent sessions across all clients
+	MaxSessionsPerIP int // Concurrent sessions per client
+
+	SessionsPerMinute float64 // New sessions per client
+	SessionBurst      int
+
+	// Messages per recipient mailbox
+	RecipientsPerMinute float64
+	RecipientBurst      int
+
+	// Recipients per client, across all mailboxes
+	ClientRecipientsPerMinute float64
+	ClientRecipientBurst      int
+}
+
+// Enabled reports whether any limit is set
+func (c LimitConfig) Enabled() bool {
+	return c.MaxSessions > 0 || c.MaxSessionsPerIP > 0 || c.SessionsPerMinute > 0 ||
+		c.RecipientsPerMinute > 0 || c.ClientRecipientsPerMinute > 0
+}
+
+const (
+	// pruneInterval is how often idle buckets are dropped
+	pruneInterval = time.Minute
+	// maxThrottledKeys bounds the per-client/per-mailbox throttle counters
+	maxThrottledKeys = 1024
+)
+
+// Limiter is the default RateLimiter: token buckets per client and per
+// recipient mailbox, plus caps on concurrent sessions. Clients are keyed by
+// IPv4 address or IPv6 /64. It is safe for concurrent use.
+type Limiter struct {
+	cfg LimitConfig
+	now func() time.Time
+
+	mu          sync.Mutex
+	active      int
+	activePerIP map[string]int
+	sessions    *bucketSet
+	recipients  *bucketSet
+	clientRcpts *bucketSet
+	decisions   map[string]uint64
+	throttled   map[string]uint64
+}
+
+// NewLimiter creates a Limiter with the given limits
+func NewLimiter(cfg LimitConfig) *Limiter {
+	return &Limiter{
+		cfg:         cfg,
+		now:         time.Now,
+		activePerIP: make(map[string]int),
+		sessions:    newBucketSet(cfg.SessionsPerMinute, cfg.SessionBurst),
+		recipients:  newBucketSet(cfg.RecipientsPerMinute, cfg.RecipientBurst),
+		clientRcpts: newBucketSet(cfg.ClientRecipientsPerMinute, cfg.ClientRecipientBurst),
+		decisions:   make(map[string]uint64),
+		throttled:   make(map[string]uint64),
+	}
+}
+
+func (l *Limiter) AllowSession(ip net.IP) (func(), error) {
+	key := clientKey(ip)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	if l.cfg.MaxSessions > 0 && l.active >= l.cfg.MaxSessions {
+		l.record(DecisionSessionGlobalCap, "")
+		return nil, ErrTooManySessions
+	}
+	if l.cfg.MaxSessionsPerIP > 0 && l.activePerIP[key] >= l.cfg.MaxSessionsPerIP {
+		l.record(DecisionSessionIPCap, "ip:"+key)
+		return nil, ErrTooManySessions
+	}
+	if !l.sessions.take(key, now) {
+		l.record(DecisionSessionIPRate, "ip:"+key)
+		return nil, ErrSessionRate
+	}
+
+	l.active++
+	l.activePerIP[key]++
+	l.record(DecisionSessionAllowed, "")
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.active--
+			if l.activePerIP[key]--; l.activePerIP[key] <= 0 {
+				delete(l.activePerIP, key)
+			}
+		})
+	}, nil
+}
+
+func (l *Limiter) AllowRecipient(ip net.IP, rcpt string) error {
+	key := clientKey(ip)
+	mailbox := strings.ToLower(rcpt)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	// Check both buckets before taking from either, so a recipient refused
+	// for its mailbox does not also use up the client's allowance
+	client := l.clientRcpts.refill(key, now)
+	if !client.allows() {
+		l.record(DecisionRecipientClientRate, "ip:"+key)
+		return ErrRecipientRate
+	}
+	box := l.recipients.refill(mailbox, now)
+	if !box.allows() {
+		l.record(DecisionRecipientRate, "rcpt:"+mailbox)
+		return ErrRecipientRate
+	}
+	client.take()
+	box.take()
+	l.record(DecisionRecipientAllowed, "")
+	return nil
+}
+
+// record counts a decision and, for rejections, the throttled key
+func (l *Limiter) record(decision, throttledKey string) {
+	l.decisions[decision]++
+	if throttledKey == "" {
+		return
+	}
+	if _, ok := l.throttled[throttledKey]; ok || len(l.throttled) < maxThrottledKeys {
+		l.throttled[throttledKey]++
+	}
+}
+
+// LimiterStats is a snapshot of the limiter's counters
+type LimiterStats struct {
+	ActiveSessions int               `json:"active_sessions"`
+	Decisions      map[string]uint64 `json:"decisions"`
+	// Throttled counts rejections per client ("ip:<addr>") and per
+	// mailbox ("rcpt:<address>")
+	Throttled map[string]uint64 `json:"throttled"`
+}
+
+// Stats returns a snapshot of the limiter's counters
+func (l *Limiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := LimiterStats{
+		ActiveSessions: l.active,
+		Decisions:      make(map[string]uint64, len(l.decisions)),
+		Throttled:      make(map[string]uint64, len(l.throttled)),
+	}
+	for k, v := range l.decisions {
+		stats.Decisions[k] = v
+	}
+	for k, v := range l.throttled {
+		stats.Throttled[k] = v
+	}
+	return stats
+}
+
+// clientKey identifies a client: its IPv4 address or its IPv6 /64, since
+// a single IPv6 host usually controls a whole /64
+func clientKey(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// bucketSet holds one token bucket per key. A zero rate disables it.
+type bucketSet struct {
+	rate      float64 // Tokens per second
+	burst     float64
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newBucketSet creates buckets refilling at perMinute tokens per minute.
+// The burst defaults to one minute's worth of tokens.
+func newBucketSet(perMinute float64, burst int) *bucketSet {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(perMinute)))
+	}
+	return &bucketSet{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// take consumes a token for key, reporting false when none is left
+func (bs *bucketSet) take(key string, now time.Time) bool {
+	b := bs.refill(key, now)
+	if !b.allows() {
+		return false
+	}
+	b.take()
+	return true
+}
+
+// refill returns key's bucket topped up to now, or nil when the set is
+// disabled
+func (bs *bucketSet) refill(key string, now time.Time) *bucket {
+	if bs.rate <= 0 {
+		return nil
+	}
+	bs.prune(now)
+
+	b, ok := bs.buckets[key]
+	if !ok {
+		b = &bucket{tokens: bs.burst, last: now}
+		bs.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * bs.rate
+	if b.tokens > bs.burst {
+		b.tokens = bs.burst
+	}
+	b.last = now
+	return b
+}
+
+// allows reports whether a token is left; a nil (disabled) bucket always
+// has one
+func (b *bucket) allows() bool {
+	return b == nil || b.tokens >= 1
+}
+
+// take consumes a token checked with allows
+func (b *bucket) take() {
+	if b != nil {
+		b.tokens--
+	}
+}
+
+// prune drops buckets that have refilled completely, which are equivalent
+// to new ones, so memory does not grow with every client seen
+func (bs *bucketSet) prune(now time.Time) {
+	if now.Sub(bs.lastPrune) < pruneInterval {
+		return
+	}
+	bs.lastPrune = now
+	refill := time.Duration(bs.burst / bs.rate * float64(time.Second))
+	for key, b := range bs.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(bs.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(cfg LimitConfig) (*Limiter, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := NewLimiter(cfg)
+	l.now = clock.now
+	return l, clock
+}
+
+func smtpCode(err error) int {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code
+	}
+	return 0
+}
+
+func TestLimiter_GlobalSessionCap(t *testing.T) {
+	l, _ := newTestLimiter(LimitConfig{MaxSessions: 2})
+
+	r1, err := l.AllowSession(net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.AllowSession(net.ParseIP("192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.AllowSession(net.ParseIP("192.0.2.3")); smtpCode(err) != 421 {
+		t.Fatalf("Expected 421 at the global cap, got %v", err)
+	}
+
+	r1()
+	r1() // Releasing twice must not free a second slot
+	if _, err := l.AllowSession(net.ParseIP("192.0.2.3")); err != nil {
+		t.Fatalf("Expected a free slot after release: %v", err)
+	}
+	if _, err := l.AllowSession(net.ParseIP("192.0.2.4")); smtpCode(err) != 421 {
+		t.Fatalf("Double release freed an extra slot: %v", err)
+	}
+}
+
+func TestLimiter_PerIPSessionCap(t *testing.T) {
+	l, _ := newTestLimiter(LimitConfig{MaxSessionsPerIP: 1})
+	ip := net.ParseIP("192.0.2.1")
+
+	release, err := l.AllowSession(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.AllowSession(ip); smtpCode(err) != 421 {
+		t.Fatalf("Expected 421 for second session, got %v", err)
+	}
+	if _, err := l.AllowSession(net.ParseIP("192.0.2.2")); err != nil {
+		t.Errorf("Other clients should not be affected: %v", err)
+	}
+	release()
+	if _, err := l.AllowSession(ip); err != nil {
+		t.Errorf("Expected session after release: %v", err)
+	}
+}
+
+func TestLimiter_SessionRate(t *testing.T) {
+	l, clock := newTestLimiter(LimitConfig{SessionsPerMinute: 6, SessionBurst: 2})
+	ip := net.ParseIP("192.0.2.1")
+
+	for i := 0; i < 2; i++ {
+		if _, err := l.AllowSession(ip); err != nil {
+			t.Fatalf("Session %d within burst refused: %v", i, err)
+		}
+	}
+	if _, err := l.AllowSession(ip); smtpCode(err) != 421 {
+		t.Fatalf("Expected 421 past the burst, got %v", err)
+	}
+
+	// 6 per minute refills one token every 10 seconds
+	clock.advance(10 * time.Second)
+	if _, err := l.AllowSession(ip); err != nil {
+		t.Errorf("Expected a refilled token: %v", err)
+	}
+	if _, err := l.AllowSession(ip); err == nil {
+		t.Error("Expected the bucket to be empty again")
+	}
+}
+
+func TestLimiter_IPv6ClientsShareTheir64(t *testing.T) {
+	l, _ := newTestLimiter(LimitConfig{MaxSessionsPerIP: 1})
+	if _, err := l.AllowSession(net.ParseIP("2001:db8:1:2::1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.AllowSession(net.ParseIP("2001:db8:1:2::ffff")); err == nil {
+		t.Error("Addresses in the same /64 should share a limit")
+	}
+	if _, err := l.AllowSession(net.ParseIP("2001:db8:1:3::1")); err != nil {
+		t.Errorf("Another /64 should have its own limit: %v", err)
+	}
+}
+
+func TestLimiter_RecipientRate(t *testing.T) {
+	l, clock := newTestLimiter(LimitConfig{RecipientsPerMinute: 1, RecipientBurst: 1})
+	ip := net.ParseIP("192.0.2.1")
+
+	if err := l.AllowRecipient(ip, "bob@test.com"); err != nil {
+		t.Fatal(err)
+	}
+	err := l.AllowRecipient(net.ParseIP("198.51.100.1"), "BOB@test.com")
+	if smtpCode(err) != 451 {
+		t.Fatalf("Expected 451 for the same mailbox from any client, got %v", err)
+	}
+	if err := l.AllowRecipient(ip, "carol@test.com"); err != nil {
+		t.Errorf("Other mailboxes should not be affected: %v", err)
+	}
+
+	clock.advance(time.Minute)
+	if err := l.AllowRecipient(ip, "bob@test.com"); err != nil {
+		t.Errorf("Expected a refilled token: %v", err)
+	}
+}
+
+func TestLimiter_ClientRecipientRate(t *testing.T) {
+	l, _ := newTestLimiter(LimitConfig{ClientRecipientsPerMinute: 2})
+	ip := net.ParseIP("192.0.2.1")
+
+	l.AllowRecipient(ip, "a@test.com")
+	l.AllowRecipient(ip, "b@test.com")
+	if err := l.AllowRecipient(ip, "c@test.com"); smtpCode(err) != 451 {
+		t.Fatalf("Expected 451 past the client limit, got %v", err)
+	}
+}
+
+func TestLimiter_RefusedRecipientKeepsClientToken(t *testing.T) {
+	l, _ := newTestLimiter(LimitConfig{
+		RecipientsPerMinute:       1,
+		ClientRecipientsPerMinute: 2,
+	})
+	ip := net.ParseIP("192.0.2.1")
+
+	if err := l.AllowRecipient(net.ParseIP("198.51.100.1"), "bob@test.com"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := l.AllowRecipient(ip, "bob@test.com"); smtpCode(err) != 451 {
+			t.Fatalf("Expected 451 for a throttled mailbox, got %v", err)
+		}
+	}
+	for _, rcpt := range []string{"a@test.com", "b@test.com"} {
+		if err := l.AllowRecipient(ip, rcpt); err != nil {
+			t.Errorf("Refused recipients should not use the client's tokens: %v", err)
+		}
+	}
+}
+
+func TestLimiter_Stats(t *testing.T) {
+	l, _ := newTestLimiter(LimitConfig{MaxSessionsPerIP: 1, RecipientsPerMinute: 1})
+	ip := net.ParseIP("192.0.2.1")
+
+	l.AllowSession(ip)
+	l.AllowSession(ip)
+	l.AllowRecipient(ip, "bob@test.com")
+	l.AllowRecipient(ip, "bob@test.com")
+	l.AllowRecipient(ip, "bob@test.com")
+
+	stats := l.Stats()
+	if stats.ActiveSessions != 1 {
+		t.Errorf("ActiveSessions = %d, want 1", stats.ActiveSessions)
+	}
+	want := map[string]uint64{
+		DecisionSessionAllowed:   1,
+		DecisionSessionIPCap:     1,
+		DecisionRecipientAllowed: 1,
+		DecisionRecipientRate:    2,
+	}
+	for k, v := range want {
+		if stats.Decisions[k] != v {
+			t.Errorf("Decisions[%s] = %d, want %d", k, stats.Decisions[k], v)
+		}
+	}
+	if stats.Throttled["ip:192.0.2.1"] != 1 || stats.Throttled["rcpt:bob@test.com"] != 2 {
+		t.Errorf("Unexpected throttled counters: %v", stats.Throttled)
+	}
+}
+
+func TestBucketSet_PrunesRefilledBuckets(t *testing.T) {
+	bs := newBucketSet(6, 5) // Refills completely in 50 seconds
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	bs.take("a", start)
+	bs.take("b", start.Add(30*time.Second))
+
+	// After 61 seconds "a" has refilled completely; "b" has not
+	bs.take("c", start.Add(61*time.Second))
+	if _, ok := bs.buckets["a"]; ok {
+		t.Error("Refilled bucket should have been pruned")
+	}
+	if _, ok := bs.buckets["b"]; !ok {
+		t.Error("Bucket still refilling should be kept")
+	}
+}
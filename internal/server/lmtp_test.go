@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/dnsutil"
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+// errMailboxFull is returned by rcptFailStore for its failing recipient
+var errMailboxFull = &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 2, 2}, Message: "Mailbox full"}
+
+// rcptFailStore fails every copy addressed to one recipient
+type rcptFailStore struct {
+	memoryStore
+	fail string
+}
+
+func (s *rcptFailStore) Save(ctx context.Context, email storage.Email) (string, error) {
+	if len(email.To) == 1 && email.To[0] == s.fail {
+		return "", errMailboxFull
+	}
+	return s.memoryStore.Save(ctx, email)
+}
+
+// startLMTPServer serves LMTP on a unix socket
+func startLMTPServer(t *testing.T, store storage.Storage) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "lmtp.sock")
+	cfg := Config{Mode: ModeLMTP, LMTPSocket: socket, CatchAll: true, SPFPolicy: SPFReject}
+	be := NewBackend(cfg, store)
+	be.Resolver = &dnsutil.StaticResolver{}
+
+	s := newSMTPServer(be, socket, nil)
+	s.Network = "unix"
+	ln, err := listen(s, be, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return socket
+}
+
+func TestLMTP_PerRecipientStatus(t *testing.T) {
+	store := &rcptFailStore{fail: "carol@test.com"}
+	socket := startLMTPServer(t, store)
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := smtp.NewClientLMTP(conn)
+	defer c.Close()
+
+	if err := c.Mail("alice@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"bob@test.com", "carol@test.com", "dave@test.com"} {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("Subject: hi\r\n\r\nbody\r\n"))
+	resp, err := w.CloseWithLMTPResponse()
+
+	lmtpErr, ok := err.(smtp.LMTPDataError)
+	if !ok || len(lmtpErr) != 1 || lmtpErr["carol@test.com"] == nil || lmtpErr["carol@test.com"].Code != 452 {
+		t.Fatalf("Expected a 452 for carol only, got %v", err)
+	}
+	if resp["bob@test.com"] == nil || resp["dave@test.com"] == nil {
+		t.Errorf("Expected 250 for bob and dave, got %v", resp)
+	}
+
+	// One copy per delivered recipient, each traced for its own recipient
+	if len(store.saved) != 2 {
+		t.Fatalf("Expected 2 stored copies, got %d", len(store.saved))
+	}
+	for i, rcpt := range []string{"bob@test.com", "dave@test.com"} {
+		saved := store.saved[i]
+		if len(saved.To) != 1 || saved.To[0] != rcpt {
+			t.Errorf("Copy %d addressed to %v, want %s", i, saved.To, rcpt)
+		}
+		if !strings.Contains(saved.Raw, "with LMTP\r\n\tfor <"+rcpt+">;") {
+			t.Errorf("Copy %d lacks an LMTP Received header for %s:\n%s", i, rcpt, saved.Raw)
+		}
+		if saved.SPF != nil {
+			t.Errorf("SPF should not be checked over LMTP, got %+v", saved.SPF)
+		}
+		if !strings.HasSuffix(saved.Raw, "Subject: hi\r\n\r\nbody\r\n") {
+			t.Errorf("Copy %d content mangled:\n%s", i, saved.Raw)
+		}
+	}
+}
+
+func TestLMTP_DuplicateRecipientStoredOnce(t *testing.T) {
+	store := &memoryStore{}
+	s := &Session{Store: store, LMTP: true}
+	s.Mail("alice@example.com", nil)
+	s.Rcpt("bob@test.com", nil)
+	s.Rcpt("bob@test.com", nil)
+
+	status := statusRecorder{}
+	if err := s.LMTPData(strings.NewReader("Subject: hi\r\n\r\nbody\r\n"), status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status["bob@test.com"]) != 2 {
+		t.Errorf("Expected a status per RCPT TO, got %v", status)
+	}
+	if len(store.saved) != 1 {
+		t.Errorf("Expected one stored copy, got %d", len(store.saved))
+	}
+}
+
+// statusRecorder collects LMTP statuses per recipient
+type statusRecorder map[string][]error
+
+func (r statusRecorder) SetStatus(rcpt string, err error) {
+	r[rcpt] = append(r[rcpt], err)
+}
+
+func TestParseServerMode(t *testing.T) {
+	for value, want := range map[string]ServerMode{"": ModeSMTP, "smtp": ModeSMTP, "lmtp": ModeLMTP} {
+		if got, err := ParseServerMode(value); err != nil || got != want {
+			t.Errorf("ParseServerMode(%q) = %q, %v; want %q", value, got, err, want)
+		}
+	}
+	if _, err := ParseServerMode("esmtp"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import "strings"
+
+// DomainPolicy decides which recipient domains the server accepts mail for.
+// Entries are exact domains ("example.com") or wildcards that match any
+// subdomain ("*.example.com"). In catch-all mode every domain is accepted.
+type DomainPolicy struct {
+	domains  map[string]bool
+	suffixes []string
+	catchAll bool
+}
+
+// NewDomainPolicy builds a policy from a list of domains
+func NewDomainPolicy(domains []string, catchAll bool) *DomainPolicy {
+	p := &DomainPolicy{domains: make(map[string]bool), catchAll: catchAll}
+	for _, d := range domains {
+		d = normalizeDomain(d)
+		if d == "" {
+			continue
+		}
+		if strings.HasPrefix(d, "*.") {
+			p.suffixes = append(p.suffixes, d[1:])
+		} else {
+			p.domains[d] = true
+		}
+	}
+	return p
+}
+
+// CatchAll reports whether every domain is accepted
+func (p *DomainPolicy) CatchAll() bool {
+	return p.catchAll
+}
+
+// Empty reports whether no domain is configured
+func (p *DomainPolicy) Empty() bool {
+	return len(p.domains) == 0 && len(p.suffixes) == 0
+}
+
+// Allows reports whether mail for the given address is accepted
+func (p *DomainPolicy) Allows(address string) bool {
+	if p.catchAll {
+		return true
+	}
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return false
+	}
+	domain := normalizeDomain(address[at+1:])
+	if p.domains[domain] {
+		return true
+	}
+	for _, suffix := range p.suffixes {
+		if strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
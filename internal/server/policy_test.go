@@ -0,0 +1,52 @@
+package server
+
+import "testing"
+
+func TestDomainPolicy_Allows(t *testing.T) {
+	p := NewDomainPolicy([]string{"mail.example.com", "Example.ORG.", "*.test.dev", " "}, false)
+	cases := []struct {
+		addr string
+		ok   bool
+	}{
+		{"bob@mail.example.com", true},
+		{"bob@MAIL.EXAMPLE.COM", true},
+		{"bob@example.org", true},
+		{"bob@a.test.dev", true},
+		{"bob@a.b.test.dev", true},
+		{"bob@test.dev", false},
+		{"bob@example.com", false},
+		{"bob@evil.com", false},
+		{"postmaster", false},
+	}
+	for _, c := range cases {
+		if got := p.Allows(c.addr); got != c.ok {
+			t.Errorf("Allows(%q) = %v, want %v", c.addr, got, c.ok)
+		}
+	}
+}
+
+func TestDomainPolicy_CatchAll(t *testing.T) {
+	p := NewDomainPolicy(nil, true)
+	if !p.Allows("anyone@anywhere.test") {
+		t.Error("Catch-all policy should accept every domain")
+	}
+	if !p.Empty() || !p.CatchAll() {
+		t.Error("Expected an empty catch-all policy")
+	}
+}
+
+func TestSession_RcptRejectsForeignDomain(t *testing.T) {
+	s := &Session{Store: &memoryStore{}, Domains: NewDomainPolicy([]string{"example.com"}, false)}
+	s.Mail("alice@sender.test", nil)
+
+	if err := s.Rcpt("bob@example.com", nil); err != nil {
+		t.Errorf("Local recipient rejected: %v", err)
+	}
+	err := s.Rcpt("bob@elsewhere.test", nil)
+	if err != ErrRecipientDomain {
+		t.Errorf("Expected ErrRecipientDomain, got %v", err)
+	}
+	if len(s.To) != 1 {
+		t.Errorf("Rejected recipient should not be collected: %v", s.To)
+	}
+}
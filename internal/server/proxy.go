@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// proxyHeaderTimeout bounds the wait for the PROXY header of a connection
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyListener accepts PROXY protocol headers from trusted peers. Their
+// connections report the client address from the header; trusted peers may
+// still connect directly, though connections admitted before the greeting
+// then wait proxyHeaderTimeout for a header. A header from any other peer
+// closes the connection.
+func proxyListener(ln net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyproto.Listener{
+		Listener: ln,
+		ConnPolicy: func(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+			if ip := remoteIP(opts.Upstream); ip != nil {
+				for _, network := range trusted {
+					if network.Contains(ip) {
+						return proxyproto.USE, nil
+					}
+				}
+			}
+			return proxyproto.REJECT, nil
+		},
+		ReadHeaderTimeout: proxyHeaderTimeout,
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/dnsutil"
+	"github.com/pires/go-proxyproto"
+)
+
+// startProxyServer serves SMTP on a loopback port with the PROXY protocol
+// trusted for the given networks
+func startProxyServer(t *testing.T, trusted string) (string, *memoryStore) {
+	t.Helper()
+	networks, err := ParseCIDRs(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memoryStore{}
+	cfg := Config{CatchAll: true, ProxyTrusted: networks}
+	be := NewBackend(cfg, store)
+	be.Resolver = &dnsutil.StaticResolver{}
+
+	s := newSMTPServer(be, "127.0.0.1:0", nil)
+	ln, err := listen(s, be, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String(), store
+}
+
+// sendThroughProxy delivers a message, prefixed with a PROXY header of the
+// given version claiming client as the source (no header when version is 0)
+func sendThroughProxy(addr string, version byte, client string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if version != 0 {
+		src := &net.TCPAddr{IP: net.ParseIP(client), Port: 40000}
+		dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+		if src.IP.To4() == nil {
+			dst.IP = net.ParseIP("2001:db8::25")
+		}
+		if _, err := proxyproto.HeaderProxyFromAddrs(version, src, dst).WriteTo(conn); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	c := smtp.NewClient(conn)
+	defer c.Close()
+	if err := c.SendMail("alice@example.com", []string{"bob@test.com"}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func TestProxyProtocol_UsesClientAddress(t *testing.T) {
+	addr, store := startProxyServer(t, "127.0.0.0/8")
+
+	cases := []struct {
+		version byte
+		client  string
+	}{
+		{1, "203.0.113.7"},
+		{2, "203.0.113.8"},
+		{2, "2001:db8::7"},
+	}
+	for i, tc := range cases {
+		if err := sendThroughProxy(addr, tc.version, tc.client); err != nil {
+			t.Fatalf("v%d from %s: %v", tc.version, tc.client, err)
+		}
+		saved := store.saved[i]
+		if saved.Connection.ClientIP != tc.client {
+			t.Errorf("v%d: client IP %q, want %q", tc.version, saved.Connection.ClientIP, tc.client)
+		}
+		if !strings.Contains(saved.Raw, "(["+tc.client+"])") {
+			t.Errorf("v%d: Received header does not name the client:\n%s", tc.version, saved.Raw)
+		}
+	}
+}
+
+func TestProxyProtocol_DirectConnectionFromTrustedPeer(t *testing.T) {
+	addr, store := startProxyServer(t, "127.0.0.1")
+	if err := sendThroughProxy(addr, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.saved[0].Connection.ClientIP; got != "127.0.0.1" {
+		t.Errorf("Client IP %q, want the peer address", got)
+	}
+}
+
+func TestProxyProtocol_RejectsUntrustedPeer(t *testing.T) {
+	addr, store := startProxyServer(t, "192.0.2.0/24")
+	if err := sendThroughProxy(addr, 1, "203.0.113.7"); err == nil {
+		t.Error("Expected a PROXY header from an untrusted peer to fail")
+	}
+	if len(store.saved) != 0 {
+		t.Errorf("Message from an untrusted proxy was stored: %+v", store.saved)
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	networks, err := ParseCIDRs(" 10.0.0.0/8, 192.0.2.5 ,2001:db8::/32,,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.0.2.5/32", "2001:db8::/32", "::1/128"}
+	if len(networks) != len(want) {
+		t.Fatalf("Got %v, want %v", networks, want)
+	}
+	for i, network := range networks {
+		if network.String() != want[i] {
+			t.Errorf("Network %d: got %s, want %s", i, network, want[i])
+		}
+	}
+	for _, value := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := ParseCIDRs(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
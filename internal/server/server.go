@@ -1,26 +1,167 @@
 package server
 
 import (
+	"crypto/tls"
 	"log"
+	"net"
+	"os"
+	"strings"
 
 	"github.com/emersion/go-smtp"
 	"github.com/habibiefaried/email-server/internal/storage"
 )
 
-func RunSMTPServer(fqdn string, port string, store storage.Storage) {
-	be := &Backend{Store: store}
+func newSMTPServer(be *Backend, addr string, tlsConfig *tls.Config) *smtp.Server {
 	s := smtp.NewServer(be)
-	s.Addr = ":" + port
-	s.AllowInsecureAuth = true
+	s.Addr = addr
+	if be.Config.FQDN != "" {
+		s.Domain = be.Config.FQDN
+	}
+	s.LMTP = be.Config.Mode == ModeLMTP && !be.submission
+	s.MaxMessageBytes = be.Config.MaxMessageBytes
+	s.MaxRecipients = be.Config.MaxRecipients
+	s.ReadTimeout = be.Config.Timeout
+	s.WriteTimeout = be.Config.Timeout
+	s.TLSConfig = tlsConfig
+	return s
+}
+
+func RunSMTPServer(cfg Config, store storage.Storage) {
+	tlsConfig, err := buildTLSConfig(cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
 
-	if fqdn != "" {
+	be := NewBackend(cfg, store)
+	s := newSMTPServer(be, ":"+cfg.Port, tlsConfig)
+	if cfg.Mode == ModeLMTP {
+		if cfg.LMTPSocket != "" {
+			s.Network, s.Addr = "unix", cfg.LMTPSocket
+		}
+		log.Printf("Starting LMTP server on %s\n", s.Addr)
+	} else {
 		log.Printf("Starting SMTP server on %s\n", s.Addr)
-		log.Printf("FQDN: %s\n", fqdn)
+	}
+	if cfg.FQDN != "" {
+		log.Printf("FQDN: %s\n", cfg.FQDN)
+	}
+	switch {
+	case be.domains.CatchAll():
+		log.Printf("Catch-all mode: accepting mail for all domains\n")
+	case be.domains.Empty():
+		log.Fatalf("No recipient domains configured, every recipient would be rejected")
+	default:
+		log.Printf("Accepting mail for: %s\n", strings.Join(cfg.RecipientDomains, ", "))
+	}
+	if cfg.MaxMessageBytes > 0 {
+		log.Printf("Message size limit: %d bytes (policy: %s)\n", cfg.MaxMessageBytes, cfg.OversizePolicy)
+	}
+	if cfg.Limiter != nil {
+		log.Printf("Inbound rate limiting enabled\n")
+	}
+	if len(cfg.ProxyTrusted) > 0 {
+		log.Printf("PROXY protocol enabled for %s\n", joinNetworks(cfg.ProxyTrusted))
+	}
+	if tlsConfig != nil {
+		log.Printf("STARTTLS enabled\n")
 	} else {
-		log.Printf("Starting SMTP server on %s (accepting all domains)\n", s.Addr)
+		log.Printf("STARTTLS disabled (no certificate configured)\n")
+	}
+
+	if cfg.ImplicitTLSPort != "" {
+		if tlsConfig == nil {
+			log.Fatalf("Implicit TLS port %s requires a TLS certificate", cfg.ImplicitTLSPort)
+		}
+		if cfg.Mode == ModeLMTP {
+			log.Fatalf("Implicit TLS port %s is not supported in LMTP mode", cfg.ImplicitTLSPort)
+		}
+		tlsServer := newSMTPServer(be, ":"+cfg.ImplicitTLSPort, tlsConfig)
+		log.Printf("Starting implicit-TLS SMTP server on %s\n", tlsServer.Addr)
+		tlsListener, err := listen(tlsServer, be, true)
+		if err != nil {
+			log.Fatalf("Failed to start implicit-TLS SMTP server: %v", err)
+		}
+		go func() {
+			if err := tlsServer.Serve(tlsListener); err != nil {
+				log.Fatalf("Failed to start implicit-TLS SMTP server: %v", err)
+			}
+		}()
+	}
+
+	if cfg.SubmissionPort != "" {
+		if tlsConfig == nil || cfg.Users == nil {
+			log.Fatalf("Submission port %s requires a TLS certificate and a user database", cfg.SubmissionPort)
+		}
+		if cfg.Mode == ModeLMTP {
+			log.Fatalf("Submission port %s is not supported in LMTP mode", cfg.SubmissionPort)
+		}
+		sub := NewBackend(cfg, store)
+		sub.submission = true
+		subServer := newSMTPServer(sub, ":"+cfg.SubmissionPort, tlsConfig)
+		log.Printf("Starting submission server on %s (STARTTLS and AUTH required)\n", subServer.Addr)
+		subListener, err := listen(subServer, sub, false)
+		if err != nil {
+			log.Fatalf("Failed to start submission server: %v", err)
+		}
+		go func() {
+			if err := subServer.Serve(subListener); err != nil {
+				log.Fatalf("Failed to start submission server: %v", err)
+			}
+		}()
 	}
 
-	if err := s.ListenAndServe(); err != nil {
+	ln, err := listen(s, be, false)
+	if err != nil {
 		log.Fatalf("Failed to start SMTP server: %v", err)
 	}
+	if err := s.Serve(ln); err != nil {
+		log.Fatalf("Failed to start SMTP server: %v", err)
+	}
+}
+
+// listen opens the listener of s, unwrapping the PROXY protocol first when
+// it is enabled, then admitting connections through be (except in LMTP
+// mode) and, for implicit-TLS listeners, unwrapping TLS. A unix socket
+// left behind by a previous run is replaced.
+func listen(s *smtp.Server, be *Backend, implicitTLS bool) (net.Listener, error) {
+	cfg := be.Config
+	network := s.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if network == "unix" {
+		if err := os.Remove(s.Addr); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen(network, s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		// The upstream MTA usually runs as another user of the same group
+		if err := os.Chmod(s.Addr, 0660); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if len(cfg.ProxyTrusted) > 0 {
+		ln = proxyListener(ln, cfg.ProxyTrusted)
+	}
+	if cfg.Mode != ModeLMTP && (cfg.Limiter != nil || (len(cfg.DNSBLZones) > 0 && !be.submission)) {
+		ln = newAdmitListener(ln, func(conn net.Conn) net.Conn { return be.admit(conn, implicitTLS) })
+	}
+	if implicitTLS {
+		ln = tls.NewListener(ln, s.TLSConfig)
+	}
+	return ln, nil
+}
+
+// joinNetworks formats networks for logging
+func joinNetworks(networks []*net.IPNet) string {
+	names := make([]string, len(networks))
+	for i, network := range networks {
+		names[i] = network.String()
+	}
+	return strings.Join(names, ", ")
 }
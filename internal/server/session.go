@@ -1,48 +1,421 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/dnsutil"
 	"github.com/habibiefaried/email-server/internal/storage"
 )
 
+const (
+	spfTimeout   = 20 * time.Second // DNS work of a single SPF check
+	dkimTimeout  = 20 * time.Second // Key lookups for all DKIM signatures
+	dmarcTimeout = 10 * time.Second // DMARC policy discovery
+	saveTimeout  = 2 * time.Minute  // Storing one copy of a message, blobs included
+)
+
+// ErrRecipientDomain is returned for recipients outside the domain policy
+var ErrRecipientDomain = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "Recipient domain not accepted here",
+}
+
+// ErrSPFFail is returned from MAIL FROM when SPFReject is set and the
+// sender's SPF policy does not authorize the client
+var ErrSPFFail = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 23},
+	Message:      "SPF validation failed",
+}
+
 type Session struct {
 	From  string
-	To    string
+	To    []string
 	Store storage.Storage
+
+	OversizePolicy OversizePolicy
+	// Domains restricts accepted recipients; nil accepts every domain
+	Domains *DomainPolicy
+
+	SPFPolicy SPFPolicy
+	Resolver  dnsutil.Resolver
+	RemoteIP  net.IP // Nil when the client address is unknown
+	Helo      string
+	// ServerName is our FQDN, used in the Received header and as the
+	// authserv-id of the Authentication-Results header
+	ServerName string
+	TLS        *tls.ConnectionState // Nil for plaintext connections
+	// LMTP marks sessions from an upstream MTA over LMTP
+	LMTP bool
+	// Users enables SMTP AUTH on submission sessions, which must
+	// authenticate over TLS before MAIL FROM; nil disables it
+	Users storage.UserStore
+	// Limiter throttles recipients per client and mailbox; nil disables it
+	Limiter RateLimiter
+	// Greylist defers unknown sender/recipient/client triplets; nil disables it
+	Greylist *Greylister
+	// Forwarder queues copies of stored messages matching forwarding
+	// rules; nil disables forwarding
+	Forwarder Forwarder
+
+	user      string    // Authenticated username, empty before AUTH
+	startedAt time.Time // When MAIL FROM started the transaction
+
+	spf   *dnsutil.SPFCheck
+	dnsbl []dnsblHit // Blocklist listings of the client, found at connect
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	if s.Users != nil {
+		if s.TLS == nil {
+			return ErrTLSRequired
+		}
+		if s.user == "" {
+			return ErrAuthRequired
+		}
+	}
 	s.From = from
+	s.startedAt = time.Now()
+	if err := s.checkSPF(); err != nil {
+		s.From = ""
+		return err
+	}
 	return nil
 }
 
+// checkSPF evaluates the sender's SPF policy according to SPFPolicy
+func (s *Session) checkSPF() error {
+	s.spf = nil
+	if s.SPFPolicy == "" || s.SPFPolicy == SPFOff || s.Resolver == nil || s.RemoteIP == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), spfTimeout)
+	defer cancel()
+	check := dnsutil.CheckSPF(ctx, s.Resolver, s.RemoteIP, s.Helo, s.From)
+	s.spf = &check
+
+	if check.Result == dnsutil.SPFFail && s.SPFPolicy == SPFReject {
+		log.Printf("from: %s, rejected: SPF %s for %s (%s)", s.From, check.Result, s.RemoteIP, check.Reason)
+		return ErrSPFFail
+	}
+	return nil
+}
+
+// headerSafe keeps client-controlled values from breaking a header line
+var headerSafe = strings.NewReplacer("\r", " ", "\n", " ")
+
+// receivedSPF formats a Received-SPF header (RFC 7208 section 9.1)
+func (s *Session) receivedSPF() string {
+	return headerSafe.Replace(fmt.Sprintf("Received-SPF: %s (%s) client-ip=%s; envelope-from=\"%s\"; helo=%s;",
+		s.spf.Result, s.spf.Reason, s.RemoteIP, s.From, s.Helo)) + "\r\n"
+}
+
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	s.To = to
+	if s.Domains != nil && !s.Domains.Allows(to) {
+		log.Printf("from: %s, rejected recipient %s: domain not accepted", s.From, to)
+		return ErrRecipientDomain
+	}
+	for _, hit := range s.dnsbl {
+		if hit.Action == DNSBLRejectRcpt {
+			log.Printf("from: %s, rejected recipient %s: %s listed in %s", s.From, to, s.RemoteIP, hit.Zone)
+			return ErrDNSBLListed
+		}
+	}
+	if s.Limiter != nil {
+		if err := s.Limiter.AllowRecipient(s.RemoteIP, to); err != nil {
+			log.Printf("from: %s, deferred recipient %s: %v", s.From, to, err)
+			return err
+		}
+	}
+	if s.Greylist != nil {
+		if err := s.Greylist.Check(s.RemoteIP, s.From, to); err != nil {
+			log.Printf("from: %s, greylisted recipient %s from %s", s.From, to, s.RemoteIP)
+			return err
+		}
+	}
+	s.To = append(s.To, to)
 	return nil
 }
 
+// Data streams the message straight into storage without buffering it.
 func (s *Session) Data(r io.Reader) error {
-	body, err := io.ReadAll(r)
+	spool, truncated, err := s.spool(r)
+	if err != nil {
+		return err
+	}
+	defer removeSpool(spool)
+
+	if err := s.save(spool, truncated, s.authenticate(spool, truncated), s.To); err != nil {
+		return err
+	}
+	s.passGreylist(s.To)
+	return nil
+}
+
+// LMTPData stores a separate copy of the message for every recipient, so
+// each one gets its own status reply (RFC 2033 section 4.2)
+func (s *Session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	spool, truncated, err := s.spool(r)
+	if err != nil {
+		return err
+	}
+	defer removeSpool(spool)
+
+	auth := s.authenticate(spool, truncated)
+	results := make(map[string]error, len(s.To))
+	for _, rcpt := range s.To {
+		// A recipient given twice gets a status per RCPT TO but one copy
+		err, done := results[rcpt]
+		if !done {
+			err = s.save(spool, truncated, auth, []string{rcpt})
+			results[rcpt] = err
+			if err == nil {
+				s.passGreylist([]string{rcpt})
+			}
+		}
+		status.SetStatus(rcpt, err)
+	}
+	return nil
+}
+
+// passGreylist whitelists the triplets of recipients whose copy was stored
+func (s *Session) passGreylist(to []string) {
+	if s.Greylist == nil {
+		return
+	}
+	for _, rcpt := range to {
+		s.Greylist.Pass(s.RemoteIP, s.From, rcpt)
+	}
+}
+
+// spool copies the DATA stream to a temporary file according to
+// OversizePolicy
+func (s *Session) spool(r io.Reader) (*os.File, bool, error) {
+	spool, truncated, err := spoolData(r, s.OversizePolicy)
+	if errors.Is(err, smtp.ErrDataTooLarge) {
+		// go-smtp's DATA reader fails once MaxMessageBytes is crossed
+		log.Printf("from: %s, to: %s, rejected: message exceeds size limit", s.From, strings.Join(s.To, ", "))
+		return nil, false, smtp.ErrDataTooLarge
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	// Results that claim to be ours can only be forged by the sender
+	stripped, err := stripAuthResults(spool, s.serverName())
 	if err != nil {
+		removeSpool(stripped)
+		return nil, false, err
+	}
+	return stripped, truncated, nil
+}
+
+// authentication holds the DKIM and DMARC results of a spooled message
+type authentication struct {
+	dkim  []dnsutil.DKIMCheck
+	dmarc *dnsutil.DMARCCheck
+}
+
+// authenticate verifies DKIM and evaluates DMARC for the spooled message
+func (s *Session) authenticate(spool *os.File, truncated bool) authentication {
+	var auth authentication
+	if s.Resolver == nil {
+		return auth
+	}
+	if !truncated {
+		// A truncated message cannot match its signatures' body hash
+		auth.dkim = s.verifyDKIM(spool)
+	}
+	auth.dmarc = s.checkDMARC(spool, auth.dkim)
+	return auth
+}
+
+// save stores the spooled message for the given recipients with the trace
+// and authentication headers prepended
+func (s *Session) save(spool *os.File, truncated bool, auth authentication, to []string) error {
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
+
 	email := storage.Email{
-		From:    s.From,
-		To:      s.To,
-		Content: string(body),
+		From:       s.From,
+		To:         to,
+		Connection: s.connectionInfo(),
+	}
+
+	var headers strings.Builder
+	if auth.dmarc != nil {
+		headers.WriteString(authenticationResults(s.serverName(), s.From, s.Helo, s.spf, auth.dkim, auth.dmarc))
+	}
+	if s.spf != nil {
+		headers.WriteString(s.receivedSPF())
 	}
-	filename, err := s.Store.Save(email)
+	for _, hit := range s.dnsbl {
+		headers.WriteString(dnsblHeader(s.RemoteIP, hit))
+		email.DNSBL = append(email.DNSBL, storage.DNSBLResult{
+			Zone:   hit.Zone,
+			Codes:  hit.Codes,
+			Action: string(hit.Action),
+			Reason: hit.Reason,
+		})
+	}
+	headers.WriteString(s.received(to))
+	if s.spf != nil {
+		email.SPF = &storage.SPFResult{
+			Result: string(s.spf.Result),
+			Domain: s.spf.Domain,
+			Reason: s.spf.Reason,
+		}
+	}
+	for _, c := range auth.dkim {
+		email.DKIM = append(email.DKIM, storage.DKIMResult{
+			Result:     string(c.Result),
+			Domain:     c.Domain,
+			Selector:   c.Selector,
+			Algorithm:  c.Algorithm,
+			Identifier: c.Identifier,
+			Reason:     c.Reason,
+		})
+	}
+	if auth.dmarc != nil {
+		email.DMARC = &storage.DMARCResult{
+			Result:      string(auth.dmarc.Result),
+			Domain:      auth.dmarc.Domain,
+			Policy:      auth.dmarc.Policy,
+			SPFAligned:  auth.dmarc.SPFAligned,
+			DKIMAligned: auth.dmarc.DKIMAligned,
+			Reason:      auth.dmarc.Reason,
+		}
+	}
+
+	var content io.Reader = spool
+	if truncated {
+		content = io.MultiReader(spool, truncatedReader{})
+	}
+	email.Content = io.MultiReader(strings.NewReader(headers.String()), content)
+
+	ctx, cancel := context.WithTimeout(context.Background(), saveTimeout)
+	defer cancel()
+	filename, err := s.Store.Save(ctx, email)
 	if err != nil {
 		return err
 	}
-	log.Printf("from: %s, to: %s, saved in %s", s.From, s.To, filename)
+	log.Printf("from: %s, to: %s, saved in %s", s.From, strings.Join(to, ", "), filename)
+
+	// Truncated messages are stored for inspection but not passed on
+	if s.Forwarder != nil && !truncated {
+		s.forward(spool, headers.String(), to)
+	}
 	return nil
 }
 
-func (s *Session) Reset() {}
+// verifyDKIM checks the signatures of the spooled message and rewinds it
+func (s *Session) verifyDKIM(spool *os.File) []dnsutil.DKIMCheck {
+	defer spool.Seek(0, io.SeekStart)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dkimTimeout)
+	defer cancel()
+	checks, err := dnsutil.VerifyDKIM(ctx, s.Resolver, spool)
+	if err != nil {
+		log.Printf("from: %s, DKIM verification failed: %v", s.From, err)
+		return nil
+	}
+	return checks
+}
+
+// checkDMARC evaluates DMARC for the From domain of the spooled message
+// and rewinds it
+func (s *Session) checkDMARC(spool *os.File, dkimChecks []dnsutil.DKIMCheck) *dnsutil.DMARCCheck {
+	domain, err := headerFromDomain(spool)
+	spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return &dnsutil.DMARCCheck{Result: dnsutil.DMARCPermError, Reason: err.Error()}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dmarcTimeout)
+	defer cancel()
+	check := dnsutil.CheckDMARC(ctx, s.Resolver, domain, s.spf, dkimChecks)
+	return &check
+}
+
+// connectionInfo describes the connection for storage
+func (s *Session) connectionInfo() storage.ConnectionInfo {
+	info := storage.ConnectionInfo{
+		Helo:       s.Helo,
+		AuthUser:   s.user,
+		ReceivedAt: s.startedAt,
+	}
+	if s.RemoteIP != nil {
+		info.ClientIP = s.RemoteIP.String()
+	}
+	if s.TLS != nil {
+		info.TLSVersion = tls.VersionName(s.TLS.Version)
+		info.TLSCipher = tls.CipherSuiteName(s.TLS.CipherSuite)
+	}
+	return info
+}
+
+// received formats the Received trace header of RFC 5321 section 4.4 for
+// a copy delivered to the given recipients
+func (s *Session) received(to []string) string {
+	helo, clientIP := s.Helo, "unknown"
+	if helo == "" {
+		helo = "unknown"
+	}
+	if s.RemoteIP != nil {
+		clientIP = s.RemoteIP.String()
+	}
+	protocol := "ESMTP"
+	if s.LMTP {
+		protocol = "LMTP"
+	}
+	// Protocol types of RFC 3848: S for TLS, A for an authenticated client
+	if s.TLS != nil {
+		protocol += "S"
+	}
+	if s.user != "" {
+		protocol += "A"
+	}
+	if s.TLS != nil {
+		protocol += fmt.Sprintf(" (%s %s)", tls.VersionName(s.TLS.Version), tls.CipherSuiteName(s.TLS.CipherSuite))
+	}
+	received := fmt.Sprintf("Received: from %s ([%s])\r\n\tby %s with %s", headerSafe.Replace(helo), clientIP, s.serverName(), protocol)
+	// Naming the recipient would disclose the others of a multi-recipient message
+	if len(to) == 1 {
+		received += fmt.Sprintf("\r\n\tfor <%s>", headerSafe.Replace(to[0]))
+	}
+	startedAt := s.startedAt
+	if startedAt.IsZero() {
+		startedAt = time.Now()
+	}
+	return received + "; " + startedAt.Format(time.RFC1123Z) + "\r\n"
+}
+
+// serverName identifies this server in the headers it adds
+func (s *Session) serverName() string {
+	if s.ServerName != "" {
+		return s.ServerName
+	}
+	return "localhost"
+}
+
+func (s *Session) Reset() {
+	s.From = ""
+	s.To = nil
+	s.spf = nil
+	s.startedAt = time.Time{}
+}
 
 func (s *Session) Logout() error {
 	return nil
@@ -0,0 +1,422 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/dnsutil"
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+type savedEmail struct {
+	storage.Email
+	Raw       string
+	Truncated bool
+}
+
+type memoryStore struct {
+	storage.MemoryStorage
+	saved []savedEmail
+}
+
+func (m *memoryStore) Save(ctx context.Context, email storage.Email) (string, error) {
+	data, err := io.ReadAll(email.Content)
+	truncated := errors.Is(err, storage.ErrTruncated)
+	if err != nil && !truncated {
+		return "", err
+	}
+	m.saved = append(m.saved, savedEmail{Email: email, Raw: string(data), Truncated: truncated})
+	return "memory", nil
+}
+
+func TestSession_CollectsAllRecipients(t *testing.T) {
+	store := &memoryStore{}
+	s := &Session{Store: store}
+
+	if err := s.Mail("alice@example.com", nil); err != nil {
+		t.Fatalf("Mail failed: %v", err)
+	}
+	for _, rcpt := range []string{"bob@example.com", "carol@example.com", "dave@example.com"} {
+		if err := s.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("Rcpt(%s) failed: %v", rcpt, err)
+		}
+	}
+	if err := s.Data(strings.NewReader("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("Data failed: %v", err)
+	}
+
+	if len(store.saved) != 1 {
+		t.Fatalf("Expected 1 saved email, got %d", len(store.saved))
+	}
+	if !strings.HasSuffix(store.saved[0].Raw, "\r\nSubject: hi\r\n\r\nhello\r\n") {
+		t.Errorf("Unexpected content: %q", store.saved[0].Raw)
+	}
+	got := store.saved[0].To
+	if len(got) != 3 || got[0] != "bob@example.com" || got[2] != "dave@example.com" {
+		t.Errorf("Unexpected recipients: %v", got)
+	}
+}
+
+func TestSession_ResetClearsEnvelope(t *testing.T) {
+	s := &Session{Store: &memoryStore{}}
+	s.Mail("alice@example.com", nil)
+	s.Rcpt("bob@example.com", nil)
+	s.Reset()
+
+	if s.From != "" || len(s.To) != 0 {
+		t.Errorf("Reset should clear envelope, got from=%q to=%v", s.From, s.To)
+	}
+
+	s.Mail("alice@example.com", nil)
+	s.Rcpt("carol@example.com", nil)
+	if len(s.To) != 1 || s.To[0] != "carol@example.com" {
+		t.Errorf("Recipients leaked across transactions: %v", s.To)
+	}
+}
+
+// oversizeReader mimics go-smtp's DATA reader hitting MaxMessageBytes
+func oversizeReader(prefix string) io.Reader {
+	return io.MultiReader(strings.NewReader(prefix), errReader{smtp.ErrDataTooLarge})
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestSession_OversizeReject(t *testing.T) {
+	store := &memoryStore{}
+	s := &Session{Store: store, OversizePolicy: OversizeReject}
+	s.Mail("alice@example.com", nil)
+	s.Rcpt("bob@example.com", nil)
+
+	err := s.Data(oversizeReader("Subject: big\r\n\r\nAAAA"))
+	if !errors.Is(err, smtp.ErrDataTooLarge) {
+		t.Fatalf("Expected ErrDataTooLarge (552), got %v", err)
+	}
+	if len(store.saved) != 0 {
+		t.Errorf("Rejected message should not be stored")
+	}
+}
+
+func TestSession_OversizeTruncate(t *testing.T) {
+	store := &memoryStore{}
+	s := &Session{Store: store, OversizePolicy: OversizeTruncate}
+	s.Mail("alice@example.com", nil)
+	s.Rcpt("bob@example.com", nil)
+
+	if err := s.Data(oversizeReader("Subject: big\r\n\r\nAAAA")); err != nil {
+		t.Fatalf("Truncate policy should accept the message, got %v", err)
+	}
+	if len(store.saved) != 1 || !store.saved[0].Truncated {
+		t.Fatalf("Expected one truncated email, got %+v", store.saved)
+	}
+}
+
+func TestParseOversizePolicy(t *testing.T) {
+	cases := []struct {
+		in   string
+		want OversizePolicy
+		ok   bool
+	}{
+		{"", OversizeReject, true},
+		{"reject", OversizeReject, true},
+		{"truncate", OversizeTruncate, true},
+		{"drop", "", false},
+	}
+	for _, c := range cases {
+		got, err := ParseOversizePolicy(c.in)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("ParseOversizePolicy(%q) = %q, %v; want %q, ok=%v", c.in, got, err, c.want, c.ok)
+		}
+	}
+}
+
+func spfSession(policy SPFPolicy, ip string) (*Session, *memoryStore) {
+	store := &memoryStore{}
+	return &Session{
+		Store:     store,
+		SPFPolicy: policy,
+		Resolver: &dnsutil.StaticResolver{TXT: map[string][]string{
+			"example.com": {"v=spf1 ip4:192.0.2.0/24 -all"},
+		}},
+		RemoteIP: net.ParseIP(ip),
+		Helo:     "client.example.com",
+	}, store
+}
+
+func TestSession_RecordsSPFResult(t *testing.T) {
+	s, store := spfSession(SPFRecord, "192.0.2.10")
+	if err := s.Mail("alice@example.com", nil); err != nil {
+		t.Fatalf("Mail failed: %v", err)
+	}
+	s.Rcpt("bob@test.com", nil)
+	if err := s.Data(strings.NewReader("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("Data failed: %v", err)
+	}
+
+	saved := store.saved[0]
+	if saved.SPF == nil || saved.SPF.Result != "pass" || saved.SPF.Domain != "example.com" {
+		t.Fatalf("Unexpected SPF result: %+v", saved.SPF)
+	}
+	if !strings.Contains(saved.Raw, "\r\nReceived-SPF: pass (") || !strings.Contains(saved.Raw, "client-ip=192.0.2.10;") {
+		t.Errorf("Missing Received-SPF header: %q", saved.Raw)
+	}
+	if !strings.HasSuffix(saved.Raw, "\r\nSubject: hi\r\n\r\nhello\r\n") {
+		t.Errorf("Message content altered: %q", saved.Raw)
+	}
+}
+
+func TestSession_SPFFailRecordedNotRejected(t *testing.T) {
+	s, store := spfSession(SPFRecord, "203.0.113.5")
+	if err := s.Mail("alice@example.com", nil); err != nil {
+		t.Fatalf("Mail should not fail in record mode: %v", err)
+	}
+	s.Rcpt("bob@test.com", nil)
+	s.Data(strings.NewReader("\r\nhello\r\n"))
+	if got := store.saved[0].SPF; got == nil || got.Result != "fail" {
+		t.Errorf("Expected recorded fail, got %+v", got)
+	}
+}
+
+func TestSession_SPFRejectMode(t *testing.T) {
+	s, _ := spfSession(SPFReject, "203.0.113.5")
+	err := s.Mail("alice@example.com", nil)
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 23}) {
+		t.Fatalf("Expected 550 5.7.23, got %v", err)
+	}
+
+	// Softfail and authorized senders still pass in reject mode
+	s, _ = spfSession(SPFReject, "192.0.2.10")
+	if err := s.Mail("alice@example.com", nil); err != nil {
+		t.Errorf("Authorized sender rejected: %v", err)
+	}
+}
+
+func TestSession_SPFOff(t *testing.T) {
+	s, store := spfSession(SPFOff, "203.0.113.5")
+	s.Mail("alice@example.com", nil)
+	s.Rcpt("bob@test.com", nil)
+	s.Data(strings.NewReader("\r\nhello\r\n"))
+	if store.saved[0].SPF != nil || strings.Contains(store.saved[0].Raw, "Received-SPF") {
+		t.Errorf("SPF should not run when off: %+v", store.saved[0])
+	}
+}
+
+func TestParseSPFPolicy(t *testing.T) {
+	for value, want := range map[string]SPFPolicy{"": SPFRecord, "off": SPFOff, "record": SPFRecord, "reject": SPFReject} {
+		got, err := ParseSPFPolicy(value)
+		if err != nil || got != want {
+			t.Errorf("ParseSPFPolicy(%q) = %q, %v; want %q", value, got, err, want)
+		}
+	}
+	if _, err := ParseSPFPolicy("strict"); err == nil {
+		t.Error("Expected error for unknown mode")
+	}
+}
+
+func TestSession_VerifiesDKIM(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signed bytes.Buffer
+	msg := "From: alice@example.com\r\nTo: bob@test.com\r\nSubject: hi\r\n\r\nhello\r\n"
+	err = dkim.Sign(&signed, strings.NewReader(msg), &dkim.SignOptions{Domain: "example.com", Selector: "s1", Signer: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &memoryStore{}
+	s := &Session{
+		Store: store,
+		Resolver: &dnsutil.StaticResolver{TXT: map[string][]string{
+			"s1._domainkey.example.com": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+		}},
+	}
+	s.Mail("alice@example.com", nil)
+	s.Rcpt("bob@test.com", nil)
+	if err := s.Data(bytes.NewReader(signed.Bytes())); err != nil {
+		t.Fatalf("Data failed: %v", err)
+	}
+
+	saved := store.saved[0]
+	if len(saved.DKIM) != 1 {
+		t.Fatalf("Expected 1 DKIM result, got %+v", saved.DKIM)
+	}
+	got := saved.DKIM[0]
+	if got.Result != "pass" || got.Domain != "example.com" || got.Selector != "s1" || got.Algorithm != "ed25519-sha256" {
+		t.Errorf("Unexpected DKIM result: %+v", got)
+	}
+	if !strings.HasSuffix(saved.Raw, "\r\n"+signed.String()) {
+		t.Errorf("Stored content differs from received message")
+	}
+}
+
+func TestSession_StampsAuthenticationResults(t *testing.T) {
+	s, store := spfSession(SPFRecord, "192.0.2.10")
+	s.ServerName = "mx.test.com"
+	s.Resolver.(*dnsutil.StaticResolver).TXT["_dmarc.example.com"] = []string{"v=DMARC1; p=reject"}
+
+	s.Mail("bounce@mail.example.com", nil)
+	s.Rcpt("bob@test.com", nil)
+	s.Data(strings.NewReader("From: Alice <alice@example.com>\r\nSubject: hi\r\n\r\nhello\r\n"))
+
+	saved := store.saved[0]
+	firstLine := saved.Raw[:strings.Index(saved.Raw, "\r\n")]
+	if !strings.HasPrefix(firstLine, "Authentication-Results: mx.test.com; ") {
+		t.Fatalf("Missing Authentication-Results header: %q", firstLine)
+	}
+	// mail.example.com has no SPF record, so nothing aligns
+	for _, want := range []string{"spf=none smtp.mailfrom=bounce@mail.example.com", "dkim=none", "dmarc=fail", "header.from=example.com"} {
+		if !strings.Contains(firstLine, want) {
+			t.Errorf("Header %q lacks %q", firstLine, want)
+		}
+	}
+	if saved.DMARC == nil || saved.DMARC.Result != "fail" || saved.DMARC.Policy != "reject" || saved.DMARC.Domain != "example.com" {
+		t.Errorf("Unexpected DMARC result: %+v", saved.DMARC)
+	}
+
+	// An aligned SPF pass satisfies DMARC
+	s.Reset()
+	s.Mail("alice@example.com", nil)
+	s.Rcpt("bob@test.com", nil)
+	s.Data(strings.NewReader("From: alice@example.com\r\n\r\nhello\r\n"))
+	if got := store.saved[1].DMARC; got == nil || got.Result != "pass" || !got.SPFAligned {
+		t.Errorf("Expected aligned DMARC pass, got %+v", got)
+	}
+}
+
+func TestSession_StripsForgedAuthenticationResults(t *testing.T) {
+	s, store := spfSession(SPFRecord, "192.0.2.10")
+	s.ServerName = "mx.test.com"
+	s.Mail("alice@example.com", nil)
+	s.Rcpt("bob@test.com", nil)
+	msg := "Authentication-Results: MX.test.com;\r\n spf=pass smtp.mailfrom=ceo@example.com;\r\n dkim=pass header.d=example.com\r\n" +
+		"From: alice@example.com\r\n" +
+		"Authentication-Results: (forged) mx.test.com 1; dmarc=pass\r\n" +
+		"Authentication-Results: relay.example.org; spf=pass\r\n" +
+		"Subject: hi\r\n\r\n" +
+		"Authentication-Results: mx.test.com; in the body\r\n"
+	if err := s.Data(strings.NewReader(msg)); err != nil {
+		t.Fatalf("Data failed: %v", err)
+	}
+
+	want := "From: alice@example.com\r\n" +
+		"Authentication-Results: relay.example.org; spf=pass\r\n" +
+		"Subject: hi\r\n\r\n" +
+		"Authentication-Results: mx.test.com; in the body\r\n"
+	if raw := store.saved[0].Raw; !strings.HasSuffix(raw, "\r\n"+want) || strings.Contains(raw, "dkim=pass") {
+		t.Errorf("Forged results kept:\n%s", raw)
+	}
+}
+
+func TestAuthResultsID(t *testing.T) {
+	cases := map[string]string{
+		" mx.test.com; spf=pass":           "mx.test.com",
+		" mx.test.com 1; none":             "mx.test.com",
+		" (comment (nested)) mx.test.com;": "mx.test.com",
+		" ; spf=pass":                      "",
+	}
+	for value, want := range cases {
+		if got := authResultsID(value); got != want {
+			t.Errorf("authResultsID(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestHeaderFromDomain(t *testing.T) {
+	cases := map[string]string{
+		"From: Alice <alice@Example.COM>\r\n\r\n":      "example.com",
+		"Subject: x\r\nFrom: bob@test.com\r\n\r\nbody": "test.com",
+		"From: a@one.com, b@two.com\r\n\r\n":           "",
+		"From: a@one.com\r\nFrom: b@two.com\r\n\r\n":   "",
+		"Subject: no from\r\n\r\n":                     "",
+	}
+	for msg, want := range cases {
+		got, err := headerFromDomain(strings.NewReader(msg))
+		if got != want || (want == "") != (err != nil) {
+			t.Errorf("headerFromDomain(%q) = %q, %v; want %q", msg, got, err, want)
+		}
+	}
+}
+
+func TestSession_ReceivedHeaderAndConnection(t *testing.T) {
+	store := &memoryStore{}
+	s := &Session{
+		Store:      store,
+		RemoteIP:   net.ParseIP("198.51.100.4"),
+		Helo:       "client.example.org",
+		ServerName: "mx.test.com",
+		TLS:        &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256},
+	}
+	before := time.Now()
+	s.Mail("alice@example.org", nil)
+	s.Rcpt("bob@test.com", nil)
+	if err := s.Data(strings.NewReader("Subject: hi\r\n\r\nhello\r\n")); err != nil {
+		t.Fatalf("Data failed: %v", err)
+	}
+
+	saved := store.saved[0]
+	wantPrefix := "Received: from client.example.org ([198.51.100.4])\r\n" +
+		"\tby mx.test.com with ESMTPS (TLS 1.3 TLS_AES_128_GCM_SHA256)\r\n" +
+		"\tfor <bob@test.com>; "
+	if !strings.HasPrefix(saved.Raw, wantPrefix) {
+		t.Errorf("Unexpected Received header: %q", saved.Raw)
+	}
+
+	conn := saved.Connection
+	if conn.ClientIP != "198.51.100.4" || conn.Helo != "client.example.org" || conn.TLSVersion != "TLS 1.3" || conn.TLSCipher != "TLS_AES_128_GCM_SHA256" {
+		t.Errorf("Unexpected connection info: %+v", conn)
+	}
+	if conn.ReceivedAt.Before(before) || conn.ReceivedAt.After(time.Now()) {
+		t.Errorf("Unexpected transaction start: %v", conn.ReceivedAt)
+	}
+}
+
+func TestSession_ReceivedOmitsRecipientsOfMultiRecipientMail(t *testing.T) {
+	store := &memoryStore{}
+	s := &Session{Store: store, Helo: "client\r\nX-Injected: yes"}
+	s.Mail("alice@example.org", nil)
+	s.Rcpt("bob@test.com", nil)
+	s.Rcpt("carol@test.com", nil)
+	s.Data(strings.NewReader("\r\nhello\r\n"))
+
+	raw := store.saved[0].Raw
+	if strings.Contains(raw, "for <") {
+		t.Errorf("Received header should not list recipients: %q", raw)
+	}
+	if strings.Contains(raw, "\r\nX-Injected") {
+		t.Errorf("HELO name injected a header: %q", raw)
+	}
+	if store.saved[0].Connection.TLSVersion != "" {
+		t.Errorf("Plaintext session recorded TLS: %+v", store.saved[0].Connection)
+	}
+}
+
+func TestSession_RcptRateLimited(t *testing.T) {
+	limiter := NewLimiter(LimitConfig{RecipientsPerMinute: 1})
+	s := &Session{Store: &memoryStore{}, Limiter: limiter, RemoteIP: net.ParseIP("192.0.2.1")}
+	s.Mail("alice@example.com", nil)
+	if err := s.Rcpt("bob@test.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rcpt("bob@test.com", nil); smtpCode(err) != 451 {
+		t.Fatalf("Expected 451, got %v", err)
+	}
+	if len(s.To) != 1 {
+		t.Errorf("Throttled recipient was accepted: %v", s.To)
+	}
+}
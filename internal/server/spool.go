@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/emersion/go-smtp"
+	"github.com/habibiefaried/email-server/internal/storage"
+)
+
+// spoolData copies the DATA stream into a temporary file so the message can
+// be read more than once (authentication checks, then storage) without
+// holding it in memory. When the size limit is crossed under the truncate
+// policy, the spool keeps what was received and truncated is true; under
+// the reject policy smtp.ErrDataTooLarge is returned.
+func spoolData(r io.Reader, policy OversizePolicy) (spool *os.File, truncated bool, err error) {
+	f, err := os.CreateTemp("", ".smtp-data-*")
+	if err != nil {
+		return nil, false, err
+	}
+
+	_, err = io.Copy(f, r)
+	if errors.Is(err, smtp.ErrDataTooLarge) && policy == OversizeTruncate {
+		truncated, err = true, nil
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeSpool(f)
+		return nil, false, err
+	}
+	return f, truncated, nil
+}
+
+func removeSpool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// truncatedReader ends a truncated message with storage.ErrTruncated, so
+// storage keeps a stub instead of the partial content.
+type truncatedReader struct{}
+
+func (truncatedReader) Read([]byte) (int, error) {
+	return 0, storage.ErrTruncated
+}
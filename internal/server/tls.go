@@ -0,0 +1,168 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are stat'ed for changes
+var certCheckInterval = 30 * time.Second
+
+// certReloader serves a certificate loaded from disk and reloads it when the
+// cert or key file changes, so certificates can rotate without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// latestModTime returns the newest modification time of the cert and key files
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.lastCheck = time.Now()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A failed reload keeps
+// serving the previous certificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) >= certCheckInterval {
+		r.lastCheck = time.Now()
+		if modTime, err := r.latestModTime(); err != nil {
+			log.Printf("Warning: cannot stat TLS certificate: %v", err)
+		} else if modTime.After(r.modTime) {
+			if err := r.reload(); err != nil {
+				log.Printf("Warning: TLS certificate reload failed, keeping previous certificate: %v", err)
+			} else {
+				log.Printf("TLS certificate reloaded from %s", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// generateSelfSignedCert creates an ECDSA certificate valid for one year for
+// the given host names / IPs. Intended for development only.
+func generateSelfSignedCert(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"email-server self-signed"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	if len(tmpl.DNSNames) > 0 {
+		tmpl.Subject.CommonName = tmpl.DNSNames[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// buildTLSConfig returns the TLS configuration for STARTTLS and implicit TLS,
+// or nil when TLS is not configured.
+func buildTLSConfig(cfg Config) (*tls.Config, error) {
+	switch {
+	case cfg.TLSCertFile != "" || cfg.TLSKeyFile != "":
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return nil, fmt.Errorf("both TLS certificate and key files are required")
+		}
+		reloader, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}, nil
+	case cfg.TLSSelfSigned:
+		hosts := []string{"localhost", "127.0.0.1"}
+		if cfg.FQDN != "" {
+			hosts = append([]string{cfg.FQDN}, hosts...)
+		}
+		cert, err := generateSelfSignedCert(hosts...)
+		if err != nil {
+			return nil, fmt.Errorf("generating self-signed certificate: %w", err)
+		}
+		return &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{cert},
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCertFiles(t *testing.T, dir string, host string) (string, string) {
+	t.Helper()
+	cert, err := generateSelfSignedCert(host)
+	if err != nil {
+		t.Fatalf("generateSelfSignedCert failed: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey failed: %v", err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestGenerateSelfSignedCert(t *testing.T) {
+	cert, err := generateSelfSignedCert("mail.example.com", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("generateSelfSignedCert failed: %v", err)
+	}
+	if err := cert.Leaf.VerifyHostname("mail.example.com"); err != nil {
+		t.Errorf("Certificate should be valid for mail.example.com: %v", err)
+	}
+	if err := cert.Leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Errorf("Certificate should be valid for 127.0.0.1: %v", err)
+	}
+}
+
+func TestCertReloader_ReloadsOnChange(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertFiles(t, dir, "old.example.com")
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader failed: %v", err)
+	}
+	first, _ := r.GetCertificate(&tls.ClientHelloInfo{})
+
+	writeCertFiles(t, dir, "new.example.com")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	r.lastCheck = time.Time{}
+
+	second, _ := r.GetCertificate(&tls.ClientHelloInfo{})
+	leaf, err := x509.ParseCertificate(second.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second || leaf.Subject.CommonName != "new.example.com" {
+		t.Errorf("Certificate was not reloaded, got CN=%s", leaf.Subject.CommonName)
+	}
+}
+
+func TestCertReloader_KeepsCertOnBadReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertFiles(t, dir, "good.example.com")
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader failed: %v", err)
+	}
+	good, _ := r.GetCertificate(&tls.ClientHelloInfo{})
+
+	os.WriteFile(certFile, []byte("not a certificate"), 0600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	r.lastCheck = time.Time{}
+
+	got, err := r.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil || got != good {
+		t.Errorf("Expected previous certificate to be kept, got %v, %v", got, err)
+	}
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	if c, err := buildTLSConfig(Config{}); c != nil || err != nil {
+		t.Errorf("TLS should be disabled by default, got %v, %v", c, err)
+	}
+	if _, err := buildTLSConfig(Config{TLSCertFile: "cert.pem"}); err == nil {
+		t.Error("A certificate without a key should be rejected")
+	}
+	c, err := buildTLSConfig(Config{FQDN: "mail.example.com", TLSSelfSigned: true})
+	if err != nil || c == nil || len(c.Certificates) != 1 {
+		t.Fatalf("Self-signed config not built: %v, %v", c, err)
+	}
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// Attachment describes a non-text MIME part of an email. Attachments are
+// numbered from 0 in MIME order: attachments first, then inline parts,
+// then other parts.
+type Attachment struct {
+	Index       int    `json:"index"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	ContentID   string `json:"content_id,omitempty"`
+	Disposition string `json:"disposition,omitempty"` // "attachment" or "inline"
+	SHA256      string `json:"sha256"`                // Hex digest of the decoded content
+}
+
+// attachmentPart is an extracted attachment with its decoded content
+type attachmentPart struct {
+	Attachment
+	content []byte
+}
+
+// extractAttachments returns the non-text parts of a parsed message
+func extractAttachments(env *enmime.Envelope) []attachmentPart {
+	var parts []attachmentPart
+	for _, group := range [][]*enmime.Part{env.Attachments, env.Inlines, env.OtherParts} {
+		for _, p := range group {
+			sum := sha256.Sum256(p.Content)
+			contentType := p.ContentType
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			parts = append(parts, attachmentPart{
+				Attachment: Attachment{
+					Index:       len(parts),
+					Filename:    p.FileName,
+					ContentType: contentType,
+					Size:        int64(len(p.Content)),
+					ContentID:   p.ContentID,
+					Disposition: p.Disposition,
+					SHA256:      hex.EncodeToString(sum[:]),
+				},
+				content: p.Content,
+			})
+		}
+	}
+	return parts
+}
+
+// openPart returns attachment n of parts
+func openPart(parts []attachmentPart, n int) (*Attachment, io.ReadCloser, error) {
+	if n < 0 || n >= len(parts) {
+		return nil, nil, ErrNotFound
+	}
+	a := parts[n].Attachment
+	return &a, io.NopCloser(bytes.NewReader(parts[n].content)), nil
+}
+
+// attachmentsOf returns the metadata of parts, or nil when there are none
+func attachmentsOf(parts []attachmentPart) []Attachment {
+	if len(parts) == 0 {
+		return nil
+	}
+	attachments := make([]Attachment, len(parts))
+	for i, p := range parts {
+		attachments[i] = p.Attachment
+	}
+	return attachments
+}
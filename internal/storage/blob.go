@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrBlobNotFound is returned by BlobStore.Open for unknown keys
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps large content, raw messages and attachments, outside the
+// database. Keys are slash-separated relative paths.
+type BlobStore interface {
+	// Put stores size bytes read from r under key, replacing any content
+	// already there
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Open streams the content of key, or returns ErrBlobNotFound. The
+	// caller closes the reader.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// blobKey returns the key of content with a SHA-256 digest. Keys are
+// content-addressed, so storing the same content twice writes one blob.
+func blobKey(kind, digest string) string {
+	return kind + "/" + digest[:2] + "/" + digest
+}
+
+// hashContent returns the hex SHA-256 digest and size of r
+func hashContent(r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// validBlobKey reports whether key is a relative slash-separated path that
+// stays inside the store
+func validBlobKey(key string) bool {
+	if key == "" || strings.ContainsAny(key, `\:`) {
+		return false
+	}
+	for _, p := range strings.Split(key, "/") {
+		if p == "" || p == "." || p == ".." || strings.HasPrefix(p, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// FSBlobStore keeps blobs as files under a directory
+type FSBlobStore struct {
+	Dir string
+}
+
+// NewFSBlobStore creates dir if needed and returns a store using it
+func NewFSBlobStore(dir string) (*FSBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FSBlobStore{Dir: dir}, nil
+}
+
+// Put writes the content to a temporary file and renames it into place,
+// so readers never see a partial blob
+func (bs *FSBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	path, err := bs.pathFor(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("blob %s: wrote %d bytes, want %d", key, n, size)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Open opens the file of key
+func (bs *FSBlobStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := bs.pathFor(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+// Delete removes the file of key
+func (bs *FSBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := bs.pathFor(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// pathFor returns the file of a key
+func (bs *FSBlobStore) pathFor(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(bs.Dir, filepath.FromSlash(key)), nil
+}
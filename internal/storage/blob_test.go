@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testBlobStore checks the behaviour every BlobStore must share
+func testBlobStore(t *testing.T, bs BlobStore) {
+	ctx := context.Background()
+	read := func(key string) (string, error) {
+		r, err := bs.Open(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		return string(data), err
+	}
+
+	key := blobKey("raw", "ab12cd")
+	if _, err := read(key); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Open before Put = %v, want ErrBlobNotFound", err)
+	}
+	if err := bs.Put(ctx, key, strings.NewReader("first"), 5); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got, err := read(key); err != nil || got != "first" {
+		t.Errorf("Open = %q, %v; want first", got, err)
+	}
+	if err := bs.Put(ctx, key, strings.NewReader("second"), 6); err != nil {
+		t.Fatalf("Put over an existing blob failed: %v", err)
+	}
+	if got, err := read(key); err != nil || got != "second" {
+		t.Errorf("Open after overwrite = %q, %v; want second", got, err)
+	}
+	if err := bs.Put(ctx, "attachments/empty", strings.NewReader(""), 0); err != nil {
+		t.Fatalf("Put of empty content failed: %v", err)
+	}
+	if got, err := read("attachments/empty"); err != nil || got != "" {
+		t.Errorf("Open of empty blob = %q, %v", got, err)
+	}
+
+	if err := bs.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := read(key); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Open after Delete = %v, want ErrBlobNotFound", err)
+	}
+	if err := bs.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing blob = %v, want nil", err)
+	}
+
+	for _, bad := range []string{"", "../escape", "a/../../b", "/abs", `a\b`, "a//b", ".hidden/x"} {
+		if err := bs.Put(ctx, bad, strings.NewReader("x"), 1); err == nil {
+			t.Errorf("Put(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestFSBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	bs, err := NewFSBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, bs)
+
+	// A short read must not leave a partial blob behind
+	if err := bs.Put(context.Background(), "raw/short", strings.NewReader("abc"), 10); err == nil {
+		t.Error("Put with a short reader succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "raw", "short")); !os.IsNotExist(err) {
+		t.Errorf("Partial blob left behind: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "raw")); len(entries) != 1 {
+		t.Errorf("Temporary files left behind: %v", entries)
+	}
+}
@@ -1,54 +1,305 @@
 package storage
 
-import "log"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
 
-// CompositeStorage writes to multiple storage backends simultaneously
+// WritePolicy decides when a CompositeStorage save succeeds
+type WritePolicy string
+
+const (
+	// WriteAll requires every backend to store the message
+	WriteAll WritePolicy = "all"
+	// WriteAny requires at least one backend
+	WriteAny WritePolicy = "any"
+	// WriteQuorum requires a strict majority of the backends
+	WriteQuorum WritePolicy = "quorum"
+)
+
+// required returns how many of n backends must succeed
+func (p WritePolicy) required(n int) int {
+	switch p {
+	case WriteAny:
+		return min(1, n)
+	case WriteQuorum:
+		return n/2 + 1
+	}
+	return n
+}
+
+// ErrBackendTimeout is the result of a backend that did not finish within
+// its timeout
+var ErrBackendTimeout = errors.New("backend timed out")
+
+// Backend is one destination of a CompositeStorage
+type Backend struct {
+	Name    string
+	Storage Storage
+	// Timeout cancels the save's context once it has run that long; 0
+	// waits for it to finish
+	Timeout time.Duration
+}
+
+// BackendResult is the outcome of saving to one backend
+type BackendResult struct {
+	Name     string
+	Location string // What the backend's Save returned
+	Err      error
+	Duration time.Duration
+}
+
+// SaveResult is the outcome of a CompositeStorage save
+type SaveResult struct {
+	Backends  []BackendResult // In backend order
+	Succeeded int
+}
+
+// Location returns the location reported by the first backend that
+// stored the message, in backend order
+func (r SaveResult) Location() string {
+	for _, b := range r.Backends {
+		if b.Err == nil {
+			return b.Location
+		}
+	}
+	return ""
+}
+
+// CompositeError is returned when too few backends stored a message to
+// satisfy the write policy
+type CompositeError struct {
+	Policy WritePolicy
+	Result SaveResult
+}
+
+func (e *CompositeError) Error() string {
+	var failures []string
+	for _, b := range e.Result.Backends {
+		if b.Err != nil {
+			failures = append(failures, b.Name+": "+b.Err.Error())
+		}
+	}
+	return fmt.Sprintf("write policy %s not met: %d of %d backends stored the message (%s)",
+		e.Policy, e.Result.Succeeded, len(e.Result.Backends), strings.Join(failures, "; "))
+}
+
+// Unwrap returns the backend errors
+func (e *CompositeError) Unwrap() []error {
+	var errs []error
+	for _, b := range e.Result.Backends {
+		if b.Err != nil {
+			errs = append(errs, b.Err)
+		}
+	}
+	return errs
+}
+
+// CompositeStorage writes to multiple storage backends concurrently
 type CompositeStorage struct {
-	storages []Storage
+	backends []Backend
+	policy   WritePolicy
 }
 
-// NewCompositeStorage creates a new composite storage with multiple backends
+// NewCompositeStorage creates a composite storage that requires every
+// backend to store each message, without timeouts
 func NewCompositeStorage(storages ...Storage) *CompositeStorage {
-	return &CompositeStorage{
-		storages: storages,
+	backends := make([]Backend, len(storages))
+	for i, s := range storages {
+		backends[i] = Backend{Name: fmt.Sprintf("%d:%T", i, s), Storage: s}
 	}
+	return NewCompositeStorageWithPolicy(WriteAll, backends...)
 }
 
-// Save saves to all configured storage backends
-func (cs *CompositeStorage) Save(email Email) (string, error) {
-	var results []string
-	var lastErr error
+// NewCompositeStorageWithPolicy creates a composite storage whose saves
+// succeed according to policy
+func NewCompositeStorageWithPolicy(policy WritePolicy, backends ...Backend) *CompositeStorage {
+	return &CompositeStorage{backends: backends, policy: policy}
+}
+
+// Save saves to every backend and returns the first backend's location
+// that succeeded. See SaveAll.
+func (cs *CompositeStorage) Save(ctx context.Context, email Email) (string, error) {
+	result, err := cs.SaveAll(ctx, email)
+	return result.Location(), err
+}
+
+// SaveAll saves to every backend at once and reports each outcome. The
+// content stream is spooled, unless an outer layer did, and replayed to
+// every backend. A backend that exceeds its timeout has its save cancelled
+// and counts as failed with ErrBackendTimeout, so a message reported as
+// not stored there is not stored later behind the caller's back. The error is a *CompositeError when the write policy is not met. The
+// email gets its ID first, so backends that honour IDs store it under the
+// same one.
+func (cs *CompositeStorage) SaveAll(ctx context.Context, email Email) (SaveResult, error) {
+	if email.ID == "" {
+		email.ID = generateUUIDv7()
+	}
+	content, release, err := spoolOf(email.Content, "")
+	if err != nil {
+		return SaveResult{}, err
+	}
+
+	defer release()
+
+	results := make([]BackendResult, len(cs.backends))
+	var done sync.WaitGroup
+	for i, b := range cs.backends {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			results[i] = cs.saveTo(ctx, b, email, content)
+		}()
+	}
+	done.Wait()
 
-	for _, storage := range cs.storages {
-		filename, err := storage.Save(email)
-		if err != nil {
-			log.Printf("Error saving to storage: %v", err)
-			lastErr = err
+	result := SaveResult{Backends: results}
+	for _, r := range results {
+		if r.Err != nil {
+			log.Printf("Error saving to storage %s: %v", r.Name, r.Err)
 		} else {
-			results = append(results, filename)
+			result.Succeeded++
 		}
 	}
+	if result.Succeeded < cs.policy.required(len(cs.backends)) {
+		return result, &CompositeError{Policy: cs.policy, Result: result}
+	}
+	return result, nil
+}
+
+// saveTo saves a replay of the content to one backend, cancelling the
+// save after its timeout
+func (cs *CompositeStorage) saveTo(ctx context.Context, b Backend, email Email, content *spooledContent) BackendResult {
+	start := time.Now()
+	saveCtx := ctx
+	if b.Timeout > 0 {
+		var cancel context.CancelFunc
+		saveCtx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+	replay := email
+	replay.Content = content.replay()
+	location, err := b.Storage.Save(saveCtx, replay)
+	if err != nil && ctx.Err() == nil && saveCtx.Err() == context.DeadlineExceeded {
+		err = ErrBackendTimeout
+	}
+	return BackendResult{Name: b.Name, Location: location, Err: err, Duration: time.Since(start)}
+}
+
+// Reads go to the backends in order and are answered by the first one
+// that does not fail. Backends that do not honour Email.ID store copies
+// under IDs of their own, which only they can answer for.
+
+// List returns one page of mailbox from the first backend that answers
+func (cs *CompositeStorage) List(ctx context.Context, mailbox string, page int) ([]EmailSummary, error) {
+	return firstAnswer(cs, func(s Storage) ([]EmailSummary, error) { return s.List(ctx, mailbox, page) })
+}
+
+// Count counts mailbox in the first backend that answers
+func (cs *CompositeStorage) Count(ctx context.Context, mailbox string) (int, error) {
+	return firstAnswer(cs, func(s Storage) (int, error) { return s.Count(ctx, mailbox) })
+}
+
+// Get returns the email from the first backend that has it
+func (cs *CompositeStorage) Get(ctx context.Context, id string) (*EmailDetail, error) {
+	return firstAnswer(cs, func(s Storage) (*EmailDetail, error) { return s.Get(ctx, id) })
+}
+
+// OpenAttachment opens the attachment in the first backend that has it
+func (cs *CompositeStorage) OpenAttachment(ctx context.Context, id string, n int) (*Attachment, io.ReadCloser, error) {
+	opened, err := firstAnswer(cs, func(s Storage) (openedAttachment, error) {
+		a, r, err := s.OpenAttachment(ctx, id, n)
+		return openedAttachment{a, r}, err
+	})
+	return opened.attachment, opened.content, err
+}
+
+// OpenRaw opens the raw message in the first backend that has it
+func (cs *CompositeStorage) OpenRaw(ctx context.Context, id string) (io.ReadCloser, error) {
+	return firstAnswer(cs, func(s Storage) (io.ReadCloser, error) { return s.OpenRaw(ctx, id) })
+}
 
-	// Return the first filename and any error that occurred
-	if len(results) > 0 {
-		return results[0], lastErr
+// openedAttachment carries the results of OpenAttachment through
+// firstAnswer
+type openedAttachment struct {
+	attachment *Attachment
+	content    io.ReadCloser
+}
+
+// Search searches the first backend that answers
+func (cs *CompositeStorage) Search(ctx context.Context, query SearchQuery) ([]EmailSummary, error) {
+	return firstAnswer(cs, func(s Storage) ([]EmailSummary, error) { return s.Search(ctx, query) })
+}
+
+// Delete removes the email from every backend that has it. It returns
+// ErrNotFound when none had it.
+func (cs *CompositeStorage) Delete(ctx context.Context, id string) error {
+	var errs []error
+	deleted := false
+	for _, b := range cs.backends {
+		err := b.Storage.Delete(ctx, id)
+		switch {
+		case err == nil:
+			deleted = true
+		case !errors.Is(err, ErrNotFound):
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name, err))
+		}
 	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrNotFound
+	}
+	return nil
+}
 
-	if lastErr != nil {
-		return "", lastErr
+// firstAnswer returns the result of read from the first backend that
+// succeeds. Backends reporting ErrNotFound are skipped; when every backend
+// fails, the first error other than ErrNotFound is returned.
+func firstAnswer[T any](cs *CompositeStorage, read func(Storage) (T, error)) (T, error) {
+	var zero T
+	var firstErr error
+	for _, b := range cs.backends {
+		v, err := read(b.Storage)
+		if err == nil {
+			return v, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("Error reading from storage %s: %v", b.Name, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", b.Name, err)
+			}
+		}
+	}
+	if firstErr == nil {
+		firstErr = ErrNotFound
 	}
+	return zero, firstErr
+}
 
-	return "", nil
+// Expire expires the emails of every backend that supports it
+func (cs *CompositeStorage) Expire(ctx context.Context, policy RetentionPolicy, opts ExpireOptions) (ExpireResult, error) {
+	backends := make([]Storage, len(cs.backends))
+	for i, b := range cs.backends {
+		backends[i] = b.Storage
+	}
+	return expireAll(ctx, backends, policy, opts)
 }
 
-// Close closes all storage backends
+// Close closes every storage backend and returns their errors joined
 func (cs *CompositeStorage) Close() error {
-	for _, storage := range cs.storages {
-		if closer, ok := storage.(interface{ Close() error }); ok {
-			if err := closer.Close(); err != nil {
-				return err
-			}
+	var errs []error
+	for _, b := range cs.backends {
+		if err := b.Storage.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name, err))
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompositeStorage_ReplaysContentToEveryBackend(t *testing.T) {
+	a := NewFileStorage(t.TempDir())
+	b := NewFileStorage(t.TempDir())
+	cs := NewCompositeStorage(a, b)
+
+	email := Email{
+		From:    "alice@example.com",
+		To:      []string{"bob@example.com"},
+		Content: strings.NewReader("Subject: hi\r\n\r\nhello"),
+	}
+	if _, err := cs.Save(context.Background(), email); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	for _, fs := range []*FileStorage{a, b} {
+		matches, _ := filepath.Glob(fs.Dir + "/bob@example.com/alice@example.com/*.txt")
+		if len(matches) != 1 {
+			t.Fatalf("Expected one file in %s, got %v", fs.Dir, matches)
+		}
+		data, _ := os.ReadFile(matches[0])
+		if !strings.HasSuffix(string(data), "Subject: hi\r\n\r\nhello") {
+			t.Errorf("Backend %s got wrong content: %q", fs.Dir, data)
+		}
+	}
+}
+
+func TestCompositeStorage_ReplaysTruncation(t *testing.T) {
+	a := NewFileStorage(t.TempDir())
+	cs := NewCompositeStorage(a)
+
+	email := Email{
+		From:    "alice@example.com",
+		To:      []string{"bob@example.com"},
+		Content: io.MultiReader(strings.NewReader("Subject: big\r\n\r\nAAAA"), errorReader{ErrTruncated}),
+	}
+	filename, err := cs.Save(context.Background(), email)
+	if err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(a.Dir, filename))
+	if !strings.Contains(string(data), oversizeNotice) || strings.Contains(string(data), "AAAA") {
+		t.Errorf("Expected truncated stub, got %q", data)
+	}
+}
+
+// stubStorage answers Save with location or err. A Save announces itself
+// on started and waits for release to be closed, when they are set, or
+// for its context to end.
+type stubStorage struct {
+	MemoryStorage
+	started  chan<- string
+	release  <-chan struct{}
+	location string
+	err      error
+	closeErr error
+}
+
+func (s *stubStorage) Save(ctx context.Context, email Email) (string, error) {
+	if s.started != nil {
+		s.started <- s.location
+	}
+	if s.release != nil {
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	io.Copy(io.Discard, email.Content)
+	return s.location, s.err
+}
+
+// saveAllAsync runs cs.SaveAll in the background
+func saveAllAsync(cs *CompositeStorage) <-chan SaveResult {
+	done := make(chan SaveResult, 1)
+	go func() {
+		result, _ := cs.SaveAll(context.Background(), testMessage())
+		done <- result
+	}()
+	return done
+}
+
+func (s *stubStorage) Close() error { return s.closeErr }
+
+func testMessage() Email {
+	return Email{From: "alice@example.com", To: []string{"bob@example.com"}, Content: strings.NewReader("Subject: hi\r\n\r\nhello")}
+}
+
+func TestCompositeStorage_WritesConcurrently(t *testing.T) {
+	started := make(chan string)
+	release := make(chan struct{})
+	cs := NewCompositeStorageWithPolicy(WriteAll,
+		Backend{Name: "pg", Storage: &stubStorage{started: started, release: release, location: "id-1"}},
+		Backend{Name: "archive", Storage: &stubStorage{started: started, release: release, location: "s3://a"}},
+	)
+	done := saveAllAsync(cs)
+
+	// Both saves are under way before either is allowed to finish
+	for range 2 {
+		select {
+		case <-started:
+		case <-done:
+			t.Fatal("SaveAll returned before both backends started")
+		case <-time.After(5 * time.Second):
+			t.Fatal("Backends written one after the other")
+		}
+	}
+	close(release)
+	result := <-done
+	if result.Succeeded != 2 || result.Location() != "id-1" || result.Backends[1].Location != "s3://a" {
+		t.Errorf("Unexpected result %+v", result)
+	}
+}
+
+func TestCompositeStorage_Policies(t *testing.T) {
+	failing := errors.New("disk full")
+	backends := []Backend{
+		{Name: "a", Storage: &stubStorage{err: failing}},
+		{Name: "b", Storage: &stubStorage{location: "b-loc"}},
+		{Name: "c", Storage: &stubStorage{err: failing}},
+	}
+	cases := []struct {
+		policy WritePolicy
+		ok     bool
+	}{
+		{WriteAll, false},
+		{WriteAny, true},
+		{WriteQuorum, false},
+	}
+	for _, tc := range cases {
+		location, err := NewCompositeStorageWithPolicy(tc.policy, backends...).Save(context.Background(), testMessage())
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok=%v", tc.policy, err, tc.ok)
+		}
+		if location != "b-loc" {
+			t.Errorf("%s: location %q, want the successful backend's", tc.policy, location)
+		}
+		var compErr *CompositeError
+		if err != nil && (!errors.As(err, &compErr) || compErr.Result.Succeeded != 1 || !errors.Is(err, failing)) {
+			t.Errorf("%s: unexpected error %#v", tc.policy, err)
+		}
+	}
+
+	// Two of three is a quorum
+	backends[2].Storage = &stubStorage{location: "c-loc"}
+	if _, err := NewCompositeStorageWithPolicy(WriteQuorum, backends...).Save(context.Background(), testMessage()); err != nil {
+		t.Errorf("quorum with 2 of 3: %v", err)
+	}
+}
+
+func TestCompositeStorage_BackendTimeout(t *testing.T) {
+	// The slow backend only returns once its save is cancelled, and SaveAll
+	// waits for every save to return
+	cs := NewCompositeStorageWithPolicy(WriteAny,
+		Backend{Name: "fast", Storage: &stubStorage{location: "fast"}},
+		Backend{Name: "slow", Storage: &stubStorage{release: make(chan struct{}), location: "late"}, Timeout: 50 * time.Millisecond},
+	)
+	var result SaveResult
+	select {
+	case result = <-saveAllAsync(cs):
+	case <-time.After(5 * time.Second):
+		t.Fatal("The slow backend's save was not cancelled")
+	}
+	if result.Succeeded != 1 || result.Location() != "fast" {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	if !errors.Is(result.Backends[1].Err, ErrBackendTimeout) {
+		t.Errorf("Expected a timeout for the slow backend, got %+v", result.Backends[1])
+	}
+}
+
+func TestCompositeStorage_CloseClosesEveryBackend(t *testing.T) {
+	errA, errC := errors.New("a failed"), errors.New("c failed")
+	cs := NewCompositeStorage(&stubStorage{closeErr: errA}, &stubStorage{}, &stubStorage{closeErr: errC})
+	err := cs.Close()
+	if !errors.Is(err, errA) || !errors.Is(err, errC) {
+		t.Errorf("Expected both close errors, got %v", err)
+	}
+}
@@ -0,0 +1,463 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStorageConformance checks the behaviour every Storage must share.
+// newStore returns an empty store.
+func testStorageConformance(t *testing.T, newStore func(t *testing.T) Storage) {
+	ctx := context.Background()
+	save := func(t *testing.T, s Storage, to, subject, body string) string {
+		t.Helper()
+		content := fmt.Sprintf("From: alice@example.com\r\nTo: %s\r\nSubject: %s\r\nDate: Mon, 2 Jan 2006 15:04:05 +0000\r\n\r\n%s\r\n", to, subject, body)
+		id, err := s.Save(ctx, Email{From: "alice@example.com", To: []string{to}, Content: strings.NewReader(content)})
+		if err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		if id == "" {
+			t.Fatal("Save returned an empty ID")
+		}
+		return id
+	}
+
+	t.Run("SaveAndGet", func(t *testing.T) {
+		s := newStore(t)
+		id := save(t, s, "bob@example.com", "Lunch", "See you at noon")
+		email, err := s.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if email.ID != id || email.Subject != "Lunch" || email.From != "alice@example.com" || email.To != "bob@example.com" {
+			t.Errorf("Unexpected email %+v", email)
+		}
+		if !strings.Contains(email.Body, "See you at noon") {
+			t.Errorf("Body lost: %q", email.Body)
+		}
+		if email.Date == "" || email.CreatedAt.IsZero() {
+			t.Errorf("Dates not set: %+v", email)
+		}
+	})
+
+	t.Run("NullSender", func(t *testing.T) {
+		s := newStore(t)
+		content := "From: MAILER-DAEMON@mx.example.net\r\nTo: bob@example.com\r\nSubject: Undelivered Mail\r\n\r\nbounced\r\n"
+		id, err := s.Save(ctx, Email{From: "", To: []string{"bob@example.com"}, Content: strings.NewReader(content)})
+		if err != nil {
+			t.Fatalf("Save of a bounce failed: %v", err)
+		}
+		listed, err := s.List(ctx, "bob@example.com", 1)
+		if err != nil || len(listed) != 1 || listed[0].ID != id {
+			t.Fatalf("List = %+v, %v; want the bounce", listed, err)
+		}
+		email, err := s.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("Get(%q) failed: %v", id, err)
+		}
+		if email.Subject != "Undelivered Mail" {
+			t.Errorf("Unexpected bounce %+v", email)
+		}
+	})
+
+	t.Run("GetUnknown", func(t *testing.T) {
+		s := newStore(t)
+		for _, id := range []string{"missing", "0190a5a1-7b3c-7000-8000-000000000000", "../../etc/passwd"} {
+			if _, err := s.Get(ctx, id); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(%q) = %v, want ErrNotFound", id, err)
+			}
+		}
+	})
+
+	t.Run("ListNewestFirstInPages", func(t *testing.T) {
+		s := newStore(t)
+		for i := range 7 {
+			save(t, s, "bob@example.com", fmt.Sprintf("msg %d", i), "hello")
+		}
+		save(t, s, "carol@example.com", "other", "hello")
+
+		first, err := s.List(ctx, "bob@example.com", 1)
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		if len(first) != PageSize || first[0].Subject != "msg 6" || first[PageSize-1].Subject != "msg 2" {
+			t.Fatalf("Unexpected first page %+v", first)
+		}
+		second, err := s.List(ctx, "BOB@example.com", 2)
+		if err != nil || len(second) != 2 || second[1].Subject != "msg 0" {
+			t.Fatalf("Unexpected second page %+v, %v", second, err)
+		}
+		if third, err := s.List(ctx, "bob@example.com", 3); err != nil || len(third) != 0 {
+			t.Errorf("Expected an empty third page, got %+v, %v", third, err)
+		}
+		if n, err := s.Count(ctx, "bob@example.com"); err != nil || n != 7 {
+			t.Errorf("Count = %d, %v; want 7", n, err)
+		}
+		if n, err := s.Count(ctx, "nobody@example.com"); err != nil || n != 0 {
+			t.Errorf("Count = %d, %v; want 0", n, err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		s := newStore(t)
+		keep := save(t, s, "bob@example.com", "keep", "hello")
+		id := save(t, s, "bob@example.com", "drop", "hello")
+		if err := s.Delete(ctx, id); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		if _, err := s.Get(ctx, id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+		}
+		if err := s.Delete(ctx, id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Second Delete = %v, want ErrNotFound", err)
+		}
+		if _, err := s.Get(ctx, keep); err != nil {
+			t.Errorf("Other email lost: %v", err)
+		}
+		if n, _ := s.Count(ctx, "bob@example.com"); n != 1 {
+			t.Errorf("Count after Delete = %d, want 1", n)
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		s := newStore(t)
+		invoice := save(t, s, "bob@example.com", "Invoice 42", "Please pay")
+		needle := save(t, s, "bob@example.com", "Hello", "a needle in the body")
+		save(t, s, "carol@example.com", "Invoice 43", "Please pay too")
+
+		got, err := s.Search(ctx, SearchQuery{Text: "invoice", Mailbox: "bob@example.com"})
+		if err != nil || len(got) != 1 || got[0].ID != invoice {
+			t.Errorf("Subject search = %+v, %v; want %s", got, err, invoice)
+		}
+		got, err = s.Search(ctx, SearchQuery{Text: "NEEDLE"})
+		if err != nil || len(got) != 1 || got[0].ID != needle {
+			t.Errorf("Body search = %+v, %v; want %s", got, err, needle)
+		}
+		got, err = s.Search(ctx, SearchQuery{Text: "invoice"})
+		if err != nil || len(got) != 2 || got[0].Subject != "Invoice 43" {
+			t.Errorf("Search across mailboxes = %+v, %v", got, err)
+		}
+		got, err = s.Search(ctx, SearchQuery{Text: "invoice", Page: 2})
+		if err != nil || len(got) != 0 {
+			t.Errorf("Search second page = %+v, %v; want none", got, err)
+		}
+		if got, err := s.Search(ctx, SearchQuery{Text: "absent"}); err != nil || len(got) != 0 {
+			t.Errorf("Search for absent text = %+v, %v", got, err)
+		}
+		got, err = s.Search(ctx, SearchQuery{Text: "carol@example.com"})
+		if err != nil || len(got) != 1 || got[0].Subject != "Invoice 43" {
+			t.Errorf("Recipient search = %+v, %v", got, err)
+		}
+		got, err = s.Search(ctx, SearchQuery{Text: "alice", Mailbox: "bob@example.com"})
+		if err != nil || len(got) != 2 {
+			t.Errorf("Sender search = %+v, %v; want 2", got, err)
+		}
+	})
+
+	t.Run("SearchDates", func(t *testing.T) {
+		s := newStore(t)
+		id := save(t, s, "bob@example.com", "Today", "hello")
+		// A day either side absorbs clock and time zone differences
+		now := time.Now()
+		got, err := s.Search(ctx, SearchQuery{Mailbox: "bob@example.com", Since: now.Add(-24 * time.Hour), Until: now.Add(24 * time.Hour)})
+		if err != nil || len(got) != 1 || got[0].ID != id {
+			t.Errorf("Search within the range = %+v, %v", got, err)
+		}
+		if got, err := s.Search(ctx, SearchQuery{Text: "hello", Since: now.Add(24 * time.Hour)}); err != nil || len(got) != 0 {
+			t.Errorf("Search since tomorrow = %+v, %v; want none", got, err)
+		}
+		if got, err := s.Search(ctx, SearchQuery{Text: "hello", Until: now.Add(-24 * time.Hour)}); err != nil || len(got) != 0 {
+			t.Errorf("Search until yesterday = %+v, %v; want none", got, err)
+		}
+	})
+
+	t.Run("Attachments", func(t *testing.T) {
+		s := newStore(t)
+		content := "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: Report\r\n" +
+			"MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b1\r\n\r\n" +
+			"--b1\r\nContent-Type: text/plain\r\n\r\nSee attached\r\n" +
+			"--b1\r\nContent-Type: application/pdf; name=report.pdf\r\n" +
+			"Content-Disposition: attachment; filename=report.pdf\r\nContent-Transfer-Encoding: base64\r\n\r\n" +
+			"JVBERi0xLjQK\r\n--b1--\r\n"
+		id, err := s.Save(ctx, Email{From: "alice@example.com", To: []string{"bob@example.com"}, Content: strings.NewReader(content)})
+		if err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		email, err := s.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if len(email.Attachments) != 1 {
+			t.Fatalf("Expected one attachment, got %+v", email.Attachments)
+		}
+		pdf := "%PDF-1.4\n"
+		want := Attachment{Index: 0, Filename: "report.pdf", ContentType: "application/pdf", Size: int64(len(pdf)),
+			Disposition: "attachment", SHA256: fmt.Sprintf("%x", sha256.Sum256([]byte(pdf)))}
+		if got := email.Attachments[0]; got != want {
+			t.Errorf("Attachment = %+v, want %+v", email.Attachments[0], want)
+		}
+
+		a, r, err := s.OpenAttachment(ctx, id, 0)
+		if err != nil {
+			t.Fatalf("OpenAttachment failed: %v", err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		if string(data) != pdf || *a != want {
+			t.Errorf("OpenAttachment = %+v %q", a, data)
+		}
+		if _, _, err := s.OpenAttachment(ctx, id, 1); !errors.Is(err, ErrNotFound) {
+			t.Errorf("OpenAttachment past the last = %v, want ErrNotFound", err)
+		}
+		if _, _, err := s.OpenAttachment(ctx, "missing", 0); !errors.Is(err, ErrNotFound) {
+			t.Errorf("OpenAttachment of an unknown email = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Raw", func(t *testing.T) {
+		s := newStore(t)
+		content := "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: Raw\r\n\r\nUntouched =E2=82=AC body\r\n"
+		id, err := s.Save(ctx, Email{From: "alice@example.com", To: []string{"bob@example.com"}, Content: strings.NewReader(content)})
+		if err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		r, err := s.OpenRaw(ctx, id)
+		if err != nil {
+			t.Fatalf("OpenRaw failed: %v", err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(data) != content {
+			t.Errorf("OpenRaw = %q, %v; want %q", data, err, content)
+		}
+		if _, err := s.OpenRaw(ctx, "0190a5a1-7b3c-7000-8000-000000000000"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("OpenRaw of an unknown email = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("TruncatedStub", func(t *testing.T) {
+		s := newStore(t)
+		id, err := s.Save(ctx, Email{
+			From:    "alice@example.com",
+			To:      []string{"bob@example.com"},
+			Content: io.MultiReader(strings.NewReader("Subject: Huge\r\n\r\nAAAAAAAA"), errorReader{ErrTruncated}),
+		})
+		if err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		email, err := s.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if email.Subject != "Huge" || !strings.Contains(email.Body, oversizeNotice) || strings.Contains(email.Body, "AAAA") {
+			t.Errorf("Expected a truncated stub, got %+v", email)
+		}
+	})
+}
+
+func TestMemoryStorage_Conformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage { return &MemoryStorage{} })
+}
+
+func TestFileStorage_Conformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage { return NewFileStorage(t.TempDir()) })
+}
+
+func TestCompositeStorage_Conformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		return NewCompositeStorage(&MemoryStorage{}, NewFileStorage(t.TempDir()))
+	})
+}
+
+// pingableMemory is a MemoryStorage that is always healthy
+type pingableMemory struct {
+	MemoryStorage
+}
+
+func (*pingableMemory) Ping(context.Context) error { return nil }
+
+func TestFailoverStorage_Conformance(t *testing.T) {
+	testStorageConformance(t, func(t *testing.T) Storage {
+		fs, err := NewFailoverStorage(FailoverConfig{
+			Primary:    &pingableMemory{},
+			Fallback:   NewFileStorage(t.TempDir()),
+			BacklogDir: filepath.Join(t.TempDir(), "backlog"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	})
+}
+
+// TestPostgresStorage_Conformance runs against the database in
+// TEST_DB_URL, which it empties; it is skipped when that is not set.
+func TestPostgresStorage_Conformance(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_URL")
+	if dsn == "" {
+		t.Skip("TEST_DB_URL not set")
+	}
+	testStorageConformance(t, func(t *testing.T) Storage { return newTestPostgres(t, dsn) })
+}
+
+// TestPostgresStorage_BlobConformance keeps content in a blob store
+func TestPostgresStorage_BlobConformance(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_URL")
+	if dsn == "" {
+		t.Skip("TEST_DB_URL not set")
+	}
+	testStorageConformance(t, func(t *testing.T) Storage {
+		ps := newTestPostgres(t, dsn)
+		blobs, err := NewFSBlobStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps.SetBlobStore(blobs)
+		return ps
+	})
+}
+
+// TestPostgresStorage_BackfillSearch indexes rows stored before the
+// search_vector column, which are NULL there
+func TestPostgresStorage_BackfillSearch(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_URL")
+	if dsn == "" {
+		t.Skip("TEST_DB_URL not set")
+	}
+	ctx := context.Background()
+	ps := newTestPostgres(t, dsn)
+	for i := 0; i < 3; i++ {
+		if _, err := ps.Save(ctx, Email{From: "alice@example.com", To: []string{"bob@example.com"}, Content: strings.NewReader("Subject: Old invoice\r\n\r\nhi\r\n")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ps.db.Exec(`UPDATE email SET search_vector = NULL`); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ps.Search(ctx, SearchQuery{Text: "invoice"}); err != nil || len(got) != 0 {
+		t.Fatalf("Search before backfill = %+v, %v; want none", got, err)
+	}
+	if n, err := ps.BackfillSearch(ctx, 2); err != nil || n != 3 {
+		t.Fatalf("BackfillSearch = %d, %v; want 3", n, err)
+	}
+	if got, err := ps.Search(ctx, SearchQuery{Text: "invoice"}); err != nil || len(got) != 3 {
+		t.Errorf("Search after backfill = %+v, %v; want 3", got, err)
+	}
+	if n, err := ps.BackfillSearch(ctx, 2); err != nil || n != 0 {
+		t.Errorf("Second BackfillSearch = %d, %v; want 0", n, err)
+	}
+}
+
+// TestPostgresStorage_SavesMetadata stores the SMTP session and
+// authentication results with a message and reads them back
+func TestPostgresStorage_SavesMetadata(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_URL")
+	if dsn == "" {
+		t.Skip("TEST_DB_URL not set")
+	}
+	ctx := context.Background()
+	ps := newTestPostgres(t, dsn)
+	conn := ConnectionInfo{
+		ClientIP:   "203.0.113.7",
+		Helo:       "mx.example.com",
+		TLSVersion: "TLS 1.3",
+		TLSCipher:  "TLS_AES_128_GCM_SHA256",
+		AuthUser:   "ci@example.com",
+		ReceivedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	spf := &SPFResult{Result: "pass", Domain: "example.com", Reason: "matched ip4"}
+	dmarc := &DMARCResult{Result: "pass", Domain: "example.com", Policy: "reject", SPFAligned: true, Reason: "aligned"}
+	id, err := ps.Save(ctx, Email{
+		From:       "alice@example.com",
+		To:         []string{"bob@example.com"},
+		Content:    strings.NewReader("From: alice@example.com\r\nSubject: Quarterly invoice\r\n\r\nhello\r\n"),
+		Connection: conn,
+		SPF:        spf,
+		DMARC:      dmarc,
+	})
+	if err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	email, err := ps.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if email.Connection == nil {
+		t.Fatal("Connection metadata lost")
+	}
+	got := *email.Connection
+	if !got.ReceivedAt.Equal(conn.ReceivedAt) {
+		t.Errorf("ReceivedAt = %v, want %v", got.ReceivedAt, conn.ReceivedAt)
+	}
+	got.ReceivedAt = conn.ReceivedAt
+	if got != conn {
+		t.Errorf("Connection = %+v, want %+v", got, conn)
+	}
+	if email.SPF == nil || *email.SPF != *spf {
+		t.Errorf("SPF = %+v, want %+v", email.SPF, spf)
+	}
+	if email.DMARC == nil || *email.DMARC != *dmarc {
+		t.Errorf("DMARC = %+v, want %+v", email.DMARC, dmarc)
+	}
+	if found, err := ps.Search(ctx, SearchQuery{Text: "invoice"}); err != nil || len(found) != 1 || found[0].ID != id {
+		t.Errorf("Search = %+v, %v; want the saved email", found, err)
+	}
+}
+
+// failingAttachments is an FSBlobStore that refuses attachments
+type failingAttachments struct{ *FSBlobStore }
+
+func (f failingAttachments) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if strings.HasPrefix(key, "attachments/") {
+		return errors.New("bucket unavailable")
+	}
+	return f.FSBlobStore.Put(ctx, key, r, size)
+}
+
+// TestPostgresStorage_FailedSaveLeavesNoBlob fails the insert transaction
+// after the raw message is uploaded
+func TestPostgresStorage_FailedSaveLeavesNoBlob(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_URL")
+	if dsn == "" {
+		t.Skip("TEST_DB_URL not set")
+	}
+	ps := newTestPostgres(t, dsn)
+	dir := t.TempDir()
+	blobs, err := NewFSBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.SetBlobStore(failingAttachments{blobs})
+
+	raw := "Subject: report\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+		"--b\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=report.pdf\r\n\r\n%PDF-1.4\r\n--b--\r\n"
+	if _, err := ps.Save(context.Background(), Email{From: "alice@example.com", To: []string{"bob@example.com"}, Content: strings.NewReader(raw)}); err == nil {
+		t.Fatal("Expected the attachment upload to fail the save")
+	}
+	if _, err := blobs.Open(context.Background(), blobKey("raw", fmt.Sprintf("%x", sha256.Sum256([]byte(raw))))); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Raw message blob of the failed save left behind: %v", err)
+	}
+}
+
+// newTestPostgres connects to dsn and empties the email tables
+func newTestPostgres(t *testing.T, dsn string) *PostgresStorage {
+	ps, err := NewPostgresStorage(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ps.Close() })
+	if _, err := ps.db.Exec(`TRUNCATE email, attachment_blob CASCADE`); err != nil {
+		t.Fatal(err)
+	}
+	return ps
+}
@@ -0,0 +1,403 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// failoverCheckInterval is the default time between health checks
+	failoverCheckInterval = 10 * time.Second
+	// failoverCheckTimeout bounds one health check
+	failoverCheckTimeout = 5 * time.Second
+	// fallbackIDExt marks the file beside a backlog entry holding the ID
+	// of its fallback copy, which is deleted once the entry is replayed
+	fallbackIDExt = ".fallback"
+)
+
+// errPrimaryDown is returned when the backlog is drained while the primary
+// is unhealthy
+var errPrimaryDown = errors.New("primary storage unavailable")
+
+// HealthCheckedStorage is a Storage whose availability can be probed
+type HealthCheckedStorage interface {
+	Storage
+	Ping(ctx context.Context) error
+}
+
+// FailoverConfig configures a FailoverStorage
+type FailoverConfig struct {
+	// Primary is the preferred backend; nil when it could not be opened
+	Primary HealthCheckedStorage
+	// Connect opens the primary while it is nil; nil keeps it nil
+	Connect func() (HealthCheckedStorage, error)
+	// Fallback stores messages while the primary is unhealthy
+	Fallback Storage
+	// BacklogDir keeps replayable copies of the messages saved to
+	// Fallback, until they are replayed into the primary
+	BacklogDir    string
+	CheckInterval time.Duration // Default 10s
+}
+
+// FailoverStorage saves to a primary backend (postgres) while it is
+// healthy and to a fallback (file storage) while it is not. Messages saved
+// to the fallback are also kept in a backlog spool and replayed into the
+// primary once it recovers. Every message gets its ID before the first
+// attempt, so a message whose insert committed but then reported an error
+// is not stored twice by the replay. The backlog is retried until the
+// primary takes it, however long the outage, and the fallback copy of a
+// replayed message is deleted.
+type FailoverStorage struct {
+	cfg     FailoverConfig
+	backlog *SpoolStorage
+	wake    chan struct{}
+
+	mu      sync.Mutex
+	primary HealthCheckedStorage
+	healthy bool
+}
+
+// NewFailoverStorage creates a FailoverStorage. The primary is considered
+// healthy until a save or a health check fails.
+func NewFailoverStorage(cfg FailoverConfig) (*FailoverStorage, error) {
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = failoverCheckInterval
+	}
+	fs := &FailoverStorage{
+		cfg:     cfg,
+		wake:    make(chan struct{}, 1),
+		primary: cfg.Primary,
+		healthy: cfg.Primary != nil,
+	}
+	backlog, err := NewSpoolStorage(cfg.BacklogDir, failoverPrimary{fs})
+	if err != nil {
+		return nil, err
+	}
+	backlog.MaxAttempts = -1
+	fs.backlog = backlog
+	return fs, nil
+}
+
+// Save stores the email in the primary, or in the fallback and the backlog
+// when the primary is unhealthy or fails. It returns the primary's ID, or
+// else the fallback's.
+func (fs *FailoverStorage) Save(ctx context.Context, email Email) (string, error) {
+	if email.ID == "" {
+		email.ID = generateUUIDv7()
+	}
+	content, release, err := spoolOf(email.Content, "")
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	if primary := fs.healthyPrimary(); primary != nil {
+		replay := email
+		replay.Content = content.replay()
+		id, err := primary.Save(ctx, replay)
+		if err == nil {
+			return id, nil
+		}
+		log.Printf("Primary storage failed, saving %s to the fallback: %v", email.ID, err)
+		fs.setHealthy(false)
+	}
+
+	// The backlog copy is what gets replayed, so it must succeed
+	replay := email
+	replay.Content = content.replay()
+	if _, err := fs.backlog.Save(ctx, replay); err != nil {
+		return "", err
+	}
+	replay.Content = content.replay()
+	id, err := fs.cfg.Fallback.Save(ctx, replay)
+	if err != nil {
+		log.Printf("Fallback storage failed for %s, kept in the backlog only: %v", email.ID, err)
+		return email.ID, nil
+	}
+	if err := os.WriteFile(fs.fallbackIDPath(email.ID), []byte(id), 0600); err != nil {
+		log.Printf("Warning: failed to record the fallback copy of %s, it will be kept after the replay: %v", email.ID, err)
+	}
+	return id, nil
+}
+
+func (fs *FailoverStorage) fallbackIDPath(id string) string {
+	return filepath.Join(fs.cfg.BacklogDir, id+fallbackIDExt)
+}
+
+// copiesDeleter is implemented by fallbacks that store several copies of
+// a message under one ID, such as FileStorage with one per recipient
+type copiesDeleter interface {
+	deleteCopies(ctx context.Context, id string, to []string) error
+}
+
+// deleteFallback deletes the fallback copy of a replayed email. A copy
+// that cannot be deleted is left in place, since the email is safe in the
+// primary either way.
+func (fs *FailoverStorage) deleteFallback(ctx context.Context, email Email) {
+	path := fs.fallbackIDPath(email.ID)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read the fallback copy of %s: %v", email.ID, err)
+		}
+		return
+	}
+	if d, ok := fs.cfg.Fallback.(copiesDeleter); ok {
+		err = d.deleteCopies(ctx, string(data), email.To)
+	} else if err = fs.cfg.Fallback.Delete(ctx, string(data)); errors.Is(err, ErrNotFound) {
+		err = nil
+	}
+	if err != nil {
+		log.Printf("Warning: failed to delete the fallback copy of %s: %v", email.ID, err)
+	}
+	os.Remove(path)
+}
+
+// Run health-checks the primary every CheckInterval until ctx is
+// cancelled, and replays the backlog while it is healthy
+func (fs *FailoverStorage) Run(ctx context.Context) {
+	if err := fs.backlog.recover(); err != nil {
+		log.Printf("Failed to recover backlog entries: %v", err)
+	}
+	ticker := time.NewTicker(fs.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		wasHealthy := fs.Healthy()
+		if fs.check(ctx) {
+			fs.replay(ctx, !wasHealthy)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-fs.wake:
+		}
+	}
+}
+
+// check probes the primary, opening it first if needed, and records the
+// result
+func (fs *FailoverStorage) check(ctx context.Context) bool {
+	fs.mu.Lock()
+	primary := fs.primary
+	fs.mu.Unlock()
+
+	if primary == nil {
+		if fs.cfg.Connect == nil {
+			return false
+		}
+		var err error
+		if primary, err = fs.cfg.Connect(); err != nil {
+			fs.setHealthy(false)
+			return false
+		}
+		fs.mu.Lock()
+		fs.primary = primary
+		fs.mu.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, failoverCheckTimeout)
+	defer cancel()
+	err := primary.Ping(ctx)
+	if err != nil {
+		log.Printf("Primary storage health check failed: %v", err)
+	}
+	fs.setHealthy(err == nil)
+	return err == nil
+}
+
+// replay drains the backlog into the primary. Right after a recovery every
+// entry is tried at once; afterwards failed entries wait for their backoff.
+func (fs *FailoverStorage) replay(ctx context.Context, recovered bool) {
+	entries, err := fs.backlog.waiting()
+	if err != nil || len(entries) == 0 {
+		return
+	}
+	log.Printf("Replaying %d backlogged messages into primary storage", len(entries))
+	n, err := fs.backlog.drain(ctx, recovered)
+	if err != nil {
+		log.Printf("Backlog replay stopped after %d messages: %v", n, err)
+	}
+}
+
+// Healthy reports whether saves currently go to the primary
+func (fs *FailoverStorage) Healthy() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.healthy
+}
+
+// Primary returns the primary backend, or nil when it was never opened
+func (fs *FailoverStorage) Primary() HealthCheckedStorage {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.primary
+}
+
+// Backlog returns the messages waiting to be replayed into the primary
+func (fs *FailoverStorage) Backlog() ([]SpoolEntry, error) {
+	return fs.backlog.Entries()
+}
+
+func (fs *FailoverStorage) healthyPrimary() HealthCheckedStorage {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fs.healthy {
+		return nil
+	}
+	return fs.primary
+}
+
+func (fs *FailoverStorage) setHealthy(healthy bool) {
+	fs.mu.Lock()
+	changed := fs.healthy != healthy
+	fs.healthy = healthy
+	fs.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if healthy {
+		log.Printf("Primary storage is healthy again, saving to it")
+		return
+	}
+	log.Printf("Primary storage is unhealthy, saving to the fallback")
+	// Check again soon rather than a full interval later
+	select {
+	case fs.wake <- struct{}{}:
+	default:
+	}
+}
+
+// readers returns the backends to read from: the primary while it is
+// healthy, then the fallback
+func (fs *FailoverStorage) readers() []Storage {
+	if primary := fs.healthyPrimary(); primary != nil {
+		return []Storage{primary, fs.cfg.Fallback}
+	}
+	return []Storage{fs.cfg.Fallback}
+}
+
+// List returns one page of mailbox from the primary while it is healthy,
+// else from the fallback
+func (fs *FailoverStorage) List(ctx context.Context, mailbox string, page int) ([]EmailSummary, error) {
+	return fs.readers()[0].List(ctx, mailbox, page)
+}
+
+// Count counts mailbox in the primary while it is healthy, else in the
+// fallback
+func (fs *FailoverStorage) Count(ctx context.Context, mailbox string) (int, error) {
+	return fs.readers()[0].Count(ctx, mailbox)
+}
+
+// Search searches the primary while it is healthy, else the fallback
+func (fs *FailoverStorage) Search(ctx context.Context, query SearchQuery) ([]EmailSummary, error) {
+	return fs.readers()[0].Search(ctx, query)
+}
+
+// Get returns the email from the primary while it is healthy, and from the
+// fallback when the primary does not have it or is down
+func (fs *FailoverStorage) Get(ctx context.Context, id string) (*EmailDetail, error) {
+	var err error
+	for _, s := range fs.readers() {
+		var email *EmailDetail
+		if email, err = s.Get(ctx, id); err == nil || !errors.Is(err, ErrNotFound) {
+			return email, err
+		}
+	}
+	return nil, err
+}
+
+// OpenAttachment opens the attachment from the primary while it is
+// healthy, and from the fallback when the primary does not have it or is
+// down
+func (fs *FailoverStorage) OpenAttachment(ctx context.Context, id string, n int) (*Attachment, io.ReadCloser, error) {
+	var err error
+	for _, s := range fs.readers() {
+		var a *Attachment
+		var r io.ReadCloser
+		if a, r, err = s.OpenAttachment(ctx, id, n); err == nil || !errors.Is(err, ErrNotFound) {
+			return a, r, err
+		}
+	}
+	return nil, nil, err
+}
+
+// OpenRaw opens the raw message from the primary while it is healthy, and
+// from the fallback when the primary does not have it or is down
+func (fs *FailoverStorage) OpenRaw(ctx context.Context, id string) (io.ReadCloser, error) {
+	var err error
+	for _, s := range fs.readers() {
+		var r io.ReadCloser
+		if r, err = s.OpenRaw(ctx, id); err == nil || !errors.Is(err, ErrNotFound) {
+			return r, err
+		}
+	}
+	return nil, err
+}
+
+// Expire expires the emails of the primary, if it is healthy, and of the
+// fallback
+func (fs *FailoverStorage) Expire(ctx context.Context, policy RetentionPolicy, opts ExpireOptions) (ExpireResult, error) {
+	return expireAll(ctx, fs.readers(), policy, opts)
+}
+
+// Delete removes the email from the primary, if it is healthy, and from
+// the fallback. It returns ErrNotFound when neither had it.
+func (fs *FailoverStorage) Delete(ctx context.Context, id string) error {
+	deleted := false
+	for _, s := range fs.readers() {
+		err := s.Delete(ctx, id)
+		if err == nil {
+			deleted = true
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	if !deleted {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Close closes the primary and the fallback
+func (fs *FailoverStorage) Close() error {
+	var firstErr error
+	if primary := fs.Primary(); primary != nil {
+		firstErr = primary.Close()
+	}
+	if err := fs.cfg.Fallback.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// failoverPrimary is the backlog's destination: the primary, as long as it
+// is healthy. A failed replay does not mark the primary unhealthy, since
+// one bad message would otherwise flap the health state; the entry is
+// retried with backoff and the health check decides. Reads are those of
+// the FailoverStorage, which owns the backends, so Close does nothing.
+type failoverPrimary struct {
+	*FailoverStorage
+}
+
+func (p failoverPrimary) Save(ctx context.Context, email Email) (string, error) {
+	primary := p.healthyPrimary()
+	if primary == nil {
+		return "", errPrimaryDown
+	}
+	id, err := primary.Save(ctx, email)
+	if err != nil {
+		return "", err
+	}
+	p.deleteFallback(ctx, email)
+	return id, nil
+}
+
+func (p failoverPrimary) Close() error { return nil }
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePrimary stores messages by ID, like postgres, and can be taken down
+type fakePrimary struct {
+	MemoryStorage
+	mu      sync.Mutex
+	down    bool
+	lostAck bool // Store the message but report a failure
+	emails  map[string]string
+	inserts int
+}
+
+func newFakePrimary() *fakePrimary {
+	return &fakePrimary{emails: make(map[string]string)}
+}
+
+func (p *fakePrimary) Save(ctx context.Context, email Email) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down {
+		return "", errors.New("connection refused")
+	}
+	data, err := io.ReadAll(email.Content)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := p.emails[email.ID]; !ok {
+		p.emails[email.ID] = string(data)
+		p.inserts++
+	}
+	if p.lostAck {
+		return "", errors.New("connection reset")
+	}
+	return email.ID, nil
+}
+
+func (p *fakePrimary) Ping(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (p *fakePrimary) set(down, lostAck bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down, p.lostAck = down, lostAck
+}
+
+func newTestFailover(t *testing.T, primary HealthCheckedStorage) (*FailoverStorage, *FileStorage) {
+	t.Helper()
+	files := NewFileStorage(t.TempDir())
+	fs, err := NewFailoverStorage(FailoverConfig{
+		Primary:    primary,
+		Fallback:   files,
+		BacklogDir: filepath.Join(t.TempDir(), "backlog"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, files
+}
+
+func testEmail(body string) Email {
+	return Email{From: "alice@example.com", To: []string{"bob@example.com"}, Content: strings.NewReader(body)}
+}
+
+func fallbackFiles(t *testing.T, files *FileStorage) []string {
+	t.Helper()
+	matches, _ := filepath.Glob(files.Dir + "/bob@example.com/alice@example.com/*.txt")
+	return matches
+}
+
+func TestFailoverStorage_FailsOverAndReplays(t *testing.T) {
+	primary := newFakePrimary()
+	fs, files := newTestFailover(t, primary)
+	ctx := context.Background()
+
+	if _, err := fs.Save(context.Background(), testEmail("one")); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.set(true, false)
+	if _, err := fs.Save(context.Background(), testEmail("two")); err != nil {
+		t.Fatalf("Save during the outage failed: %v", err)
+	}
+	if fs.Healthy() {
+		t.Fatal("Primary still considered healthy after a failed save")
+	}
+	fs.Save(context.Background(), testEmail("three"))
+	if len(fallbackFiles(t, files)) != 2 {
+		t.Errorf("Expected 2 messages in the fallback, got %v", fallbackFiles(t, files))
+	}
+	if fs.check(ctx) {
+		t.Fatal("Health check passed while the primary is down")
+	}
+
+	primary.set(false, false)
+	if !fs.check(ctx) {
+		t.Fatal("Health check failed after the primary recovered")
+	}
+	fs.replay(ctx, true)
+
+	if primary.inserts != 3 {
+		t.Errorf("Expected 3 messages in the primary, got %d", primary.inserts)
+	}
+	if backlog, _ := fs.Backlog(); len(backlog) != 0 {
+		t.Errorf("Backlog not drained: %+v", backlog)
+	}
+	if copies := fallbackFiles(t, files); len(copies) != 0 {
+		t.Errorf("Fallback copies left after the replay: %v", copies)
+	}
+	if _, err := fs.Save(context.Background(), testEmail("four")); err != nil || primary.inserts != 4 {
+		t.Errorf("Save after recovery: %v, %d inserts", err, primary.inserts)
+	}
+}
+
+func TestFailoverStorage_ReplayDoesNotDuplicate(t *testing.T) {
+	primary := newFakePrimary()
+	fs, _ := newTestFailover(t, primary)
+	ctx := context.Background()
+
+	// The insert commits but the client sees an error
+	primary.set(false, true)
+	fs.Save(context.Background(), testEmail("once"))
+	if backlog, _ := fs.Backlog(); len(backlog) != 1 {
+		t.Fatalf("Expected the message in the backlog, got %+v", backlog)
+	}
+
+	primary.set(false, false)
+	fs.check(ctx)
+	fs.replay(ctx, true)
+	if primary.inserts != 1 || len(primary.emails) != 1 {
+		t.Errorf("Message stored %d times, want once", primary.inserts)
+	}
+	if backlog, _ := fs.Backlog(); len(backlog) != 0 {
+		t.Errorf("Backlog not drained: %+v", backlog)
+	}
+}
+
+func TestFailoverStorage_ConnectsLater(t *testing.T) {
+	primary := newFakePrimary()
+	connected := false
+	files := NewFileStorage(t.TempDir())
+	fs, err := NewFailoverStorage(FailoverConfig{
+		Connect: func() (HealthCheckedStorage, error) {
+			if !connected {
+				return nil, errors.New("no route to host")
+			}
+			return primary, nil
+		},
+		Fallback:   files,
+		BacklogDir: filepath.Join(t.TempDir(), "backlog"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	fs.Save(context.Background(), testEmail("early"))
+	if fs.check(ctx) || fs.Primary() != nil {
+		t.Fatal("Primary available before it could connect")
+	}
+
+	connected = true
+	if !fs.check(ctx) {
+		t.Fatal("Health check failed once the primary was reachable")
+	}
+	fs.replay(ctx, true)
+	if primary.inserts != 1 || len(fallbackFiles(t, files)) != 0 {
+		t.Errorf("Expected the early message moved to the primary, got %d inserts and %v", primary.inserts, fallbackFiles(t, files))
+	}
+}
+
+func TestFailoverStorage_ReplayDeletesEveryFallbackCopy(t *testing.T) {
+	primary := newFakePrimary()
+	fs, files := newTestFailover(t, primary)
+	ctx := context.Background()
+
+	primary.set(true, false)
+	email := testEmail("two recipients")
+	email.To = []string{"bob@example.com", "carol@example.com"}
+	if _, err := fs.Save(ctx, email); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := files.Count(ctx, "carol@example.com"); n != 1 || len(fallbackFiles(t, files)) != 1 {
+		t.Fatalf("Expected a fallback copy per recipient")
+	}
+
+	primary.set(false, false)
+	fs.check(ctx)
+	fs.replay(ctx, true)
+	if primary.inserts != 1 {
+		t.Fatalf("Expected the message in the primary, got %d inserts", primary.inserts)
+	}
+	for _, mailbox := range email.To {
+		if n, _ := files.Count(ctx, mailbox); n != 0 {
+			t.Errorf("Fallback copy for %s left after the replay", mailbox)
+		}
+	}
+	if leftover, _ := filepath.Glob(filepath.Join(fs.cfg.BacklogDir, "*"+fallbackIDExt)); len(leftover) != 0 {
+		t.Errorf("Fallback IDs left after the replay: %v", leftover)
+	}
+}
+
+func TestFailoverStorage_BacklogOutlastsMaxAttempts(t *testing.T) {
+	primary := newFakePrimary()
+	fs, _ := newTestFailover(t, primary)
+	ctx := context.Background()
+
+	primary.set(true, false)
+	fs.Save(ctx, testEmail("long outage"))
+	// The primary passes health checks but every replay fails
+	fs.setHealthy(true)
+	for i := 0; i < DefaultSpoolMaxAttempts+1; i++ {
+		fs.backlog.drain(ctx, true)
+	}
+	if failed, _ := fs.backlog.Failed(); len(failed) != 0 {
+		t.Fatalf("Backlog entry given up on: %+v", failed)
+	}
+
+	primary.set(false, false)
+	fs.replay(ctx, true)
+	if primary.inserts != 1 {
+		t.Errorf("Expected the message replayed after the outage, got %d inserts", primary.inserts)
+	}
+}
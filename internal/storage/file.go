@@ -1,12 +1,28 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/mail"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/jhillyerd/enmime"
 )
 
+// nullSenderDir stands in for the empty sender of bounces (MAIL FROM:<>)
+// in paths, which cannot have an empty directory name
+const nullSenderDir = "MAILER-DAEMON"
+
 type FileStorage struct {
 	Dir string
 }
@@ -16,22 +32,431 @@ func NewFileStorage(dir string) *FileStorage {
 	return &FileStorage{Dir: dir}
 }
 
-func (fs *FileStorage) Save(email Email) (string, error) {
+// Save writes one copy of the email per recipient, under <dir>/<to>/<from>/,
+// with nullSenderDir as <from> for bounces.
+// The content is spooled to disk as it is read, unless an outer layer did,
+// then copied per recipient.
+// Each copy's ID is its path relative to the directory, with forward
+// slashes; Save returns the ID of the first copy.
+func (fs *FileStorage) Save(ctx context.Context, email Email) (string, error) {
+	if len(email.To) == 0 {
+		return "", fmt.Errorf("email has no recipients")
+	}
+	content, release, err := spoolOf(email.Content, fs.Dir)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	from := email.From
+	if from == "" {
+		from = nullSenderDir
+	}
 	now := time.Now()
 	filename := fmt.Sprintf("%s.%09d.txt", now.Format("2006-01-02-15-04-05"), now.Nanosecond())
-	dirPath := filepath.Join(fs.Dir, email.To, email.From)
+
+	var first string
+	for _, to := range email.To {
+		if err := ctx.Err(); err != nil {
+			return first, err
+		}
+		if err := fs.saveCopy(from, to, filename, content.raw()); err != nil {
+			return first, err
+		}
+		if first == "" {
+			first = to + "/" + from + "/" + filename
+		}
+	}
+	return first, nil
+}
+
+func (fs *FileStorage) saveCopy(from, to, filename string, content io.Reader) error {
+	dirPath := filepath.Join(fs.Dir, to, from)
 	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		return "", err
+		return err
 	}
-	path := filepath.Join(dirPath, filename)
-	f, err := os.Create(path)
+	f, err := os.Create(filepath.Join(dirPath, filename))
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer f.Close()
-	content := fmt.Sprintf("From: %s\nTo: %s\n\n%s", email.From, email.To, email.Content)
-	if _, err := f.WriteString(content); err != nil {
-		return "", err
+	if _, err := fmt.Fprintf(f, "From: %s\nTo: %s\n\n", from, to); err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, content); err != nil {
+		return err
+	}
+	return nil
+}
+
+// fileEntry is one stored copy found by scan
+type fileEntry struct {
+	id      string
+	path    string
+	modTime time.Time
+}
+
+// scan returns the stored copies of mailbox, or of every mailbox when it
+// is empty, newest first. Mailbox directories match case-insensitively;
+// directories starting with a dot (spools, backlogs) are skipped.
+func (fs *FileStorage) scan(ctx context.Context, mailbox string) ([]fileEntry, error) {
+	mailboxes, err := os.ReadDir(fs.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fileEntry
+	for _, m := range mailboxes {
+		if !m.IsDir() || strings.HasPrefix(m.Name(), ".") {
+			continue
+		}
+		if mailbox != "" && !strings.EqualFold(m.Name(), strings.TrimSpace(mailbox)) {
+			continue
+		}
+		root := filepath.Join(fs.Dir, m.Name())
+		err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if d.IsDir() || !strings.HasSuffix(d.Name(), ".txt") {
+				return nil
+			}
+			rel, err := filepath.Rel(fs.Dir, path)
+			if err != nil {
+				return err
+			}
+			if strings.Count(filepath.ToSlash(rel), "/") != 2 {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			entries = append(entries, fileEntry{id: filepath.ToSlash(rel), path: path, modTime: info.ModTime()})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Filenames start with the time of the save, so newest first is
+	// descending filename order
+	sort.Slice(entries, func(i, j int) bool {
+		bi, bj := filepath.Base(entries[i].path), filepath.Base(entries[j].path)
+		if bi != bj {
+			return bi > bj
+		}
+		return entries[i].id > entries[j].id
+	})
+	return entries, nil
+}
+
+// List returns one page of the copies stored for mailbox
+func (fs *FileStorage) List(ctx context.Context, mailbox string, page int) ([]EmailSummary, error) {
+	entries, err := fs.scan(ctx, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	emails := make([]EmailSummary, 0)
+	for _, e := range pageOf(entries, page) {
+		summary, err := readFileSummary(e)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, summary)
+	}
+	return emails, nil
+}
+
+// Count returns the number of copies stored for mailbox
+func (fs *FileStorage) Count(ctx context.Context, mailbox string) (int, error) {
+	entries, err := fs.scan(ctx, mailbox)
+	return len(entries), err
+}
+
+// Get parses a stored copy
+func (fs *FileStorage) Get(ctx context.Context, id string) (*EmailDetail, error) {
+	email, env, err := fs.read(id)
+	if err != nil {
+		return nil, err
+	}
+	if env == nil {
+		email.Body = "<pre>Email parsing failed</pre>"
+		return email, nil
+	}
+	if h := env.GetHeader("From"); h != "" {
+		email.From = h
+	}
+	if h := env.GetHeader("To"); h != "" {
+		email.To = h
+	}
+	email.Subject = env.GetHeader("Subject")
+	email.Date = env.GetHeader("Date")
+	email.Body = emailToHTML(env)
+	email.Attachments = attachmentsOf(extractAttachments(env))
+	return email, nil
+}
+
+// OpenAttachment parses a stored copy and returns its attachment n
+func (fs *FileStorage) OpenAttachment(ctx context.Context, id string, n int) (*Attachment, io.ReadCloser, error) {
+	_, env, err := fs.read(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if env == nil {
+		return nil, nil, ErrNotFound
+	}
+	return openPart(extractAttachments(env), n)
+}
+
+// OpenRaw opens a stored copy past the envelope lines saveCopy wrote
+func (fs *FileStorage) OpenRaw(ctx context.Context, id string) (io.ReadCloser, error) {
+	path, err := fs.pathFor(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	if _, _, err := readFileEnvelope(br); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, f}, nil
+}
+
+// read opens a stored copy and parses it. The envelope is nil when the
+// message cannot be parsed.
+func (fs *FileStorage) read(id string) (*EmailDetail, *enmime.Envelope, error) {
+	path, err := fs.pathFor(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, ErrNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(f)
+	from, to, err := readFileEnvelope(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	email := &EmailDetail{ID: id, From: from, To: to, CreatedAt: info.ModTime()}
+	env, err := enmime.ReadEnvelope(br)
+	if err != nil {
+		log.Printf("Failed to parse email %s: %v", id, err)
+		return email, nil, nil
+	}
+	return email, env, nil
+}
+
+// Delete removes a stored copy, and its sender and mailbox directories
+// once they are empty
+func (fs *FileStorage) Delete(ctx context.Context, id string) error {
+	path, err := fs.pathFor(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	senderDir := filepath.Dir(path)
+	if os.Remove(senderDir) == nil {
+		os.Remove(filepath.Dir(senderDir))
+	}
+	return nil
+}
+
+// deleteCopies removes every copy of the email Save stored as id, one per
+// recipient in to; copies already gone are skipped
+func (fs *FileStorage) deleteCopies(ctx context.Context, id string, to []string) error {
+	parts := strings.SplitN(id, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid file storage ID %q", id)
+	}
+	for _, rcpt := range to {
+		if err := fs.Delete(ctx, rcpt+"/"+parts[1]); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search scans the stored copies, newest first, for the query text in the
+// raw file or the decoded subject. Every copy in the date range is read,
+// so this is a fallback for small stores rather than an index.
+func (fs *FileStorage) Search(ctx context.Context, query SearchQuery) ([]EmailSummary, error) {
+	entries, err := fs.scan(ctx, query.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.ToLower(query.Text)
+	skip := pageOffset(query.Page)
+	emails := make([]EmailSummary, 0)
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !query.inRange(e.modTime) {
+			continue
+		}
+		data, err := os.ReadFile(e.path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Deleted since the scan
+		} else if err != nil {
+			return nil, err
+		}
+		summary := parseFileSummary(e, bufio.NewReader(bytes.NewReader(data)))
+		if !bytes.Contains(bytes.ToLower(data), []byte(text)) &&
+			!strings.Contains(strings.ToLower(summary.Subject), text) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		emails = append(emails, summary)
+		if len(emails) == PageSize {
+			break
+		}
+	}
+	return emails, nil
+}
+
+// Expire deletes the stored copies older than the TTL of their mailbox.
+// Each copy is deleted on its own, so opts.Batch does not apply.
+func (fs *FileStorage) Expire(ctx context.Context, policy RetentionPolicy, opts ExpireOptions) (ExpireResult, error) {
+	var result ExpireResult
+	if !policy.Enabled() {
+		return result, nil
+	}
+	entries, err := fs.scan(ctx, "")
+	if err != nil {
+		return result, err
+	}
+	now := opts.now()
+	for _, e := range entries {
+		mailbox, _, _ := strings.Cut(e.id, "/")
+		ttl, rule := policy.ttlFor(mailbox)
+		if ttl == 0 || e.modTime.Add(ttl).After(now) {
+			continue
+		}
+		if !opts.DryRun {
+			if err := fs.Delete(ctx, e.id); errors.Is(err, ErrNotFound) {
+				continue
+			} else if err != nil {
+				return result, err
+			}
+		}
+		result.add(rule, 1)
+	}
+	return result, nil
+}
+
+// Close does nothing; files are closed after every operation
+func (fs *FileStorage) Close() error {
+	return nil
+}
+
+// pathFor returns the file of an ID, which must be exactly
+// <to>/<from>/<file>.txt so IDs cannot reach outside the directory
+func (fs *FileStorage) pathFor(id string) (string, error) {
+	parts := strings.Split(id, "/")
+	if len(parts) != 3 || !strings.HasSuffix(parts[2], ".txt") {
+		return "", ErrNotFound
+	}
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." || strings.ContainsAny(p, `\:`) || strings.HasPrefix(p, ".") {
+			return "", ErrNotFound
+		}
+	}
+	return filepath.Join(fs.Dir, parts[0], parts[1], parts[2]), nil
+}
+
+// pageOf returns the items of a 1-based page
+func pageOf[T any](items []T, page int) []T {
+	start := pageOffset(page)
+	if start >= len(items) {
+		return nil
+	}
+	return items[start:min(start+PageSize, len(items))]
+}
+
+// readFileSummary reads the envelope and message headers of a copy
+func readFileSummary(e fileEntry) (EmailSummary, error) {
+	f, err := os.Open(e.path)
+	if err != nil {
+		return EmailSummary{}, err
+	}
+	defer f.Close()
+	return parseFileSummary(e, bufio.NewReader(io.LimitReader(f, maxFileHeaderSize))), nil
+}
+
+// maxFileHeaderSize bounds how much of a copy is read for its summary
+const maxFileHeaderSize = 64 << 10
+
+// parseFileSummary builds a summary from the start of a copy
+func parseFileSummary(e fileEntry, br *bufio.Reader) EmailSummary {
+	summary := EmailSummary{ID: e.id, CreatedAt: e.modTime}
+	summary.From, summary.To, _ = readFileEnvelope(br)
+	headers, err := readHeaderSection(br)
+	if err != nil {
+		return summary
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(headers))
+	if err != nil {
+		return summary
+	}
+	if h := msg.Header.Get("From"); h != "" {
+		summary.From = h
+	}
+	if h := msg.Header.Get("To"); h != "" {
+		summary.To = h
+	}
+	summary.Subject = msg.Header.Get("Subject")
+	if subject, err := new(mime.WordDecoder).DecodeHeader(summary.Subject); err == nil {
+		summary.Subject = subject
+	}
+	summary.Date = msg.Header.Get("Date")
+	return summary
+}
+
+// readFileEnvelope reads the "From:" and "To:" lines and the blank line
+// that saveCopy writes before the message
+func readFileEnvelope(br *bufio.Reader) (from, to string, err error) {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return from, to, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "From: "):
+			from = strings.TrimPrefix(line, "From: ")
+		case strings.HasPrefix(line, "To: "):
+			to = strings.TrimPrefix(line, "To: ")
+		}
+		if line == "" || err == io.EOF {
+			return from, to, nil
+		}
 	}
-	return path, nil
 }
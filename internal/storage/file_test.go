@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"context"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -11,20 +14,21 @@ func TestFileStorage_Save(t *testing.T) {
 	fs := NewFileStorage(dir)
 	email := Email{
 		From:    "alice@example.com",
-		To:      "bob@example.com",
-		Content: "Hello, Bob!",
+		To:      []string{"bob@example.com"},
+		Content: strings.NewReader("Hello, Bob!"),
 	}
-	filename, err := fs.Save(email)
+	id, err := fs.Save(context.Background(), email)
 	if err != nil {
 		t.Fatalf("Save failed: %v", err)
 	}
-	// Check path format: should be <dir>/<to>/<from>/YYYY-MM-DD-HH-MM-SS.<nano>.txt
-	expectedDir := dir + string(os.PathSeparator) + email.To + string(os.PathSeparator) + email.From
-	if !strings.HasPrefix(filename, expectedDir) {
-		t.Errorf("File not saved in correct directory. Got: %s, Want prefix: %s", filename, expectedDir)
+	// Check ID format: should be <to>/<from>/YYYY-MM-DD-HH-MM-SS.<nano>.txt
+	expectedDir := email.To[0] + "/" + email.From + "/"
+	if !strings.HasPrefix(id, expectedDir) {
+		t.Errorf("File not saved in correct directory. Got: %s, Want prefix: %s", id, expectedDir)
 	}
+	filename := filepath.Join(dir, filepath.FromSlash(id))
 	// Check filename format
-	parts := strings.Split(filename, string(os.PathSeparator))
+	parts := strings.Split(id, "/")
 	filePart := parts[len(parts)-1]
 	if !strings.HasSuffix(filePart, ".txt") || len(strings.Split(filePart, ".")) < 3 {
 		t.Errorf("Filename format incorrect: %s", filePart)
@@ -39,3 +43,79 @@ func TestFileStorage_Save(t *testing.T) {
 		t.Errorf("Saved file content incorrect: %s", content)
 	}
 }
+
+func TestFileStorage_SaveMultipleRecipients(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewFileStorage(dir)
+	email := Email{
+		From:    "alice@example.com",
+		To:      []string{"bob@example.com", "carol@example.com"},
+		Content: strings.NewReader("Hello, everyone!"),
+	}
+	if _, err := fs.Save(context.Background(), email); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	for _, rcpt := range email.To {
+		paths, _ := filepath.Glob(filepath.Join(dir, rcpt, email.From, "*.txt"))
+		if len(paths) != 1 {
+			t.Fatalf("Expected one copy for %s, got %v", rcpt, paths)
+		}
+		data, err := os.ReadFile(paths[0])
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if !strings.Contains(string(data), "To: "+rcpt) || !strings.Contains(string(data), "Hello, everyone!") {
+			t.Errorf("Copy for %s has wrong content: %s", rcpt, data)
+		}
+	}
+}
+
+func TestFileStorage_SaveNoRecipients(t *testing.T) {
+	fs := NewFileStorage(t.TempDir())
+	if _, err := fs.Save(context.Background(), Email{From: "alice@example.com", Content: strings.NewReader("x")}); err == nil {
+		t.Error("Save should fail when there are no recipients")
+	}
+}
+
+func TestFileStorage_SaveTruncatedStub(t *testing.T) {
+	fs := NewFileStorage(t.TempDir())
+	email := Email{
+		From:    "alice@example.com",
+		To:      []string{"bob@example.com"},
+		Content: io.MultiReader(strings.NewReader("Subject: Huge\r\n\r\nAAAAAAAAAAAAAAAA"), errorReader{ErrTruncated}),
+	}
+	id, err := fs.Save(context.Background(), email)
+	if err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(fs.Dir, filepath.FromSlash(id)))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	content := string(data)
+	if !strings.Contains(content, "Subject: Huge") || !strings.Contains(content, oversizeNotice) {
+		t.Errorf("Stub should keep headers and the notice: %s", content)
+	}
+	if strings.Contains(content, "AAAA") {
+		t.Errorf("Stub should drop the partial body: %s", content)
+	}
+}
+
+func TestFileStorage_SaveLeavesNoSpool(t *testing.T) {
+	dir := t.TempDir()
+	fs := NewFileStorage(dir)
+	email := Email{
+		From:    "alice@example.com",
+		To:      []string{"bob@example.com"},
+		Content: strings.NewReader("Hello"),
+	}
+	if _, err := fs.Save(context.Background(), email); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".spool-") {
+			t.Errorf("Spool file left behind: %s", e.Name())
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// GreylistEntry is the state of one greylisting triplet
+type GreylistEntry struct {
+	FirstSeen time.Time // First delivery attempt of the current cycle
+	LastSeen  time.Time // Latest delivery attempt
+	Passed    bool      // A retry succeeded; later attempts are accepted
+}
+
+// GreylistStore persists greylisting triplets. Keys are opaque strings
+// built by the caller.
+type GreylistStore interface {
+	// Get returns the entry for key, or nil if there is none
+	Get(ctx context.Context, key string) (*GreylistEntry, error)
+	Put(ctx context.Context, key string, entry GreylistEntry) error
+	// Expire deletes entries last seen before the given time
+	Expire(ctx context.Context, before time.Time) (int64, error)
+}
+
+// MemoryGreylist keeps greylisting state in memory. State is lost on
+// restart, which only means senders are greylisted once more.
+type MemoryGreylist struct {
+	mu      sync.Mutex
+	entries map[string]GreylistEntry
+}
+
+func NewMemoryGreylist() *MemoryGreylist {
+	return &MemoryGreylist{entries: make(map[string]GreylistEntry)}
+}
+
+func (m *MemoryGreylist) Get(ctx context.Context, key string) (*GreylistEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
+func (m *MemoryGreylist) Put(ctx context.Context, key string, entry GreylistEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = entry
+	return nil
+}
+
+func (m *MemoryGreylist) Expire(ctx context.Context, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for key, entry := range m.entries {
+		if entry.LastSeen.Before(before) {
+			delete(m.entries, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// postgresGreylist keeps greylisting state in the greylist table, so it is
+// shared by every instance using the database and survives restarts
+type postgresGreylist struct {
+	db *sql.DB
+}
+
+// Greylist returns a GreylistStore backed by the same database
+func (ps *PostgresStorage) Greylist() GreylistStore {
+	return &postgresGreylist{db: ps.db}
+}
+
+func (pg *postgresGreylist) Get(ctx context.Context, key string) (*GreylistEntry, error) {
+	var entry GreylistEntry
+	err := pg.db.QueryRowContext(ctx,
+		`SELECT first_seen, last_seen, passed FROM greylist WHERE key = $1`, key,
+	).Scan(&entry.FirstSeen, &entry.LastSeen, &entry.Passed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (pg *postgresGreylist) Put(ctx context.Context, key string, entry GreylistEntry) error {
+	_, err := pg.db.ExecContext(ctx, `
+		INSERT INTO greylist (key, first_seen, last_seen, passed)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (key) DO UPDATE
+		SET first_seen = EXCLUDED.first_seen, last_seen = EXCLUDED.last_seen, passed = EXCLUDED.passed`,
+		key, entry.FirstSeen.UTC(), entry.LastSeen.UTC(), entry.Passed,
+	)
+	return err
+}
+
+func (pg *postgresGreylist) Expire(ctx context.Context, before time.Time) (int64, error) {
+	res, err := pg.db.ExecContext(ctx, `DELETE FROM greylist WHERE last_seen < $1`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
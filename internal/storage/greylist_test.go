@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryGreylist(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryGreylist()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if entry, err := m.Get(ctx, "k1"); entry != nil || err != nil {
+		t.Fatalf("Expected no entry, got %+v, %v", entry, err)
+	}
+	m.Put(ctx, "k1", GreylistEntry{FirstSeen: start, LastSeen: start})
+	m.Put(ctx, "k2", GreylistEntry{FirstSeen: start, LastSeen: start.Add(time.Hour), Passed: true})
+
+	entry, err := m.Get(ctx, "k2")
+	if err != nil || entry == nil || !entry.Passed || !entry.LastSeen.Equal(start.Add(time.Hour)) {
+		t.Fatalf("Unexpected entry: %+v, %v", entry, err)
+	}
+
+	n, err := m.Expire(ctx, start.Add(time.Minute))
+	if err != nil || n != 1 {
+		t.Fatalf("Expire removed %d entries, %v; want 1", n, err)
+	}
+	if entry, _ := m.Get(ctx, "k1"); entry != nil {
+		t.Error("Expired entry still present")
+	}
+	if entry, _ := m.Get(ctx, "k2"); entry == nil {
+		t.Error("Recent entry was expired")
+	}
+}
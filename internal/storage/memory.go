@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// MemoryStorage keeps emails in memory. It is meant for tests and local
+// development; the zero value is an empty store.
+type MemoryStorage struct {
+	mu     sync.Mutex
+	emails []memoryEmail // In save order
+}
+
+type memoryEmail struct {
+	detail    EmailDetail
+	mailboxes []string // Normalized envelope recipients
+	raw       string
+	parts     []attachmentPart
+}
+
+// Save parses and stores the email. An email whose ID is already stored
+// is not stored again.
+func (ms *MemoryStorage) Save(ctx context.Context, email Email) (string, error) {
+	data, err := io.ReadAll(email.Content)
+	raw := string(data)
+	if errors.Is(err, ErrTruncated) {
+		header, err := readHeaderSection(strings.NewReader(raw))
+		if err != nil {
+			return "", err
+		}
+		raw = header + oversizeNotice + "\r\n"
+	} else if err != nil {
+		return "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	id := emailIDFor(email)
+	var parts []attachmentPart
+	detail := EmailDetail{ID: id, CreatedAt: time.Now().UTC(), DKIM: email.DKIM, DNSBL: email.DNSBL, SPF: email.SPF, DMARC: email.DMARC}
+	if !email.Connection.ReceivedAt.IsZero() || email.Connection.ClientIP != "" {
+		conn := email.Connection
+		detail.Connection = &conn
+	}
+	if env, err := enmime.ReadEnvelope(strings.NewReader(raw)); err == nil {
+		detail.From = env.GetHeader("From")
+		detail.To = env.GetHeader("To")
+		detail.Subject = env.GetHeader("Subject")
+		detail.Date = env.GetHeader("Date")
+		detail.Body = emailToHTML(env)
+		parts = extractAttachments(env)
+		detail.Attachments = attachmentsOf(parts)
+	} else {
+		log.Printf("Warning: enmime parse error: %v, storing raw content", err)
+		detail.Body = "Email parsing failed"
+	}
+	if detail.From == "" {
+		detail.From = email.From
+	}
+	if detail.To == "" {
+		detail.To = strings.Join(email.To, ", ")
+	}
+	mailboxes := make([]string, len(email.To))
+	for i, to := range email.To {
+		mailboxes[i] = normalizeAddress(to)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, e := range ms.emails {
+		if e.detail.ID == id {
+			return id, nil
+		}
+	}
+	ms.emails = append(ms.emails, memoryEmail{detail: detail, mailboxes: mailboxes, raw: raw, parts: parts})
+	return id, nil
+}
+
+// List returns one page of the emails delivered to mailbox
+func (ms *MemoryStorage) List(ctx context.Context, mailbox string, page int) ([]EmailSummary, error) {
+	return ms.Search(ctx, SearchQuery{Mailbox: mailbox, Page: page})
+}
+
+// Count returns the number of emails delivered to mailbox
+func (ms *MemoryStorage) Count(ctx context.Context, mailbox string) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	n := 0
+	for _, e := range ms.emails {
+		if e.delivered(mailbox) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Get returns a copy of a stored email
+func (ms *MemoryStorage) Get(ctx context.Context, id string) (*EmailDetail, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, e := range ms.emails {
+		if e.detail.ID == id {
+			detail := e.detail
+			return &detail, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// OpenAttachment returns attachment n of a stored email
+func (ms *MemoryStorage) OpenAttachment(ctx context.Context, id string, n int) (*Attachment, io.ReadCloser, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, e := range ms.emails {
+		if e.detail.ID == id {
+			return openPart(e.parts, n)
+		}
+	}
+	return nil, nil, ErrNotFound
+}
+
+// OpenRaw returns the raw message of a stored email
+func (ms *MemoryStorage) OpenRaw(ctx context.Context, id string) (io.ReadCloser, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, e := range ms.emails {
+		if e.detail.ID == id {
+			return io.NopCloser(strings.NewReader(e.raw)), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Delete removes a stored email
+func (ms *MemoryStorage) Delete(ctx context.Context, id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for i, e := range ms.emails {
+		if e.detail.ID == id {
+			ms.emails = append(ms.emails[:i], ms.emails[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// Search returns one page of the emails whose sender, recipients, subject
+// or raw content contain the query text
+func (ms *MemoryStorage) Search(ctx context.Context, query SearchQuery) ([]EmailSummary, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	text := strings.ToLower(query.Text)
+	skip := pageOffset(query.Page)
+	emails := make([]EmailSummary, 0)
+	for i := len(ms.emails) - 1; i >= 0 && len(emails) < PageSize; i-- {
+		e := ms.emails[i]
+		if query.Mailbox != "" && !e.delivered(query.Mailbox) {
+			continue
+		}
+		if !query.inRange(e.detail.CreatedAt) {
+			continue
+		}
+		if text != "" && !e.contains(text) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		d := e.detail
+		emails = append(emails, EmailSummary{ID: d.ID, From: d.From, To: d.To, Subject: d.Subject, Date: d.Date, CreatedAt: d.CreatedAt})
+	}
+	return emails, nil
+}
+
+// Close does nothing
+func (ms *MemoryStorage) Close() error {
+	return nil
+}
+
+func (e memoryEmail) delivered(mailbox string) bool {
+	mailbox = normalizeAddress(mailbox)
+	for _, m := range e.mailboxes {
+		if m == mailbox {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether the email matches lowercase text
+func (e memoryEmail) contains(text string) bool {
+	for _, field := range []string{e.detail.From, e.detail.To, e.detail.Subject, e.raw} {
+		if strings.Contains(strings.ToLower(field), text) {
+			return true
+		}
+	}
+	return false
+}
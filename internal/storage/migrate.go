@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the schema migrations, named
+// <version>_<name>.up.sql and <version>_<name>.down.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the advisory lock held while migrating, so
+// instances starting together apply each migration once
+const migrationLockKey int64 = 0x656d61696c // "email"
+
+// Migration is one numbered schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration and whether it is applied
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time // Nil while pending
+}
+
+// Migrations returns the embedded migrations in version order
+func Migrations() ([]Migration, error) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return parseMigrations(sub)
+}
+
+// parseMigrations reads the migrations of fsys. Versions must start at 1
+// without gaps, and each needs an up and a down file.
+func parseMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		base, direction, ok := strings.Cut(strings.TrimSuffix(file, ".sql"), ".")
+		versionStr, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(versionStr)
+		if !ok || err != nil || version < 1 || name == "" || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name %q (want <version>_<name>.up.sql or .down.sql)", file)
+		}
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration %d is named both %q and %q", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+	}
+	return migrations, nil
+}
+
+// Migrator applies and reverts the schema migrations of a database. The
+// applied versions are recorded in the schema_migrations table, and every
+// operation holds a postgres advisory lock.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// NewMigrator returns a Migrator for db with the embedded migrations
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Up applies every pending migration in order and returns them
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+	err := m.locked(ctx, func(conn *sql.Conn, versions map[int]time.Time) error {
+		for _, mig := range m.migrations {
+			if _, ok := versions[mig.Version]; ok {
+				continue
+			}
+			err := migrateTx(ctx, conn, mig.Up,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, mig.Version, mig.Name)
+			if err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", mig.Version, mig.Name, err)
+			}
+			applied = append(applied, mig)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the latest steps applied migrations, newest first, and
+// returns them
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.locked(ctx, func(conn *sql.Conn, versions map[int]time.Time) error {
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			mig := m.migrations[i]
+			if _, ok := versions[mig.Version]; !ok {
+				continue
+			}
+			err := migrateTx(ctx, conn, mig.Down,
+				`DELETE FROM schema_migrations WHERE version = $1`, mig.Version)
+			if err != nil {
+				return fmt.Errorf("revert %04d_%s: %w", mig.Version, mig.Name, err)
+			}
+			reverted = append(reverted, mig)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status returns every known migration with the time it was applied.
+// Versions applied by a newer release, unknown to this one, are listed
+// with an empty name and SQL.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var status []MigrationStatus
+	err := m.locked(ctx, func(conn *sql.Conn, versions map[int]time.Time) error {
+		for _, mig := range m.migrations {
+			s := MigrationStatus{Migration: mig}
+			if at, ok := versions[mig.Version]; ok {
+				s.AppliedAt = &at
+			}
+			status = append(status, s)
+		}
+		for version, at := range versions {
+			if version > len(m.migrations) {
+				status = append(status, MigrationStatus{Migration: Migration{Version: version}, AppliedAt: &at})
+			}
+		}
+		sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+		return nil
+	})
+	return status, err
+}
+
+// locked runs fn on one connection holding the migration lock, with the
+// applied versions
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn, versions map[int]time.Time) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return err
+	}
+	// Unlock even when ctx is done, or the lock outlives the session in the pool
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	_, err = conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	versions := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			rows.Close()
+			return err
+		}
+		versions[version] = at
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return fn(conn, versions)
+}
+
+// migrateTx runs a migration's SQL and its schema_migrations change in one
+// transaction, so a failed migration leaves nothing behind
+func migrateTx(ctx context.Context, conn *sql.Conn, script, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
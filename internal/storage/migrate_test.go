@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMigrations_Embedded(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatalf("Migrations failed: %v", err)
+	}
+	if len(migrations) == 0 || migrations[0].Name != "initial" {
+		t.Fatalf("Unexpected migrations %+v", migrations)
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 || strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			t.Errorf("Incomplete migration %04d_%s", m.Version, m.Name)
+		}
+	}
+}
+
+func TestParseMigrations_Invalid(t *testing.T) {
+	file := &fstest.MapFile{Data: []byte("SELECT 1;")}
+	cases := map[string]fstest.MapFS{
+		"gap":           {"0001_a.up.sql": file, "0001_a.down.sql": file, "0003_c.up.sql": file, "0003_c.down.sql": file},
+		"missing down":  {"0001_a.up.sql": file},
+		"bad name":      {"first.up.sql": file, "first.down.sql": file},
+		"bad direction": {"0001_a.sideways.sql": file},
+		"renamed":       {"0001_a.up.sql": file, "0001_b.down.sql": file},
+	}
+	for name, fsys := range cases {
+		if _, err := parseMigrations(fsys); err == nil {
+			t.Errorf("%s: parseMigrations accepted %v", name, fsys)
+		}
+	}
+}
+
+// TestMigrator_UpDown runs against the database in TEST_DB_URL, which it
+// migrates down to nothing and back up; it is skipped when that is not set.
+func TestMigrator_UpDown(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_URL")
+	if dsn == "" {
+		t.Skip("TEST_DB_URL not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	all, _ := Migrations()
+
+	if _, err := migrator.Up(ctx); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+	if reverted, err := migrator.Down(ctx, len(all)); err != nil || len(reverted) != len(all) {
+		t.Fatalf("Down = %d migrations, %v; want %d", len(reverted), err, len(all))
+	}
+	status, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if s.AppliedAt != nil {
+			t.Errorf("Migration %d still applied after Down", s.Version)
+		}
+	}
+	if applied, err := migrator.Up(ctx); err != nil || len(applied) != len(all) {
+		t.Fatalf("Up = %d migrations, %v; want %d", len(applied), err, len(all))
+	}
+	if applied, err := migrator.Up(ctx); err != nil || len(applied) != 0 {
+		t.Errorf("Second Up = %d migrations, %v; want none", len(applied), err)
+	}
+}
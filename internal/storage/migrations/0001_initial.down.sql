@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS email_dnsbl;
+DROP TABLE IF EXISTS email_dkim;
+DROP TABLE IF EXISTS email_recipient;
+DROP TABLE IF EXISTS email;
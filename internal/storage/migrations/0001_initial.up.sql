@@ -0,0 +1,64 @@
+-- Baseline schema. Everything is IF NOT EXISTS, so databases created by
+-- earlier releases are adopted as they are.
+CREATE TABLE IF NOT EXISTS email (
+	id UUID PRIMARY KEY,
+	"from" TEXT NOT NULL,
+	"to" TEXT NOT NULL,
+	subject TEXT,
+	date TEXT,
+	body TEXT,
+	raw_content TEXT,
+	headers TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE email ADD COLUMN IF NOT EXISTS spf_result TEXT;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS spf_domain TEXT;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS spf_reason TEXT;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS dmarc_result TEXT;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS dmarc_domain TEXT;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS dmarc_policy TEXT;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS dmarc_spf_aligned BOOLEAN;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS dmarc_dkim_aligned BOOLEAN;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS dmarc_reason TEXT;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS client_ip TEXT;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS helo TEXT;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS tls_version TEXT;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS tls_cipher TEXT;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS auth_user TEXT;
+ALTER TABLE email ADD COLUMN IF NOT EXISTS received_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_email_from ON email("from");
+CREATE INDEX IF NOT EXISTS idx_email_to ON email("to");
+CREATE INDEX IF NOT EXISTS idx_email_created_at ON email(created_at);
+CREATE INDEX IF NOT EXISTS idx_email_id ON email(id);
+
+-- One row per envelope recipient, so a message sent to several
+-- mailboxes shows up in each of their inboxes.
+CREATE TABLE IF NOT EXISTS email_recipient (
+	email_id UUID NOT NULL REFERENCES email(id) ON DELETE CASCADE,
+	address TEXT NOT NULL,
+	PRIMARY KEY (email_id, address)
+);
+CREATE INDEX IF NOT EXISTS idx_email_recipient_address ON email_recipient(address);
+
+CREATE TABLE IF NOT EXISTS email_dkim (
+	email_id UUID NOT NULL REFERENCES email(id) ON DELETE CASCADE,
+	position INT NOT NULL,
+	result TEXT NOT NULL,
+	domain TEXT NOT NULL,
+	selector TEXT NOT NULL,
+	algorithm TEXT,
+	identifier TEXT,
+	reason TEXT,
+	PRIMARY KEY (email_id, position)
+);
+
+CREATE TABLE IF NOT EXISTS email_dnsbl (
+	email_id UUID NOT NULL REFERENCES email(id) ON DELETE CASCADE,
+	zone TEXT NOT NULL,
+	codes TEXT NOT NULL,
+	action TEXT NOT NULL,
+	reason TEXT,
+	PRIMARY KEY (email_id, zone)
+);
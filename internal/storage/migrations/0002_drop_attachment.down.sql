@@ -0,0 +1,10 @@
+-- Restores the legacy table with its rows, or empty once it was dropped
+ALTER TABLE IF EXISTS attachment_legacy RENAME TO attachment;
+CREATE TABLE IF NOT EXISTS attachment (
+	id UUID PRIMARY KEY,
+	email_id UUID NOT NULL REFERENCES email(id) ON DELETE CASCADE,
+	filename TEXT,
+	content_type TEXT,
+	data BYTEA,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
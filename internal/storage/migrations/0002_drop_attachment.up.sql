@@ -0,0 +1,5 @@
+-- Attachments used to be stored as rows of their own; the HTML body
+-- embeds inline images and the raw content keeps everything else. The
+-- old table is renamed rather than dropped, since this runs on every
+-- start: "email-server migrate drop-legacy-attachments -confirm" drops it.
+ALTER TABLE IF EXISTS attachment RENAME TO attachment_legacy;
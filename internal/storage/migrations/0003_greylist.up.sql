@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS greylist (
+	key TEXT PRIMARY KEY,
+	first_seen TIMESTAMP NOT NULL,
+	last_seen TIMESTAMP NOT NULL,
+	passed BOOLEAN NOT NULL DEFAULT FALSE
+);
+CREATE INDEX IF NOT EXISTS idx_greylist_last_seen ON greylist(last_seen);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS smtp_user (
+	username TEXT PRIMARY KEY,
+	password_hash TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT NOW(),
+	updated_at TIMESTAMP DEFAULT NOW()
+);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS outbound_queue (
+	id UUID PRIMARY KEY,
+	mail_from TEXT NOT NULL,
+	rcpt_to TEXT NOT NULL,
+	content BYTEA NOT NULL,
+	status TEXT NOT NULL DEFAULT 'queued',
+	attempts INT NOT NULL DEFAULT 0,
+	next_attempt TIMESTAMP NOT NULL,
+	last_error TEXT,
+	created_at TIMESTAMP DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_outbound_queue_due ON outbound_queue(next_attempt) WHERE status = 'queued';
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS email_attachment;
+DROP TABLE IF EXISTS attachment_blob;
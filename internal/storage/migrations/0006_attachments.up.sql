@@ -0,0 +1,21 @@
+-- Attachment content is stored once per SHA-256 digest, however many
+-- emails carry it
+CREATE TABLE attachment_blob (
+	sha256 TEXT PRIMARY KEY,
+	size BIGINT NOT NULL,
+	data BYTEA NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE email_attachment (
+	email_id UUID NOT NULL REFERENCES email(id) ON DELETE CASCADE,
+	position INT NOT NULL,
+	sha256 TEXT NOT NULL REFERENCES attachment_blob(sha256),
+	filename TEXT,
+	content_type TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	content_id TEXT,
+	disposition TEXT,
+	PRIMARY KEY (email_id, position)
+);
+CREATE INDEX idx_email_attachment_sha256 ON email_attachment(sha256);
@@ -0,0 +1,18 @@
+-- Refuse to revert while content exists only in the blob store, rather
+-- than lose it
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM email WHERE raw_ref IS NOT NULL)
+	   OR EXISTS (SELECT 1 FROM attachment_blob WHERE data IS NULL) THEN
+		RAISE EXCEPTION 'content is stored in the blob store; revert requires it back in the database';
+	END IF;
+END
+$$;
+
+ALTER TABLE attachment_blob
+	DROP CONSTRAINT attachment_blob_content,
+	ALTER COLUMN data SET NOT NULL,
+	DROP COLUMN ref;
+
+DROP INDEX IF EXISTS idx_email_raw_ref;
+ALTER TABLE email DROP COLUMN raw_sha256, DROP COLUMN raw_ref;
@@ -0,0 +1,9 @@
+-- With a blob store, raw messages and attachment contents live outside the
+-- database: rows keep the blob key (ref) and the SHA-256 of the content
+ALTER TABLE email ADD COLUMN raw_ref TEXT, ADD COLUMN raw_sha256 TEXT;
+CREATE INDEX idx_email_raw_ref ON email(raw_ref);
+
+ALTER TABLE attachment_blob
+	ADD COLUMN ref TEXT,
+	ALTER COLUMN data DROP NOT NULL,
+	ADD CONSTRAINT attachment_blob_content CHECK (data IS NOT NULL OR ref IS NOT NULL);
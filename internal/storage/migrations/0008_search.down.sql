@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_email_search;
+ALTER TABLE email DROP COLUMN IF EXISTS search_vector;
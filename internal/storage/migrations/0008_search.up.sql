@@ -0,0 +1,8 @@
+-- Full-text search over the addresses, subject and plain-text body. New
+-- rows are indexed on insert from the parsed message. Existing rows are
+-- left NULL here, so the migration does not rewrite the whole table in
+-- one transaction; PostgresStorage.BackfillSearch indexes them in
+-- batches afterwards.
+ALTER TABLE email ADD COLUMN search_vector tsvector;
+
+CREATE INDEX idx_email_search ON email USING GIN (search_vector);
@@ -0,0 +1,15 @@
+-- Refuse to revert while queued content exists only in the blob store,
+-- rather than lose it
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM outbound_queue WHERE content IS NULL) THEN
+		RAISE EXCEPTION 'forwarded copies are stored in the blob store; revert requires them back in the database';
+	END IF;
+END
+$$;
+
+DROP INDEX IF EXISTS idx_outbound_queue_content_ref;
+ALTER TABLE outbound_queue
+	DROP CONSTRAINT outbound_queue_content,
+	ALTER COLUMN content SET NOT NULL,
+	DROP COLUMN content_ref;
@@ -0,0 +1,7 @@
+-- With a blob store, forwarded copies keep their content outside the
+-- database: rows keep the blob key (content_ref) instead
+ALTER TABLE outbound_queue
+	ADD COLUMN content_ref TEXT,
+	ALTER COLUMN content DROP NOT NULL,
+	ADD CONSTRAINT outbound_queue_content CHECK (content IS NOT NULL OR content_ref IS NOT NULL);
+CREATE INDEX idx_outbound_queue_content_ref ON outbound_queue(content_ref);
@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OutboundMessage is a copy of a message waiting to be relayed to one
+// external recipient. Its content is kept by the queue and read with Open.
+type OutboundMessage struct {
+	ID          string
+	MailFrom    string // Envelope sender, already SRS-rewritten; empty for bounces
+	RcptTo      string
+	Attempts    int       // Failed delivery attempts so far
+	NextAttempt time.Time // When the message is due
+	LastError   string
+	CreatedAt   time.Time
+}
+
+// OutboundQueue persists messages until they are relayed. Claimed messages
+// are leased: they are not handed out again until the lease runs out, so
+// several workers (or instances) can share one queue.
+type OutboundQueue interface {
+	// Enqueue queues msg with content, read from its start
+	Enqueue(ctx context.Context, msg OutboundMessage, content io.ReadSeeker) error
+	// Claim returns up to limit messages due at now, leased until now+lease
+	Claim(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]OutboundMessage, error)
+	// Open streams the content of a queued message. The caller closes the
+	// reader.
+	Open(ctx context.Context, id string) (io.ReadCloser, error)
+	// Delivered removes a relayed message
+	Delivered(ctx context.Context, id string) error
+	// Retry schedules another attempt after a temporary failure
+	Retry(ctx context.Context, id string, next time.Time, lastErr string) error
+	// Fail keeps a message that will not be retried, for inspection
+	Fail(ctx context.Context, id string, lastErr string) error
+}
+
+// MemoryOutbound keeps the outbound queue in memory. Queued messages are
+// lost on restart.
+type MemoryOutbound struct {
+	mu       sync.Mutex
+	messages map[string]*OutboundMessage
+	failed   map[string]*OutboundMessage
+	content  map[string][]byte
+}
+
+func NewMemoryOutbound() *MemoryOutbound {
+	return &MemoryOutbound{
+		messages: make(map[string]*OutboundMessage),
+		failed:   make(map[string]*OutboundMessage),
+		content:  make(map[string][]byte),
+	}
+}
+
+func (m *MemoryOutbound) Enqueue(ctx context.Context, msg OutboundMessage, content io.ReadSeeker) error {
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg.ID == "" {
+		msg.ID = generateUUIDv7()
+	}
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+	m.messages[msg.ID] = &msg
+	m.content[msg.ID] = data
+	return nil
+}
+
+func (m *MemoryOutbound) Claim(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]OutboundMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var due []*OutboundMessage
+	for _, msg := range m.messages {
+		if !msg.NextAttempt.After(now) {
+			due = append(due, msg)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttempt.Before(due[j].NextAttempt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	claimed := make([]OutboundMessage, len(due))
+	for i, msg := range due {
+		claimed[i] = *msg
+		msg.NextAttempt = now.Add(lease)
+	}
+	return claimed, nil
+}
+
+func (m *MemoryOutbound) Open(ctx context.Context, id string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.content[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *MemoryOutbound) Delivered(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.messages, id)
+	delete(m.content, id)
+	return nil
+}
+
+func (m *MemoryOutbound) Retry(ctx context.Context, id string, next time.Time, lastErr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg, ok := m.messages[id]; ok {
+		msg.Attempts++
+		msg.NextAttempt = next
+		msg.LastError = lastErr
+	}
+	return nil
+}
+
+func (m *MemoryOutbound) Fail(ctx context.Context, id string, lastErr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg, ok := m.messages[id]; ok {
+		msg.Attempts++
+		msg.LastError = lastErr
+		m.failed[id] = msg
+		delete(m.messages, id)
+	}
+	return nil
+}
+
+// Failed returns the messages that were given up on
+func (m *MemoryOutbound) Failed() []OutboundMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var failed []OutboundMessage
+	for _, msg := range m.failed {
+		failed = append(failed, *msg)
+	}
+	return failed
+}
+
+// Len returns the number of messages still queued
+func (m *MemoryOutbound) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.messages)
+}
+
+// postgresOutbound keeps the outbound queue in the outbound_queue table.
+// Failed messages stay in the table with status 'failed'. With a blob
+// store the content is streamed to it under a content-addressed key, so
+// the copies of one message share a blob; without one it is held in
+// memory to be inserted, up to MaxInlineRawSize.
+type postgresOutbound struct {
+	db    *sql.DB
+	blobs BlobStore
+}
+
+// Outbound returns an OutboundQueue backed by the same database
+func (ps *PostgresStorage) Outbound() OutboundQueue {
+	return &postgresOutbound{db: ps.db, blobs: ps.blobs}
+}
+
+// Enqueue inserts the message. With a blob store its content is uploaded
+// once the row is inserted, under the lock deleteBlob takes, and deleted
+// again when the transaction fails and no other message refers to it.
+func (po *postgresOutbound) Enqueue(ctx context.Context, msg OutboundMessage, content io.ReadSeeker) (err error) {
+	if msg.ID == "" {
+		msg.ID = generateUUIDv7()
+	}
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+	next := msg.NextAttempt
+	if next.IsZero() {
+		next = msg.CreatedAt
+	}
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var inline any // The content column; NULL with a blob store
+	var ref string
+	if po.blobs == nil {
+		if size > MaxInlineRawSize {
+			return fmt.Errorf("message of %d bytes exceeds %d bytes, the limit without a blob store", size, MaxInlineRawSize)
+		}
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		inline = data
+	} else {
+		digest, _, err := hashContent(content)
+		if err != nil {
+			return err
+		}
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		ref = blobKey("outbound", digest)
+	}
+
+	tx, err := po.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	uploaded := false
+	defer func() {
+		if err != nil && uploaded {
+			tx.Rollback()
+			if err := po.deleteBlob(context.WithoutCancel(ctx), ref); err != nil {
+				log.Printf("Warning: failed to delete blob %s of unqueued message %s: %v", ref, msg.ID, err)
+			}
+		}
+	}()
+
+	// Times are stored in UTC, matching Claim and Retry
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO outbound_queue (id, mail_from, rcpt_to, content, content_ref, next_attempt, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		msg.ID, msg.MailFrom, msg.RcptTo, inline, nullString(ref), next.UTC(), msg.CreatedAt.UTC(),
+	)
+	if err != nil {
+		return err
+	}
+	if ref != "" {
+		if err := lockBlob(ctx, tx, ref); err != nil {
+			return err
+		}
+		if err := po.blobs.Put(ctx, ref, content, size); err != nil {
+			return fmt.Errorf("store forwarded message: %w", err)
+		}
+		uploaded = true
+	}
+	return tx.Commit()
+}
+
+func (po *postgresOutbound) Claim(ctx context.Context, now time.Time, limit int, lease time.Duration) ([]OutboundMessage, error) {
+	// SKIP LOCKED lets concurrent workers claim disjoint batches
+	rows, err := po.db.QueryContext(ctx, `
+		UPDATE outbound_queue SET next_attempt = $3
+		WHERE id IN (
+			SELECT id FROM outbound_queue
+			WHERE status = 'queued' AND next_attempt <= $1
+			ORDER BY next_attempt
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, mail_from, rcpt_to, attempts, COALESCE(last_error, ''), created_at`,
+		now.UTC(), limit, now.Add(lease).UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claimed []OutboundMessage
+	for rows.Next() {
+		var msg OutboundMessage
+		if err := rows.Scan(&msg.ID, &msg.MailFrom, &msg.RcptTo, &msg.Attempts, &msg.LastError, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, msg)
+	}
+	return claimed, rows.Err()
+}
+
+// Open reads the content from the blob store when the row refers to one,
+// else from the row
+func (po *postgresOutbound) Open(ctx context.Context, id string) (io.ReadCloser, error) {
+	var data []byte
+	var ref sql.NullString
+	err := po.db.QueryRowContext(ctx, `SELECT content, content_ref FROM outbound_queue WHERE id = $1`, id).Scan(&data, &ref)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if !ref.Valid {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	if po.blobs == nil {
+		return nil, fmt.Errorf("message %s is in the blob store, which is not configured", id)
+	}
+	return po.blobs.Open(ctx, ref.String)
+}
+
+// Delivered removes the message, and its content blob once no other
+// message refers to it
+func (po *postgresOutbound) Delivered(ctx context.Context, id string) error {
+	var ref sql.NullString
+	err := po.db.QueryRowContext(ctx, `DELETE FROM outbound_queue WHERE id = $1 RETURNING content_ref`, id).Scan(&ref)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !ref.Valid) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if po.blobs == nil {
+		log.Printf("Warning: blob %s of forwarded message %s kept, the blob store is not configured", ref.String, id)
+		return nil
+	}
+	return po.deleteBlob(ctx, ref.String)
+}
+
+// deleteBlob deletes the content blob ref unless a message refers to it.
+// Under the lock, a message being queued with it either committed before
+// the check or uploads the blob again after the delete.
+func (po *postgresOutbound) deleteBlob(ctx context.Context, ref string) error {
+	tx, err := po.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := lockBlob(ctx, tx, ref); err != nil {
+		return err
+	}
+	var used bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM outbound_queue WHERE content_ref = $1)`, ref).Scan(&used); err != nil {
+		return err
+	}
+	if !used {
+		if err := po.blobs.Delete(ctx, ref); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (po *postgresOutbound) Retry(ctx context.Context, id string, next time.Time, lastErr string) error {
+	_, err := po.db.ExecContext(ctx, `
+		UPDATE outbound_queue
+		SET attempts = attempts + 1, next_attempt = $2, last_error = $3
+		WHERE id = $1`,
+		id, next.UTC(), lastErr,
+	)
+	return err
+}
+
+func (po *postgresOutbound) Fail(ctx context.Context, id string, lastErr string) error {
+	_, err := po.db.ExecContext(ctx, `
+		UPDATE outbound_queue
+		SET attempts = attempts + 1, status = 'failed', last_error = $2
+		WHERE id = $1`,
+		id, lastErr,
+	)
+	return err
+}
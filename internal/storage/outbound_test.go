@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryOutbound(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryOutbound()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	m.Enqueue(ctx, OutboundMessage{RcptTo: "a@x.com", NextAttempt: start}, strings.NewReader("to a"))
+	m.Enqueue(ctx, OutboundMessage{RcptTo: "b@x.com", NextAttempt: start.Add(time.Hour)}, strings.NewReader("to b"))
+
+	claimed, err := m.Claim(ctx, start, 10, time.Minute)
+	if err != nil || len(claimed) != 1 || claimed[0].RcptTo != "a@x.com" || claimed[0].ID == "" {
+		t.Fatalf("Claim = %+v, %v; want the due message", claimed, err)
+	}
+	// Leased messages are not handed out again until the lease runs out
+	if again, _ := m.Claim(ctx, start.Add(30*time.Second), 10, time.Minute); len(again) != 0 {
+		t.Fatalf("Leased message claimed twice: %+v", again)
+	}
+
+	id := claimed[0].ID
+	if content := readOutbound(t, m, id); content != "to a" {
+		t.Errorf("Open = %q, want the queued content", content)
+	}
+	m.Retry(ctx, id, start.Add(5*time.Minute), "451 try later")
+	claimed, _ = m.Claim(ctx, start.Add(5*time.Minute), 10, time.Minute)
+	if len(claimed) != 1 || claimed[0].Attempts != 1 || claimed[0].LastError != "451 try later" {
+		t.Fatalf("Unexpected retried message: %+v", claimed)
+	}
+
+	m.Fail(ctx, id, "550 no such user")
+	if failed := m.Failed(); len(failed) != 1 || failed[0].Attempts != 2 {
+		t.Errorf("Unexpected failed messages: %+v", failed)
+	}
+	claimed, _ = m.Claim(ctx, start.Add(2*time.Hour), 10, time.Minute)
+	if len(claimed) != 1 || claimed[0].RcptTo != "b@x.com" {
+		t.Fatalf("Claim = %+v; want only the remaining message", claimed)
+	}
+	m.Delivered(ctx, claimed[0].ID)
+	if m.Len() != 0 {
+		t.Errorf("Queue still holds %d messages", m.Len())
+	}
+	if _, err := m.Open(ctx, claimed[0].ID); err != ErrNotFound {
+		t.Errorf("Open of a delivered message = %v, want ErrNotFound", err)
+	}
+}
+
+func readOutbound(t *testing.T, queue OutboundQueue, id string) string {
+	t.Helper()
+	r, err := queue.Open(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Open(%s) failed: %v", id, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestPostgresOutbound runs against TEST_DB_URL, with the content inline
+// and in a blob store; it is skipped when that is not set
+func TestPostgresOutbound(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_URL")
+	if dsn == "" {
+		t.Skip("TEST_DB_URL not set")
+	}
+	for _, withBlobs := range []bool{false, true} {
+		ps := newTestPostgres(t, dsn)
+		if _, err := ps.db.Exec(`TRUNCATE outbound_queue`); err != nil {
+			t.Fatal(err)
+		}
+		var blobs *FSBlobStore
+		if withBlobs {
+			var err error
+			if blobs, err = NewFSBlobStore(t.TempDir()); err != nil {
+				t.Fatal(err)
+			}
+			ps.SetBlobStore(blobs)
+		}
+		ctx := context.Background()
+		queue := ps.Outbound()
+		start := time.Now().Add(-time.Minute)
+
+		// Two copies of one message share its blob
+		for _, rcpt := range []string{"a@x.com", "b@x.com"} {
+			if err := queue.Enqueue(ctx, OutboundMessage{RcptTo: rcpt, NextAttempt: start}, strings.NewReader("Subject: hi\r\n\r\nbody\r\n")); err != nil {
+				t.Fatalf("Enqueue failed (blobs %v): %v", withBlobs, err)
+			}
+		}
+		claimed, err := queue.Claim(ctx, time.Now(), 10, time.Minute)
+		if err != nil || len(claimed) != 2 {
+			t.Fatalf("Claim = %+v, %v; want both copies", claimed, err)
+		}
+		for _, msg := range claimed {
+			if content := readOutbound(t, queue, msg.ID); content != "Subject: hi\r\n\r\nbody\r\n" {
+				t.Errorf("Open = %q (blobs %v)", content, withBlobs)
+			}
+		}
+
+		queue.Delivered(ctx, claimed[0].ID)
+		if content := readOutbound(t, queue, claimed[1].ID); content == "" {
+			t.Errorf("Delivering one copy removed the content of the other (blobs %v)", withBlobs)
+		}
+		queue.Delivered(ctx, claimed[1].ID)
+		if withBlobs {
+			if keys, _ := filepath.Glob(filepath.Join(blobs.Dir, "outbound", "*", "*")); len(keys) != 0 {
+				t.Errorf("Blobs left after delivery: %v", keys)
+			}
+		}
+	}
+}
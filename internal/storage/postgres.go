@@ -2,31 +2,30 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"log"
 	"net/mail"
-	"os"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jhillyerd/enmime"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // PostgresStorage implements Storage interface with Postgres backend
 type PostgresStorage struct {
-	db           *sql.DB
-	maxEmailSize int64 // Maximum email size in bytes (default 512KB)
+	db    *sql.DB
+	blobs BlobStore // Nil keeps raw messages and attachments in the database
 }
 
 // NewPostgresStorage creates a new postgres storage instance
 // dsn format: "user=username password=pass dbname=emaildb host=localhost port=5432 sslmode=disable"
-// EMAIL_SIZE_LIMIT env var controls max email size in bytes (default 524288 = 512KB)
 func NewPostgresStorage(dsn string) (*PostgresStorage, error) {
 	db, err := sql.Open("postgres", dsn)
 	if err != nil {
@@ -35,62 +34,267 @@ func NewPostgresStorage(dsn string) (*PostgresStorage, error) {
 
 	// Test connection
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	// Read email size limit from environment (default 512KB = 524288 bytes)
-	maxEmailSize := int64(524288) // 512KB default
-	if envSize := os.Getenv("EMAIL_SIZE_LIMIT"); envSize != "" {
-		if parsed, err := strconv.ParseInt(envSize, 10, 64); err == nil {
-			maxEmailSize = parsed
-			log.Printf("Email size limit set to %d bytes", maxEmailSize)
-		} else {
-			log.Printf("Warning: Invalid EMAIL_SIZE_LIMIT value %q, using default 512KB", envSize)
-		}
-	}
-
 	ps := &PostgresStorage{
-		db:           db,
-		maxEmailSize: maxEmailSize,
+		db: db,
 	}
-	if err := ps.createTables(); err != nil {
+	if err := ps.migrate(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	log.Printf("Connected to Postgres database (max email size: %d bytes)", ps.maxEmailSize)
+	log.Printf("Connected to Postgres database")
 	return ps, nil
 }
 
-// createTables creates the email table if it doesn't exist
-func (ps *PostgresStorage) createTables() error {
-	emailTableSQL := `
-	CREATE TABLE IF NOT EXISTS email (
-		id UUID PRIMARY KEY,
-		"from" TEXT NOT NULL,
-		"to" TEXT NOT NULL,
-		subject TEXT,
-		date TEXT,
-		body TEXT,
-		raw_content TEXT,
-		headers TEXT,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
-
-	if _, err := ps.db.Exec(emailTableSQL); err != nil {
+// migrate applies the pending schema migrations and warns when the
+// database was migrated by a newer release
+func (ps *PostgresStorage) migrate() error {
+	migrator, err := NewMigrator(ps.db)
+	if err != nil {
 		return err
 	}
+	ctx := context.Background()
+	applied, err := migrator.Up(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range applied {
+		log.Printf("Applied schema migration %04d_%s", m.Version, m.Name)
+	}
+	status, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if n := len(status); n > 0 && status[n-1].Name == "" {
+		log.Printf("Warning: database schema is at version %d, newer than this release knows", status[n-1].Version)
+	}
+	return nil
+}
 
-	indexSQL := `
-	CREATE INDEX IF NOT EXISTS idx_email_from ON email("from");
-	CREATE INDEX IF NOT EXISTS idx_email_to ON email("to");
-	CREATE INDEX IF NOT EXISTS idx_email_created_at ON email(created_at);
-	CREATE INDEX IF NOT EXISTS idx_email_id ON email(id);`
+// SetBlobStore keeps the raw messages and attachment contents of emails
+// saved from now on in blobs; rows keep their key and SHA-256. Emails
+// saved before stay readable from the database. Call it before the
+// storage is used.
+func (ps *PostgresStorage) SetBlobStore(blobs BlobStore) {
+	ps.blobs = blobs
+}
+
+// emailRow holds the parsed columns of an email row
+type emailRow struct {
+	ID         string
+	From       string
+	To         string
+	Subject    string
+	Date       string
+	Body       string
+	Text       string // Plain-text body, indexed for search
+	RawContent string // Empty when the raw message is in the blob store
+	RawRef     string // Blob key of the raw message
+	RawSHA256  string
+	// raw is uploaded to RawRef once the row is inserted
+	raw     io.Reader
+	rawSize int64
+	// Attachments are stored by digest, each distinct content once
+	Attachments []attachmentPart
+}
 
-	if _, err := ps.db.Exec(indexSQL); err != nil {
+// insertEmail inserts the email row, with the envelope data carried by email,
+// and its envelope recipients in one transaction. A row with the same ID
+// is left untouched, so replaying a message is harmless. The raw message
+// blob is uploaded once the row is inserted, under the lock deleteRawBlob
+// takes, and deleted again when the transaction fails and no other email
+// refers to it.
+func (ps *PostgresStorage) insertEmail(ctx context.Context, row emailRow, email Email) (err error) {
+	tx, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+	uploaded := false
+	defer func() {
+		if err != nil && uploaded {
+			tx.Rollback()
+			if err := ps.deleteRawBlob(context.WithoutCancel(ctx), row.RawRef); err != nil {
+				log.Printf("Warning: failed to delete blob %s of unsaved email %s: %v", row.RawRef, row.ID, err)
+			}
+		}
+	}()
 
-	return nil
+	var spfResult, spfDomain, spfReason sql.NullString
+	if email.SPF != nil {
+		spfResult = sql.NullString{String: email.SPF.Result, Valid: true}
+		spfDomain = sql.NullString{String: email.SPF.Domain, Valid: true}
+		spfReason = sql.NullString{String: email.SPF.Reason, Valid: true}
+	}
+	var dmarcResult, dmarcDomain, dmarcPolicy, dmarcReason sql.NullString
+	var dmarcSPFAligned, dmarcDKIMAligned sql.NullBool
+	if email.DMARC != nil {
+		dmarcResult = sql.NullString{String: email.DMARC.Result, Valid: true}
+		dmarcDomain = sql.NullString{String: email.DMARC.Domain, Valid: true}
+		dmarcPolicy = sql.NullString{String: email.DMARC.Policy, Valid: true}
+		dmarcSPFAligned = sql.NullBool{Bool: email.DMARC.SPFAligned, Valid: true}
+		dmarcDKIMAligned = sql.NullBool{Bool: email.DMARC.DKIMAligned, Valid: true}
+		dmarcReason = sql.NullString{String: email.DMARC.Reason, Valid: true}
+	}
+	conn := email.Connection
+	var receivedAt sql.NullTime
+	if !conn.ReceivedAt.IsZero() {
+		receivedAt = sql.NullTime{Time: conn.ReceivedAt.UTC(), Valid: true}
+	}
+
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO email (id, "from", "to", subject, date, body, raw_content, raw_ref, raw_sha256,
+		                    spf_result, spf_domain, spf_reason,
+		                    dmarc_result, dmarc_domain, dmarc_policy,
+		                    dmarc_spf_aligned, dmarc_dkim_aligned, dmarc_reason,
+		                    client_ip, helo, tls_version, tls_cipher, auth_user, received_at, search_vector)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16,
+		         $17, $18, $19, $20, $21, $22, $23, $24, `+searchVector+`)
+		 ON CONFLICT (id) DO NOTHING`,
+		row.ID, row.From, row.To, row.Subject, row.Date, row.Body,
+		nullString(row.RawContent), nullString(row.RawRef), nullString(row.RawSHA256),
+		spfResult, spfDomain, spfReason,
+		dmarcResult, dmarcDomain, dmarcPolicy,
+		dmarcSPFAligned, dmarcDKIMAligned, dmarcReason,
+		nullString(conn.ClientIP), nullString(conn.Helo),
+		nullString(conn.TLSVersion), nullString(conn.TLSCipher), nullString(conn.AuthUser), receivedAt,
+		row.From+" "+row.To, row.Subject, searchText(row.Text),
+	)
+	if err != nil {
+		return err
+	}
+	if inserted, err := res.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		// A retry of a message that is already stored
+		log.Printf("Email %s already stored, skipping", row.ID)
+		return nil
+	}
+
+	if row.RawRef != "" {
+		if err := lockBlob(ctx, tx, row.RawRef); err != nil {
+			return err
+		}
+		if err := ps.blobs.Put(ctx, row.RawRef, row.raw, row.rawSize); err != nil {
+			return fmt.Errorf("store raw message: %w", err)
+		}
+		uploaded = true
+	}
+
+	for _, rcpt := range email.To {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO email_recipient (email_id, address) VALUES ($1, $2)
+			 ON CONFLICT DO NOTHING`,
+			row.ID, normalizeAddress(rcpt),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, sig := range email.DKIM {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO email_dkim (email_id, position, result, domain, selector, algorithm, identifier, reason)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			row.ID, i, sig.Result, sig.Domain, sig.Selector, sig.Algorithm, sig.Identifier, sig.Reason,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, hit := range email.DNSBL {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO email_dnsbl (email_id, zone, codes, action, reason)
+			 VALUES ($1, $2, $3, $4, $5)
+			 ON CONFLICT DO NOTHING`,
+			row.ID, hit.Zone, strings.Join(hit.Codes, ","), hit.Action, nullString(hit.Reason),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, part := range row.Attachments {
+		// With a blob store the row only refers to the content. The upsert
+		// locks the row, so a concurrent Delete cannot remove the blob
+		// between the upload and the commit.
+		data, ref := part.content, sql.NullString{}
+		if ps.blobs != nil {
+			data, ref = nil, nullString(blobKey("attachments", part.SHA256))
+		}
+		err = tx.QueryRowContext(ctx,
+			`INSERT INTO attachment_blob (sha256, size, data, ref) VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (sha256) DO UPDATE SET size = EXCLUDED.size
+			 RETURNING ref`,
+			part.SHA256, part.Size, data, ref,
+		).Scan(&ref)
+		if err != nil {
+			return err
+		}
+		if ref.Valid {
+			if ps.blobs == nil {
+				return fmt.Errorf("attachment %s is in the blob store, but none is configured", part.SHA256)
+			}
+			if err := ps.blobs.Put(ctx, ref.String, bytes.NewReader(part.content), part.Size); err != nil {
+				return fmt.Errorf("store attachment %s: %w", part.SHA256, err)
+			}
+		}
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO email_attachment (email_id, position, sha256, filename, content_type, size, content_id, disposition)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			row.ID, part.Index, part.SHA256, nullString(part.Filename), part.ContentType, part.Size,
+			nullString(part.ContentID), nullString(part.Disposition),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// searchVector is the search_vector of an inserted email, from the
+// addresses ($25), subject ($26) and plain-text body ($27). Addresses are
+// indexed whole and split at "@" and dots, so "alice@example.com" is
+// found by "alice" and "example" too. BackfillSearch indexes rows stored
+// before it the same way.
+const searchVector = `to_tsvector('simple', $25::text || ' ' || regexp_replace($25::text, '[@.<>"]+', ' ', 'g'))
+	|| to_tsvector('english', $26::text) || to_tsvector('english', $27::text)`
+
+// maxSearchText bounds the body text indexed per email, well below the
+// 1MB limit of a tsvector
+const maxSearchText = 256 << 10
+
+// searchText returns the part of a plain-text body that is indexed
+func searchText(text string) string {
+	if len(text) <= maxSearchText {
+		return text
+	}
+	return strings.ToValidUTF8(text[:maxSearchText], "")
+}
+
+// nullString stores empty strings as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// normalizeAddress lowercases an address and strips surrounding whitespace so
+// recipient lookups are case-insensitive.
+func normalizeAddress(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// emailIDFor returns the caller's ID for email, or a new one
+func emailIDFor(email Email) string {
+	if email.ID != "" {
+		return email.ID
+	}
+	return generateUUIDv7()
 }
 
 // generateUUIDv7 generates a UUIDv7 using github.com/google/uuid
@@ -109,15 +313,10 @@ func extractHeadersFromRawContent(raw string) (string, string, string, string) {
 	}
 
 	// Read only the header section to avoid expensive parsing.
-	headerEnd := strings.Index(raw, "\r\n\r\n")
-	if headerEnd == -1 {
-		headerEnd = strings.Index(raw, "\n\n")
-	}
-	if headerEnd == -1 {
-		headerEnd = len(raw)
+	headers, err := readHeaderSection(strings.NewReader(raw))
+	if err != nil {
+		return "", "", "", ""
 	}
-
-	headers := raw[:headerEnd] + "\r\n\r\n"
 	msg, err := mail.ReadMessage(strings.NewReader(headers))
 	if err != nil {
 		return "", "", "", ""
@@ -127,44 +326,56 @@ func extractHeadersFromRawContent(raw string) (string, string, string, string) {
 }
 
 // Save saves an email and its attachments to postgres
-// Base64 content is decoded by the parser BEFORE inserting into the database
-func (ps *PostgresStorage) Save(email Email) (string, error) {
-	// Check email size limit before parsing
-	if ps.maxEmailSize > 0 && int64(len(email.Content)) > ps.maxEmailSize {
-		log.Printf("Warning: Email exceeds size limit (%d > %d bytes), storing error message", len(email.Content), ps.maxEmailSize)
-		from, to, subject, date := extractHeadersFromRawContent(email.Content)
-		if from == "" {
-			from = email.From
-		}
-		if to == "" {
-			to = email.To
+// Base64 content is decoded by the parser BEFORE inserting into the database.
+// The content stream is spooled to a temporary file first, unless an outer
+// layer did, so the message is never held in memory more than once while
+// it is parsed and inserted. With a blob store the raw message is uploaded
+// from the spool file.
+func (ps *PostgresStorage) Save(ctx context.Context, email Email) (string, error) {
+	content, release, err := spoolOf(email.Content, "")
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	save := func(row emailRow) (string, error) {
+		if err := ps.storeRaw(ctx, content.raw(), &row); err != nil {
+			return "", err
 		}
-		emailID := generateUUIDv7()
-		_, err := ps.db.Exec(
-			`INSERT INTO email (id, "from", "to", subject, date, body, raw_content)
-			 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-			emailID, from, to, subject, date, "Sorry, the email exceeds our limit (512kb)", "",
-		)
-		if err != nil {
+		if err := ps.insertEmail(ctx, row, email); err != nil {
 			return "", err
 		}
-		return emailID, nil
+		return row.ID, nil
 	}
 
-	// Parse email using enmime
-	env, err := enmime.ReadEnvelope(strings.NewReader(email.Content))
-	if err != nil {
-		log.Printf("Warning: enmime parse error: %v, storing raw content", err)
-		emailID := generateUUIDv7()
-		_, err := ps.db.Exec(
-			`INSERT INTO email (id, "from", "to", subject, date, body, raw_content)
-			 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-			emailID, email.From, email.To, "", "", "Email parsing failed", email.Content,
-		)
+	// Messages cut at the SMTP size limit are stored as a stub: headers only
+	if content.truncated {
+		log.Printf("Warning: Email exceeded the size limit, storing truncated stub")
+		headers, err := readHeaderSection(content.raw())
 		if err != nil {
 			return "", err
 		}
-		return emailID, nil
+		from, to, subject, date := extractHeadersFromRawContent(headers)
+		if from == "" {
+			from = email.From
+		}
+		if to == "" {
+			to = strings.Join(email.To, ", ")
+		}
+		return save(emailRow{
+			ID: emailIDFor(email), From: from, To: to, Subject: subject, Date: date,
+			Body: oversizeNotice,
+		})
+	}
+
+	// Parse email using enmime
+	env, parseErr := enmime.ReadEnvelope(content.raw())
+	if parseErr != nil {
+		log.Printf("Warning: enmime parse error: %v, storing raw content", parseErr)
+		return save(emailRow{
+			ID: emailIDFor(email), From: email.From, To: strings.Join(email.To, ", "),
+			Body: "Email parsing failed",
+		})
 	}
 
 	// Check for parsing errors (enmime continues even with errors)
@@ -188,66 +399,216 @@ func (ps *PostgresStorage) Save(email Email) (string, error) {
 		from = email.From
 	}
 	if to == "" {
-		to = email.To
+		to = strings.Join(email.To, ", ")
 	}
 
-	emailID := generateUUIDv7()
-	_, err = ps.db.Exec(
-		`INSERT INTO email (id, "from", "to", subject, date, body, raw_content)
-		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-		emailID, from, to, subject, date, htmlBody, email.Content,
-	)
+	attachments := extractAttachments(env)
+	emailID, err := save(emailRow{
+		ID: emailIDFor(email), From: from, To: to, Subject: subject, Date: date,
+		Body: htmlBody, Text: env.Text, Attachments: attachments,
+	})
 	if err != nil {
 		return "", err
 	}
 
-	log.Printf("Email saved to postgres: id=%s, from=%s, to=%s, inline_images=%d",
-		emailID, from, to, len(env.Inlines))
+	log.Printf("Email saved to postgres: id=%s, from=%s, to=%s, recipients=%d, attachments=%d",
+		emailID, from, to, len(email.To), len(attachments))
 
 	return emailID, nil
 }
 
-// EmailSummary represents email metadata for inbox listing (no body/attachments)
-type EmailSummary struct {
-	ID        string    `json:"id"`
-	From      string    `json:"from"`
-	To        string    `json:"to"`
-	Subject   string    `json:"subject"`
-	Date      string    `json:"date"`
-	CreatedAt time.Time `json:"created_at"`
+// MaxInlineRawSize is the largest raw message stored without a blob
+// store. The driver cannot stream a parameter, so raw_content is held in
+// memory while it is inserted; memory stays bounded by the message size
+// limit only with a blob store, or with a limit of at most this.
+const MaxInlineRawSize = 32 << 20
+
+// storeRaw fills the raw message columns of row from the spool file: its
+// SHA-256, and either the content or its blob key, for insertEmail to
+// upload it. Without a blob store the content is read once, into the
+// string the column is inserted from, up to MaxInlineRawSize; with one it
+// is streamed.
+func (ps *PostgresStorage) storeRaw(ctx context.Context, spool io.ReadSeeker, row *emailRow) error {
+	if ps.blobs == nil {
+		size, err := spool.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if size > MaxInlineRawSize {
+			return fmt.Errorf("raw message of %d bytes exceeds %d bytes, the limit without a blob store", size, MaxInlineRawSize)
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		var raw strings.Builder
+		raw.Grow(int(size))
+		digest, _, err := hashContent(io.TeeReader(spool, &raw))
+		if err != nil {
+			return err
+		}
+		row.RawSHA256, row.RawContent = digest, raw.String()
+		return nil
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	digest, size, err := hashContent(spool)
+	if err != nil {
+		return err
+	}
+	row.RawSHA256 = digest
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	row.RawRef = blobKey("raw", digest)
+	row.raw, row.rawSize = spool, size
+	return nil
+}
+
+// lockBlob takes the lock, held until tx ends, that serialises uploading
+// the blob ref for a new email and deleting it once unused
+func lockBlob(ctx context.Context, tx *sql.Tx, ref string) error {
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, ref)
+	return err
 }
 
-// EmailDetail represents a full email with body and attachment metadata
-type EmailDetail struct {
-	ID        string    `json:"id"`
-	From      string    `json:"from"`
-	To        string    `json:"to"`
-	Subject   string    `json:"subject"`
-	Date      string    `json:"date"`
-	Body      string    `json:"body"`
-	CreatedAt time.Time `json:"created_at"`
+// deleteRawBlob deletes the raw message blob ref unless an email refers to
+// it. Under the lock, an email being inserted with it either committed
+// before the check or uploads the blob again after the delete.
+func (ps *PostgresStorage) deleteRawBlob(ctx context.Context, ref string) error {
+	tx, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := lockBlob(ctx, tx, ref); err != nil {
+		return err
+	}
+	var used bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM email WHERE raw_ref = $1)`, ref).Scan(&used); err != nil {
+		return err
+	}
+	if !used {
+		if err := ps.blobs.Delete(ctx, ref); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-// GetInbox fetches email summaries for a recipient (5 per page).
+// mailboxFilter matches the emails of mailbox $1 ($2 normalized): those
+// that had it as an envelope recipient, or (for rows stored before
+// recipients were tracked) whose To header equals it.
+const mailboxFilter = `(id IN (SELECT email_id FROM email_recipient WHERE address = $2) OR "to" = $1)`
+
+// List fetches email summaries for a recipient, PageSize per page.
 // The page parameter is 1-based: page=1 returns rows 1-5, page=2 returns rows 6-10, etc.
-func (ps *PostgresStorage) GetInbox(address string, page int) ([]EmailSummary, error) {
-	if page < 1 {
-		page = 1
+func (ps *PostgresStorage) List(ctx context.Context, mailbox string, page int) ([]EmailSummary, error) {
+	rows, err := ps.db.QueryContext(ctx, `
+		SELECT id, "from", "to", COALESCE(subject, ''), COALESCE(date, ''), created_at
+		FROM email
+		WHERE `+mailboxFilter+`
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3 OFFSET $4
+	`, mailbox, normalizeAddress(mailbox), PageSize, pageOffset(page))
+	if err != nil {
+		return nil, err
+	}
+	return scanSummaries(rows)
+}
+
+// Count returns the number of emails of a recipient
+func (ps *PostgresStorage) Count(ctx context.Context, mailbox string) (int, error) {
+	var n int
+	err := ps.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM email WHERE `+mailboxFilter,
+		mailbox, normalizeAddress(mailbox)).Scan(&n)
+	return n, err
+}
+
+// Search fetches the summaries of the emails matching the query, PageSize
+// per page, newest first. The text is a web search query over the
+// search_vector index of the addresses, subject and plain-text body.
+func (ps *PostgresStorage) Search(ctx context.Context, query SearchQuery) ([]EmailSummary, error) {
+	var conds []string
+	var args []any
+	if query.Mailbox != "" {
+		conds = append(conds, mailboxFilter)
+		args = append(args, query.Mailbox, normalizeAddress(query.Mailbox))
+	}
+	param := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if query.Text != "" {
+		conds = append(conds, "search_vector @@ websearch_to_tsquery('english', "+param(query.Text)+")")
+	}
+	// created_at is a local TIMESTAMP; comparing with timestamptz converts it
+	if !query.Since.IsZero() {
+		conds = append(conds, "created_at >= "+param(query.Since)+"::timestamptz")
 	}
-	const pageSize = 5
-	sqlOffset := (page - 1) * pageSize
-	rows, err := ps.db.Query(`
+	if !query.Until.IsZero() {
+		conds = append(conds, "created_at < "+param(query.Until)+"::timestamptz")
+	}
+	where := "TRUE"
+	if len(conds) > 0 {
+		where = strings.Join(conds, " AND ")
+	}
+	rows, err := ps.db.QueryContext(ctx, `
 		SELECT id, "from", "to", COALESCE(subject, ''), COALESCE(date, ''), created_at
 		FROM email
-		WHERE "to" = $1
-		ORDER BY created_at DESC
-		LIMIT $2 OFFSET $3
-	`, address, pageSize, sqlOffset)
+		WHERE `+where+`
+		ORDER BY created_at DESC, id DESC
+		LIMIT `+param(PageSize)+` OFFSET `+param(pageOffset(query.Page)),
+		args...)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return scanSummaries(rows)
+}
 
+// DefaultBackfillBatch is the number of emails BackfillSearch indexes per
+// statement when its batch is zero
+const DefaultBackfillBatch = 1000
+
+// BackfillSearch indexes the emails stored before search_vector existed,
+// from their HTML body with the tags stripped, batch rows per statement
+// so no long lock is held on the email table. It returns how many it
+// indexed; those not indexed yet are not found by Search.
+func (ps *PostgresStorage) BackfillSearch(ctx context.Context, batch int) (int, error) {
+	if batch <= 0 {
+		batch = DefaultBackfillBatch
+	}
+	total := 0
+	for {
+		res, err := ps.db.ExecContext(ctx, `
+			UPDATE email SET search_vector =
+				to_tsvector('simple', COALESCE("from", '') || ' ' || COALESCE("to", '') || ' ' ||
+					regexp_replace(COALESCE("from", '') || ' ' || COALESCE("to", ''), '[@.<>"]+', ' ', 'g'))
+				|| to_tsvector('english', COALESCE(subject, ''))
+				|| to_tsvector('english', left(regexp_replace(COALESCE(body, ''), '<[^>]*>|data:[^"'' ]*', ' ', 'g'), $2))
+			WHERE id IN (
+				SELECT id FROM email WHERE search_vector IS NULL
+				LIMIT $1 FOR UPDATE SKIP LOCKED
+			)
+		`, batch, maxSearchText)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += int(n)
+		if int(n) < batch {
+			return total, nil
+		}
+	}
+}
+
+// scanSummaries reads and closes rows of email summaries
+func scanSummaries(rows *sql.Rows) ([]EmailSummary, error) {
+	defer rows.Close()
 	emails := make([]EmailSummary, 0)
 	for rows.Next() {
 		var email EmailSummary
@@ -259,38 +620,90 @@ func (ps *PostgresStorage) GetInbox(address string, page int) ([]EmailSummary, e
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-
 	return emails, nil
 }
 
-// GetEmailByID fetches full email detail including body and attachments by UUIDv7
-func (ps *PostgresStorage) GetEmailByID(id string) (*EmailDetail, error) {
+// Get fetches full email detail including body and attachments by UUIDv7
+func (ps *PostgresStorage) Get(ctx context.Context, id string) (*EmailDetail, error) {
+	// Anything but a UUID cannot be stored, and would be a query error
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrNotFound
+	}
 	var email EmailDetail
-	var rawContent sql.NullString
-	err := ps.db.QueryRow(`
+	var rawContent, rawRef sql.NullString
+	var spfResult, spfDomain, spfReason sql.NullString
+	var dmarcResult, dmarcDomain, dmarcPolicy, dmarcReason sql.NullString
+	var dmarcSPFAligned, dmarcDKIMAligned sql.NullBool
+	var clientIP, helo, tlsVersion, tlsCipher, authUser sql.NullString
+	var receivedAt sql.NullTime
+	err := ps.db.QueryRowContext(ctx, `
 		SELECT id, "from", "to", COALESCE(subject, ''), COALESCE(date, ''),
-		       COALESCE(body, ''), raw_content, created_at
+		       COALESCE(body, ''), raw_content, raw_ref, created_at,
+		       spf_result, spf_domain, spf_reason,
+		       dmarc_result, dmarc_domain, dmarc_policy,
+		       dmarc_spf_aligned, dmarc_dkim_aligned, dmarc_reason,
+		       client_ip, helo, tls_version, tls_cipher, auth_user, received_at
 		FROM email WHERE id = $1
 	`, id).Scan(
 		&email.ID, &email.From, &email.To, &email.Subject, &email.Date,
-		&email.Body, &rawContent, &email.CreatedAt,
+		&email.Body, &rawContent, &rawRef, &email.CreatedAt,
+		&spfResult, &spfDomain, &spfReason,
+		&dmarcResult, &dmarcDomain, &dmarcPolicy,
+		&dmarcSPFAligned, &dmarcDKIMAligned, &dmarcReason,
+		&clientIP, &helo, &tlsVersion, &tlsCipher, &authUser, &receivedAt,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, nil
+			return nil, ErrNotFound
 		}
 		return nil, err
 	}
+	if spfResult.Valid {
+		email.SPF = &SPFResult{Result: spfResult.String, Domain: spfDomain.String, Reason: spfReason.String}
+	}
+	if dmarcResult.Valid {
+		email.DMARC = &DMARCResult{
+			Result:      dmarcResult.String,
+			Domain:      dmarcDomain.String,
+			Policy:      dmarcPolicy.String,
+			SPFAligned:  dmarcSPFAligned.Bool,
+			DKIMAligned: dmarcDKIMAligned.Bool,
+			Reason:      dmarcReason.String,
+		}
+	}
+	if receivedAt.Valid || clientIP.Valid {
+		email.Connection = &ConnectionInfo{
+			ClientIP:   clientIP.String,
+			Helo:       helo.String,
+			TLSVersion: tlsVersion.String,
+			TLSCipher:  tlsCipher.String,
+			AuthUser:   authUser.String,
+			ReceivedAt: receivedAt.Time,
+		}
+	}
+	if email.DKIM, err = ps.getDKIMResults(ctx, id); err != nil {
+		return nil, err
+	}
+	if email.DNSBL, err = ps.getDNSBLResults(ctx, id); err != nil {
+		return nil, err
+	}
+	if email.Attachments, err = ps.getAttachments(ctx, id); err != nil {
+		return nil, err
+	}
 
-	// If body is empty, try to reprocess raw_content
-	if email.Body == "" && rawContent.Valid && rawContent.String != "" {
-		rawContentStr := rawContent.String
-
+	// If body is empty, try to reprocess the raw message
+	if email.Body == "" && (rawContent.String != "" || rawRef.Valid) {
+		raw, err := ps.openRaw(ctx, rawContent, rawRef)
+		if err != nil {
+			return nil, err
+		}
 		// Re-parse with enmime
-		if env, err := enmime.ReadEnvelope(strings.NewReader(rawContentStr)); err == nil {
+		env, err := enmime.ReadEnvelope(raw)
+		raw.Close()
+		if err == nil {
 			email.Body = emailToHTML(env)
 			// Update database so we don't reprocess again
-			ps.db.Exec(`UPDATE email SET body = $1 WHERE id = $2`, email.Body, id)
+			ps.db.ExecContext(ctx, `UPDATE email SET body = $1 WHERE id = $2`, email.Body, id)
 		} else {
 			log.Printf("Failed to reprocess email %s: %v", id, err)
 			email.Body = "<pre>Email parsing failed</pre>"
@@ -300,6 +713,328 @@ func (ps *PostgresStorage) GetEmailByID(id string) (*EmailDetail, error) {
 	return &email, nil
 }
 
+// getDKIMResults returns the DKIM results of an email in signature order
+func (ps *PostgresStorage) getDKIMResults(ctx context.Context, id string) ([]DKIMResult, error) {
+	rows, err := ps.db.QueryContext(ctx, `
+		SELECT result, domain, selector, COALESCE(algorithm, ''),
+		       COALESCE(identifier, ''), COALESCE(reason, '')
+		FROM email_dkim WHERE email_id = $1 ORDER BY position
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []DKIMResult
+	for rows.Next() {
+		var r DKIMResult
+		if err := rows.Scan(&r.Result, &r.Domain, &r.Selector, &r.Algorithm, &r.Identifier, &r.Reason); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// getDNSBLResults returns the blocklist listings recorded for an email
+func (ps *PostgresStorage) getDNSBLResults(ctx context.Context, id string) ([]DNSBLResult, error) {
+	rows, err := ps.db.QueryContext(ctx, `
+		SELECT zone, codes, action, COALESCE(reason, '')
+		FROM email_dnsbl WHERE email_id = $1 ORDER BY zone
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []DNSBLResult
+	for rows.Next() {
+		var r DNSBLResult
+		var codes string
+		if err := rows.Scan(&r.Zone, &codes, &r.Action, &r.Reason); err != nil {
+			return nil, err
+		}
+		r.Codes = strings.Split(codes, ",")
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// getAttachments returns the attachment metadata of an email in MIME order
+func (ps *PostgresStorage) getAttachments(ctx context.Context, id string) ([]Attachment, error) {
+	rows, err := ps.db.QueryContext(ctx, `
+		SELECT position, COALESCE(filename, ''), content_type, size, sha256,
+		       COALESCE(content_id, ''), COALESCE(disposition, '')
+		FROM email_attachment WHERE email_id = $1 ORDER BY position
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.Index, &a.Filename, &a.ContentType, &a.Size, &a.SHA256, &a.ContentID, &a.Disposition); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// OpenRaw streams the raw message of an email, from the database or the
+// blob store
+func (ps *PostgresStorage) OpenRaw(ctx context.Context, id string) (io.ReadCloser, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrNotFound
+	}
+	var content, ref sql.NullString
+	err := ps.db.QueryRowContext(ctx, `SELECT raw_content, raw_ref FROM email WHERE id = $1`, id).Scan(&content, &ref)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ps.openRaw(ctx, content, ref)
+}
+
+// openRaw streams a raw message from the raw_content and raw_ref columns
+// of its row
+func (ps *PostgresStorage) openRaw(ctx context.Context, content, ref sql.NullString) (io.ReadCloser, error) {
+	if !ref.Valid {
+		return io.NopCloser(strings.NewReader(content.String)), nil
+	}
+	return ps.openBlob(ctx, ref.String)
+}
+
+// openBlob streams content from the blob store. A missing blob is an
+// error, not ErrNotFound: the row refers to it.
+func (ps *PostgresStorage) openBlob(ctx context.Context, ref string) (io.ReadCloser, error) {
+	if ps.blobs == nil {
+		return nil, fmt.Errorf("blob %s: no blob store configured", ref)
+	}
+	r, err := ps.blobs.Open(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("blob %s: %w", ref, err)
+	}
+	return r, nil
+}
+
+// OpenAttachment returns attachment n of an email with its content
+func (ps *PostgresStorage) OpenAttachment(ctx context.Context, id string, n int) (*Attachment, io.ReadCloser, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, nil, ErrNotFound
+	}
+	a := Attachment{Index: n}
+	var data []byte
+	var ref sql.NullString
+	err := ps.db.QueryRowContext(ctx, `
+		SELECT COALESCE(a.filename, ''), a.content_type, a.size, a.sha256,
+		       COALESCE(a.content_id, ''), COALESCE(a.disposition, ''), b.data, b.ref
+		FROM email_attachment a JOIN attachment_blob b ON b.sha256 = a.sha256
+		WHERE a.email_id = $1 AND a.position = $2
+	`, id, n).Scan(&a.Filename, &a.ContentType, &a.Size, &a.SHA256, &a.ContentID, &a.Disposition, &data, &ref)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if data == nil && ref.Valid {
+		r, err := ps.openBlob(ctx, ref.String)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &a, r, nil
+	}
+	return &a, io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Delete removes an email; its recipients, authentication results and
+// attachment links are removed with it, and so are its raw message and
+// attachment contents when no other email refers to them. Blobs are
+// deleted after the commit; one that fails to delete is only logged.
+func (ps *PostgresStorage) Delete(ctx context.Context, id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrNotFound
+	}
+	n, err := ps.deleteEmails(ctx, []string{id})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// deleteEmails deletes the emails of ids, as Delete does, in one
+// transaction and returns how many existed
+func (ps *PostgresStorage) deleteEmails(ctx context.Context, ids []string) (int, error) {
+	tx, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	digests, err := queryStrings(ctx, tx,
+		`SELECT DISTINCT sha256 FROM email_attachment WHERE email_id = ANY($1::uuid[])`, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.QueryContext(ctx, `DELETE FROM email WHERE id = ANY($1::uuid[]) RETURNING raw_ref`, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	rawRefs := make(map[string]bool)
+	for rows.Next() {
+		var ref sql.NullString
+		if err := rows.Scan(&ref); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		deleted++
+		if ref.Valid {
+			rawRefs[ref.String] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var unused []string
+	for _, digest := range digests {
+		var ref sql.NullString
+		err := tx.QueryRowContext(ctx, `
+			DELETE FROM attachment_blob b WHERE sha256 = $1
+			AND NOT EXISTS (SELECT 1 FROM email_attachment a WHERE a.sha256 = b.sha256)
+			RETURNING ref`, digest).Scan(&ref)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+		if ref.Valid {
+			unused = append(unused, ref.String)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	for ref := range rawRefs {
+		if ps.blobs == nil {
+			log.Printf("Warning: blob %s may no longer be used, but no blob store is configured to delete it", ref)
+			continue
+		}
+		if err := ps.deleteRawBlob(ctx, ref); err != nil {
+			log.Printf("Warning: failed to delete blob %s: %v", ref, err)
+		}
+	}
+	ps.deleteBlobs(ctx, unused)
+	return deleted, nil
+}
+
+// queryStrings returns the single text column of a query's rows
+func queryStrings(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// Expire deletes the expired emails, opts.Batch per transaction. Emails
+// older than the shortest TTL are read in ID order with their recipients,
+// and each batch's expired ones are deleted before the next is read.
+func (ps *PostgresStorage) Expire(ctx context.Context, policy RetentionPolicy, opts ExpireOptions) (ExpireResult, error) {
+	var result ExpireResult
+	if !policy.Enabled() {
+		return result, nil
+	}
+	now := opts.now()
+	cutoff := now.Add(-policy.minTTL())
+	after := uuid.Nil.String()
+	for {
+		// created_at is a local TIMESTAMP; the cast makes it an instant
+		rows, err := ps.db.QueryContext(ctx, `
+			SELECT id, created_at::timestamptz, COALESCE("to", ''),
+			       ARRAY(SELECT address FROM email_recipient WHERE email_id = email.id)
+			FROM email
+			WHERE created_at < $1::timestamptz AND id > $2
+			ORDER BY id
+			LIMIT $3
+		`, cutoff, after, opts.batch())
+		if err != nil {
+			return result, err
+		}
+		var expired []string
+		byRule := make(map[string]int)
+		scanned := 0
+		for rows.Next() {
+			var id, to string
+			var createdAt time.Time
+			var recipients []string
+			if err := rows.Scan(&id, &createdAt, &to, pq.Array(&recipients)); err != nil {
+				rows.Close()
+				return result, err
+			}
+			scanned++
+			after = id
+			ttl, rule := policy.ttlForAll(recipientsOf(recipients, to))
+			if ttl > 0 && !createdAt.Add(ttl).After(now) {
+				expired = append(expired, id)
+				byRule[rule]++
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return result, err
+		}
+
+		if len(expired) > 0 && !opts.DryRun {
+			if _, err := ps.deleteEmails(ctx, expired); err != nil {
+				return result, err
+			}
+		}
+		for rule, n := range byRule {
+			result.add(rule, n)
+		}
+		if scanned < opts.batch() {
+			return result, nil
+		}
+	}
+}
+
+// deleteBlobs removes blobs no row refers to any more. Failures leave
+// unreachable blobs behind, so they are logged rather than returned.
+func (ps *PostgresStorage) deleteBlobs(ctx context.Context, refs []string) {
+	for _, ref := range refs {
+		if ps.blobs == nil {
+			log.Printf("Warning: blob %s is no longer used, but no blob store is configured to delete it", ref)
+			continue
+		}
+		if err := ps.blobs.Delete(ctx, ref); err != nil {
+			log.Printf("Warning: failed to delete blob %s: %v", ref, err)
+		}
+	}
+}
+
+// Ping checks that the database is reachable
+func (ps *PostgresStorage) Ping(ctx context.Context) error {
+	return ps.db.PingContext(ctx)
+}
+
 // Close closes the database connection
 func (ps *PostgresStorage) Close() error {
 	if ps.db != nil {
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultExpireBatch is the number of emails deleted per transaction when
+// ExpireOptions.Batch is zero
+const DefaultExpireBatch = 500
+
+// RetentionDefault names the global TTL in ExpireResult.ByRule
+const RetentionDefault = "default"
+
+// RetentionPolicy decides how long emails are kept. A TTL of zero keeps
+// emails forever.
+type RetentionPolicy struct {
+	TTL time.Duration // For every mailbox without an override
+	// Overrides replace TTL by lowercase mailbox address, or by domain;
+	// an address override wins over its domain's
+	Overrides map[string]time.Duration
+}
+
+// ParseRetentionOverrides parses a RETENTION_OVERRIDES value:
+// comma-separated <domain or address>=<Go duration> pairs, e.g.
+// "example.com=24h,vip@example.com=0". Zero keeps that mail forever.
+func ParseRetentionOverrides(value string) (map[string]time.Duration, error) {
+	overrides := make(map[string]time.Duration)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, ttl, ok := strings.Cut(entry, "=")
+		key = normalizeAddress(key)
+		d, err := time.ParseDuration(strings.TrimSpace(ttl))
+		if !ok || key == "" || err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid retention override %q (want <domain or address>=<duration>)", entry)
+		}
+		overrides[key] = d
+	}
+	return overrides, nil
+}
+
+// Enabled reports whether the policy expires any email
+func (p RetentionPolicy) Enabled() bool {
+	return p.minTTL() > 0
+}
+
+// minTTL returns the shortest TTL other than forever, or zero when every
+// email is kept forever. No email younger than it can be expired.
+func (p RetentionPolicy) minTTL() time.Duration {
+	shortest := p.TTL
+	for _, ttl := range p.Overrides {
+		if ttl > 0 && (shortest == 0 || ttl < shortest) {
+			shortest = ttl
+		}
+	}
+	return shortest
+}
+
+// ttlFor returns the TTL of a mailbox and the rule it comes from: the
+// address, its domain or RetentionDefault
+func (p RetentionPolicy) ttlFor(mailbox string) (time.Duration, string) {
+	mailbox = normalizeAddress(mailbox)
+	if ttl, ok := p.Overrides[mailbox]; ok {
+		return ttl, mailbox
+	}
+	if i := strings.LastIndex(mailbox, "@"); i >= 0 {
+		if ttl, ok := p.Overrides[mailbox[i+1:]]; ok {
+			return ttl, mailbox[i+1:]
+		}
+	}
+	return p.TTL, RetentionDefault
+}
+
+// ttlForAll returns the TTL of an email delivered to several mailboxes:
+// the longest of theirs, so no recipient loses mail early, and forever if
+// any keeps it forever
+func (p RetentionPolicy) ttlForAll(mailboxes []string) (time.Duration, string) {
+	if len(mailboxes) == 0 {
+		return p.TTL, RetentionDefault
+	}
+	var longest time.Duration
+	var rule string
+	for _, m := range mailboxes {
+		ttl, r := p.ttlFor(m)
+		if ttl == 0 {
+			return 0, r
+		}
+		if ttl > longest {
+			longest, rule = ttl, r
+		}
+	}
+	return longest, rule
+}
+
+// ExpireOptions controls one expiry pass
+type ExpireOptions struct {
+	Now    time.Time // Zero means time.Now()
+	Batch  int       // Emails deleted per transaction; zero means DefaultExpireBatch
+	DryRun bool      // Count the expired emails without deleting them
+}
+
+func (o ExpireOptions) now() time.Time {
+	if o.Now.IsZero() {
+		return time.Now()
+	}
+	return o.Now
+}
+
+func (o ExpireOptions) batch() int {
+	if o.Batch <= 0 {
+		return DefaultExpireBatch
+	}
+	return o.Batch
+}
+
+// ExpireResult counts the emails an expiry pass deleted, or would delete
+// in a dry run
+type ExpireResult struct {
+	Purged int
+	// ByRule splits Purged by the rule that set the TTL: an address, a
+	// domain or RetentionDefault
+	ByRule map[string]int
+}
+
+func (r *ExpireResult) add(rule string, n int) {
+	if n == 0 {
+		return
+	}
+	if r.ByRule == nil {
+		r.ByRule = make(map[string]int)
+	}
+	r.Purged += n
+	r.ByRule[rule] += n
+}
+
+func (r *ExpireResult) merge(other ExpireResult) {
+	for rule, n := range other.ByRule {
+		r.add(rule, n)
+	}
+}
+
+// Expirer is a Storage that can delete the emails a RetentionPolicy has
+// expired
+type Expirer interface {
+	// Expire deletes the emails older than their TTL under policy, and
+	// returns how many it deleted. Deletions are batched, so an error
+	// leaves the batches before it deleted.
+	Expire(ctx context.Context, policy RetentionPolicy, opts ExpireOptions) (ExpireResult, error)
+}
+
+// expireAll expires the emails of every backend that is an Expirer and
+// adds up the results
+func expireAll(ctx context.Context, backends []Storage, policy RetentionPolicy, opts ExpireOptions) (ExpireResult, error) {
+	var result ExpireResult
+	for _, b := range backends {
+		e, ok := b.(Expirer)
+		if !ok {
+			continue
+		}
+		r, err := e.Expire(ctx, policy, opts)
+		result.merge(r)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// recipientsOf returns the mailboxes of an email row: its envelope
+// recipients, or for rows stored before recipients were tracked, the
+// addresses of its To header
+func recipientsOf(recipients []string, to string) []string {
+	if len(recipients) > 0 || to == "" {
+		return recipients
+	}
+	list, err := mail.ParseAddressList(to)
+	if err != nil {
+		return []string{to}
+	}
+	mailboxes := make([]string, len(list))
+	for i, a := range list {
+		mailboxes[i] = a.Address
+	}
+	return mailboxes
+}
+
+// Janitor deletes expired emails from a store periodically
+type Janitor struct {
+	store    Expirer
+	policy   RetentionPolicy
+	interval time.Duration
+	batch    int
+}
+
+// NewJanitor returns a janitor expiring store under policy every
+// interval (zero means an hour), batch emails per transaction (zero means
+// DefaultExpireBatch)
+func NewJanitor(store Expirer, policy RetentionPolicy, interval time.Duration, batch int) *Janitor {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	return &Janitor{store: store, policy: policy, interval: interval, batch: batch}
+}
+
+// Run expires emails right away and then every interval until ctx is
+// done, logging the number purged per rule
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		result, err := j.store.Expire(ctx, j.policy, ExpireOptions{Batch: j.batch})
+		if result.Purged > 0 {
+			log.Printf("Retention: purged %d expired email(s) (%s)", result.Purged, result.rules())
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Retention: failed to expire emails: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rules formats ByRule as "rule=n" pairs in rule order
+func (r ExpireResult) rules() string {
+	rules := make([]string, 0, len(r.ByRule))
+	for rule, n := range r.ByRule {
+		rules = append(rules, fmt.Sprintf("%s=%d", rule, n))
+	}
+	sort.Strings(rules)
+	return strings.Join(rules, ", ")
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionOverrides(t *testing.T) {
+	got, err := ParseRetentionOverrides(" Example.com=24h, vip@example.com=0 ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["example.com"] != 24*time.Hour || got["vip@example.com"] != 0 {
+		t.Errorf("Unexpected overrides %v", got)
+	}
+	for _, bad := range []string{"example.com", "example.com=1d", "=1h", "example.com=-1h"} {
+		if _, err := ParseRetentionOverrides(bad); err == nil {
+			t.Errorf("ParseRetentionOverrides(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestRetentionPolicy_TTL(t *testing.T) {
+	p := RetentionPolicy{TTL: 24 * time.Hour, Overrides: map[string]time.Duration{
+		"short.com":     time.Hour,
+		"vip@short.com": 0,
+		"long.com":      48 * time.Hour,
+	}}
+	tests := []struct {
+		mailboxes []string
+		ttl       time.Duration
+		rule      string
+	}{
+		{nil, 24 * time.Hour, RetentionDefault},
+		{[]string{"bob@other.com"}, 24 * time.Hour, RetentionDefault},
+		{[]string{"Bob@Short.com"}, time.Hour, "short.com"},
+		{[]string{"vip@short.com"}, 0, "vip@short.com"},
+		{[]string{"bob@short.com", "bob@long.com"}, 48 * time.Hour, "long.com"},
+		{[]string{"bob@long.com", "vip@short.com"}, 0, "vip@short.com"},
+	}
+	for _, tt := range tests {
+		ttl, rule := p.ttlForAll(tt.mailboxes)
+		if ttl != tt.ttl || rule != tt.rule {
+			t.Errorf("ttlForAll(%v) = %s, %q; want %s, %q", tt.mailboxes, ttl, rule, tt.ttl, tt.rule)
+		}
+	}
+	if got := p.minTTL(); got != time.Hour {
+		t.Errorf("minTTL = %s, want 1h", got)
+	}
+	if (RetentionPolicy{Overrides: map[string]time.Duration{"a.com": 0}}).Enabled() {
+		t.Error("A policy keeping everything is enabled")
+	}
+}
+
+func TestFileStorage_Expire(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fs := NewFileStorage(dir)
+	save := func(to string, age time.Duration) string {
+		t.Helper()
+		id, err := fs.Save(ctx, Email{From: "alice@example.com", To: []string{to}, Content: strings.NewReader("Subject: x\r\n\r\nhi\r\n")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-age)
+		if err := os.Chtimes(filepath.Join(dir, filepath.FromSlash(id)), old, old); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	expiredDefault := save("bob@example.com", 48*time.Hour)
+	fresh := save("bob@example.com", time.Hour)
+	expiredShort := save("carol@short.com", 2*time.Hour)
+	kept := save("vip@short.com", 1000*time.Hour)
+
+	policy := RetentionPolicy{TTL: 24 * time.Hour, Overrides: map[string]time.Duration{"short.com": time.Hour, "vip@short.com": 0}}
+	dry, err := fs.Expire(ctx, policy, ExpireOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dry.Purged != 2 || dry.ByRule[RetentionDefault] != 1 || dry.ByRule["short.com"] != 1 {
+		t.Errorf("Dry run = %+v", dry)
+	}
+	if n, _ := fs.Count(ctx, "bob@example.com"); n != 2 {
+		t.Errorf("Dry run deleted emails: %d left", n)
+	}
+
+	result, err := fs.Expire(ctx, policy, ExpireOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Purged != 2 {
+		t.Errorf("Expire = %+v, want 2 purged", result)
+	}
+	for _, id := range []string{expiredDefault, expiredShort} {
+		if _, err := fs.Get(ctx, id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expired %s still stored: %v", id, err)
+		}
+	}
+	for _, id := range []string{fresh, kept} {
+		if _, err := fs.Get(ctx, id); err != nil {
+			t.Errorf("%s was expired: %v", id, err)
+		}
+	}
+}
+
+func TestFailoverStorage_Expire(t *testing.T) {
+	ctx := context.Background()
+	fallback := NewFileStorage(t.TempDir())
+	fs, err := NewFailoverStorage(FailoverConfig{Primary: &pingableMemory{}, Fallback: fallback, BacklogDir: filepath.Join(t.TempDir(), "backlog")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := fallback.Save(ctx, Email{From: "alice@example.com", To: []string{"bob@example.com"}, Content: strings.NewReader("Subject: x\r\n\r\nhi\r\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The memory primary cannot expire, the file fallback can
+	result, err := fs.Expire(ctx, RetentionPolicy{TTL: time.Hour}, ExpireOptions{Now: time.Now().Add(2 * time.Hour)})
+	if err != nil || result.Purged != 1 {
+		t.Fatalf("Expire = %+v, %v; want 1 purged", result, err)
+	}
+	if _, err := fallback.Get(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expired email still stored: %v", err)
+	}
+}
+
+// TestPostgresStorage_Expire runs against the database in TEST_DB_URL,
+// which it empties; it is skipped when that is not set.
+func TestPostgresStorage_Expire(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_URL")
+	if dsn == "" {
+		t.Skip("TEST_DB_URL not set")
+	}
+	ctx := context.Background()
+	ps := newTestPostgres(t, dsn)
+	var ids []string
+	for _, to := range [][]string{{"bob@example.com"}, {"bob@example.com", "vip@example.com"}, {"carol@short.com"}} {
+		id, err := ps.Save(ctx, Email{From: "alice@example.com", To: to, Content: strings.NewReader("Subject: x\r\n\r\nhi\r\n")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := ps.db.Exec(`UPDATE email SET created_at = created_at - INTERVAL '2 days' WHERE id <> $1`, ids[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := RetentionPolicy{TTL: 24 * time.Hour, Overrides: map[string]time.Duration{"vip@example.com": 0, "short.com": 72 * time.Hour}}
+	dry, err := ps.Expire(ctx, policy, ExpireOptions{DryRun: true, Batch: 1})
+	if err != nil || dry.Purged != 1 || dry.ByRule[RetentionDefault] != 1 {
+		t.Fatalf("Dry run = %+v, %v; want the first email", dry, err)
+	}
+	result, err := ps.Expire(ctx, policy, ExpireOptions{Batch: 1})
+	if err != nil || result.Purged != 1 {
+		t.Fatalf("Expire = %+v, %v", result, err)
+	}
+	if _, err := ps.Get(ctx, ids[0]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expired email still stored: %v", err)
+	}
+	for _, id := range ids[1:] {
+		if _, err := ps.Get(ctx, id); err != nil {
+			t.Errorf("Email %s was expired: %v", id, err)
+		}
+	}
+}
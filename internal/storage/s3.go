@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3BlobStore
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g.
+	// https://s3.eu-west-1.amazonaws.com or http://localhost:9000 for MinIO
+	Endpoint        string
+	Region          string // Defaults to us-east-1
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Client sends the requests; nil uses http.DefaultClient
+	Client *http.Client
+}
+
+// S3BlobStore keeps blobs as objects in a bucket of an S3-compatible
+// service (AWS S3, MinIO, Ceph, R2...). Requests use path-style URLs and
+// are signed with AWS Signature Version 4.
+type S3BlobStore struct {
+	cfg      S3Config
+	endpoint *url.URL
+}
+
+// NewS3BlobStore returns a store for the bucket of cfg. It does not
+// contact the service.
+func NewS3BlobStore(cfg S3Config) (*S3BlobStore, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q (want http://host[:port] or https://host[:port])", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is required")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("S3 access key and secret key are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	return &S3BlobStore{cfg: cfg, endpoint: endpoint}, nil
+}
+
+// Put uploads the content in one PUT request. The payload is not signed,
+// so it is streamed without being read twice.
+func (bs *S3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	var body io.ReadCloser = http.NoBody
+	if size > 0 {
+		// The transport closes the body; r belongs to the caller
+		body = io.NopCloser(r)
+	}
+	resp, err := bs.do(ctx, http.MethodPut, key, body, size, unsignedPayload)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Open streams the object of key
+func (bs *S3BlobStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := bs.do(ctx, http.MethodGet, key, http.NoBody, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the object of key
+func (bs *S3BlobStore) Delete(ctx context.Context, key string) error {
+	resp, err := bs.do(ctx, http.MethodDelete, key, http.NoBody, 0, emptyPayloadHash)
+	if err == ErrBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request for the object of key. Responses other than
+// 2xx are closed and returned as errors; 404 is ErrBlobNotFound.
+func (bs *S3BlobStore) do(ctx context.Context, method, key string, body io.ReadCloser, size int64, payloadHash string) (*http.Response, error) {
+	if !validBlobKey(key) {
+		return nil, fmt.Errorf("invalid blob key %q", key)
+	}
+	u := *bs.endpoint
+	u.Path = u.Path + "/" + bs.cfg.Bucket + "/" + key
+	u.RawPath = s3Escape(u.Path)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, bs.cfg.AccessKeyID, bs.cfg.SecretAccessKey, bs.cfg.Region, time.Now())
+
+	resp, err := bs.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrBlobNotFound
+	}
+	var s3Err struct {
+		Code    string
+		Message string
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&s3Err)
+	if s3Err.Code == "" {
+		s3Err.Code = resp.Status
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, s3Err.Code, s3Err.Message)
+}
+
+const (
+	// unsignedPayload is the payload hash of requests whose body is not
+	// part of the signature
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// emptyPayloadHash is the SHA-256 of an empty body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// signV4 adds the X-Amz-Date and Authorization headers of AWS Signature
+// Version 4 to req. Every header already set is signed, with the host;
+// X-Amz-Content-Sha256 must be set.
+func signV4(req *http.Request, accessKeyID, secretAccessKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"", // No request has a query string
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters and
+// slashes, as Signature Version 4 expects
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
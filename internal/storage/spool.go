@@ -0,0 +1,640 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// spoolExt marks complete spool entries; anything else in the spool
+	// directory is ignored
+	spoolExt = ".msg"
+	// spoolRetryExt marks the retry state kept beside an entry that failed
+	spoolRetryExt = ".retry"
+	// spoolPollInterval is how often the drain worker looks for entries
+	// when it is not woken by Save
+	spoolPollInterval = 5 * time.Second
+	// spoolMinBackoff is the delay before retrying a failed entry; it
+	// doubles per failure up to spoolMaxBackoff
+	spoolMinBackoff = 5 * time.Second
+	spoolMaxBackoff = 5 * time.Minute
+	// DefaultSpoolMaxAttempts is how many times an entry is tried before it
+	// is moved to failed/; at the maximum backoff this is about four hours
+	DefaultSpoolMaxAttempts = 50
+)
+
+// errSpoolHeader marks entries whose header cannot be read, which no
+// retry will fix
+var errSpoolHeader = errors.New("unreadable spool header")
+
+// SpoolEntry describes a message waiting in the spool
+type SpoolEntry struct {
+	ID        string    `json:"id"`
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Size      int64     `json:"size"` // Raw message bytes
+	QueuedAt  time.Time `json:"queued_at"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	Failed    bool      `json:"failed,omitempty"` // Moved to failed/, no longer retried
+}
+
+// spoolHeader is the first line of a spool file: everything about the
+// Email except its content, which follows the line verbatim
+type spoolHeader struct {
+	From       string         `json:"from"`
+	To         []string       `json:"to"`
+	Connection ConnectionInfo `json:"connection"`
+	SPF        *SPFResult     `json:"spf,omitempty"`
+	DKIM       []DKIMResult   `json:"dkim,omitempty"`
+	DMARC      *DMARCResult   `json:"dmarc,omitempty"`
+	DNSBL      []DNSBLResult  `json:"dnsbl,omitempty"`
+	Truncated  bool           `json:"truncated,omitempty"`
+	QueuedAt   time.Time      `json:"queued_at"`
+}
+
+// spoolRetry is the content of <id>.retry: the failures of one entry, so
+// its backoff and attempt count survive restarts
+type spoolRetry struct {
+	Attempts  int       `json:"attempts"`
+	Next      time.Time `json:"next"`
+	LastError string    `json:"last_error"`
+}
+
+// SpoolStorage writes every message to a local spool directory before
+// reporting it saved, and drains the spool into another Storage in the
+// background. A message is on disk (fsync, then rename into place) by
+// the time the SMTP client sees 250, so database outages and restarts
+// delay messages instead of losing or refusing them. Delivery to the
+// next Storage is at-least-once: a crash between its Save and the
+// removal of the entry replays the message, with the same Email.ID, so
+// backends that honour IDs store it once. An entry that still fails after
+// MaxAttempts tries, or whose header is unreadable, is moved to failed/
+// for an operator to inspect; moving it back into the spool directory
+// retries it.
+//
+// Layout of the spool directory:
+//
+//	tmp/          entries being written
+//	active/       entries being drained
+//	failed/       entries given up on, with their .retry files
+//	<id>.msg      entries waiting for the next Storage
+//	<id>.retry    attempts and next retry of a waiting entry that failed
+type SpoolStorage struct {
+	// MaxAttempts is how many times an entry is tried before it is moved
+	// to failed/; 0 means DefaultSpoolMaxAttempts, and a negative value
+	// retries entries until they are saved
+	MaxAttempts int
+
+	dir  string
+	next Storage
+	now  func() time.Time
+	wake chan struct{}
+}
+
+// NewSpoolStorage creates the spool directory and returns a SpoolStorage
+// draining into next
+func NewSpoolStorage(dir string, next Storage) (*SpoolStorage, error) {
+	for _, sub := range []string{"tmp", "active", "failed"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &SpoolStorage{
+		dir:  dir,
+		next: next,
+		now:  time.Now,
+		wake: make(chan struct{}, 1),
+	}, nil
+}
+
+// Save durably spools the email and returns its ID, which the next
+// Storage is given too. The entry is named after email.ID, or a new ID
+// when it is empty.
+func (ss *SpoolStorage) Save(ctx context.Context, email Email) (string, error) {
+	id := emailIDFor(email)
+	tmp, err := os.CreateTemp(filepath.Join(ss.dir, "tmp"), id+"-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := ss.write(tmp, id, email); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	select {
+	case ss.wake <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// write fills tmp with the entry and moves it into place. The content is
+// copied straight after the header line; when it ends with ErrTruncated,
+// the file is rewritten as a header recording that and the stub.
+func (ss *SpoolStorage) write(tmp *os.File, id string, email Email) (string, error) {
+	header := spoolHeader{
+		From:       email.From,
+		To:         email.To,
+		Connection: email.Connection,
+		SPF:        email.SPF,
+		DKIM:       email.DKIM,
+		DMARC:      email.DMARC,
+		DNSBL:      email.DNSBL,
+		QueuedAt:   ss.now().UTC(),
+	}
+	line, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(tmp)
+	w.Write(line)
+	w.WriteByte('\n')
+	_, err = io.Copy(w, email.Content)
+	if err != nil && !errors.Is(err, ErrTruncated) {
+		return "", err
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	if err != nil {
+		if err := rewriteTruncated(tmp, header, int64(len(line)+1)); err != nil {
+			return "", err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(ss.dir, id+spoolExt)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	// The rename is only durable once the directory is synced. The entry
+	// is queued either way and may already be draining, so a failed sync
+	// is reported as success: failing would have the client resend a
+	// message that is still delivered.
+	if err := syncDir(ss.dir); err != nil {
+		log.Printf("Warning: failed to sync spool directory after queueing %s: %v", id, err)
+	}
+	return path, nil
+}
+
+// rewriteTruncated replaces the entry in f, whose content from offset on
+// was cut at the size limit, with the header marked truncated and the
+// content's header section followed by oversizeNotice
+func rewriteTruncated(f *os.File, header spoolHeader, offset int64) error {
+	headers, err := readHeaderSection(io.NewSectionReader(f, offset, math.MaxInt64-offset))
+	if err != nil {
+		return err
+	}
+	header.Truncated = true
+	line, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = f.WriteString(string(line) + "\n" + headers + oversizeNotice + "\r\n")
+	return err
+}
+
+// Run drains the spool until ctx is cancelled. Entries left in active/ by
+// a previous run that crashed mid-delivery are put back first.
+func (ss *SpoolStorage) Run(ctx context.Context) {
+	if err := ss.recover(); err != nil {
+		log.Printf("Failed to recover spool entries: %v", err)
+	}
+	ticker := time.NewTicker(spoolPollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := ss.drain(ctx, false); err != nil {
+			log.Printf("Failed to drain spool: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-ss.wake:
+		}
+	}
+}
+
+// Flush tries every waiting entry once, ignoring retry delays, and
+// returns how many were delivered
+func (ss *SpoolStorage) Flush(ctx context.Context) (int, error) {
+	return ss.drain(ctx, true)
+}
+
+// drain delivers waiting entries in queue order. Each entry is claimed by
+// renaming it into active/, so concurrent drains (the server and the
+// spool command) never deliver the same entry twice. A failure is recorded
+// in the entry's .retry file before it is put back, or moved to failed/.
+func (ss *SpoolStorage) drain(ctx context.Context, force bool) (int, error) {
+	ids, err := ss.waiting()
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	var lastErr error
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return delivered, ctx.Err()
+		}
+		if !force && !ss.due(id) {
+			continue
+		}
+
+		queued := filepath.Join(ss.dir, id+spoolExt)
+		active := filepath.Join(ss.dir, "active", id+spoolExt)
+		if err := os.Rename(queued, active); err != nil {
+			if os.IsNotExist(err) {
+				continue // Claimed by another drain
+			}
+			return delivered, err
+		}
+
+		location, err := ss.deliver(ctx, active)
+		if err != nil {
+			lastErr = err
+			if err := ss.failed(id, active, err); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		log.Printf("Spooled message %s saved in %s", id, location)
+		delivered++
+		if err := os.Remove(active); err != nil {
+			return delivered, err
+		}
+		ss.delivered(id)
+	}
+	if force {
+		return delivered, lastErr
+	}
+	return delivered, nil
+}
+
+// deliver saves the entry at path to the next Storage. The content is
+// handed on as already spooled, so the layers below read it from the
+// entry instead of spooling it again.
+func (ss *SpoolStorage) deliver(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	header, n, err := readSpoolHeader(bufio.NewReader(f))
+	if err != nil {
+		return "", err
+	}
+	content := &spooledContent{
+		r:         io.NewSectionReader(f, int64(n), info.Size()-int64(n)),
+		truncated: header.Truncated,
+	}
+	return ss.next.Save(ctx, Email{
+		ID:         strings.TrimSuffix(filepath.Base(path), spoolExt),
+		From:       header.From,
+		To:         header.To,
+		Content:    content,
+		Connection: header.Connection,
+		SPF:        header.SPF,
+		DKIM:       header.DKIM,
+		DMARC:      header.DMARC,
+		DNSBL:      header.DNSBL,
+	})
+}
+
+// Entries returns the entries waiting in the spool, oldest first
+func (ss *SpoolStorage) Entries() ([]SpoolEntry, error) {
+	return ss.entries(ss.dir, false)
+}
+
+// Failed returns the entries moved to failed/, oldest first
+func (ss *SpoolStorage) Failed() ([]SpoolEntry, error) {
+	return ss.entries(filepath.Join(ss.dir, "failed"), true)
+}
+
+func (ss *SpoolStorage) entries(dir string, failed bool) ([]SpoolEntry, error) {
+	ids, err := listSpool(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []SpoolEntry
+	for _, id := range ids {
+		entry, err := ss.entry(dir, id)
+		if os.IsNotExist(err) {
+			continue // Drained meanwhile
+		}
+		if err != nil {
+			return nil, fmt.Errorf("spool entry %s: %w", id, err)
+		}
+		entry.Failed = failed
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// entry describes the entry id in dir. An entry with an unreadable header
+// is still described, by its ID, size and error, so it can be found.
+func (ss *SpoolStorage) entry(dir, id string) (SpoolEntry, error) {
+	f, err := os.Open(filepath.Join(dir, id+spoolExt))
+	if err != nil {
+		return SpoolEntry{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return SpoolEntry{}, err
+	}
+	entry := SpoolEntry{ID: id, Size: info.Size()}
+	if retry, err := readSpoolRetry(filepath.Join(dir, id+spoolRetryExt)); err != nil {
+		entry.LastError = err.Error()
+	} else {
+		entry.Attempts, entry.LastError = retry.Attempts, retry.LastError
+	}
+	header, n, err := readSpoolHeader(bufio.NewReader(f))
+	if err != nil {
+		if entry.LastError == "" {
+			entry.LastError = err.Error()
+		}
+		return entry, nil
+	}
+	entry.From = header.From
+	entry.To = header.To
+	entry.Size -= int64(n)
+	entry.QueuedAt = header.QueuedAt
+	entry.Truncated = header.Truncated
+	return entry, nil
+}
+
+// readSpoolHeader reads the header line of a spool file and returns it
+// with its length
+func readSpoolHeader(r *bufio.Reader) (spoolHeader, int, error) {
+	var header spoolHeader
+	line, err := r.ReadBytes('\n')
+	if err == io.EOF {
+		return header, 0, fmt.Errorf("%w: no header line", errSpoolHeader)
+	}
+	if err != nil {
+		return header, 0, fmt.Errorf("reading spool header: %w", err)
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return header, 0, fmt.Errorf("%w: %v", errSpoolHeader, err)
+	}
+	return header, len(line), nil
+}
+
+// waiting returns the IDs of the entries waiting in the spool
+func (ss *SpoolStorage) waiting() ([]string, error) {
+	return listSpool(ss.dir)
+}
+
+// listSpool returns the IDs of the entries in dir. IDs are UUIDv7, so
+// sorting them yields queue order.
+func listSpool(dir string) ([]string, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range dirEntries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), spoolExt) {
+			ids = append(ids, strings.TrimSuffix(e.Name(), spoolExt))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// recover puts entries interrupted mid-delivery back in the queue and
+// removes files of writes that never completed. Recent temporary files may
+// belong to a Save in progress and are left alone.
+func (ss *SpoolStorage) recover() error {
+	tmpEntries, err := os.ReadDir(filepath.Join(ss.dir, "tmp"))
+	if err != nil {
+		return err
+	}
+	for _, e := range tmpEntries {
+		if info, err := e.Info(); err == nil && ss.now().Sub(info.ModTime()) > time.Hour {
+			os.Remove(filepath.Join(ss.dir, "tmp", e.Name()))
+		}
+	}
+
+	dirEntries, err := os.ReadDir(filepath.Join(ss.dir, "active"))
+	if err != nil {
+		return err
+	}
+	for _, e := range dirEntries {
+		if strings.HasSuffix(e.Name(), spoolExt) {
+			log.Printf("Requeueing interrupted spool entry %s", strings.TrimSuffix(e.Name(), spoolExt))
+			if err := os.Rename(filepath.Join(ss.dir, "active", e.Name()), filepath.Join(ss.dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// due reports whether the entry id has no retry pending. An unreadable
+// .retry file does not hold the entry back.
+func (ss *SpoolStorage) due(id string) bool {
+	r, err := readSpoolRetry(ss.retryPath(id))
+	return err != nil || !ss.now().Before(r.Next)
+}
+
+// failed records a failed delivery of the entry id, claimed at active, and
+// puts it back in the queue, or in failed/ once it is out of attempts
+func (ss *SpoolStorage) failed(id, active string, cause error) error {
+	r, err := readSpoolRetry(ss.retryPath(id))
+	if err != nil {
+		log.Printf("Spool entry %s: resetting retry state: %v", id, err)
+	}
+	delay := spoolMaxBackoff
+	if r.Attempts < 10 {
+		delay = min(spoolMinBackoff<<r.Attempts, spoolMaxBackoff)
+	}
+	r.Attempts++
+	r.Next = ss.now().Add(delay)
+	r.LastError = cause.Error()
+	if err := ss.writeRetry(id, r); err != nil {
+		return err
+	}
+
+	maxAttempts := ss.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = DefaultSpoolMaxAttempts
+	}
+	if (maxAttempts < 0 || r.Attempts < maxAttempts) && !errors.Is(cause, errSpoolHeader) {
+		if maxAttempts < 0 {
+			log.Printf("Spooled message %s not saved (attempt %d), will retry: %v", id, r.Attempts, cause)
+		} else {
+			log.Printf("Spooled message %s not saved (attempt %d of %d), will retry: %v", id, r.Attempts, maxAttempts, cause)
+		}
+		return os.Rename(active, filepath.Join(ss.dir, id+spoolExt))
+	}
+
+	log.Printf("Spooled message %s not saved after %d attempt(s), moved to %s: %v", id, r.Attempts, filepath.Join(ss.dir, "failed"), cause)
+	failedDir := filepath.Join(ss.dir, "failed")
+	if err := os.Rename(ss.retryPath(id), filepath.Join(failedDir, id+spoolRetryExt)); err != nil {
+		return err
+	}
+	if err := os.Rename(active, filepath.Join(failedDir, id+spoolExt)); err != nil {
+		return err
+	}
+	return syncDir(failedDir)
+}
+
+// delivered forgets the retry state of the entry id
+func (ss *SpoolStorage) delivered(id string) {
+	os.Remove(ss.retryPath(id))
+}
+
+func (ss *SpoolStorage) retryPath(id string) string {
+	return filepath.Join(ss.dir, id+spoolRetryExt)
+}
+
+// writeRetry replaces the .retry file of the entry id
+func (ss *SpoolStorage) writeRetry(id string, r spoolRetry) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(ss.dir, "tmp"), id+"-*"+spoolRetryExt)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), ss.retryPath(id))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// readSpoolRetry reads a .retry file; a missing one is a zero spoolRetry
+func readSpoolRetry(path string) (spoolRetry, error) {
+	var r spoolRetry
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return spoolRetry{}, fmt.Errorf("invalid %s: %w", filepath.Base(path), err)
+	}
+	return r, nil
+}
+
+// List, Count, Get and Search read from the next Storage, so messages
+// still waiting in the spool are not visible yet
+
+// List returns one page of the emails of mailbox in the next Storage
+func (ss *SpoolStorage) List(ctx context.Context, mailbox string, page int) ([]EmailSummary, error) {
+	return ss.next.List(ctx, mailbox, page)
+}
+
+// Count returns the number of emails of mailbox in the next Storage
+func (ss *SpoolStorage) Count(ctx context.Context, mailbox string) (int, error) {
+	return ss.next.Count(ctx, mailbox)
+}
+
+// Get returns an email from the next Storage
+func (ss *SpoolStorage) Get(ctx context.Context, id string) (*EmailDetail, error) {
+	return ss.next.Get(ctx, id)
+}
+
+// OpenAttachment opens an attachment from the next Storage
+func (ss *SpoolStorage) OpenAttachment(ctx context.Context, id string, n int) (*Attachment, io.ReadCloser, error) {
+	return ss.next.OpenAttachment(ctx, id, n)
+}
+
+// OpenRaw opens a raw message from the next Storage
+func (ss *SpoolStorage) OpenRaw(ctx context.Context, id string) (io.ReadCloser, error) {
+	return ss.next.OpenRaw(ctx, id)
+}
+
+// Expire expires the emails of the next Storage, if it supports it.
+// Messages still waiting in the spool are not expired.
+func (ss *SpoolStorage) Expire(ctx context.Context, policy RetentionPolicy, opts ExpireOptions) (ExpireResult, error) {
+	return expireAll(ctx, []Storage{ss.next}, policy, opts)
+}
+
+// Search searches the next Storage
+func (ss *SpoolStorage) Search(ctx context.Context, query SearchQuery) ([]EmailSummary, error) {
+	return ss.next.Search(ctx, query)
+}
+
+// Delete removes an email that is still waiting in the spool or in
+// failed/, or else from the next Storage
+func (ss *SpoolStorage) Delete(ctx context.Context, id string) error {
+	if !strings.ContainsAny(id, `/\`) && id != "" && !strings.HasPrefix(id, ".") {
+		for _, dir := range []string{ss.dir, filepath.Join(ss.dir, "failed")} {
+			err := os.Remove(filepath.Join(dir, id+spoolExt))
+			if err == nil {
+				os.Remove(filepath.Join(dir, id+spoolRetryExt))
+				return nil
+			}
+			if !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return ss.next.Delete(ctx, id)
+}
+
+// Close closes the next Storage
+func (ss *SpoolStorage) Close() error {
+	return ss.next.Close()
+}
+
+// syncDir flushes a directory's entries to disk. Windows cannot sync
+// directories; NTFS renames are journaled instead.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
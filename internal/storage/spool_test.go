@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyStorage fails while down and records what it saved otherwise
+type flakyStorage struct {
+	MemoryStorage
+	down  bool
+	saved []Email
+	raw   []string
+}
+
+func (f *flakyStorage) Save(ctx context.Context, email Email) (string, error) {
+	if f.down {
+		return "", errors.New("database unavailable")
+	}
+	data, err := io.ReadAll(email.Content)
+	if err != nil && !errors.Is(err, ErrTruncated) {
+		return "", err
+	}
+	if errors.Is(err, ErrTruncated) {
+		data = append(data, "[truncated]"...)
+	}
+	f.saved = append(f.saved, email)
+	f.raw = append(f.raw, string(data))
+	return "db", nil
+}
+
+func TestSpoolStorage_SavesDurablyAndDrains(t *testing.T) {
+	dir := t.TempDir()
+	next := &flakyStorage{down: true}
+	ss, err := NewSpoolStorage(dir, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	email := Email{
+		From:       "alice@example.com",
+		To:         []string{"bob@example.com", "carol@example.com"},
+		Content:    strings.NewReader("Subject: hi\r\n\r\nhello\r\n"),
+		Connection: ConnectionInfo{ClientIP: "203.0.113.7", Helo: "mx.example.com"},
+		SPF:        &SPFResult{Result: "pass", Domain: "example.com"},
+		DNSBL:      []DNSBLResult{{Zone: "bl.test", Codes: []string{"127.0.0.2"}, Action: "tag"}},
+	}
+	id, err := ss.Save(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, id+spoolExt)); err != nil {
+		t.Errorf("Entry %s not spooled: %v", id, err)
+	}
+
+	entries, err := ss.Entries()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("List = %+v, %v; want one entry", entries, err)
+	}
+	if e := entries[0]; e.From != "alice@example.com" || len(e.To) != 2 || e.Size != int64(len("Subject: hi\r\n\r\nhello\r\n")) {
+		t.Errorf("Unexpected entry %+v", e)
+	}
+
+	// The database is down: the entry stays and is retried later
+	if n, err := ss.Flush(context.Background()); n != 0 || err == nil {
+		t.Fatalf("Flush = %d, %v; want a failure", n, err)
+	}
+	if entries, _ := ss.Entries(); len(entries) != 1 {
+		t.Fatalf("Failed entry left the spool: %+v", entries)
+	}
+
+	next.down = false
+	if n, err := ss.Flush(context.Background()); n != 1 || err != nil {
+		t.Fatalf("Flush = %d, %v; want 1", n, err)
+	}
+	if entries, _ := ss.Entries(); len(entries) != 0 {
+		t.Errorf("Delivered entry still spooled: %+v", entries)
+	}
+	got := next.saved[0]
+	if next.raw[0] != "Subject: hi\r\n\r\nhello\r\n" || got.From != email.From || len(got.To) != 2 {
+		t.Errorf("Replayed email differs: %+v %q", got, next.raw[0])
+	}
+	if got.Connection.ClientIP != "203.0.113.7" || got.SPF == nil || got.SPF.Result != "pass" || len(got.DNSBL) != 1 {
+		t.Errorf("Metadata lost in the spool: %+v", got)
+	}
+}
+
+func TestSpoolStorage_BacksOffFailedEntries(t *testing.T) {
+	next := &flakyStorage{down: true}
+	ss, err := NewSpoolStorage(t.TempDir(), next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ss.now = func() time.Time { return now }
+	ss.Save(context.Background(), Email{From: "a@x.com", To: []string{"b@x.com"}, Content: strings.NewReader("x")})
+
+	ss.drain(context.Background(), false)
+	next.down = false
+	ss.drain(context.Background(), false)
+	if len(next.saved) != 0 {
+		t.Fatal("Entry retried before its backoff elapsed")
+	}
+	now = now.Add(spoolMinBackoff)
+	ss.drain(context.Background(), false)
+	if len(next.saved) != 1 {
+		t.Fatal("Entry not retried after its backoff")
+	}
+}
+
+func TestSpoolStorage_PersistsAttemptsAndGivesUp(t *testing.T) {
+	dir := t.TempDir()
+	next := &flakyStorage{down: true}
+	ss, err := NewSpoolStorage(dir, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ss.now = func() time.Time { return now }
+	ss.MaxAttempts = 3
+	id, _ := ss.Save(context.Background(), Email{From: "a@x.com", To: []string{"b@x.com"}, Content: strings.NewReader("x")})
+	ss.drain(context.Background(), false)
+
+	// A restart keeps the backoff and the attempt count
+	ss, err = NewSpoolStorage(dir, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.now = func() time.Time { return now }
+	ss.MaxAttempts = 3
+	next.down = false
+	ss.drain(context.Background(), false)
+	if len(next.saved) != 0 {
+		t.Fatal("Restart reset the entry's backoff")
+	}
+	next.down = true
+	entries, _ := ss.Entries()
+	if len(entries) != 1 || entries[0].Attempts != 1 || entries[0].LastError != "database unavailable" {
+		t.Fatalf("Entries = %+v; want one attempt recorded", entries)
+	}
+
+	ss.Flush(context.Background())
+	ss.Flush(context.Background())
+	if entries, _ := ss.Entries(); len(entries) != 0 {
+		t.Errorf("Exhausted entry still waiting: %+v", entries)
+	}
+	failed, err := ss.Failed()
+	if err != nil || len(failed) != 1 || failed[0].ID != id || !failed[0].Failed || failed[0].Attempts != 3 || failed[0].From != "a@x.com" {
+		t.Fatalf("Failed = %+v, %v; want the exhausted entry", failed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, id+spoolRetryExt)); !os.IsNotExist(err) {
+		t.Errorf("Retry state left in the queue: %v", err)
+	}
+
+	// Failed entries are not retried
+	next.down = false
+	if n, _ := ss.Flush(context.Background()); n != 0 || len(next.saved) != 0 {
+		t.Errorf("Failed entry retried")
+	}
+	if err := ss.Delete(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	if failed, _ := ss.Failed(); len(failed) != 0 {
+		t.Errorf("Deleted entry still failed: %+v", failed)
+	}
+}
+
+func TestSpoolStorage_GivesUpOnUnreadableEntries(t *testing.T) {
+	dir := t.TempDir()
+	next := &flakyStorage{}
+	ss, err := NewSpoolStorage(dir, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "broken"+spoolExt), []byte("not json\nx"), 0600)
+
+	if n, err := ss.Flush(context.Background()); n != 0 || err == nil {
+		t.Fatalf("Flush = %d, %v; want a failure", n, err)
+	}
+	failed, err := ss.Failed()
+	if err != nil || len(failed) != 1 || failed[0].ID != "broken" || failed[0].Attempts != 1 || failed[0].LastError == "" {
+		t.Errorf("Failed = %+v, %v; want the unreadable entry after one attempt", failed, err)
+	}
+}
+
+func TestSpoolStorage_ReplaysTruncation(t *testing.T) {
+	next := &flakyStorage{}
+	ss, err := NewSpoolStorage(t.TempDir(), next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.Save(context.Background(), Email{
+		From:    "a@x.com",
+		To:      []string{"b@x.com"},
+		Content: io.MultiReader(strings.NewReader("Subject: big\r\n\r\nAAAA"), errorReader{ErrTruncated}),
+	})
+	ss.Flush(context.Background())
+	if len(next.raw) != 1 || strings.Contains(next.raw[0], "AAAA") || !strings.HasSuffix(next.raw[0], "[truncated]") {
+		t.Errorf("Expected a truncated stub, got %q", next.raw)
+	}
+}
+
+func TestSpoolStorage_RecoversInterruptedEntries(t *testing.T) {
+	dir := t.TempDir()
+	ss, err := NewSpoolStorage(dir, &flakyStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := ss.Save(context.Background(), Email{From: "a@x.com", To: []string{"b@x.com"}, Content: strings.NewReader("x")})
+	path := filepath.Join(dir, id+spoolExt)
+
+	// A crash mid-delivery leaves the entry in active/
+	os.Rename(path, filepath.Join(dir, "active", filepath.Base(path)))
+	stale := filepath.Join(dir, "tmp", "stale")
+	os.WriteFile(stale, []byte("partial"), 0600)
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(stale, old, old)
+
+	if err := ss.recover(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := ss.Entries(); len(entries) != 1 {
+		t.Errorf("Interrupted entry not requeued: %+v", entries)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Stale temporary file not removed")
+	}
+}
+
+func TestSpoolStorage_FailedWriteLeavesNothing(t *testing.T) {
+	dir := t.TempDir()
+	ss, err := NewSpoolStorage(dir, &flakyStorage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Save(context.Background(), Email{To: []string{"b@x.com"}, Content: errorReader{io.ErrUnexpectedEOF}}); err == nil {
+		t.Fatal("Expected the broken stream to fail")
+	}
+	for _, sub := range []string{"", "tmp"} {
+		files, _ := os.ReadDir(filepath.Join(dir, sub))
+		for _, f := range files {
+			if !f.IsDir() {
+				t.Errorf("Leftover file %s", filepath.Join(sub, f.Name()))
+			}
+		}
+	}
+}
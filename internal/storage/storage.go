@@ -1,15 +1,302 @@
 package storage
 
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
 // Email represents a simple email structure
 // (expand as needed for more fields)
 type Email struct {
-	From    string
-	To      string
-	Content string
+	// ID identifies the message across retries. Backends that honour it
+	// store a message with a given ID at most once; empty lets the backend
+	// generate one.
+	ID   string
+	From string
+	To   []string // Envelope recipients (RCPT TO), one entry per mailbox
+	// Content streams the raw message. Save consumes it exactly once;
+	// backends that need the bytes more than once spool them to disk.
+	Content io.Reader
+
+	// Connection describes the SMTP connection the message arrived on
+	Connection ConnectionInfo
+
+	SPF   *SPFResult    // Nil when SPF was not checked
+	DKIM  []DKIMResult  // One entry per DKIM-Signature header
+	DMARC *DMARCResult  // Nil when DMARC was not evaluated
+	DNSBL []DNSBLResult // Blocklists listing the client
+}
+
+// ConnectionInfo records the client and transport of an SMTP transaction
+type ConnectionInfo struct {
+	ClientIP   string    `json:"client_ip,omitempty"`
+	Helo       string    `json:"helo,omitempty"`
+	TLSVersion string    `json:"tls_version,omitempty"` // Empty for plaintext sessions
+	TLSCipher  string    `json:"tls_cipher,omitempty"`
+	AuthUser   string    `json:"auth_user,omitempty"` // SMTP AUTH username on the submission port
+	ReceivedAt time.Time `json:"received_at"`         // Start of the transaction (MAIL FROM)
+}
+
+// DNSBLResult records a listing of the client in a DNS blocklist
+type DNSBLResult struct {
+	Zone   string   `json:"zone"`
+	Codes  []string `json:"codes"`            // A records of the listing, e.g. 127.0.0.2
+	Action string   `json:"action"`           // Action configured for the zone
+	Reason string   `json:"reason,omitempty"` // TXT record of the listing
+}
+
+// SPFResult records the SPF verdict for the envelope sender
+type SPFResult struct {
+	Result string `json:"result"`
+	Domain string `json:"domain,omitempty"`
+	Reason string `json:"reason,omitempty"`
 }
 
-// Storage is the interface for saving emails
-// Save should return the filename or an error
+// DMARCResult records the DMARC evaluation of the RFC5322.From domain
+type DMARCResult struct {
+	Result      string `json:"result"`
+	Domain      string `json:"domain,omitempty"`
+	Policy      string `json:"policy,omitempty"`
+	SPFAligned  bool   `json:"spf_aligned"`
+	DKIMAligned bool   `json:"dkim_aligned"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// DKIMResult records the verification result of one DKIM signature
+type DKIMResult struct {
+	Result     string `json:"result"`
+	Domain     string `json:"domain"`
+	Selector   string `json:"selector"`
+	Algorithm  string `json:"algorithm,omitempty"`
+	Identifier string `json:"identifier,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// PageSize is the number of summaries per page of List and Search
+const PageSize = 5
+
+// ErrNotFound is returned by Get and Delete for unknown IDs
+var ErrNotFound = errors.New("email not found")
+
+// Storage is a mailbox store: it saves received emails and serves them
+// back by mailbox or ID. Every method honours the cancellation and
+// deadline of its context.
 type Storage interface {
-	Save(email Email) (string, error)
+	// Save stores the email and returns its ID
+	Save(ctx context.Context, email Email) (string, error)
+	// List returns one page (1-based, PageSize per page) of the emails
+	// delivered to mailbox, newest first
+	List(ctx context.Context, mailbox string, page int) ([]EmailSummary, error)
+	// Count returns the number of emails delivered to mailbox
+	Count(ctx context.Context, mailbox string) (int, error)
+	// Get returns an email with its body, or ErrNotFound
+	Get(ctx context.Context, id string) (*EmailDetail, error)
+	// OpenAttachment streams attachment n (0-based) of an email, or
+	// returns ErrNotFound. The caller closes the reader.
+	OpenAttachment(ctx context.Context, id string, n int) (*Attachment, io.ReadCloser, error)
+	// OpenRaw streams the raw message of an email as received, or returns
+	// ErrNotFound. The caller closes the reader.
+	OpenRaw(ctx context.Context, id string) (io.ReadCloser, error)
+	// Delete removes an email, or returns ErrNotFound
+	Delete(ctx context.Context, id string) error
+	// Search returns one page of the emails matching query, newest first
+	Search(ctx context.Context, query SearchQuery) ([]EmailSummary, error)
+	// Close releases the resources of the store
+	Close() error
+}
+
+// SearchQuery selects emails for Storage.Search
+type SearchQuery struct {
+	// Text is matched case-insensitively against the sender, recipients,
+	// subject and body. PostgresStorage matches words, with stemming and
+	// web search syntax ("quoted phrases", or, -word); the other backends
+	// match the text as a substring of the message. Empty matches all.
+	Text string
+	// Mailbox restricts the search to one recipient; empty searches all
+	Mailbox string
+	// Since and Until restrict the search to emails stored in
+	// [Since, Until); zero values leave that end open
+	Since time.Time
+	Until time.Time
+	Page  int // 1-based
+}
+
+// inRange reports whether an email stored at t is within the dates of q
+func (q SearchQuery) inRange(t time.Time) bool {
+	return (q.Since.IsZero() || !t.Before(q.Since)) && (q.Until.IsZero() || t.Before(q.Until))
+}
+
+// EmailSummary represents email metadata for inbox listing (no body/attachments)
+type EmailSummary struct {
+	ID        string    `json:"id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Subject   string    `json:"subject"`
+	Date      string    `json:"date"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// EmailDetail represents a full email with body and attachment metadata
+type EmailDetail struct {
+	ID          string          `json:"id"`
+	From        string          `json:"from"`
+	To          string          `json:"to"`
+	Subject     string          `json:"subject"`
+	Date        string          `json:"date"`
+	Body        string          `json:"body"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Connection  *ConnectionInfo `json:"connection,omitempty"`
+	SPF         *SPFResult      `json:"spf,omitempty"`
+	DKIM        []DKIMResult    `json:"dkim,omitempty"`
+	DMARC       *DMARCResult    `json:"dmarc,omitempty"`
+	DNSBL       []DNSBLResult   `json:"dnsbl,omitempty"`
+	Attachments []Attachment    `json:"attachments,omitempty"`
+}
+
+// pageOffset returns the index of the first item of a 1-based page
+func pageOffset(page int) int {
+	if page < 1 {
+		page = 1
+	}
+	return (page - 1) * PageSize
+}
+
+// ErrTruncated ends an Email's Content stream when the message crossed the
+// SMTP size limit and the server keeps a stub instead of rejecting it. Save
+// then stores the headers received so far with oversizeNotice as the body.
+var ErrTruncated = errors.New("message truncated at size limit")
+
+// oversizeNotice replaces the body of messages stored as truncated stubs
+const oversizeNotice = "Sorry, the email exceeds our size limit"
+
+// spoolContent copies a message stream into a temporary file in dir (the
+// system temp dir when empty) and rewinds it, so memory use does not grow
+// with the message size. If the stream ends with ErrTruncated the file is
+// rewritten as the truncated stub and truncated is true. The caller must
+// remove the file with removeSpool.
+func spoolContent(r io.Reader, dir string) (f *os.File, truncated bool, err error) {
+	f, err = os.CreateTemp(dir, ".spool-*")
+	if err != nil {
+		return nil, false, err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		if !errors.Is(err, ErrTruncated) {
+			removeSpool(f)
+			return nil, false, err
+		}
+		truncated = true
+		if err = rewriteAsStub(f); err != nil {
+			removeSpool(f)
+			return nil, false, err
+		}
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		removeSpool(f)
+		return nil, false, err
+	}
+	return f, truncated, nil
+}
+
+// removeSpool closes and deletes a file created by spoolContent
+func removeSpool(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// spooledContent is an Email.Content that an outer layer already spooled.
+// Layers below replay it instead of copying the message to a file of
+// their own, so a message is spooled once however many layers it passes
+// through. Like the stream it was spooled from, a truncated stub ends with
+// ErrTruncated.
+type spooledContent struct {
+	r         *io.SectionReader
+	truncated bool
+}
+
+func (c *spooledContent) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF && c.truncated {
+		err = ErrTruncated
+	}
+	return n, err
+}
+
+// replay returns an independent reader over the whole message
+func (c *spooledContent) replay() *spooledContent {
+	return &spooledContent{r: c.raw(), truncated: c.truncated}
+}
+
+// raw returns an independent reader over the spooled bytes, which for a
+// truncated stub end without ErrTruncated
+func (c *spooledContent) raw() *io.SectionReader {
+	return io.NewSectionReader(c.r, 0, c.r.Size())
+}
+
+// spoolOf returns r as spooled content: a replay of it when an outer layer
+// spooled it already, or else a new spool in dir (see spoolContent).
+// release removes a new spool; the outer layer's outlives the call.
+func spoolOf(r io.Reader, dir string) (content *spooledContent, release func(), err error) {
+	if c, ok := r.(*spooledContent); ok {
+		return c.replay(), func() {}, nil
+	}
+	f, truncated, err := spoolContent(r, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		removeSpool(f)
+		return nil, nil, err
+	}
+	content = &spooledContent{r: io.NewSectionReader(f, 0, info.Size()), truncated: truncated}
+	return content, func() { removeSpool(f) }, nil
+}
+
+// rewriteAsStub replaces the partial message in f with its header section
+// followed by oversizeNotice.
+func rewriteAsStub(f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header, err := readHeaderSection(f)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = f.WriteString(header + oversizeNotice + "\r\n")
+	return err
+}
+
+// readHeaderSection reads the raw header block, including the blank line
+// that terminates it. If the message ends inside its headers, the partial
+// last line is dropped and a terminator is added.
+func readHeaderSection(r io.Reader) (string, error) {
+	br := bufio.NewReader(r)
+	var sb strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			if sb.Len() == 0 {
+				return "", nil
+			}
+			return sb.String() + "\r\n", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(line)
+		if line == "\r\n" || line == "\n" {
+			return sb.String(), nil
+		}
+	}
 }
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// errorReader is an io.Reader that always fails with err
+type errorReader struct{ err error }
+
+func (r errorReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestReadHeaderSection(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"crlf", "Subject: a\r\nFrom: b\r\n\r\nbody", "Subject: a\r\nFrom: b\r\n\r\n"},
+		{"lf", "Subject: a\n\nbody", "Subject: a\n\n"},
+		{"cut inside headers", "Subject: a\r\nFrom: b@exa", "Subject: a\r\n\r\n"},
+		{"no newline", "Subject: a", ""},
+	}
+	for _, c := range cases {
+		got, err := readHeaderSection(strings.NewReader(c.raw))
+		if err != nil || got != c.want {
+			t.Errorf("%s: readHeaderSection() = %q, %v; want %q", c.name, got, err, c.want)
+		}
+	}
+}
+
+func TestSpoolContent(t *testing.T) {
+	f, truncated, err := spoolContent(strings.NewReader("Subject: a\r\n\r\nbody"), t.TempDir())
+	if err != nil {
+		t.Fatalf("spoolContent failed: %v", err)
+	}
+	defer removeSpool(f)
+	data, _ := io.ReadAll(f)
+	if truncated || string(data) != "Subject: a\r\n\r\nbody" {
+		t.Errorf("Unexpected spool: truncated=%v data=%q", truncated, data)
+	}
+}
+
+func TestSpoolContent_Truncated(t *testing.T) {
+	r := io.MultiReader(strings.NewReader("Subject: a\r\n\r\nAAAA"), errorReader{ErrTruncated})
+	f, truncated, err := spoolContent(r, t.TempDir())
+	if err != nil {
+		t.Fatalf("spoolContent failed: %v", err)
+	}
+	defer removeSpool(f)
+	data, _ := io.ReadAll(f)
+	if !truncated || string(data) != "Subject: a\r\n\r\n"+oversizeNotice+"\r\n" {
+		t.Errorf("Unexpected stub: truncated=%v data=%q", truncated, data)
+	}
+}
+
+func TestSpoolContent_ErrorRemovesFile(t *testing.T) {
+	dir := t.TempDir()
+	boom := errors.New("boom")
+	r := io.MultiReader(strings.NewReader("partial"), errorReader{boom})
+	if _, _, err := spoolContent(r, dir); !errors.Is(err, boom) {
+		t.Fatalf("Expected read error, got %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("Spool file left behind: %v", entries)
+	}
+}
+
+func TestSpoolOf_ReusesOuterSpool(t *testing.T) {
+	dir := t.TempDir()
+	r := io.MultiReader(strings.NewReader("Subject: a\r\n\r\nAAAA"), errorReader{ErrTruncated})
+	outer, release, err := spoolOf(r, dir)
+	if err != nil {
+		t.Fatalf("spoolOf failed: %v", err)
+	}
+	defer release()
+
+	inner, releaseInner, err := spoolOf(outer, dir)
+	if err != nil {
+		t.Fatalf("spoolOf failed: %v", err)
+	}
+	releaseInner()
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Spooled content spooled again: %v", entries)
+	}
+	data, err := io.ReadAll(inner)
+	if !errors.Is(err, ErrTruncated) || string(data) != "Subject: a\r\n\r\n"+oversizeNotice+"\r\n" {
+		t.Errorf("Replay = %q, %v; want the stub ending with ErrTruncated", data, err)
+	}
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UserStore looks up the accounts allowed to submit mail over SMTP AUTH
+type UserStore interface {
+	// PasswordHash returns the password hash of username, or "" if there
+	// is no such user
+	PasswordHash(ctx context.Context, username string) (string, error)
+}
+
+// MemoryUsers maps usernames to password hashes
+type MemoryUsers map[string]string
+
+func (m MemoryUsers) PasswordHash(ctx context.Context, username string) (string, error) {
+	return m[NormalizeUsername(username)], nil
+}
+
+// NormalizeUsername lowercases a username and strips surrounding whitespace
+func NormalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// HashPassword hashes a password with bcrypt for the smtp_user table
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// CheckPassword reports whether password matches hash. Hashes are bcrypt
+// ($2a$, $2b$, $2y$) or argon2id in the PHC string format
+// ($argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>).
+func CheckPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return checkArgon2id(hash, password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// checkArgon2id verifies a PHC-formatted argon2id hash
+func checkArgon2id(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return false
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	// Zero parameters are invalid; argon2.IDKey panics on a zero time or parallelism
+	if memory == 0 || iterations == 0 || threads == 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	got := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(got, key) == 1
+}
+
+// PostgresUsers keeps submission accounts in the smtp_user table
+type PostgresUsers struct {
+	db *sql.DB
+}
+
+// Users returns the submission accounts stored in the same database
+func (ps *PostgresStorage) Users() *PostgresUsers {
+	return &PostgresUsers{db: ps.db}
+}
+
+func (pu *PostgresUsers) PasswordHash(ctx context.Context, username string) (string, error) {
+	var hash string
+	err := pu.db.QueryRowContext(ctx,
+		`SELECT password_hash FROM smtp_user WHERE username = $1`, NormalizeUsername(username),
+	).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+// SetPasswordHash creates username or replaces its password hash
+func (pu *PostgresUsers) SetPasswordHash(ctx context.Context, username, hash string) error {
+	_, err := pu.db.ExecContext(ctx, `
+		INSERT INTO smtp_user (username, password_hash)
+		VALUES ($1, $2)
+		ON CONFLICT (username) DO UPDATE
+		SET password_hash = EXCLUDED.password_hash, updated_at = NOW()`,
+		NormalizeUsername(username), hash,
+	)
+	return err
+}
+
+// Delete removes username and reports whether it existed
+func (pu *PostgresUsers) Delete(ctx context.Context, username string) (bool, error) {
+	res, err := pu.db.ExecContext(ctx, `DELETE FROM smtp_user WHERE username = $1`, NormalizeUsername(username))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// List returns every username in order
+func (pu *PostgresUsers) List(ctx context.Context) ([]string, error) {
+	rows, err := pu.db.QueryContext(ctx, `SELECT username FROM smtp_user ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		users = append(users, username)
+	}
+	return users, rows.Err()
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestCheckPassword_Bcrypt(t *testing.T) {
+	hash, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckPassword(hash, "s3cret") {
+		t.Error("Correct password rejected")
+	}
+	if CheckPassword(hash, "wrong") {
+		t.Error("Wrong password accepted")
+	}
+}
+
+func TestCheckPassword_Argon2id(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("s3cret"), salt, 1, 8*1024, 1, 32)
+	hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, 8*1024, 1, 1,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	if !CheckPassword(hash, "s3cret") {
+		t.Error("Correct password rejected")
+	}
+	if CheckPassword(hash, "wrong") {
+		t.Error("Wrong password accepted")
+	}
+	for _, bad := range []string{"$argon2id$v=19$m=8192$salt$key", "$argon2id$v=18$m=8192,t=1,p=1$c2FsdA$a2V5", "", "plain"} {
+		if CheckPassword(bad, "s3cret") {
+			t.Errorf("Malformed hash %q accepted", bad)
+		}
+	}
+	// Zero parameters are rejected rather than passed on to argon2
+	for _, params := range []string{"m=0,t=1,p=1", "m=8192,t=0,p=1", "m=8192,t=1,p=0"} {
+		zero := strings.Replace(hash, "m=8192,t=1,p=1", params, 1)
+		if CheckPassword(zero, "s3cret") {
+			t.Errorf("Hash with %s accepted", params)
+		}
+	}
+}
+
+func TestMemoryUsers(t *testing.T) {
+	users := MemoryUsers{"ci@test.com": "hash"}
+	if hash, err := users.PasswordHash(context.Background(), " CI@Test.com "); err != nil || hash != "hash" {
+		t.Errorf("Got %q, %v", hash, err)
+	}
+	if hash, _ := users.PasswordHash(context.Background(), "other@test.com"); hash != "" {
+		t.Errorf("Unknown user: got %q", hash)
+	}
+}